@@ -38,6 +38,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 )
@@ -55,6 +62,67 @@ type CSConfig struct {
 		ProjectID   string `gcfg:"project-id"`
 		Zone        string `gcfg:"zone"`
 		Region      string `gcfg:"region"`
+
+		// NodeNameSource is the field of a VM that node names are matched against when a node
+		// has no provider ID yet: name (default) or displayname.
+		NodeNameSource string `gcfg:"node-name-source"`
+
+		// MultiZone includes the zone in provider IDs, as <provider>://<zone-id>/<instance-id>, for
+		// clusters that span several zones.
+		MultiZone bool `gcfg:"multi-zone"`
+
+		// InstanceTypeFormat is the format of the instance type of nodes, with the placeholders
+		// {name} and {id} of the service offering, {cpu} and {memory} (MiB).
+		InstanceTypeFormat string `gcfg:"instance-type-format"`
+	}
+	NodeAddresses struct {
+		// InternalNetworkID and InternalNetworkName select the network whose addresses are
+		// reported first. The default NIC is used if neither is set.
+		InternalNetworkID   string `gcfg:"internal-network-id"`
+		InternalNetworkName string `gcfg:"internal-network-name"`
+
+		// ExternalIPSources is the comma separated list of sources the external IP of a node is
+		// resolved from, in order: override, static-nat, port-forwarding and source-nat.
+		ExternalIPSources string `gcfg:"external-ip-sources"`
+	}
+	NodeLabels struct {
+		Enabled bool `gcfg:"enabled"`
+
+		// Tags is the comma separated list of VM tags copied to node labels, prefixed with
+		// TagLabelPrefix.
+		Tags           string `gcfg:"tags"`
+		TagLabelPrefix string `gcfg:"tag-label-prefix"`
+
+		// Taints is the comma separated list of VM tags mapped to node taints, as <tag>:<effect>.
+		Taints string `gcfg:"taints"`
+	}
+	LoadBalancer struct {
+		// NetworkID and NetworkName select the network load balancers balance the nodes in, for
+		// nodes spread across networks or VPC tiers. Nodes without a NIC in it are not balanced.
+		NetworkID   string `gcfg:"network-id"`
+		NetworkName string `gcfg:"network-name"`
+
+		// ReservedIPTTL is how long the IP of a deleted service that was retained stays reserved
+		// if no other service claims it. Reserved IPs do not expire if it is not set.
+		ReservedIPTTL string `gcfg:"reserved-ip-ttl"`
+	}
+	Routes struct {
+		Enabled bool `gcfg:"enabled"`
+
+		// VPCID is the VPC the static routes are created in. It defaults to the VPC of the node.
+		VPCID string `gcfg:"vpc-id"`
+	}
+	InstanceCache struct {
+		TTL string `gcfg:"ttl"`
+	}
+	Sweeper struct {
+		Enabled     bool   `gcfg:"enabled"`
+		Interval    string `gcfg:"interval"`
+		GracePeriod string `gcfg:"grace-period"`
+		DryRun      bool   `gcfg:"dry-run"`
+	}
+	NetworkACL struct {
+		ManageLists bool `gcfg:"manage-lists"`
 	}
 }
 
@@ -66,6 +134,63 @@ type CSCloud struct {
 	region        string
 	version       semver.Version
 	clientBuilder cloudprovider.ControllerClientBuilder
+	clusterName   string
+	eventRecorder record.EventRecorder
+	sweeper       *loadBalancerSweeper
+	nodeLabeler   *nodeLabeler
+
+	// manageNetworkACLLists replaces default network ACL lists of VPC tiers with lists owned by the cluster.
+	manageNetworkACLLists bool
+
+	// multiZone includes the zone in the provider IDs of the nodes.
+	multiZone bool
+
+	// nodeNameSource is the VM field node names are matched against.
+	nodeNameSource string
+
+	// instanceTypeFormat is the format of the instance type of nodes.
+	instanceTypeFormat string
+
+	// internalNetworkID and internalNetworkName select the network of the node InternalIPs
+	// reported first.
+	internalNetworkID   string
+	internalNetworkName string
+
+	// externalIPSources are the sources the external IP of a node is resolved from, in order.
+	externalIPSources []string
+
+	// lbNetworkID and lbNetworkName select the network of the load balancers, if the nodes are in
+	// several networks.
+	lbNetworkID   string
+	lbNetworkName string
+
+	// reservedIPTTL is how long retained IPs stay reserved, or 0 if they do not expire.
+	reservedIPTTL time.Duration
+
+	// routesEnabled enables the VPC static routes to the pod CIDRs of the nodes, in routesVPCID
+	// or else the VPC of each node.
+	routesEnabled bool
+	routesVPCID   string
+
+	// ipLocks serializes the changes to the public IPs shared by several services.
+	ipLocks keyedMutex
+
+	// serviceLocks serializes the changes to the load balancer of a service made by the
+	// service controller, the endpoint watcher and the SSL certificate watcher.
+	serviceLocks keyedMutex
+
+	// instanceCache holds the VMs looked up by the instances, zones and load balancers, if enabled.
+	instanceCache *instanceCache
+
+	// Listers and queue of the endpoint watcher, set up by Initialize.
+	endpointSliceLister discoverylisters.EndpointSliceLister
+	serviceLister       corelisters.ServiceLister
+	nodeLister          corelisters.NodeLister
+	endpointQueue       workqueue.RateLimitingInterface
+	servicesSynced      cache.InformerSynced
+
+	// sslCertQueue holds the services whose TLS secret changed, set up by Initialize.
+	sslCertQueue workqueue.RateLimitingInterface
 }
 
 func init() {
@@ -96,10 +221,54 @@ func readConfig(config io.Reader) (*CSConfig, error) {
 // newCSCloud creates a new instance of CSCloud.
 func newCSCloud(cfg *CSConfig) (*CSCloud, error) {
 	cs := &CSCloud{
-		projectID: cfg.Global.ProjectID,
-		zone:      cfg.Global.Zone,
-		region:    cfg.Global.Region,
-		version:   semver.Version{},
+		projectID:             cfg.Global.ProjectID,
+		zone:                  cfg.Global.Zone,
+		region:                cfg.Global.Region,
+		version:               semver.Version{},
+		manageNetworkACLLists: cfg.NetworkACL.ManageLists,
+		nodeNameSource:        cfg.Global.NodeNameSource,
+		multiZone:             cfg.Global.MultiZone,
+		instanceTypeFormat:    cfg.Global.InstanceTypeFormat,
+		lbNetworkID:           cfg.LoadBalancer.NetworkID,
+		lbNetworkName:         cfg.LoadBalancer.NetworkName,
+		routesEnabled:         cfg.Routes.Enabled,
+		routesVPCID:           cfg.Routes.VPCID,
+		internalNetworkID:     cfg.NodeAddresses.InternalNetworkID,
+		internalNetworkName:   cfg.NodeAddresses.InternalNetworkName,
+	}
+
+	if cs.lbNetworkID != "" && cs.lbNetworkName != "" {
+		return nil, errors.New("only one of the load balancer network-id and network-name can be set")
+	}
+
+	if err := validateInstanceTypeFormat(cs.instanceTypeFormat); err != nil {
+		return nil, err
+	}
+
+	if cs.internalNetworkID != "" && cs.internalNetworkName != "" {
+		return nil, errors.New("only one of internal-network-id and internal-network-name can be set")
+	}
+
+	if cfg.LoadBalancer.ReservedIPTTL != "" {
+		ttl, err := time.ParseDuration(cfg.LoadBalancer.ReservedIPTTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid reserved-ip-ttl %q", cfg.LoadBalancer.ReservedIPTTL)
+		}
+		cs.reservedIPTTL = ttl
+	}
+
+	externalIPSources, err := parseExternalIPSources(cfg.NodeAddresses.ExternalIPSources)
+	if err != nil {
+		return nil, err
+	}
+	cs.externalIPSources = externalIPSources
+
+	switch cs.nodeNameSource {
+	case "":
+		cs.nodeNameSource = nodeNameSourceName
+	case nodeNameSourceName, nodeNameSourceDisplayName:
+	default:
+		return nil, fmt.Errorf("invalid node-name-source %q, must be %s or %s", cs.nodeNameSource, nodeNameSourceName, nodeNameSourceDisplayName)
 	}
 
 	if cfg.Global.APIURL != "" && cfg.Global.APIKey != "" && cfg.Global.SecretKey != "" {
@@ -110,6 +279,28 @@ func newCSCloud(cfg *CSConfig) (*CSCloud, error) {
 		return nil, errors.New("no cloud provider config given")
 	}
 
+	instanceCache, err := newInstanceCache(cfg, cs.listAllVirtualMachines)
+	if err != nil {
+		return nil, err
+	}
+	cs.instanceCache = instanceCache
+
+	if cfg.NodeLabels.Enabled {
+		labeler, err := newNodeLabeler(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cs.nodeLabeler = labeler
+	}
+
+	if cfg.Sweeper.Enabled {
+		sweeper, err := newLoadBalancerSweeper(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cs.sweeper = sweeper
+	}
+
 	version, err := cs.getManagementServerVersion()
 	if err != nil {
 		return nil, err
@@ -136,9 +327,44 @@ func (cs *CSCloud) getManagementServerVersion() (semver.Version, error) {
 	return v, nil
 }
 
+// SetClusterName sets the name of the cluster, as passed to the cloud controller manager. It is
+// used for the resources the controller manages outside of the service controller.
+func (cs *CSCloud) SetClusterName(clusterName string) {
+	cs.clusterName = clusterName
+}
+
 // Initialize passes a Kubernetes clientBuilder interface to the cloud provider
 func (cs *CSCloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	cs.clientBuilder = clientBuilder
+
+	if cs.instanceCache != nil {
+		cs.instanceCache.start(stop)
+	}
+
+	if cs.reservedIPTTL > 0 {
+		cs.startIPReservationReaper(stop)
+	}
+
+	client, err := clientBuilder.Client("cloud-controller-manager")
+	if err != nil {
+		klog.Errorf("Failed to get Kubernetes client, endpoints will not be watched: %v", err)
+		return
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	cs.eventRecorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cloudstack-cloud-controller-manager"})
+
+	cs.startEndpointWatcher(client, stop)
+	cs.startSSLCertificateWatcher(client, stop)
+
+	if cs.sweeper != nil {
+		cs.startLoadBalancerSweeper(stop)
+	}
+
+	if cs.nodeLabeler != nil {
+		cs.startNodeLabeler(client, stop)
+	}
 }
 
 // LoadBalancer returns an implementation of LoadBalancer for CloudStack.
@@ -188,12 +414,11 @@ func (cs *CSCloud) Clusters() (cloudprovider.Clusters, bool) {
 
 // Routes returns an implementation of Routes for CloudStack.
 func (cs *CSCloud) Routes() (cloudprovider.Routes, bool) {
-	if cs.client == nil {
+	if cs.client == nil || !cs.routesEnabled {
 		return nil, false
 	}
 
-	klog.Warning("This cloud provider doesn't support routes")
-	return nil, false
+	return cs, true
 }
 
 // ProviderName returns the cloud provider ID.
@@ -210,7 +435,8 @@ func (cs *CSCloud) HasClusterID() bool {
 func (cs *CSCloud) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
 	zone := cloudprovider.Zone{}
 
-	if cs.zone == "" {
+	currentZone := cs.zone
+	if currentZone == "" {
 		// In Kubernetes pods, os.Hostname() returns the pod name, not the node hostname.
 		// We need to get the node name from the pod's spec.nodeName using the Kubernetes API.
 		nodeName, err := cs.getNodeNameFromPod(ctx)
@@ -218,24 +444,25 @@ func (cs *CSCloud) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
 			return zone, fmt.Errorf("failed to get node name for retrieving the zone: %v", err)
 		}
 
-		instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
-			nodeName,
-			cloudstack.WithProject(cs.projectID),
-		)
+		instance, err := cs.getInstanceByNodeName(nodeName, "")
 		if err != nil {
-			if count == 0 {
-				return zone, fmt.Errorf("could not find CloudStack instance with name %s for retrieving the zone: %v", nodeName, err)
+			if err == cloudprovider.InstanceNotFound {
+				return zone, fmt.Errorf("could not find CloudStack instance of node %s for retrieving the zone", nodeName)
 			}
 			return zone, fmt.Errorf("error getting instance for retrieving the zone: %v", err)
 		}
 
-		cs.zone = instance.Zonename
+		currentZone = instance.Zonename
+		// In multi-zone clusters, the controller may move to a node in another zone.
+		if !cs.multiZone {
+			cs.zone = currentZone
+		}
 	}
 
-	klog.V(2).Infof("Current zone is %v", cs.zone)
-	zone.FailureDomain = cs.zone
+	klog.V(2).Infof("Current zone is %v", currentZone)
+	zone.FailureDomain = currentZone
 
-	zone.Region = cs.getRegionFromZone(cs.zone)
+	zone.Region = cs.getRegionFromZone(currentZone)
 
 	return zone, nil
 }
@@ -244,10 +471,7 @@ func (cs *CSCloud) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
 func (cs *CSCloud) GetZoneByProviderID(ctx context.Context, providerID string) (cloudprovider.Zone, error) {
 	zone := cloudprovider.Zone{}
 
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
-		cs.getInstanceIDFromProviderID(providerID),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, count, err := cs.getVirtualMachineByProviderID(providerID)
 	if err != nil {
 		if count == 0 {
 			return zone, fmt.Errorf("could not find node by ID: %v", providerID)
@@ -255,7 +479,7 @@ func (cs *CSCloud) GetZoneByProviderID(ctx context.Context, providerID string) (
 		return zone, fmt.Errorf("error retrieving zone: %v", err)
 	}
 
-	klog.V(2).Infof("Current zone is %v", cs.zone)
+	klog.V(2).Infof("Zone of instance %v is %v", instance.Name, instance.Zonename)
 	zone.FailureDomain = instance.Zonename
 	zone.Region = cs.getRegionFromZone(instance.Zonename)
 
@@ -266,18 +490,15 @@ func (cs *CSCloud) GetZoneByProviderID(ctx context.Context, providerID string) (
 func (cs *CSCloud) GetZoneByNodeName(ctx context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
 	zone := cloudprovider.Zone{}
 
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
-		string(nodeName),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, err := cs.getInstanceByNodeName(string(nodeName), "")
 	if err != nil {
-		if count == 0 {
+		if err == cloudprovider.InstanceNotFound {
 			return zone, fmt.Errorf("could not find node: %v", nodeName)
 		}
 		return zone, fmt.Errorf("error retrieving zone: %v", err)
 	}
 
-	klog.V(2).Infof("Current zone is %v", cs.zone)
+	klog.V(2).Infof("Zone of instance %v is %v", instance.Name, instance.Zonename)
 	zone.FailureDomain = instance.Zonename
 	zone.Region = cs.getRegionFromZone(instance.Zonename)
 
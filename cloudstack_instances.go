@@ -24,23 +24,55 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/apache/cloudstack-go/v2/cloudstack"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog/v2"
 )
 
 var labelInvalidCharsRegex *regexp.Regexp = regexp.MustCompile(`([^A-Za-z0-9][^-A-Za-z0-9_.]*)?[^A-Za-z0-9]`)
 
+// The placeholders of the instance type format.
+const (
+	instanceTypeName   = "{name}"
+	instanceTypeID     = "{id}"
+	instanceTypeCPU    = "{cpu}"
+	instanceTypeMemory = "{memory}"
+
+	defaultInstanceTypeFormat = instanceTypeName
+)
+
+// The VM fields node names can be matched against.
+const (
+	nodeNameSourceName        = "name"
+	nodeNameSourceDisplayName = "displayname"
+)
+
+// isInstanceShutdown returns true if the VM state means the instance is not running, so its
+// volumes can safely be detached.
+func isInstanceShutdown(state string) bool {
+	switch state {
+	case "Stopped", "Stopping", "Shutdown", "Error", "Destroyed", "Expunging":
+		return true
+	default:
+		return false
+	}
+}
+
+// isInstanceDeleted returns true if the VM state means the instance is gone, even though
+// CloudStack still lists it.
+func isInstanceDeleted(state string) bool {
+	return state == "Destroyed" || state == "Expunging"
+}
+
 // NodeAddresses returns the addresses of the specified instance.
 func (cs *CSCloud) NodeAddresses(ctx context.Context, name types.NodeName) ([]corev1.NodeAddress, error) {
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
-		string(name),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, count, err := cs.getVirtualMachineByName(string(name))
 	if err != nil {
 		if count == 0 {
 			return nil, cloudprovider.InstanceNotFound
@@ -53,10 +85,7 @@ func (cs *CSCloud) NodeAddresses(ctx context.Context, name types.NodeName) ([]co
 
 // NodeAddressesByProviderID returns the addresses of the specified instance.
 func (cs *CSCloud) NodeAddressesByProviderID(ctx context.Context, providerID string) ([]corev1.NodeAddress, error) {
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
-		cs.getInstanceIDFromProviderID(providerID),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, count, err := cs.getVirtualMachineByProviderID(providerID)
 	if err != nil {
 		if count == 0 {
 			return nil, cloudprovider.InstanceNotFound
@@ -68,35 +97,87 @@ func (cs *CSCloud) NodeAddressesByProviderID(ctx context.Context, providerID str
 }
 
 func (cs *CSCloud) nodeAddresses(instance *cloudstack.VirtualMachine) ([]corev1.NodeAddress, error) {
-	if len(instance.Nic) == 0 {
+	internal := cs.internalNic(instance)
+	if internal == nil {
 		return nil, errors.New("instance does not have an internal IP")
 	}
 
-	addresses := []corev1.NodeAddress{
-		{Type: corev1.NodeInternalIP, Address: instance.Nic[0].Ipaddress},
+	var addresses []corev1.NodeAddress
+	seen := make(map[string]bool)
+	add := func(addressType corev1.NodeAddressType, address string) {
+		if address == "" || seen[address] {
+			return
+		}
+		seen[address] = true
+		addresses = append(addresses, corev1.NodeAddress{Type: addressType, Address: address})
+	}
+
+	// The addresses of the internal network come first, so they are picked as the node IPs
+	// of both families.
+	for _, address := range nicAddresses(internal) {
+		add(corev1.NodeInternalIP, address)
+	}
+	for i := range instance.Nic {
+		if &instance.Nic[i] == internal {
+			continue
+		}
+		for _, address := range nicAddresses(&instance.Nic[i]) {
+			add(corev1.NodeInternalIP, address)
+		}
 	}
 
 	if instance.Hostname != "" {
-		addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeHostName, Address: instance.Hostname})
+		add(corev1.NodeHostName, instance.Hostname)
 	}
 
-	if instance.Publicip != "" {
-		addresses = append(addresses, corev1.NodeAddress{Type: corev1.NodeExternalIP, Address: instance.Publicip})
+	if externalIP := cs.externalIP(instance); externalIP != "" {
+		add(corev1.NodeExternalIP, externalIP)
 	} else {
-		// Since there is no sane way to determine the external IP if the host isn't
-		// using static NAT, we will just fire a log message and omit the external IP.
 		klog.V(4).Infof("Could not determine the public IP of host %v (%v)", instance.Name, instance.Id)
 	}
 
 	return addresses, nil
 }
 
+// internalNic returns the NIC of the instance in the internal network: the network set in the
+// config, or else the default NIC. It returns nil if the instance has no NICs.
+func (cs *CSCloud) internalNic(instance *cloudstack.VirtualMachine) *cloudstack.Nic {
+	if len(instance.Nic) == 0 {
+		return nil
+	}
+
+	if cs.internalNetworkID != "" || cs.internalNetworkName != "" {
+		for i := range instance.Nic {
+			nic := &instance.Nic[i]
+			if (cs.internalNetworkID != "" && nic.Networkid == cs.internalNetworkID) ||
+				(cs.internalNetworkName != "" && nic.Networkname == cs.internalNetworkName) {
+				return nic
+			}
+		}
+		klog.Warningf("Instance %v (%v) has no NIC in the internal network, using its default NIC", instance.Name, instance.Id)
+	}
+
+	for i := range instance.Nic {
+		if instance.Nic[i].Isdefault {
+			return &instance.Nic[i]
+		}
+	}
+
+	return &instance.Nic[0]
+}
+
+// nicAddresses returns the IPv4 and IPv6 addresses of a NIC, followed by its secondary IPs.
+func nicAddresses(nic *cloudstack.Nic) []string {
+	addresses := []string{nic.Ipaddress, nic.Ip6address}
+	for _, ip := range nic.Secondaryip {
+		addresses = append(addresses, ip.Ipaddress)
+	}
+	return addresses
+}
+
 // InstanceID returns the cloud provider ID of the specified instance.
 func (cs *CSCloud) InstanceID(ctx context.Context, name types.NodeName) (string, error) {
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
-		string(name),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, count, err := cs.getVirtualMachineByName(string(name))
 	if err != nil {
 		if count == 0 {
 			return "", cloudprovider.InstanceNotFound
@@ -104,15 +185,17 @@ func (cs *CSCloud) InstanceID(ctx context.Context, name types.NodeName) (string,
 		return "", fmt.Errorf("error retrieving instance ID: %v", err)
 	}
 
+	// The node controller prefixes the instance ID with the provider name to get the provider ID.
+	if cs.multiZone && instance.Zoneid != "" {
+		return instance.Zoneid + "/" + instance.Id, nil
+	}
+
 	return instance.Id, nil
 }
 
 // InstanceType returns the type of the specified instance.
 func (cs *CSCloud) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByName(
-		string(name),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, count, err := cs.getVirtualMachineByName(string(name))
 	if err != nil {
 		if count == 0 {
 			return "", cloudprovider.InstanceNotFound
@@ -120,15 +203,12 @@ func (cs *CSCloud) InstanceType(ctx context.Context, name types.NodeName) (strin
 		return "", fmt.Errorf("error retrieving instance type: %v", err)
 	}
 
-	return labelInvalidCharsRegex.ReplaceAllString(instance.Serviceofferingname, ``), nil
+	return cs.instanceType(instance), nil
 }
 
 // InstanceTypeByProviderID returns the type of the specified instance.
 func (cs *CSCloud) InstanceTypeByProviderID(ctx context.Context, providerID string) (string, error) {
-	instance, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
-		cs.getInstanceIDFromProviderID(providerID),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, count, err := cs.getVirtualMachineByProviderID(providerID)
 	if err != nil {
 		if count == 0 {
 			return "", cloudprovider.InstanceNotFound
@@ -136,7 +216,39 @@ func (cs *CSCloud) InstanceTypeByProviderID(ctx context.Context, providerID stri
 		return "", fmt.Errorf("error retrieving instance type: %v", err)
 	}
 
-	return labelInvalidCharsRegex.ReplaceAllString(instance.Serviceofferingname, ``), nil
+	return cs.instanceType(instance), nil
+}
+
+// instanceType returns the instance type label of an instance from the configured format. The
+// characters not allowed in labels are removed from the result.
+func (cs *CSCloud) instanceType(instance *cloudstack.VirtualMachine) string {
+	format := cs.instanceTypeFormat
+	if format == "" {
+		format = defaultInstanceTypeFormat
+	}
+
+	instanceType := strings.NewReplacer(
+		instanceTypeName, instance.Serviceofferingname,
+		instanceTypeID, instance.Serviceofferingid,
+		instanceTypeCPU, strconv.Itoa(instance.Cpunumber),
+		instanceTypeMemory, strconv.Itoa(instance.Memory),
+	).Replace(format)
+
+	instanceType = labelInvalidCharsRegex.ReplaceAllString(instanceType, ``)
+	if len(instanceType) > validation.LabelValueMaxLength {
+		instanceType = instanceType[:validation.LabelValueMaxLength]
+	}
+
+	return instanceType
+}
+
+// validateInstanceTypeFormat returns an error if the format has unknown placeholders.
+func validateInstanceTypeFormat(format string) error {
+	rest := strings.NewReplacer(instanceTypeName, "", instanceTypeID, "", instanceTypeCPU, "", instanceTypeMemory, "").Replace(format)
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("invalid instance-type-format %q, the placeholders are %s, %s, %s and %s", format, instanceTypeName, instanceTypeID, instanceTypeCPU, instanceTypeMemory)
+	}
+	return nil
 }
 
 // AddSSHKeyToAllInstances is currently not implemented.
@@ -151,10 +263,7 @@ func (cs *CSCloud) CurrentNodeName(ctx context.Context, hostname string) (types.
 
 // InstanceExistsByProviderID returns if the instance still exists.
 func (cs *CSCloud) InstanceExistsByProviderID(ctx context.Context, providerID string) (bool, error) {
-	_, count, err := cs.client.VirtualMachine.GetVirtualMachineByID(
-		cs.getInstanceIDFromProviderID(providerID),
-		cloudstack.WithProject(cs.projectID),
-	)
+	instance, count, err := cs.getVirtualMachineByProviderID(providerID)
 	if err != nil {
 		if count == 0 {
 			return false, nil
@@ -162,67 +271,212 @@ func (cs *CSCloud) InstanceExistsByProviderID(ctx context.Context, providerID st
 		return false, fmt.Errorf("error retrieving instance: %v", err)
 	}
 
+	if isInstanceDeleted(instance.State) {
+		klog.V(4).Infof("Instance %v (%v) is %v", instance.Name, instance.Id, instance.State)
+		return false, nil
+	}
+
 	return true, nil
 }
 
 // InstanceShutdownByProviderID returns true if the instance is in safe state to detach volumes
 func (cs *CSCloud) InstanceShutdownByProviderID(ctx context.Context, providerID string) (bool, error) {
-	return false, cloudprovider.NotImplemented
+	instance, count, err := cs.getVirtualMachineByProviderID(providerID)
+	if err != nil {
+		if count == 0 {
+			return false, cloudprovider.InstanceNotFound
+		}
+		return false, fmt.Errorf("error retrieving instance state: %v", err)
+	}
+
+	return isInstanceShutdown(instance.State), nil
 }
 
+// InstanceExists returns true if the instance of the node still exists.
 func (cs *CSCloud) InstanceExists(ctx context.Context, node *corev1.Node) (bool, error) {
-	nodeName := types.NodeName(node.Name)
-	providerID, err := cs.InstanceID(ctx, nodeName)
+	instance, err := cs.getInstanceForNode(node)
 	if err != nil {
+		if err == cloudprovider.InstanceNotFound {
+			return false, nil
+		}
 		return false, err
 	}
 
-	return cs.InstanceExistsByProviderID(ctx, providerID)
+	if isInstanceDeleted(instance.State) {
+		klog.V(4).Infof("Instance %v (%v) is %v", instance.Name, instance.Id, instance.State)
+		return false, nil
+	}
+
+	return true, nil
 }
 
+// InstanceShutdown returns true if the instance of the node is in safe state to detach volumes.
 func (cs *CSCloud) InstanceShutdown(ctx context.Context, node *corev1.Node) (bool, error) {
-	return false, cloudprovider.NotImplemented
+	instance, err := cs.getInstanceForNode(node)
+	if err != nil {
+		return false, err
+	}
+
+	return isInstanceShutdown(instance.State), nil
 }
 
+// InstanceMetadata returns the metadata of the instance of the node.
 func (cs *CSCloud) InstanceMetadata(ctx context.Context, node *corev1.Node) (*cloudprovider.InstanceMetadata, error) {
-
-	instanceID, err := cs.InstanceID(ctx, types.NodeName(node.Name))
+	instance, err := cs.getInstanceForNode(node)
 	if err != nil {
 		return nil, err
 	}
 
-	instanceType, err := cs.InstanceType(ctx, types.NodeName(node.Name))
+	addresses, err := cs.nodeAddresses(instance)
 	if err != nil {
 		return nil, err
 	}
 
-	addresses, err := cs.NodeAddresses(ctx, types.NodeName(node.Name))
+	return &cloudprovider.InstanceMetadata{
+		ProviderID:    cs.getProviderID(instance),
+		InstanceType:  cs.instanceType(instance),
+		NodeAddresses: addresses,
+		Zone:          instance.Zonename,
+		Region:        cs.getRegionFromZone(instance.Zonename),
+	}, nil
+}
+
+// getInstanceForNode returns the instance of the node, by its provider ID if it is set, and by
+// its name otherwise. In multi-zone clusters, the name is only matched in the zone of the node,
+// if it is labeled with one.
+func (cs *CSCloud) getInstanceForNode(node *corev1.Node) (*cloudstack.VirtualMachine, error) {
+	if node.Spec.ProviderID == "" {
+		var zone string
+		if cs.multiZone {
+			zone = node.Labels[corev1.LabelTopologyZone]
+		}
+		return cs.getInstanceByNodeName(node.Name, zone)
+	}
+
+	instance, count, err := cs.getVirtualMachineByProviderID(node.Spec.ProviderID)
 	if err != nil {
-		return nil, err
+		if count == 0 {
+			return nil, cloudprovider.InstanceNotFound
+		}
+		return nil, fmt.Errorf("error retrieving instance %v: %v", node.Spec.ProviderID, err)
+	}
+
+	return instance, nil
+}
+
+// getInstanceByNodeName returns the instance whose name or display name matches the node name,
+// in the given zone if it is not empty. The node name can be an FQDN, so only the host part of
+// both is compared.
+func (cs *CSCloud) getInstanceByNodeName(nodeName, zone string) (*cloudstack.VirtualMachine, error) {
+	if cs.instanceCache != nil {
+		vms, err := cs.instanceCache.virtualMachines()
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving instance of node %v: %v", nodeName, err)
+		}
+		// If the cache does not hold the VM, it may have been created since the cache was filled.
+		if instance, err := cs.matchInstanceByNodeName(vms, nodeName, zone); err != cloudprovider.InstanceNotFound {
+			return instance, err
+		}
+	}
+
+	hostName := shortHostName(nodeName)
+
+	p := cs.client.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetListall(true)
+	p.SetDetails([]string{"min", "nics"})
+	if cs.nodeNameSource == nodeNameSourceDisplayName {
+		p.SetKeyword(hostName)
+	} else {
+		p.SetName(hostName)
+	}
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
 	}
 
-	zone, err := cs.GetZoneByNodeName(ctx, types.NodeName(node.Name))
+	l, err := cs.client.VirtualMachine.ListVirtualMachines(p)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error retrieving instance of node %v: %v", nodeName, err)
 	}
 
-	return &cloudprovider.InstanceMetadata{
-		ProviderID:    cs.getProviderIDFromInstanceID(instanceID),
-		InstanceType:  instanceType,
-		NodeAddresses: addresses,
-		Zone:          zone.FailureDomain,
-		Region:        zone.Region,
-	}, nil
+	return cs.matchInstanceByNodeName(l.VirtualMachines, nodeName, zone)
+}
+
+// matchInstanceByNodeName returns the only VM matching the node name, in the given zone if it is
+// not empty.
+func (cs *CSCloud) matchInstanceByNodeName(vms []*cloudstack.VirtualMachine, nodeName, zone string) (*cloudstack.VirtualMachine, error) {
+	hostName := shortHostName(nodeName)
+
+	var matches []*cloudstack.VirtualMachine
+	for _, vm := range vms {
+		if zone != "" && vm.Zonename != zone {
+			continue
+		}
+		if shortHostName(cs.instanceNodeName(vm)) == hostName {
+			matches = append(matches, vm)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, cloudprovider.InstanceNotFound
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("found %d instances matching node %v by %s", len(matches), nodeName, cs.nodeNameSource)
+	}
+}
+
+// instanceNodeName returns the field of the VM that node names are matched against.
+func (cs *CSCloud) instanceNodeName(vm *cloudstack.VirtualMachine) string {
+	switch cs.nodeNameSource {
+	case nodeNameSourceDisplayName:
+		return vm.Displayname
+	default:
+		return vm.Name
+	}
+}
+
+// shortHostName returns the lowercase host part of a name that can be an FQDN.
+func shortHostName(name string) string {
+	return strings.Split(strings.ToLower(name), ".")[0]
 }
 
 func (cs *CSCloud) getProviderIDFromInstanceID(instanceID string) string {
 	return fmt.Sprintf("%s://%s", cs.ProviderName(), instanceID)
 }
 
+// getProviderID returns the provider ID of an instance, which includes the ID of its zone in
+// multi-zone clusters. Zone names can contain spaces and slashes, so they are not used.
+func (cs *CSCloud) getProviderID(instance *cloudstack.VirtualMachine) string {
+	if cs.multiZone && instance.Zoneid != "" {
+		return fmt.Sprintf("%s://%s/%s", cs.ProviderName(), instance.Zoneid, instance.Id)
+	}
+	return cs.getProviderIDFromInstanceID(instance.Id)
+}
+
+// getInstanceIDFromProviderID returns the instance ID of provider IDs with and without a zone.
 func (cs *CSCloud) getInstanceIDFromProviderID(providerID string) string {
 	parts := strings.Split(providerID, "://")
 	if len(parts) == 1 {
 		return providerID
 	}
+	if i := strings.LastIndex(parts[1], "/"); i >= 0 {
+		return parts[1][i+1:]
+	}
 	return parts[1]
 }
+
+// getZoneFromProviderID returns the zone of a zone-aware provider ID, or "" for other provider IDs.
+// The zone is a zone ID, or the zone name of provider IDs set by earlier versions. Instance IDs
+// have no slashes, so a zone name with slashes is kept whole.
+func getZoneFromProviderID(providerID string) string {
+	parts := strings.Split(providerID, "://")
+	if len(parts) == 1 {
+		return ""
+	}
+	i := strings.LastIndex(parts[1], "/")
+	if i < 0 {
+		return ""
+	}
+	return strings.Trim(parts[1][:i], "/")
+}
@@ -0,0 +1,247 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+// instanceCachePageSize is the number of VMs fetched per ListVirtualMachines call.
+const instanceCachePageSize = 500
+
+var (
+	instanceCacheRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      "cloudstack_instance_cache",
+			Name:           "requests_total",
+			Help:           "Number of VM lookups served by the instance cache, by result (hit or miss).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+	instanceCacheRefreshes = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      "cloudstack_instance_cache",
+			Name:           "refreshes_total",
+			Help:           "Number of times the instance cache listed all VMs, by result (success or error).",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"result"},
+	)
+
+	registerInstanceCacheMetrics sync.Once
+)
+
+// instanceCache holds all VMs of the account or project, so nodes can be looked up without an API
+// call each. The VMs are listed again in the background every TTL, and on use once they are older.
+type instanceCache struct {
+	ttl  time.Duration
+	list func() ([]*cloudstack.VirtualMachine, error)
+	now  func() time.Time
+
+	mu        sync.Mutex
+	vms       []*cloudstack.VirtualMachine
+	byID      map[string]*cloudstack.VirtualMachine
+	byName    map[string]*cloudstack.VirtualMachine
+	refreshed time.Time
+}
+
+// newInstanceCache creates a cache from the [InstanceCache] section of the config. It returns nil if
+// no TTL is configured, as the cache is opt-in.
+func newInstanceCache(cfg *CSConfig, list func() ([]*cloudstack.VirtualMachine, error)) (*instanceCache, error) {
+	if cfg.InstanceCache.TTL == "" {
+		return nil, nil
+	}
+	ttl, err := time.ParseDuration(cfg.InstanceCache.TTL)
+	if err != nil || ttl < 0 {
+		return nil, fmt.Errorf("invalid instance cache TTL %q", cfg.InstanceCache.TTL)
+	}
+	if ttl == 0 {
+		return nil, nil
+	}
+
+	registerInstanceCacheMetrics.Do(func() {
+		legacyregistry.MustRegister(instanceCacheRequests, instanceCacheRefreshes)
+	})
+
+	return &instanceCache{
+		ttl:  ttl,
+		list: list,
+		now:  time.Now,
+	}, nil
+}
+
+// start refreshes the cache every TTL until stop is closed.
+func (c *instanceCache) start(stop <-chan struct{}) {
+	go wait.Until(func() {
+		if _, err := c.refresh(); err != nil {
+			klog.Errorf("Error refreshing the instance cache: %v", err)
+		}
+	}, c.ttl, stop)
+}
+
+// refresh lists all VMs and replaces the cached ones.
+func (c *instanceCache) refresh() ([]*cloudstack.VirtualMachine, error) {
+	vms, err := c.list()
+	if err != nil {
+		instanceCacheRefreshes.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	instanceCacheRefreshes.WithLabelValues("success").Inc()
+
+	// VM names are only unique per zone, so names used in several zones are left to the API,
+	// which rejects them as ambiguous.
+	byID := make(map[string]*cloudstack.VirtualMachine, len(vms))
+	byName := make(map[string]*cloudstack.VirtualMachine, len(vms))
+	for _, vm := range vms {
+		byID[vm.Id] = vm
+		if _, ok := byName[vm.Name]; ok {
+			byName[vm.Name] = nil
+		} else {
+			byName[vm.Name] = vm
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.vms = vms
+	c.byID = byID
+	c.byName = byName
+	c.refreshed = c.now()
+
+	return vms, nil
+}
+
+// fresh returns true if the cached VMs are younger than the TTL. The caller must hold the lock.
+func (c *instanceCache) fresh() bool {
+	return c.byID != nil && c.now().Sub(c.refreshed) < c.ttl
+}
+
+// virtualMachines returns all VMs, listing them again if the cached ones are too old.
+func (c *instanceCache) virtualMachines() ([]*cloudstack.VirtualMachine, error) {
+	c.mu.Lock()
+	if c.fresh() {
+		vms := c.vms
+		c.mu.Unlock()
+		instanceCacheRequests.WithLabelValues("hit").Inc()
+		return vms, nil
+	}
+	c.mu.Unlock()
+
+	instanceCacheRequests.WithLabelValues("miss").Inc()
+	return c.refresh()
+}
+
+// get returns a cached VM by ID or by name, if the cache is fresh and holds it.
+func (c *instanceCache) get(id, name string) (*cloudstack.VirtualMachine, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var vm *cloudstack.VirtualMachine
+	if c.fresh() {
+		if id != "" {
+			vm = c.byID[id]
+		} else {
+			vm = c.byName[name]
+		}
+	}
+
+	if vm == nil {
+		instanceCacheRequests.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	instanceCacheRequests.WithLabelValues("hit").Inc()
+	return vm, true
+}
+
+// listAllVirtualMachines lists all VMs of the account or project, page by page.
+func (cs *CSCloud) listAllVirtualMachines() ([]*cloudstack.VirtualMachine, error) {
+	var vms []*cloudstack.VirtualMachine
+
+	for page := 1; ; page++ {
+		p := cs.client.VirtualMachine.NewListVirtualMachinesParams()
+		p.SetListall(true)
+		p.SetDetails([]string{"min", "nics", "servoff", "affgrp", "tmpl"})
+		p.SetPage(page)
+		p.SetPagesize(instanceCachePageSize)
+		if cs.projectID != "" {
+			p.SetProjectid(cs.projectID)
+		}
+
+		l, err := cs.client.VirtualMachine.ListVirtualMachines(p)
+		if err != nil {
+			return nil, fmt.Errorf("error listing virtual machines: %v", err)
+		}
+
+		vms = append(vms, l.VirtualMachines...)
+		if len(l.VirtualMachines) < instanceCachePageSize || len(vms) >= l.Count {
+			return vms, nil
+		}
+	}
+}
+
+// getVirtualMachineByID returns a VM by ID, from the instance cache if it holds it.
+func (cs *CSCloud) getVirtualMachineByID(id string) (*cloudstack.VirtualMachine, int, error) {
+	if cs.instanceCache != nil {
+		if vm, ok := cs.instanceCache.get(id, ""); ok {
+			return vm, 1, nil
+		}
+	}
+
+	return cs.client.VirtualMachine.GetVirtualMachineByID(id, cloudstack.WithProject(cs.projectID))
+}
+
+// getVirtualMachineByProviderID returns the VM of a provider ID, from the instance cache if it
+// holds it. Lookups through the API are scoped to the zone of zone-aware provider IDs.
+func (cs *CSCloud) getVirtualMachineByProviderID(providerID string) (*cloudstack.VirtualMachine, int, error) {
+	id := cs.getInstanceIDFromProviderID(providerID)
+
+	zone := getZoneFromProviderID(providerID)
+	if zone == "" {
+		return cs.getVirtualMachineByID(id)
+	}
+
+	if cs.instanceCache != nil {
+		if vm, ok := cs.instanceCache.get(id, ""); ok {
+			return vm, 1, nil
+		}
+	}
+
+	return cs.client.VirtualMachine.GetVirtualMachineByID(id, cloudstack.WithProject(cs.projectID), cloudstack.WithZone(zone))
+}
+
+// getVirtualMachineByName returns a VM by name, from the instance cache if it holds it.
+func (cs *CSCloud) getVirtualMachineByName(name string) (*cloudstack.VirtualMachine, int, error) {
+	if cs.instanceCache != nil {
+		if vm, ok := cs.instanceCache.get("", name); ok {
+			return vm, 1, nil
+		}
+	}
+
+	return cs.client.VirtualMachine.GetVirtualMachineByName(name, cloudstack.WithProject(cs.projectID))
+}
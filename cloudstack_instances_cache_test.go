@@ -0,0 +1,217 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestNewInstanceCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      string
+		wantTTL  time.Duration
+		disabled bool
+		wantErr  bool
+	}{
+		{name: "disabled by default", disabled: true},
+		{name: "custom", ttl: "5m", wantTTL: 5 * time.Minute},
+		{name: "disabled", ttl: "0s", disabled: true},
+		{name: "invalid", ttl: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &CSConfig{}
+			cfg.InstanceCache.TTL = tt.ttl
+
+			c, err := newInstanceCache(cfg, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.disabled {
+				if c != nil {
+					t.Errorf("expected cache to be disabled")
+				}
+				return
+			}
+			if c.ttl != tt.wantTTL {
+				t.Errorf("ttl = %v, want %v", c.ttl, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestListAllVirtualMachines(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	firstPage := make([]*cloudstack.VirtualMachine, instanceCachePageSize)
+	for i := range firstPage {
+		firstPage[i] = &cloudstack.VirtualMachine{Id: fmt.Sprintf("vm-%d", i)}
+	}
+	secondPage := []*cloudstack.VirtualMachine{{Id: "vm-last"}}
+
+	p1 := &cloudstack.ListVirtualMachinesParams{}
+	p2 := &cloudstack.ListVirtualMachinesParams{}
+
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	gomock.InOrder(
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(p1),
+		mockVM.EXPECT().ListVirtualMachines(p1).Return(&cloudstack.ListVirtualMachinesResponse{Count: instanceCachePageSize + 1, VirtualMachines: firstPage}, nil),
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(p2),
+		mockVM.EXPECT().ListVirtualMachines(p2).Return(&cloudstack.ListVirtualMachinesResponse{Count: instanceCachePageSize + 1, VirtualMachines: secondPage}, nil),
+	)
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			VirtualMachine: mockVM,
+		},
+	}
+
+	vms, err := cs.listAllVirtualMachines()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vms) != instanceCachePageSize+1 {
+		t.Errorf("listed %d VMs, want %d", len(vms), instanceCachePageSize+1)
+	}
+	if page, _ := p2.GetPage(); page != 2 {
+		t.Errorf("second page = %d, want 2", page)
+	}
+}
+
+func TestInstanceCache(t *testing.T) {
+	vm := &cloudstack.VirtualMachine{
+		Id:                  "vm-1",
+		Name:                "node-1",
+		State:               "Running",
+		Serviceofferingname: "Medium Instance",
+		Zonename:            "zone-1",
+		Nic:                 []cloudstack.Nic{{Ipaddress: "10.0.0.1"}},
+	}
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	// Lookups by ID of VMs the cache does not hold go to the API.
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockVM.EXPECT().GetVirtualMachineByID("vm-new", gomock.Any()).Return(&cloudstack.VirtualMachine{Id: "vm-new"}, 1, nil)
+
+	cfg := &CSConfig{}
+	cfg.InstanceCache.TTL = "1m"
+
+	lists := 0
+	cache, err := newInstanceCache(cfg, func() ([]*cloudstack.VirtualMachine, error) {
+		lists++
+		return []*cloudstack.VirtualMachine{vm}, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			VirtualMachine: mockVM,
+		},
+		instanceCache: cache,
+	}
+
+	hitsBefore, _ := testutil.GetCounterMetricValue(instanceCacheRequests.WithLabelValues("hit"))
+
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+	metadata, err := cs.InstanceMetadata(context.Background(), node)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if metadata.ProviderID != "external-cloudstack://vm-1" || metadata.Zone != "zone-1" || metadata.InstanceType != "MediumInstance" {
+		t.Errorf("metadata = %+v", metadata)
+	}
+
+	if exists, err := cs.InstanceExistsByProviderID(context.Background(), "external-cloudstack://vm-1"); err != nil || !exists {
+		t.Errorf("InstanceExistsByProviderID() = %v, %v, want true", exists, err)
+	}
+	if _, _, err := cs.getVirtualMachineByID("vm-new"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if lists != 1 {
+		t.Errorf("listed VMs %d times, want 1", lists)
+	}
+
+	hitsAfter, _ := testutil.GetCounterMetricValue(instanceCacheRequests.WithLabelValues("hit"))
+	if hitsAfter-hitsBefore != 1 {
+		t.Errorf("cache hits = %v, want 1", hitsAfter-hitsBefore)
+	}
+
+	// Once the TTL passed, the VMs are listed again.
+	now = now.Add(2 * time.Minute)
+	if _, err := cs.InstanceMetadata(context.Background(), node); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lists != 2 {
+		t.Errorf("listed VMs %d times, want 2", lists)
+	}
+}
+
+func TestInstanceCacheNameInSeveralZones(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.InstanceCache.TTL = "1m"
+
+	cache, err := newInstanceCache(cfg, func() ([]*cloudstack.VirtualMachine, error) {
+		return []*cloudstack.VirtualMachine{
+			{Id: "vm-1", Name: "node-1", Zonename: "zone-a"},
+			{Id: "vm-2", Name: "node-1", Zonename: "zone-b"},
+			{Id: "vm-3", Name: "node-2", Zonename: "zone-a"},
+		}, nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := cache.refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if vm, ok := cache.get("", "node-1"); ok {
+		t.Errorf("get(node-1) = %v, want a miss for a name in several zones", vm.Id)
+	}
+	if vm, ok := cache.get("", "node-2"); !ok || vm.Id != "vm-3" {
+		t.Errorf("get(node-2) = %v, %v, want vm-3", vm, ok)
+	}
+	if vm, ok := cache.get("vm-2", ""); !ok || vm.Id != "vm-2" {
+		t.Errorf("get(vm-2) = %v, %v, want vm-2", vm, ok)
+	}
+}
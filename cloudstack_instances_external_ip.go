@@ -0,0 +1,193 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+)
+
+// The sources the external IP of a node can be resolved from.
+const (
+	externalIPSourceOverride       = "override"
+	externalIPSourceStaticNAT      = "static-nat"
+	externalIPSourcePortForwarding = "port-forwarding"
+	externalIPSourceSourceNAT      = "source-nat"
+)
+
+// tagExternalIP is the VM tag or detail that overrides the external IP of a node.
+const tagExternalIP = "kubernetes-external-ip"
+
+// parseExternalIPSources parses the comma separated list of external IP sources from the config.
+func parseExternalIPSources(value string) ([]string, error) {
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case "":
+			continue
+		case externalIPSourceOverride, externalIPSourceStaticNAT, externalIPSourcePortForwarding, externalIPSourceSourceNAT:
+			sources = append(sources, source)
+		default:
+			return nil, fmt.Errorf("invalid external-ip-sources entry %q, must be one of %s, %s, %s or %s",
+				source, externalIPSourceOverride, externalIPSourceStaticNAT, externalIPSourcePortForwarding, externalIPSourceSourceNAT)
+		}
+	}
+	return sources, nil
+}
+
+// externalIP returns the external IP of an instance from the first configured source that has
+// one. Without sources, only the static NAT IP listed with the instance is used.
+func (cs *CSCloud) externalIP(instance *cloudstack.VirtualMachine) string {
+	if len(cs.externalIPSources) == 0 {
+		return instance.Publicip
+	}
+
+	for _, source := range cs.externalIPSources {
+		var ip string
+		var err error
+
+		switch source {
+		case externalIPSourceOverride:
+			ip = externalIPOverride(instance)
+		case externalIPSourceStaticNAT:
+			ip, err = cs.staticNATIP(instance)
+		case externalIPSourcePortForwarding:
+			ip, err = cs.portForwardingIP(instance)
+		case externalIPSourceSourceNAT:
+			ip, err = cs.sourceNATIP(instance)
+		}
+
+		if err != nil {
+			klog.Warningf("Error resolving the %s external IP of host %v (%v): %v", source, instance.Name, instance.Id, err)
+			continue
+		}
+		if ip != "" {
+			klog.V(4).Infof("Resolved external IP %v of host %v (%v) from %s", ip, instance.Name, instance.Id, source)
+			return ip
+		}
+	}
+
+	return ""
+}
+
+// externalIPOverride returns the external IP set in a tag or detail of the instance.
+func externalIPOverride(instance *cloudstack.VirtualMachine) string {
+	ip, ok := getTag(instance.Tags, tagExternalIP)
+	if !ok {
+		ip = instance.Details[tagExternalIP]
+	}
+	if ip == "" {
+		return ""
+	}
+
+	if net.ParseIP(ip) == nil {
+		klog.Warningf("Ignoring invalid %s %q of host %v (%v)", tagExternalIP, ip, instance.Name, instance.Id)
+		return ""
+	}
+
+	return ip
+}
+
+// staticNATIP returns the public IP that has static NAT enabled to the instance.
+func (cs *CSCloud) staticNATIP(instance *cloudstack.VirtualMachine) (string, error) {
+	if instance.Publicip != "" {
+		return instance.Publicip, nil
+	}
+
+	p := cs.client.Address.NewListPublicIpAddressesParams()
+	p.SetIsstaticnat(true)
+	p.SetListall(true)
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := cs.client.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving static NAT IP addresses: %v", err)
+	}
+
+	for _, ip := range l.PublicIpAddresses {
+		if ip.Virtualmachineid == instance.Id {
+			return ip.Ipaddress, nil
+		}
+	}
+
+	return "", nil
+}
+
+// portForwardingIP returns the public IP of a port forwarding rule to the instance.
+func (cs *CSCloud) portForwardingIP(instance *cloudstack.VirtualMachine) (string, error) {
+	p := cs.client.Firewall.NewListPortForwardingRulesParams()
+	p.SetListall(true)
+	if nic := cs.internalNic(instance); nic != nil && nic.Networkid != "" {
+		p.SetNetworkid(nic.Networkid)
+	}
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := cs.client.Firewall.ListPortForwardingRules(p)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving port forwarding rules: %v", err)
+	}
+
+	for _, rule := range l.PortForwardingRules {
+		if rule.Virtualmachineid == instance.Id {
+			return rule.Ipaddress, nil
+		}
+	}
+
+	return "", nil
+}
+
+// sourceNATIP returns the source NAT IP of the internal network of the instance, or of its VPC.
+func (cs *CSCloud) sourceNATIP(instance *cloudstack.VirtualMachine) (string, error) {
+	nic := cs.internalNic(instance)
+	if nic == nil || nic.Networkid == "" {
+		return "", nil
+	}
+
+	p := cs.client.Address.NewListPublicIpAddressesParams()
+	p.SetIssourcenat(true)
+	p.SetListall(true)
+	if nic.Vpcid != "" {
+		p.SetVpcid(nic.Vpcid)
+	} else {
+		p.SetAssociatednetworkid(nic.Networkid)
+	}
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := cs.client.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving source NAT IP address of network %v: %v", nic.Networkid, err)
+	}
+	if l.Count == 0 {
+		return "", nil
+	}
+
+	return l.PublicIpAddresses[0].Ipaddress, nil
+}
@@ -0,0 +1,163 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+)
+
+func TestParseExternalIPSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "empty", value: ""},
+		{name: "ordered", value: "override, static-nat,source-nat", want: []string{"override", "static-nat", "source-nat"}},
+		{name: "invalid", value: "static-nat,dns", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExternalIPSources(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExternalIPSources() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExternalIP(t *testing.T) {
+	newInstance := func() *cloudstack.VirtualMachine {
+		return &cloudstack.VirtualMachine{
+			Id:   "vm-1",
+			Name: "node-1",
+			Nic:  []cloudstack.Nic{{Ipaddress: "10.0.0.1", Networkid: "net-1", Isdefault: true}},
+		}
+	}
+
+	t.Run("without sources uses the listed public IP", func(t *testing.T) {
+		instance := newInstance()
+		instance.Publicip = "203.0.113.1"
+
+		cs := &CSCloud{}
+		if got := cs.externalIP(instance); got != "203.0.113.1" {
+			t.Errorf("externalIP() = %q, want %q", got, "203.0.113.1")
+		}
+	})
+
+	t.Run("override comes first", func(t *testing.T) {
+		instance := newInstance()
+		instance.Publicip = "203.0.113.1"
+		instance.Tags = []cloudstack.Tags{{Key: tagExternalIP, Value: "198.51.100.1"}}
+
+		cs := &CSCloud{externalIPSources: []string{externalIPSourceOverride, externalIPSourceStaticNAT}}
+		if got := cs.externalIP(instance); got != "198.51.100.1" {
+			t.Errorf("externalIP() = %q, want %q", got, "198.51.100.1")
+		}
+	})
+
+	t.Run("invalid override is ignored", func(t *testing.T) {
+		instance := newInstance()
+		instance.Publicip = "203.0.113.1"
+		instance.Details = map[string]string{tagExternalIP: "not-an-ip"}
+
+		cs := &CSCloud{externalIPSources: []string{externalIPSourceOverride, externalIPSourceStaticNAT}}
+		if got := cs.externalIP(instance); got != "203.0.113.1" {
+			t.Errorf("externalIP() = %q, want %q", got, "203.0.113.1")
+		}
+	})
+
+	t.Run("static NAT lookup", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 2,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				{Ipaddress: "203.0.113.2", Virtualmachineid: "vm-2"},
+				{Ipaddress: "203.0.113.1", Virtualmachineid: "vm-1"},
+			},
+		}, nil)
+
+		cs := &CSCloud{
+			client:            &cloudstack.CloudStackClient{Address: mockAddress},
+			externalIPSources: []string{externalIPSourceStaticNAT},
+		}
+		if got := cs.externalIP(newInstance()); got != "203.0.113.1" {
+			t.Errorf("externalIP() = %q, want %q", got, "203.0.113.1")
+		}
+		if staticNAT, _ := listParams.GetIsstaticnat(); !staticNAT {
+			t.Errorf("expected lookup of static NAT IPs")
+		}
+	})
+
+	t.Run("falls through to port forwarding and source NAT", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		pfParams := &cloudstack.ListPortForwardingRulesParams{}
+		ipParams := &cloudstack.ListPublicIpAddressesParams{}
+
+		gomock.InOrder(
+			mockFirewall.EXPECT().NewListPortForwardingRulesParams().Return(pfParams),
+			mockFirewall.EXPECT().ListPortForwardingRules(pfParams).Return(nil, errors.New("API error")),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(ipParams),
+			mockAddress.EXPECT().ListPublicIpAddresses(ipParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             1,
+				PublicIpAddresses: []*cloudstack.PublicIpAddress{{Ipaddress: "203.0.113.10", Issourcenat: true}},
+			}, nil),
+		)
+
+		cs := &CSCloud{
+			client:            &cloudstack.CloudStackClient{Address: mockAddress, Firewall: mockFirewall},
+			externalIPSources: []string{externalIPSourceOverride, externalIPSourcePortForwarding, externalIPSourceSourceNAT},
+		}
+		if got := cs.externalIP(newInstance()); got != "203.0.113.10" {
+			t.Errorf("externalIP() = %q, want %q", got, "203.0.113.10")
+		}
+		if networkID, _ := pfParams.GetNetworkid(); networkID != "net-1" {
+			t.Errorf("port forwarding lookup network = %q, want %q", networkID, "net-1")
+		}
+		if networkID, _ := ipParams.GetAssociatednetworkid(); networkID != "net-1" {
+			t.Errorf("source NAT lookup network = %q, want %q", networkID, "net-1")
+		}
+	})
+}
@@ -0,0 +1,433 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+// The labels set on nodes from the metadata of their VM.
+const (
+	labelHost       = "cloudstack.apache.org/host"
+	labelPod        = "cloudstack.apache.org/pod"
+	labelCluster    = "cloudstack.apache.org/cluster"
+	labelHypervisor = "cloudstack.apache.org/hypervisor"
+	labelTemplate   = "cloudstack.apache.org/template"
+	labelCPU        = "cloudstack.apache.org/cpu"
+	labelMemory     = "cloudstack.apache.org/memory"
+
+	// labelAffinityGroupPrefix is the prefix of the labels set for the affinity groups of a VM.
+	labelAffinityGroupPrefix = "affinity-group.cloudstack.apache.org/"
+
+	// defaultTagLabelPrefix is the default prefix of the labels copied from VM tags.
+	defaultTagLabelPrefix = "tag.cloudstack.apache.org/"
+
+	// nodeLabelResyncPeriod is the resync period of the node informer of the node labeler.
+	nodeLabelResyncPeriod = 10 * time.Minute
+)
+
+// labelValueInvalidCharsRegex matches the characters that are not allowed in label values.
+var labelValueInvalidCharsRegex = regexp.MustCompile(`[^-A-Za-z0-9_.]+`)
+
+// nodeLabels are the labels fully managed by the node labeler.
+var nodeLabels = []string{labelHost, labelPod, labelCluster, labelHypervisor, labelTemplate, labelCPU, labelMemory}
+
+// taintMapping maps a VM tag to a node taint with the same key and value.
+type taintMapping struct {
+	tag    string
+	effect corev1.TaintEffect
+}
+
+// nodeLabeler keeps labels and taints of nodes in sync with the metadata of their VM.
+type nodeLabeler struct {
+	tags           []string
+	tagLabelPrefix string
+	taints         []taintMapping
+
+	client     kubernetes.Interface
+	nodeLister corelisters.NodeLister
+	queue      workqueue.RateLimitingInterface
+
+	// hosts holds the hosts looked up for their pod and cluster, which do not change.
+	mu    sync.Mutex
+	hosts map[string]*cloudstack.Host
+}
+
+// newNodeLabeler creates a node labeler from the [NodeLabels] section of the config.
+func newNodeLabeler(cfg *CSConfig) (*nodeLabeler, error) {
+	l := &nodeLabeler{
+		tagLabelPrefix: defaultTagLabelPrefix,
+		hosts:          make(map[string]*cloudstack.Host),
+	}
+
+	if cfg.NodeLabels.TagLabelPrefix != "" {
+		l.tagLabelPrefix = cfg.NodeLabels.TagLabelPrefix
+	}
+
+	for _, tag := range splitList(cfg.NodeLabels.Tags) {
+		if errs := validation.IsQualifiedName(l.tagLabelPrefix + tag); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid node label for tag %q: %s", tag, strings.Join(errs, ", "))
+		}
+		l.tags = append(l.tags, tag)
+	}
+
+	for _, taint := range splitList(cfg.NodeLabels.Taints) {
+		parts := strings.SplitN(taint, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid taint %q, must be <tag>:<effect>", taint)
+		}
+		if errs := validation.IsQualifiedName(parts[0]); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid taint key %q: %s", parts[0], strings.Join(errs, ", "))
+		}
+
+		effect := corev1.TaintEffect(parts[1])
+		switch effect {
+		case corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("invalid taint effect %q, must be one of %s, %s or %s", parts[1], corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute)
+		}
+
+		l.taints = append(l.taints, taintMapping{tag: parts[0], effect: effect})
+	}
+
+	return l, nil
+}
+
+// splitList splits a comma separated list from the config.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// startNodeLabeler watches nodes and keeps their labels and taints in sync with their VM.
+func (cs *CSCloud) startNodeLabeler(client kubernetes.Interface, stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(client, nodeLabelResyncPeriod)
+	nodeInformer := factory.Core().V1().Nodes()
+
+	cs.nodeLabeler.client = client
+	cs.nodeLabeler.nodeLister = nodeInformer.Lister()
+	cs.nodeLabeler.queue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "cloudstack-node-labels")
+
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    cs.enqueueNode,
+		UpdateFunc: func(_, obj interface{}) { cs.enqueueNode(obj) },
+	})
+
+	factory.Start(stop)
+
+	go func() {
+		defer cs.nodeLabeler.queue.ShutDown()
+
+		if !cache.WaitForCacheSync(stop, nodeInformer.Informer().HasSynced) {
+			klog.Errorf("Failed to sync the node labeler cache")
+			return
+		}
+
+		go wait.Until(cs.runNodeLabelWorker, time.Second, stop)
+		<-stop
+	}()
+}
+
+func (cs *CSCloud) enqueueNode(obj interface{}) {
+	node, ok := obj.(*corev1.Node)
+	if !ok {
+		return
+	}
+	cs.nodeLabeler.queue.Add(node.Name)
+}
+
+func (cs *CSCloud) runNodeLabelWorker() {
+	for cs.processNextNodeItem() {
+	}
+}
+
+func (cs *CSCloud) processNextNodeItem() bool {
+	key, quit := cs.nodeLabeler.queue.Get()
+	if quit {
+		return false
+	}
+	defer cs.nodeLabeler.queue.Done(key)
+
+	if err := cs.syncNodeLabels(context.TODO(), key.(string)); err != nil {
+		klog.Errorf("Error updating labels of node %v: %v", key, err)
+		cs.nodeLabeler.queue.AddRateLimited(key)
+		return true
+	}
+
+	cs.nodeLabeler.queue.Forget(key)
+	return true
+}
+
+// syncNodeLabels updates the labels and taints of a node from the metadata of its VM.
+func (cs *CSCloud) syncNodeLabels(ctx context.Context, name string) error {
+	node, err := cs.nodeLabeler.nodeLister.Get(name)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	instance, err := cs.getInstanceForNode(node)
+	if err != nil {
+		if err == cloudprovider.InstanceNotFound {
+			klog.V(4).Infof("Node %v has no instance, not updating its labels", name)
+			return nil
+		}
+		return err
+	}
+
+	labels := cs.instanceLabels(instance)
+	taints := cs.nodeLabeler.instanceTaints(instance)
+
+	if !cs.nodeLabeler.needsUpdate(node, labels, taints) {
+		return nil
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := cs.nodeLabeler.client.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		updated := current.DeepCopy()
+		updated.Labels = cs.nodeLabeler.mergeLabels(current.Labels, labels)
+		updated.Spec.Taints = cs.nodeLabeler.mergeTaints(current.Spec.Taints, taints)
+		if reflect.DeepEqual(mapOrEmpty(current.Labels), updated.Labels) && taintsEqual(current.Spec.Taints, updated.Spec.Taints) {
+			return nil
+		}
+
+		klog.V(2).Infof("Updating labels and taints of node %v from instance %v (%v)", name, instance.Name, instance.Id)
+		_, err = cs.nodeLabeler.client.CoreV1().Nodes().Update(ctx, updated, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// instanceLabels returns the node labels for the metadata of a VM.
+func (cs *CSCloud) instanceLabels(instance *cloudstack.VirtualMachine) map[string]string {
+	labels := make(map[string]string)
+	set := func(key, value string) {
+		if value = sanitizeLabelValue(value); value != "" {
+			labels[key] = value
+		}
+	}
+
+	set(labelHost, instance.Hostname)
+	set(labelHypervisor, instance.Hypervisor)
+	set(labelTemplate, instance.Templatename)
+	if instance.Cpunumber > 0 {
+		set(labelCPU, strconv.Itoa(instance.Cpunumber))
+	}
+	if instance.Memory > 0 {
+		set(labelMemory, strconv.Itoa(instance.Memory))
+	}
+
+	if instance.Hostid != "" {
+		if host, err := cs.getHost(instance.Hostid); err != nil {
+			klog.Warningf("Error retrieving host %v of instance %v (%v), omitting pod and cluster labels: %v", instance.Hostid, instance.Name, instance.Id, err)
+		} else {
+			set(labelPod, host.Podname)
+			set(labelCluster, host.Clustername)
+		}
+	}
+
+	for _, group := range instance.Affinitygroup {
+		key := labelAffinityGroupPrefix + sanitizeLabelValue(group.Name)
+		if len(validation.IsQualifiedName(key)) > 0 {
+			klog.V(4).Infof("Affinity group %q of instance %v cannot be used as a node label", group.Name, instance.Name)
+			continue
+		}
+		labels[key] = "true"
+	}
+
+	for _, tag := range cs.nodeLabeler.tags {
+		if value, ok := getTag(instance.Tags, tag); ok {
+			set(cs.nodeLabeler.tagLabelPrefix+tag, value)
+		}
+	}
+
+	return labels
+}
+
+// sanitizeLabelValue turns a CloudStack name into a valid label value, or returns "".
+func sanitizeLabelValue(value string) string {
+	value = labelValueInvalidCharsRegex.ReplaceAllString(value, "-")
+	if len(value) > validation.LabelValueMaxLength {
+		value = value[:validation.LabelValueMaxLength]
+	}
+	value = strings.TrimFunc(value, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	})
+	if len(validation.IsValidLabelValue(value)) > 0 {
+		return ""
+	}
+	return value
+}
+
+// getHost returns a host by ID, looking it up once.
+func (cs *CSCloud) getHost(id string) (*cloudstack.Host, error) {
+	cs.nodeLabeler.mu.Lock()
+	defer cs.nodeLabeler.mu.Unlock()
+
+	if host, ok := cs.nodeLabeler.hosts[id]; ok {
+		return host, nil
+	}
+
+	host, _, err := cs.client.Host.GetHostByID(id)
+	if err != nil {
+		return nil, err
+	}
+	cs.nodeLabeler.hosts[id] = host
+
+	return host, nil
+}
+
+// instanceTaints returns the node taints for the tags of a VM.
+func (l *nodeLabeler) instanceTaints(instance *cloudstack.VirtualMachine) []corev1.Taint {
+	var taints []corev1.Taint
+	for _, mapping := range l.taints {
+		value, ok := getTag(instance.Tags, mapping.tag)
+		if !ok {
+			continue
+		}
+		if len(validation.IsValidLabelValue(value)) > 0 {
+			klog.Warningf("Tag %v of instance %v (%v) has an invalid taint value %q", mapping.tag, instance.Name, instance.Id, value)
+			continue
+		}
+		taints = append(taints, corev1.Taint{Key: mapping.tag, Value: value, Effect: mapping.effect})
+	}
+	return taints
+}
+
+// isManagedLabel returns true if the label is set by the node labeler.
+func (l *nodeLabeler) isManagedLabel(key string) bool {
+	for _, label := range nodeLabels {
+		if key == label {
+			return true
+		}
+	}
+	return strings.HasPrefix(key, labelAffinityGroupPrefix) || strings.HasPrefix(key, l.tagLabelPrefix)
+}
+
+// isManagedTaint returns true if the taint is set by the node labeler.
+func (l *nodeLabeler) isManagedTaint(taint corev1.Taint) bool {
+	for _, mapping := range l.taints {
+		if taint.Key == mapping.tag && taint.Effect == mapping.effect {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeLabels replaces the managed labels of a node with the desired ones.
+func (l *nodeLabeler) mergeLabels(current, desired map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for key, value := range current {
+		if !l.isManagedLabel(key) {
+			merged[key] = value
+		}
+	}
+	for key, value := range desired {
+		merged[key] = value
+	}
+	return merged
+}
+
+// mergeTaints replaces the managed taints of a node with the desired ones, keeping the order of
+// the taints that do not change.
+func (l *nodeLabeler) mergeTaints(current, desired []corev1.Taint) []corev1.Taint {
+	used := make([]bool, len(desired))
+	var merged []corev1.Taint
+	for _, taint := range current {
+		if !l.isManagedTaint(taint) {
+			merged = append(merged, taint)
+			continue
+		}
+		for i, d := range desired {
+			if !used[i] && d.Key == taint.Key && d.Value == taint.Value && d.Effect == taint.Effect {
+				used[i] = true
+				merged = append(merged, taint)
+				break
+			}
+		}
+	}
+	for i, d := range desired {
+		if !used[i] {
+			merged = append(merged, d)
+		}
+	}
+	return merged
+}
+
+// taintsEqual returns true if both lists hold the same taints in the same order.
+func taintsEqual(a, b []corev1.Taint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !reflect.DeepEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// needsUpdate returns true if the managed labels or taints of a node differ from the desired ones.
+func (l *nodeLabeler) needsUpdate(node *corev1.Node, labels map[string]string, taints []corev1.Taint) bool {
+	if !reflect.DeepEqual(l.mergeLabels(node.Labels, labels), mapOrEmpty(node.Labels)) {
+		return true
+	}
+	return !taintsEqual(l.mergeTaints(node.Spec.Taints, taints), node.Spec.Taints)
+}
+
+// mapOrEmpty returns an empty map for nil, so it compares equal to merged labels.
+func mapOrEmpty(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
@@ -0,0 +1,302 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestNewNodeLabeler(t *testing.T) {
+	tests := []struct {
+		name       string
+		tags       string
+		prefix     string
+		taints     string
+		wantTags   []string
+		wantPrefix string
+		wantTaints []taintMapping
+		wantErr    bool
+	}{
+		{name: "defaults", wantPrefix: defaultTagLabelPrefix},
+		{
+			name:       "tags and taints",
+			tags:       "team, pool",
+			prefix:     "example.com/",
+			taints:     "dedicated:NoSchedule",
+			wantTags:   []string{"team", "pool"},
+			wantPrefix: "example.com/",
+			wantTaints: []taintMapping{{tag: "dedicated", effect: corev1.TaintEffectNoSchedule}},
+		},
+		{name: "invalid tag", tags: "my team", wantErr: true},
+		{name: "missing effect", taints: "dedicated", wantErr: true},
+		{name: "invalid effect", taints: "dedicated:Never", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &CSConfig{}
+			cfg.NodeLabels.Enabled = true
+			cfg.NodeLabels.Tags = tt.tags
+			cfg.NodeLabels.TagLabelPrefix = tt.prefix
+			cfg.NodeLabels.Taints = tt.taints
+
+			l, err := newNodeLabeler(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(l.tags, tt.wantTags) || l.tagLabelPrefix != tt.wantPrefix || !reflect.DeepEqual(l.taints, tt.wantTaints) {
+				t.Errorf("labeler = %v, %q, %v, want %v, %q, %v", l.tags, l.tagLabelPrefix, l.taints, tt.wantTags, tt.wantPrefix, tt.wantTaints)
+			}
+		})
+	}
+}
+
+func newLabeledInstance() *cloudstack.VirtualMachine {
+	return &cloudstack.VirtualMachine{
+		Id:           "vm-1",
+		Name:         "node-1",
+		Hostid:       "host-1",
+		Hostname:     "kvm-01.example.com",
+		Hypervisor:   "KVM",
+		Templatename: "Ubuntu 22.04 (k8s)",
+		Cpunumber:    4,
+		Memory:       8192,
+		Affinitygroup: []cloudstack.VirtualMachineAffinitygroup{
+			{Name: "workers"},
+		},
+		Tags: []cloudstack.Tags{
+			{Key: "team", Value: "platform"},
+			{Key: "dedicated", Value: "gpu"},
+			{Key: "billing", Value: "1234"},
+		},
+	}
+}
+
+func TestInstanceLabels(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	// The host is looked up once.
+	mockHost := cloudstack.NewMockHostServiceIface(ctrl)
+	mockHost.EXPECT().GetHostByID("host-1").Return(&cloudstack.Host{Id: "host-1", Podname: "pod-a", Clustername: "cluster 1"}, 1, nil)
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{Host: mockHost},
+		nodeLabeler: &nodeLabeler{
+			tags:           []string{"team"},
+			tagLabelPrefix: defaultTagLabelPrefix,
+			taints:         []taintMapping{{tag: "dedicated", effect: corev1.TaintEffectNoSchedule}},
+			hosts:          make(map[string]*cloudstack.Host),
+		},
+	}
+
+	want := map[string]string{
+		labelHost:                            "kvm-01.example.com",
+		labelPod:                             "pod-a",
+		labelCluster:                         "cluster-1",
+		labelHypervisor:                      "KVM",
+		labelTemplate:                        "Ubuntu-22.04-k8s",
+		labelCPU:                             "4",
+		labelMemory:                          "8192",
+		labelAffinityGroupPrefix + "workers": "true",
+		defaultTagLabelPrefix + "team":       "platform",
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := cs.instanceLabels(newLabeledInstance()); !reflect.DeepEqual(got, want) {
+			t.Errorf("instanceLabels() = %v, want %v", got, want)
+		}
+	}
+
+	wantTaints := []corev1.Taint{{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule}}
+	if got := cs.nodeLabeler.instanceTaints(newLabeledInstance()); !reflect.DeepEqual(got, wantTaints) {
+		t.Errorf("instanceTaints() = %v, want %v", got, wantTaints)
+	}
+}
+
+func TestSyncNodeLabels(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "node-1",
+			Labels: map[string]string{
+				"kubernetes.io/hostname":             "node-1",
+				labelTemplate:                        "old-template",
+				defaultTagLabelPrefix + "removed":    "value",
+				labelAffinityGroupPrefix + "workers": "true",
+			},
+		},
+		Spec: corev1.NodeSpec{
+			ProviderID: "external-cloudstack://vm-1",
+			Taints: []corev1.Taint{
+				{Key: "node.kubernetes.io/unschedulable", Effect: corev1.TaintEffectNoSchedule},
+				{Key: "dedicated", Value: "cpu", Effect: corev1.TaintEffectNoSchedule},
+			},
+		},
+	}
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	instance := newLabeledInstance()
+	instance.Hostid = ""
+	instance.Hostname = ""
+
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockVM.EXPECT().GetVirtualMachineByID("vm-1", gomock.Any()).Return(instance, 1, nil).Times(2)
+
+	client := fake.NewSimpleClientset(node)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(node); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+		nodeLabeler: &nodeLabeler{
+			tags:           []string{"team"},
+			tagLabelPrefix: defaultTagLabelPrefix,
+			taints:         []taintMapping{{tag: "dedicated", effect: corev1.TaintEffectNoSchedule}},
+			hosts:          make(map[string]*cloudstack.Host),
+			client:         client,
+			nodeLister:     corelisters.NewNodeLister(indexer),
+		},
+	}
+
+	if err := cs.syncNodeLabels(context.Background(), "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated, err := client.CoreV1().Nodes().Get(context.Background(), "node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wantLabels := map[string]string{
+		"kubernetes.io/hostname":             "node-1",
+		labelHypervisor:                      "KVM",
+		labelTemplate:                        "Ubuntu-22.04-k8s",
+		labelCPU:                             "4",
+		labelMemory:                          "8192",
+		labelAffinityGroupPrefix + "workers": "true",
+		defaultTagLabelPrefix + "team":       "platform",
+	}
+	if !reflect.DeepEqual(updated.Labels, wantLabels) {
+		t.Errorf("labels = %v, want %v", updated.Labels, wantLabels)
+	}
+
+	wantTaints := []corev1.Taint{
+		{Key: "node.kubernetes.io/unschedulable", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "dedicated", Value: "gpu", Effect: corev1.TaintEffectNoSchedule},
+	}
+	if !reflect.DeepEqual(updated.Spec.Taints, wantTaints) {
+		t.Errorf("taints = %v, want %v", updated.Spec.Taints, wantTaints)
+	}
+
+	// A node that is up to date is not updated again.
+	if err := indexer.Update(updated); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.ClearActions()
+	if err := cs.syncNodeLabels(context.Background(), "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actions := client.Actions(); len(actions) != 0 {
+		t.Errorf("expected no API calls, got %v", actions)
+	}
+}
+
+func TestSyncNodeLabelsFromInstanceCache(t *testing.T) {
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Spec:       corev1.NodeSpec{ProviderID: "external-cloudstack://vm-1"},
+	}
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	// The API only returns the fields of the requested details.
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+	mockVM.EXPECT().ListVirtualMachines(gomock.Any()).DoAndReturn(func(p *cloudstack.ListVirtualMachinesParams) (*cloudstack.ListVirtualMachinesResponse, error) {
+		instance := newLabeledInstance()
+		instance.Hostid = ""
+		instance.Hostname = ""
+		details, _ := p.GetDetails()
+		if !slices.Contains(details, "tmpl") {
+			instance.Templatename = ""
+		}
+		return &cloudstack.ListVirtualMachinesResponse{Count: 1, VirtualMachines: []*cloudstack.VirtualMachine{instance}}, nil
+	})
+
+	client := fake.NewSimpleClientset(node)
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(node); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+		nodeLabeler: &nodeLabeler{
+			tagLabelPrefix: defaultTagLabelPrefix,
+			hosts:          make(map[string]*cloudstack.Host),
+			client:         client,
+			nodeLister:     corelisters.NewNodeLister(indexer),
+		},
+	}
+	cfg := &CSConfig{}
+	cfg.InstanceCache.TTL = "1m"
+	instanceCache, err := newInstanceCache(cfg, cs.listAllVirtualMachines)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cs.instanceCache = instanceCache
+	if _, err := cs.instanceCache.refresh(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := cs.syncNodeLabels(context.Background(), "node-1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated, err := client.CoreV1().Nodes().Get(context.Background(), "node-1", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := updated.Labels[labelTemplate]; got != "Ubuntu-22.04-k8s" {
+		t.Errorf("template label = %q, want %q", got, "Ubuntu-22.04-k8s")
+	}
+}
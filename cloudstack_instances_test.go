@@ -20,11 +20,17 @@
 package cloudstack
 
 import (
+	"context"
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cloudprovider "k8s.io/cloud-provider"
 )
 
 func TestNodeAddresses(t *testing.T) {
@@ -124,7 +130,7 @@ func TestNodeAddresses(t *testing.T) {
 			errContains: "does not have an internal IP",
 		},
 		{
-			name: "instance with multiple NICs uses first",
+			name: "instance with multiple NICs reports all",
 			instance: &cloudstack.VirtualMachine{
 				Id:   "vm-1",
 				Name: "test-vm",
@@ -135,6 +141,51 @@ func TestNodeAddresses(t *testing.T) {
 			},
 			wantAddrs: []corev1.NodeAddress{
 				{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.2"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "default NIC comes first",
+			instance: &cloudstack.VirtualMachine{
+				Id:   "vm-1",
+				Name: "test-vm",
+				Nic: []cloudstack.Nic{
+					{Ipaddress: "192.168.0.1"},
+					{Ipaddress: "10.0.0.1", Isdefault: true},
+				},
+			},
+			wantAddrs: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: corev1.NodeInternalIP, Address: "192.168.0.1"},
+			},
+			wantErr: false,
+		},
+		{
+			name: "dual-stack NIC with secondary IPs",
+			instance: &cloudstack.VirtualMachine{
+				Id:   "vm-1",
+				Name: "test-vm",
+				Nic: []cloudstack.Nic{
+					{
+						Ipaddress:  "10.0.0.1",
+						Ip6address: "fd00::1",
+						Isdefault:  true,
+						Secondaryip: []struct {
+							Id        string `json:"id"`
+							Ipaddress string `json:"ipaddress"`
+						}{
+							{Id: "ip-1", Ipaddress: "10.0.0.10"},
+							{Id: "ip-2", Ipaddress: "fd00::10"},
+						},
+					},
+				},
+			},
+			wantAddrs: []corev1.NodeAddress{
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.1"},
+				{Type: corev1.NodeInternalIP, Address: "fd00::1"},
+				{Type: corev1.NodeInternalIP, Address: "10.0.0.10"},
+				{Type: corev1.NodeInternalIP, Address: "fd00::10"},
 			},
 			wantErr: false,
 		},
@@ -175,6 +226,48 @@ func TestNodeAddresses(t *testing.T) {
 	}
 }
 
+func TestNodeAddressesInternalNetwork(t *testing.T) {
+	instance := &cloudstack.VirtualMachine{
+		Id:   "vm-1",
+		Name: "test-vm",
+		Nic: []cloudstack.Nic{
+			{Ipaddress: "10.0.0.1", Networkid: "net-1", Networkname: "public", Isdefault: true},
+			{Ipaddress: "192.168.0.1", Ip6address: "fd00::1", Networkid: "net-2", Networkname: "cluster"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		cs   *CSCloud
+		want []string
+	}{
+		{name: "default NIC", cs: &CSCloud{}, want: []string{"10.0.0.1", "192.168.0.1", "fd00::1"}},
+		{name: "by network ID", cs: &CSCloud{internalNetworkID: "net-2"}, want: []string{"192.168.0.1", "fd00::1", "10.0.0.1"}},
+		{name: "by network name", cs: &CSCloud{internalNetworkName: "cluster"}, want: []string{"192.168.0.1", "fd00::1", "10.0.0.1"}},
+		{name: "unknown network", cs: &CSCloud{internalNetworkName: "other"}, want: []string{"10.0.0.1", "192.168.0.1", "fd00::1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := tt.cs.nodeAddresses(instance)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, addr := range addrs {
+				if addr.Type != corev1.NodeInternalIP {
+					t.Errorf("address %v has type %v, want %v", addr.Address, addr.Type, corev1.NodeInternalIP)
+				}
+				got = append(got, addr.Address)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nodeAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetProviderIDFromInstanceID(t *testing.T) {
 	cs := &CSCloud{}
 
@@ -238,6 +331,11 @@ func TestGetInstanceIDFromProviderID(t *testing.T) {
 			providerID: "aws://i-1234567890abcdef0",
 			want:       "i-1234567890abcdef0",
 		},
+		{
+			name:       "zone-aware provider ID",
+			providerID: "external-cloudstack://zone-1/vm-123",
+			want:       "vm-123",
+		},
 	}
 
 	for _, tt := range tests {
@@ -249,3 +347,258 @@ func TestGetInstanceIDFromProviderID(t *testing.T) {
 		})
 	}
 }
+
+func TestGetZoneFromProviderID(t *testing.T) {
+	tests := []struct {
+		providerID string
+		want       string
+	}{
+		{providerID: "external-cloudstack://vm-123", want: ""},
+		{providerID: "external-cloudstack://3f1d6a0e-zone/vm-123", want: "3f1d6a0e-zone"},
+		{providerID: "external-cloudstack://Zone 1/vm-123", want: "Zone 1"},
+		{providerID: "external-cloudstack://eu/west-1/vm-123", want: "eu/west-1"},
+		{providerID: "vm-123", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := getZoneFromProviderID(tt.providerID); got != tt.want {
+			t.Errorf("getZoneFromProviderID(%q) = %q, want %q", tt.providerID, got, tt.want)
+		}
+	}
+}
+
+func TestMultiZoneProviderID(t *testing.T) {
+	instance := &cloudstack.VirtualMachine{Id: "vm-123", Name: "node-1", Zoneid: "zone-id-1", Zonename: "Zone 1"}
+
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	// Lookups by zone-aware provider IDs are scoped to the zone.
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockVM.EXPECT().GetVirtualMachineByName("node-1", gomock.Any()).Return(instance, 1, nil)
+	mockVM.EXPECT().GetVirtualMachineByID("vm-123", gomock.Any(), gomock.Any()).Return(instance, 1, nil)
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			VirtualMachine: mockVM,
+		},
+		multiZone: true,
+	}
+
+	if got, want := cs.getProviderID(instance), "external-cloudstack://zone-id-1/vm-123"; got != want {
+		t.Errorf("getProviderID() = %q, want %q", got, want)
+	}
+
+	id, err := cs.InstanceID(context.Background(), "node-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id != "zone-id-1/vm-123" {
+		t.Errorf("InstanceID() = %q, want %q", id, "zone-id-1/vm-123")
+	}
+
+	exists, err := cs.InstanceExistsByProviderID(context.Background(), "external-cloudstack://zone-id-1/vm-123")
+	if err != nil || !exists {
+		t.Errorf("InstanceExistsByProviderID() = %v, %v, want true", exists, err)
+	}
+
+	cs.multiZone = false
+	if got, want := cs.getProviderID(instance), "external-cloudstack://vm-123"; got != want {
+		t.Errorf("getProviderID() = %q, want %q", got, want)
+	}
+}
+
+func TestInstanceType(t *testing.T) {
+	instance := &cloudstack.VirtualMachine{
+		Id:                  "vm-1",
+		Name:                "node-1",
+		Serviceofferingid:   "3f2a6b1c-custom",
+		Serviceofferingname: "Custom Offering",
+		Cpunumber:           4,
+		Memory:              8192,
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{name: "default", want: "CustomOffering"},
+		{name: "size", format: "{name}-{cpu}cpu-{memory}mb", want: "CustomOffering4cpu8192mb"},
+		{name: "offering ID", format: "{id}", want: "3f2a6b1ccustom"},
+		{name: "truncated", format: "{name}{name}{name}{name}{name}{name}", want: "CustomOfferingCustomOfferingCustomOfferingCustomOfferingCustomO"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			mockVM.EXPECT().GetVirtualMachineByID("vm-1", gomock.Any()).Return(instance, 1, nil)
+
+			cs := &CSCloud{
+				client: &cloudstack.CloudStackClient{
+					VirtualMachine: mockVM,
+				},
+				instanceTypeFormat: tt.format,
+			}
+
+			got, err := cs.InstanceTypeByProviderID(context.Background(), "external-cloudstack://vm-1")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("InstanceTypeByProviderID() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateInstanceTypeFormat(t *testing.T) {
+	if err := validateInstanceTypeFormat("{name}-{id}-{cpu}-{memory}"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateInstanceTypeFormat("{name}-{disk}"); err == nil {
+		t.Errorf("expected error for unknown placeholder")
+	}
+}
+
+func TestInstanceShutdownAndExists(t *testing.T) {
+	tests := []struct {
+		name         string
+		state        string
+		count        int
+		err          error
+		wantShutdown bool
+		wantExists   bool
+		wantErr      error
+	}{
+		{name: "running", state: "Running", count: 1, wantShutdown: false, wantExists: true},
+		{name: "starting", state: "Starting", count: 1, wantShutdown: false, wantExists: true},
+		{name: "stopping", state: "Stopping", count: 1, wantShutdown: true, wantExists: true},
+		{name: "stopped", state: "Stopped", count: 1, wantShutdown: true, wantExists: true},
+		{name: "shutdown", state: "Shutdown", count: 1, wantShutdown: true, wantExists: true},
+		{name: "error", state: "Error", count: 1, wantShutdown: true, wantExists: true},
+		{name: "destroyed", state: "Destroyed", count: 1, wantShutdown: true, wantExists: false},
+		{name: "expunging", state: "Expunging", count: 1, wantShutdown: true, wantExists: false},
+		{name: "not found", count: 0, err: errors.New("No match found"), wantExists: false, wantErr: cloudprovider.InstanceNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			var instance *cloudstack.VirtualMachine
+			if tt.err == nil {
+				instance = &cloudstack.VirtualMachine{Id: "vm-1", Name: "node-1", State: tt.state}
+			}
+
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			mockVM.EXPECT().GetVirtualMachineByID("vm-1", gomock.Any()).Return(instance, tt.count, tt.err).Times(2)
+
+			cs := &CSCloud{
+				client: &cloudstack.CloudStackClient{
+					VirtualMachine: mockVM,
+				},
+			}
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+				Spec:       corev1.NodeSpec{ProviderID: "external-cloudstack://vm-1"},
+			}
+
+			shutdown, err := cs.InstanceShutdown(context.Background(), node)
+			if err != tt.wantErr {
+				t.Fatalf("InstanceShutdown() error = %v, want %v", err, tt.wantErr)
+			}
+			if shutdown != tt.wantShutdown {
+				t.Errorf("InstanceShutdown() = %v, want %v", shutdown, tt.wantShutdown)
+			}
+
+			exists, err := cs.InstanceExists(context.Background(), node)
+			if err != nil {
+				t.Fatalf("InstanceExists() unexpected error: %v", err)
+			}
+			if exists != tt.wantExists {
+				t.Errorf("InstanceExists() = %v, want %v", exists, tt.wantExists)
+			}
+		})
+	}
+}
+
+func TestGetInstanceForNode(t *testing.T) {
+	vms := []*cloudstack.VirtualMachine{
+		{Id: "vm-1", Name: "node-1", Displayname: "worker-1", Hostname: "kvm-host-1"},
+		{Id: "vm-2", Name: "node-2", Displayname: "worker-2", Hostname: "kvm-host-2.example.com"},
+		{Id: "vm-3", Name: "node-3", Displayname: "worker-1", Hostname: "kvm-host-2", Zonename: "zone-a"},
+		{Id: "vm-4", Name: "node-3", Displayname: "worker-4", Hostname: "kvm-host-3", Zonename: "zone-b"},
+	}
+
+	tests := []struct {
+		name       string
+		source     string
+		nodeName   string
+		zone       string
+		providerID string
+		wantID     string
+		wantErr    bool
+	}{
+		{name: "by provider ID", nodeName: "other-name", providerID: "external-cloudstack://vm-2", wantID: "vm-2"},
+		{name: "by name", source: nodeNameSourceName, nodeName: "node-1", wantID: "vm-1"},
+		{name: "by name with FQDN", source: nodeNameSourceName, nodeName: "Node-1.cluster.local", wantID: "vm-1"},
+		{name: "by display name", source: nodeNameSourceDisplayName, nodeName: "worker-2", wantID: "vm-2"},
+		{name: "ambiguous display name", source: nodeNameSourceDisplayName, nodeName: "worker-1", wantErr: true},
+		{name: "not found", source: nodeNameSourceName, nodeName: "node-4", wantErr: true},
+		{name: "name in several zones", source: nodeNameSourceName, nodeName: "node-3", wantErr: true},
+		{name: "by name in the zone of the node", source: nodeNameSourceName, nodeName: "node-3", zone: "zone-b", wantID: "vm-4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+			listParams := &cloudstack.ListVirtualMachinesParams{}
+			if tt.providerID != "" {
+				mockVM.EXPECT().GetVirtualMachineByID("vm-2", gomock.Any()).Return(vms[1], 1, nil)
+			} else {
+				mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+				mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+					Count:           len(vms),
+					VirtualMachines: vms,
+				}, nil)
+			}
+
+			cs := &CSCloud{
+				client: &cloudstack.CloudStackClient{
+					VirtualMachine: mockVM,
+				},
+				nodeNameSource: tt.source,
+				multiZone:      true,
+			}
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: tt.nodeName},
+				Spec:       corev1.NodeSpec{ProviderID: tt.providerID},
+			}
+			if tt.zone != "" {
+				node.Labels = map[string]string{corev1.LabelTopologyZone: tt.zone}
+			}
+
+			instance, err := cs.getInstanceForNode(node)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if instance.Id != tt.wantID {
+				t.Errorf("instance = %v, want %v", instance.Id, tt.wantID)
+			}
+		})
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -31,6 +32,7 @@ import (
 	"k8s.io/klog/v2"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 )
 
@@ -56,6 +58,11 @@ const (
 	// associated the IP address. This annotation is set by the controller when it associates
 	// an unallocated IP, and is used to determine if the IP should be disassociated on deletion.
 	ServiceAnnotationLoadBalancerIPAssociatedByController = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-associated-by-controller" //nolint:gosec
+
+	// ServiceAnnotationLoadBalancerAlgorithm is the annotation used on the service
+	// to select the load balancing algorithm (e.g. "roundrobin", "leastconn" or "source").
+	// If not specified, the algorithm is derived from the session affinity of the service.
+	ServiceAnnotationLoadBalancerAlgorithm = "service.beta.kubernetes.io/cloudstack-load-balancer-algorithm"
 )
 
 type loadBalancer struct {
@@ -69,7 +76,27 @@ type loadBalancer struct {
 	networkID                string
 	projectID                string
 	rules                    map[string]*cloudstack.LoadBalancerRule
+	secondaryRules           map[string]*cloudstack.LoadBalancerRule
+	tags                     map[string]string
 	ipAssociatedByController bool
+	manageNetworkACLLists    bool
+
+	// ipReservation is the name of the reservation the IP was claimed from, if any.
+	ipReservation string
+
+	// isStaleIPSharer returns true if a sharer tag of the public IP belongs to a deleted service.
+	isStaleIPSharer func(key, value string) bool
+
+	// primaryName is set on the load balancer on the IP of the secondary family of a dual-stack
+	// service, to the name of the load balancer on the primary IP the certificates are uploaded for.
+	primaryName string
+
+	// ipLocks serializes the changes to the public IPs shared by several services.
+	ipLocks *keyedMutex
+
+	// service and eventRecorder are used to record the steps taken as events on the service.
+	service       *corev1.Service
+	eventRecorder record.EventRecorder
 }
 
 // GetLoadBalancer returns whether the specified load balancer exists, and if so, what its status is.
@@ -77,11 +104,29 @@ func (cs *CSCloud) GetLoadBalancer(ctx context.Context, clusterName string, serv
 	klog.V(4).Infof("GetLoadBalancer(%v, %v, %v)", clusterName, service.Namespace, service.Name)
 
 	// Get the load balancer details and existing rules.
-	lb, err := cs.getLoadBalancer(service)
+	lb, err := cs.getLoadBalancer(clusterName, service)
 	if err != nil {
 		return nil, false, err
 	}
 
+	if isInternalLoadBalancer(service) {
+		ilbs, err := lb.getInternalLoadBalancers()
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, ilb := range ilbs {
+			klog.V(4).Infof("Found an internal load balancer with source IP %v", ilb.Sourceipaddress)
+
+			status := &corev1.LoadBalancerStatus{}
+			status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: ilb.Sourceipaddress})
+
+			return status, true, nil
+		}
+
+		return nil, false, nil
+	}
+
 	// If we don't have any rules, the load balancer does not exist.
 	if len(lb.rules) == 0 {
 		return nil, false, nil
@@ -91,6 +136,9 @@ func (cs *CSCloud) GetLoadBalancer(ctx context.Context, clusterName string, serv
 
 	status := &corev1.LoadBalancerStatus{}
 	status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: lb.ipAddr})
+	if len(lb.secondaryRules) > 0 {
+		status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: lb.secondaryLoadBalancer("").ipAddr})
+	}
 
 	return status, true, nil
 }
@@ -99,64 +147,186 @@ func (cs *CSCloud) GetLoadBalancer(ctx context.Context, clusterName string, serv
 func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) (status *corev1.LoadBalancerStatus, err error) {
 	klog.V(4).Infof("EnsureLoadBalancer(%v, %v, %v, %v, %v, %v)", clusterName, service.Namespace, service.Name, service.Spec.LoadBalancerIP, service.Spec.Ports, nodes)
 
+	unlock := cs.serviceLocks.lock(service.Namespace + "/" + service.Name)
+	defer unlock()
+
+	defer func() {
+		cs.setReconcileStatus(ctx, service, err)
+	}()
+
 	if len(service.Spec.Ports) == 0 {
 		return nil, fmt.Errorf("requested load balancer with no ports")
 	}
 
 	// Get the load balancer details and existing rules.
-	lb, err := cs.getLoadBalancer(service)
+	lb, err := cs.getLoadBalancer(clusterName, service)
 	if err != nil {
 		return nil, err
 	}
 
 	// Set the load balancer algorithm.
-	switch service.Spec.SessionAffinity {
-	case corev1.ServiceAffinityNone:
-		lb.algorithm = "roundrobin"
-	case corev1.ServiceAffinityClientIP:
-		lb.algorithm = "source"
-	default:
-		return nil, fmt.Errorf("unsupported load balancer affinity: %v", service.Spec.SessionAffinity)
+	lb.algorithm, err = getLoadBalancerAlgorithm(service)
+	if err != nil {
+		return nil, err
 	}
 
+	// For services with externalTrafficPolicy Local, only use the nodes that have ready endpoints.
+	nodes = filterNodesWithLocalEndpoints(cs.endpointSliceLister, service, nodes)
+
 	// Verify that all the hosts belong to the same network, and retrieve their ID's.
-	lb.hostIDs, lb.networkID, err = cs.verifyHosts(nodes)
+	lb.hostIDs, lb.networkID, err = cs.verifyHosts(service, nodes)
 	if err != nil {
 		return nil, err
 	}
 
-	if !lb.hasLoadBalancerIP() {
-		// Create or retrieve the load balancer IP.
-		if err := lb.getLoadBalancerIP(service.Spec.LoadBalancerIP); err != nil {
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
 			return nil, err
 		}
+		return nil, err
+	}
+
+	if !isLoadBalancerAlgorithmSupported(network.Service, lb.algorithm) {
+		return nil, fmt.Errorf("load balancer algorithm %v is not supported by network %v", lb.algorithm, network.Name)
+	}
+
+	if isInternalLoadBalancer(service) {
+		return cs.ensureInternalLoadBalancer(ctx, clusterName, lb, network, service)
+	}
+
+	if err := lb.checkLoadBalancerNetwork(); err != nil {
+		return nil, err
+	}
+
+	// Remove the internal load balancers if the service was switched to a public one.
+	ilbs, err := lb.getInternalLoadBalancers()
+	if err != nil {
+		return nil, err
+	}
+	if err := lb.deleteInternalLoadBalancers(ilbs); err != nil {
+		return nil, err
+	}
+
+	sslCertID, err := cs.ensurePublicLoadBalancer(ctx, lb, network, service)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up the IP of the secondary family of dual-stack services once the primary IP is
+	// unlocked again, so no service holds the locks of two IPs at a time.
+	sec, err := cs.ensureSecondaryLoadBalancer(lb, network, service, sslCertID)
+	if err != nil {
+		return nil, err
+	}
+
+	status = &corev1.LoadBalancerStatus{}
+	// If hostname is explicitly set using service annotation
+	// Workaround for https://github.com/kubernetes/kubernetes/issues/66607
+	if hostname := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerLoadbalancerHostname, ""); hostname != "" {
+		status.Ingress = []corev1.LoadBalancerIngress{{Hostname: hostname}}
+		return status, nil
+	}
+	// Default to IP
+	status.Ingress = []corev1.LoadBalancerIngress{{IP: lb.ipAddr}}
+	if sec != nil {
+		status.Ingress = append(status.Ingress, corev1.LoadBalancerIngress{IP: sec.ipAddr})
+	}
+
+	return status, nil
+}
+
+// ensurePublicLoadBalancer sets up the public IP of the load balancer and its rules. It returns
+// the ID of the certificate used by the ports that terminate TLS, if any.
+func (cs *CSCloud) ensurePublicLoadBalancer(ctx context.Context, lb *loadBalancer, network *cloudstack.Network, service *corev1.Service) (sslCertID string, err error) {
+	// Serialize the changes to the IP with the other services sharing it. The lock is held until
+	// the rules are set up, so the IP is not released or taken over meanwhile.
+	var unlockIP func()
+	if !lb.hasLoadBalancerIP() {
+		// Create or retrieve the load balancer IP, which is returned locked.
+		if unlockIP, err = lb.getLoadBalancerIP(service.Spec.LoadBalancerIP); err != nil {
+			return "", err
+		}
+		defer unlockIP()
 
-		if lb.ipAddr != "" && lb.ipAddr != service.Spec.LoadBalancerIP {
+		if lb.ipAddr != "" && !ipRequestedByService(service, lb.ipAddr) {
 			defer func(lb *loadBalancer) {
 				if err != nil {
-					if err := lb.releaseLoadBalancerIP(); err != nil {
+					if err := lb.releaseUnusedLoadBalancerIP(); err != nil {
 						klog.Errorf(err.Error())
 					}
 				}
 			}(lb)
 		}
 
-		// If the controller associated the IP and matches the service spec, set the annotation to persist this information.
-		if lb.ipAssociatedByController && lb.ipAddr == service.Spec.LoadBalancerIP {
+		// If the controller associated the IP requested by the service, set the annotation to persist this information.
+		if lb.ipAssociatedByController && ipRequestedByService(service, lb.ipAddr) {
 			if err := cs.setServiceAnnotation(ctx, service, ServiceAnnotationLoadBalancerIPAssociatedByController, "true"); err != nil {
 				// Log the error but don't fail - the annotation is helpful but not critical
 				klog.Warningf("Failed to set annotation on service %s/%s: %v", service.Namespace, service.Name, err)
 			}
 		}
+	} else {
+		unlockIP = cs.ipLocks.lock(lb.ipAddrID)
+		defer unlockIP()
+
+		// The load balancer keeps its IP, so reject a selection of another one.
+		if hasIPSelector(service) {
+			if err := lb.checkSelectedIPAddress(service); err != nil {
+				return "", err
+			}
+		}
 	}
 
 	klog.V(4).Infof("Load balancer %v is associated with IP %v", lb.name, lb.ipAddr)
 
+	if err := lb.shareIPAddress(service); err != nil {
+		return "", err
+	}
+
+	// Upload or look up the certificate used by the ports that terminate TLS.
+	sslCert, err := cs.getSSLCertificate(ctx, service, lb.name)
+	if err != nil {
+		return "", err
+	}
+
+	if sslCert != nil {
+		var uploaded bool
+		if sslCertID, uploaded, err = lb.ensureSSLCertificate(sslCert); err != nil {
+			return "", err
+		}
+		if uploaded {
+			// Don't leave the new certificate behind if it could not be assigned.
+			defer func(certID string) {
+				if err != nil {
+					if err := lb.deleteUnusedSSLCertificates([]string{certID}); err != nil {
+						klog.Errorf(err.Error())
+					}
+				}
+			}(sslCertID)
+		}
+	}
+
+	if err := cs.ensureLoadBalancerRules(lb, service, network, sslCertID); err != nil {
+		return "", err
+	}
+
+	return sslCertID, nil
+
+}
+
+// ensureLoadBalancerRules creates or updates a load balancer rule for every port of the service,
+// together with its policies and firewall or network ACL rules, and deletes the rules of the
+// ports that were removed.
+func (cs *CSCloud) ensureLoadBalancerRules(lb *loadBalancer, service *corev1.Service, network *cloudstack.Network, sslCertID string) error {
+	// Certificates that were replaced or whose rules are deleted, and may no longer be in use.
+	var staleSSLCertIDs []string
+
 	for _, port := range service.Spec.Ports {
 		// Construct the protocol name first, we need it a few times
 		protocol := ProtocolFromServicePort(port, service)
 		if protocol == LoadBalancerProtocolInvalid {
-			return nil, fmt.Errorf("unsupported load balancer protocol: %v", port.Protocol)
+			return fmt.Errorf("unsupported load balancer protocol: %v", port.Protocol)
 		}
 
 		// All ports have their own load balancer rule, so add the port to lbName to keep the names unique.
@@ -165,14 +335,14 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 		// If the load balancer rule exists and is up-to-date, we move on to the next rule.
 		lbRule, needsUpdate, err := lb.checkLoadBalancerRule(lbRuleName, port, protocol, service, cs.version)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		if lbRule != nil {
 			if needsUpdate {
 				klog.V(4).Infof("Updating load balancer rule: %v", lbRuleName)
 				if err := lb.updateLoadBalancerRule(lbRuleName, protocol, service, cs.version); err != nil {
-					return nil, err
+					return err
 				}
 				// Delete the rule from the map, to prevent it being deleted.
 				delete(lb.rules, lbRuleName)
@@ -181,37 +351,54 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 				// Delete the rule from the map, to prevent it being deleted.
 				delete(lb.rules, lbRuleName)
 			}
+
+			// The hosts change with the nodes, or with the traffic policy of the service.
+			if err := lb.syncRuleHosts(lbRule); err != nil {
+				return err
+			}
 		} else {
 			klog.V(4).Infof("Creating load balancer rule: %v", lbRuleName)
 			lbRule, err = lb.createLoadBalancerRule(lbRuleName, port, protocol, service)
 			if err != nil {
-				return nil, err
+				return err
 			}
 
 			klog.V(4).Infof("Assigning hosts (%v) to load balancer rule: %v", lb.hostIDs, lbRuleName)
 			if err = lb.assignHostsToRule(lbRule, lb.hostIDs); err != nil {
-				return nil, err
+				return err
 			}
 		}
 
-		network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
-		if err != nil {
-			if count == 0 {
-				return nil, err
+		// Reconcile the health check and stickiness policies, so changes to the annotations converge.
+		if err := lb.reconcileHealthCheckPolicy(lbRule, service); err != nil {
+			return err
+		}
+		if err := lb.reconcileStickinessPolicy(lbRule, service); err != nil {
+			return err
+		}
+
+		if protocol == LoadBalancerProtocolSSL {
+			removed, err := lb.reconcileSSLCertificate(lbRule, sslCertID)
+			staleSSLCertIDs = append(staleSSLCertIDs, removed...)
+			if err != nil {
+				return err
 			}
-			return nil, err
 		}
 
 		if lbRule != nil {
 			if isFirewallSupported(network.Service) {
 				klog.V(4).Infof("Creating firewall rules for load balancer rule: %v (%v:%v:%v)", lbRuleName, protocol, lbRule.Publicip, port.Port)
 				if _, err := lb.updateFirewallRule(lbRule.Publicipid, int(port.Port), protocol, service.Spec.LoadBalancerSourceRanges); err != nil {
-					return nil, err
+					return err
 				}
 			} else if isNetworkACLSupported(network.Service) {
 				klog.V(4).Infof("Creating ACL rules for load balancer rule: %v (%v:%v:%v)", lbRuleName, protocol, lbRule.Publicip, port.Port)
-				if _, err := lb.updateNetworkACL(int(port.Port), protocol, network.Id); err != nil {
-					return nil, err
+				sourceRanges, err := lb.getSourceRanges(service)
+				if err != nil {
+					return err
+				}
+				if _, err := lb.updateNetworkACL(int(port.Port), protocol, network.Id, sourceRanges); err != nil {
+					return err
 				}
 			}
 		}
@@ -221,81 +408,130 @@ func (cs *CSCloud) EnsureLoadBalancer(ctx context.Context, clusterName string, s
 	for _, lbRule := range lb.rules {
 		protocol := ProtocolFromLoadBalancer(lbRule.Protocol)
 		if protocol == LoadBalancerProtocolInvalid {
-			return nil, fmt.Errorf("error parsing protocol %v: %v", lbRule.Protocol, err)
+			return fmt.Errorf("error parsing protocol %v", lbRule.Protocol)
 		}
 		port, err := strconv.ParseInt(lbRule.Publicport, 10, 32)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing port %s: %v", lbRule.Publicport, err)
+			return fmt.Errorf("error parsing port %s: %v", lbRule.Publicport, err)
 		}
 
 		klog.V(4).Infof("Deleting firewall rules associated with load balancer rule: %v (%v:%v:%v)", lbRule.Name, protocol, lbRule.Publicip, port)
 		if _, err := lb.deleteFirewallRule(lbRule.Publicipid, int(port), protocol); err != nil {
-			return nil, err
+			return err
 		}
 
 		klog.V(4).Infof("Deleting Network ACL rules associated with load balancer rule: %v (%v:%v)", lbRule.Name, protocol, port)
 		if _, err := lb.deleteNetworkACLRule(int(port), protocol, lb.networkID); err != nil {
-			return nil, err
+			return err
+		}
+
+		if protocol == LoadBalancerProtocolSSL {
+			certIDs, err := lb.ownedSSLCertificateIDs(lbRule)
+			if err != nil {
+				return err
+			}
+			staleSSLCertIDs = append(staleSSLCertIDs, certIDs...)
 		}
 
 		klog.V(4).Infof("Deleting obsolete load balancer rule: %v", lbRule.Name)
 		if err := lb.deleteLoadBalancerRule(lbRule); err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	status = &corev1.LoadBalancerStatus{}
-	// If hostname is explicitly set using service annotation
-	// Workaround for https://github.com/kubernetes/kubernetes/issues/66607
-	if hostname := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerLoadbalancerHostname, ""); hostname != "" {
-		status.Ingress = []corev1.LoadBalancerIngress{{Hostname: hostname}}
-		return status, nil
+	if err := lb.deleteUnusedSSLCertificates(staleSSLCertIDs); err != nil {
+		return err
 	}
-	// Default to IP
-	status.Ingress = []corev1.LoadBalancerIngress{{IP: lb.ipAddr}}
 
-	return status, nil
+	return nil
 }
 
 // UpdateLoadBalancer updates hosts under the specified load balancer.
-func (cs *CSCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) error {
+func (cs *CSCloud) UpdateLoadBalancer(ctx context.Context, clusterName string, service *corev1.Service, nodes []*corev1.Node) (err error) {
 	klog.V(4).Infof("UpdateLoadBalancer(%v, %v, %v, %v)", clusterName, service.Namespace, service.Name, nodes)
 
+	unlock := cs.serviceLocks.lock(service.Namespace + "/" + service.Name)
+	defer unlock()
+
+	defer func() {
+		cs.setReconcileStatus(ctx, service, err)
+	}()
+
 	// Get the load balancer details and existing rules.
-	lb, err := cs.getLoadBalancer(service)
+	lb, err := cs.getLoadBalancer(clusterName, service)
 	if err != nil {
 		return err
 	}
 
+	// For services with externalTrafficPolicy Local, only use the nodes that have ready endpoints.
+	nodes = filterNodesWithLocalEndpoints(cs.endpointSliceLister, service, nodes)
+
 	// Verify that all the hosts belong to the same network, and retrieve their ID's.
-	lb.hostIDs, _, err = cs.verifyHosts(nodes)
+	lb.hostIDs, lb.networkID, err = cs.verifyHosts(service, nodes)
 	if err != nil {
 		return err
 	}
 
-	for _, lbRule := range lb.rules {
-		p := lb.LoadBalancer.NewListLoadBalancerRuleInstancesParams(lbRule.Id)
-
-		// Retrieve all VMs currently associated to this load balancer rule.
-		l, err := lb.LoadBalancer.ListLoadBalancerRuleInstances(p)
+	if isInternalLoadBalancer(service) {
+		ilbs, err := lb.getInternalLoadBalancers()
 		if err != nil {
-			return fmt.Errorf("error retrieving associated instances: %v", err)
+			return err
 		}
 
-		assign, remove := symmetricDifference(lb.hostIDs, l.LoadBalancerRuleInstances)
-
-		if len(assign) > 0 {
-			klog.V(4).Infof("Assigning new hosts (%v) to load balancer rule: %v", assign, lbRule.Name)
-			if err := lb.assignHostsToRule(lbRule, assign); err != nil {
+		for _, ilb := range ilbs {
+			if err := lb.updateInternalLoadBalancerHosts(ilb); err != nil {
 				return err
 			}
 		}
 
-		if len(remove) > 0 {
-			klog.V(4).Infof("Removing old hosts (%v) from load balancer rule: %v", assign, lbRule.Name)
-			if err := lb.removeHostsFromRule(lbRule, remove); err != nil {
-				return err
-			}
+		return nil
+	}
+
+	// The hosts of another network cannot be assigned to the rules.
+	if err := lb.checkLoadBalancerNetwork(); err != nil {
+		return err
+	}
+
+	for _, lbRule := range lb.rules {
+		if err := lb.syncRuleHosts(lbRule); err != nil {
+			return err
+		}
+	}
+
+	sec := lb.secondaryLoadBalancer("")
+	for _, lbRule := range sec.rules {
+		if err := sec.syncRuleHosts(lbRule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncRuleHosts assigns the hosts of the load balancer to an existing rule, and removes the
+// hosts that are no longer part of it.
+func (lb *loadBalancer) syncRuleHosts(lbRule *cloudstack.LoadBalancerRule) error {
+	p := lb.LoadBalancer.NewListLoadBalancerRuleInstancesParams(lbRule.Id)
+
+	// Retrieve all VMs currently associated to this load balancer rule.
+	l, err := lb.LoadBalancer.ListLoadBalancerRuleInstances(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving associated instances: %v", err)
+	}
+
+	assign, remove := symmetricDifference(lb.hostIDs, l.LoadBalancerRuleInstances)
+
+	if len(assign) > 0 {
+		klog.V(4).Infof("Assigning new hosts (%v) to load balancer rule: %v", assign, lbRule.Name)
+		if err := lb.assignHostsToRule(lbRule, assign); err != nil {
+			return err
+		}
+	}
+
+	if len(remove) > 0 {
+		klog.V(4).Infof("Removing old hosts (%v) from load balancer rule: %v", remove, lbRule.Name)
+		if err := lb.removeHostsFromRule(lbRule, remove); err != nil {
+			return err
 		}
 	}
 
@@ -320,16 +556,109 @@ func isNetworkACLSupported(services []cloudstack.NetworkServiceInternal) bool {
 	return false
 }
 
+// isLoadBalancerAlgorithmSupported returns true if the load balancer provider of the network
+// advertises the algorithm. Networks that don't advertise their algorithms accept any of them.
+func isLoadBalancerAlgorithmSupported(services []cloudstack.NetworkServiceInternal, algorithm string) bool {
+	for _, svc := range services {
+		if svc.Name != "Lb" {
+			continue
+		}
+		for _, capability := range svc.Capability {
+			if capability.Name != "SupportedLbAlgorithms" || capability.Value == "" {
+				continue
+			}
+			for _, supported := range strings.Split(capability.Value, ",") {
+				if strings.EqualFold(strings.TrimSpace(supported), algorithm) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// getLoadBalancerAlgorithm returns the load balancer algorithm for the service. The algorithm
+// annotation takes precedence, otherwise it is derived from the session affinity.
+func getLoadBalancerAlgorithm(service *corev1.Service) (string, error) {
+	algorithm := strings.ToLower(strings.TrimSpace(getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerAlgorithm, "")))
+
+	switch service.Spec.SessionAffinity {
+	case corev1.ServiceAffinityNone:
+		if algorithm == "" {
+			algorithm = "roundrobin"
+		}
+	case corev1.ServiceAffinityClientIP:
+		if algorithm == "" {
+			algorithm = "source"
+		} else if algorithm != "source" {
+			return "", fmt.Errorf("load balancer algorithm %v conflicts with session affinity %v", algorithm, service.Spec.SessionAffinity)
+		}
+	default:
+		return "", fmt.Errorf("unsupported load balancer affinity: %v", service.Spec.SessionAffinity)
+	}
+
+	return algorithm, nil
+}
+
 // EnsureLoadBalancerDeleted deletes the specified load balancer if it exists, returning
 // nil if the load balancer specified either didn't exist or was successfully deleted.
 func (cs *CSCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *corev1.Service) error {
 	klog.V(4).Infof("EnsureLoadBalancerDeleted(%v, %v, %v)", clusterName, service.Namespace, service.Name)
 
+	unlock := cs.serviceLocks.lock(service.Namespace + "/" + service.Name)
+	defer unlock()
+
 	// Get the load balancer details and existing rules.
-	lb, err := cs.getLoadBalancer(service)
+	lb, err := cs.getLoadBalancer(clusterName, service)
+	if err != nil {
+		return err
+	}
+
+	// Always look for internal load balancers, the annotation may have been removed since they were created.
+	ilbs, err := lb.getInternalLoadBalancers()
 	if err != nil {
 		return err
 	}
+	if err := lb.deleteInternalLoadBalancers(ilbs); err != nil {
+		return err
+	}
+
+	// Networks whose managed network ACL list may no longer be needed.
+	aclNetworkIDs := make(map[string]bool)
+	for _, ilb := range ilbs {
+		aclNetworkIDs[ilb.Networkid] = true
+	}
+
+	networkIDs, err := cs.deletePublicLoadBalancerRules(lb)
+	if err != nil {
+		return err
+	}
+	for _, networkID := range networkIDs {
+		aclNetworkIDs[networkID] = true
+	}
+
+	if lb.manageNetworkACLLists {
+		for networkID := range aclNetworkIDs {
+			if err := lb.releaseManagedNetworkACLList(networkID); err != nil {
+				klog.Errorf("Error releasing managed network ACL list of network %v: %v", networkID, err)
+			}
+		}
+	}
+
+	if err := cs.releasePublicLoadBalancerIP(lb, service); err != nil {
+		return err
+	}
+
+	return cs.deleteSecondaryLoadBalancer(lb, service)
+}
+
+// deletePublicLoadBalancerRules deletes the public load balancer rules of the load balancer,
+// together with their firewall rules, network ACL items and certificates. It returns the ID's
+// of the VPC tiers whose network ACL items were deleted.
+func (cs *CSCloud) deletePublicLoadBalancerRules(lb *loadBalancer) ([]string, error) {
+	var aclNetworkIDs []string
+	var sslCertIDs []string
 
 	for _, lbRule := range lb.rules {
 		klog.V(4).Infof("Deleting firewall rules / Network ACLs for load balancer: %v", lbRule.Name)
@@ -337,21 +666,29 @@ func (cs *CSCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName st
 		if protocol == LoadBalancerProtocolInvalid {
 			klog.Errorf("Error parsing protocol: %v", lbRule.Protocol)
 		} else {
+			if protocol == LoadBalancerProtocolSSL {
+				certIDs, err := lb.ownedSSLCertificateIDs(lbRule)
+				if err != nil {
+					return nil, err
+				}
+				sslCertIDs = append(sslCertIDs, certIDs...)
+			}
+
 			port, err := strconv.ParseInt(lbRule.Publicport, 10, 32)
 			if err != nil {
 				klog.Errorf("Error parsing port: %v", err)
 			} else {
 				networkId, err := cs.getNetworkIDFromIPAddress(lb.ipAddrID)
 				if err != nil {
-					return err
+					return nil, err
 				}
 				network, count, err := lb.Network.GetNetworkByID(networkId, cloudstack.WithProject(lb.projectID))
 				if err != nil {
 					if count == 0 {
 						klog.Errorf("No network found with ID: %v", networkId)
-						return err
+						return nil, err
 					}
-					return err
+					return nil, err
 				}
 				if network.Vpcid == "" {
 					_, err = lb.deleteFirewallRule(lbRule.Publicipid, int(port), protocol)
@@ -364,139 +701,332 @@ func (cs *CSCloud) EnsureLoadBalancerDeleted(ctx context.Context, clusterName st
 					if err != nil {
 						klog.Errorf("Error deleting Network ACL rule: %v", err)
 					}
+					aclNetworkIDs = append(aclNetworkIDs, networkId)
 				}
 			}
 
 			klog.V(4).Infof("Deleting load balancer rule: %v", lbRule.Name)
 			if err := lb.deleteLoadBalancerRule(lbRule); err != nil {
-				return err
+				return nil, err
 			}
 		}
 	}
 
+	if err := lb.deleteUnusedSSLCertificates(sslCertIDs); err != nil {
+		return nil, err
+	}
+
+	return aclNetworkIDs, nil
+}
+
+// releasePublicLoadBalancerIP releases the public IP of the load balancer once its rules are
+// deleted, unless the service requested it or other services still share it.
+func (cs *CSCloud) releasePublicLoadBalancerIP(lb *loadBalancer, service *corev1.Service) error {
 	if lb.ipAddr != "" {
-		// If the IP was allocated by the controller (not specified in service spec), release it.
-		if lb.ipAddr != service.Spec.LoadBalancerIP {
+		// Serialize the release of the IP with the other services sharing it.
+		unlock := cs.ipLocks.lock(lb.ipAddrID)
+		defer unlock()
+
+		// The IP is released if it was allocated by the controller (not requested by the service), or
+		// if the controller associated the IP requested by the service. It is kept as long as other
+		// services use it, and released with the last of them.
+		release := !ipRequestedByService(service, lb.ipAddr) ||
+			getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPAssociatedByController, false)
+
+		users, release, err := lb.unshareIPAddress(release)
+		if err != nil {
+			return fmt.Errorf("error checking the other services using IP %v, not releasing it: %v", lb.ipAddr, err)
+		}
+
+		switch {
+		case users > 0:
+			klog.V(4).Infof("IP %v is still used by %d other service(s), not releasing it", lb.ipAddr, users)
+		case release:
 			klog.V(4).Infof("Releasing load balancer IP: %v", lb.ipAddr)
-			if err := lb.releaseLoadBalancerIP(); err != nil {
+			if err := lb.releaseOrRetainLoadBalancerIP(service); err != nil {
 				return err
 			}
+		}
+	}
+
+	return nil
+}
+
+// GetLoadBalancerName retrieves the name of the LoadBalancer. The name is prefixed with the
+// cluster name, so load balancers of different clusters in the same account don't collide.
+func (cs *CSCloud) GetLoadBalancerName(ctx context.Context, clusterName string, service *corev1.Service) string {
+	name := cloudprovider.DefaultLoadBalancerName(service)
+	if clusterName == "" {
+		return name
+	}
+	return fmt.Sprintf("%s-%s", clusterName, name)
+}
+
+// getLoadBalancer retrieves the IP address and ID and all the existing rules it can find.
+//
+// Rules are looked up by the tags of the service. If none are found, untagged rules created before
+// tagging was introduced are looked up by name and adopted.
+func (cs *CSCloud) getLoadBalancer(clusterName string, service *corev1.Service) (*loadBalancer, error) {
+	lb := &loadBalancer{
+		CloudStackClient:      cs.client,
+		name:                  cs.GetLoadBalancerName(context.TODO(), clusterName, service),
+		projectID:             cs.projectID,
+		rules:                 make(map[string]*cloudstack.LoadBalancerRule),
+		secondaryRules:        make(map[string]*cloudstack.LoadBalancerRule),
+		tags:                  serviceTags(clusterName, service),
+		manageNetworkACLLists: cs.manageNetworkACLLists,
+		ipLocks:               &cs.ipLocks,
+		isStaleIPSharer:       cs.isStaleIPSharer,
+		service:               service,
+		eventRecorder:         cs.eventRecorder,
+	}
+
+	var lbRules []*cloudstack.LoadBalancerRule
+
+	if owner := lb.ownerTags(); owner != nil {
+		p := cs.client.LoadBalancer.NewListLoadBalancerRulesParams()
+		p.SetTags(owner)
+		p.SetListall(true)
+
+		if cs.projectID != "" {
+			p.SetProjectid(cs.projectID)
+		}
+
+		l, err := cs.client.LoadBalancer.ListLoadBalancerRules(p)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving load balancer rules: %v", err)
+		}
+		lbRules = l.LoadBalancerRules
+	}
+
+	if len(lbRules) == 0 {
+		var err error
+		lbRules, err = lb.adoptLegacyLoadBalancerRules(cloudprovider.DefaultLoadBalancerName(service))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, lbRule := range lbRules {
+		// The rules on the IP of the secondary family of a dual-stack service are kept apart.
+		if isSecondaryRule(lb.name, lbRule.Name) {
+			lb.secondaryRules[lbRule.Name] = lbRule
+			continue
+		}
+
+		lb.rules[lbRule.Name] = lbRule
+
+		if lb.ipAddr != "" && lb.ipAddr != lbRule.Publicip {
+			klog.Warningf("Load balancer for service %v/%v has rules associated with different IP's: %v, %v", service.Namespace, service.Name, lb.ipAddr, lbRule.Publicip)
+		}
+
+		lb.ipAddr = lbRule.Publicip
+		lb.ipAddrID = lbRule.Publicipid
+	}
+
+	klog.V(4).Infof("Load balancer %v contains %d rule(s)", lb.name, len(lb.rules)+len(lb.secondaryRules))
+
+	return lb, nil
+}
+
+// Get network ID from Public IP Address
+func (cs *CSCloud) getNetworkIDFromIPAddress(publicIpId string) (string, error) {
+	ip, count, err := cs.client.Address.GetPublicIpAddressByID(publicIpId)
+	if err != nil {
+		klog.Errorf("Failed to fetch the public IP for id: %v", publicIpId)
+		return "", err
+	}
+	if count == 0 {
+		return "", err
+	}
+	if ip.Networkid != "" {
+		network, _, netErr := cs.client.Network.GetNetworkByID(ip.Associatednetworkid)
+		if netErr != nil {
+			klog.Errorf("Failed to fetch the network for id: %v", ip.Associatednetworkid)
+			return "", err
+		}
+		return network.Id, nil
+	}
+	return "", nil
+}
+
+// verifyHosts verifies if all hosts belong to the same network, and returns the host ID's and network ID.
+// Nodes with several NICs can be balanced in any network they share, or in the network selected
+// for the service.
+func (cs *CSCloud) verifyHosts(service *corev1.Service, nodes []*corev1.Node) ([]string, string, error) {
+	hostNames := map[string]bool{}
+	for _, node := range nodes {
+		// node.Name can be an FQDN as well, and CloudStack VM names aren't
+		// To match, we need to Split the domain part off here, if present
+		hostNames[shortHostName(node.Name)] = true
+	}
+
+	vms, err := cs.listVirtualMachinesForHosts(hostNames)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var matched []*cloudstack.VirtualMachine
+	for _, vm := range vms {
+		if hostNames[shortHostName(cs.instanceNodeName(vm))] && len(vm.Nic) > 0 {
+			matched = append(matched, vm)
+		}
+	}
+	matched = cs.filterHostsByZone(service, matched)
+
+	if len(matched) == 0 {
+		return nil, "", fmt.Errorf("none of the hosts matched the list of VMs retrieved from CS API")
+	}
+
+	selectedID, selectedName := cs.loadBalancerNetwork(service)
+	networkID, err := cs.selectLoadBalancerNetwork(matched, selectedID, selectedName)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var hostIDs []string
+	var missing []string
+	for _, vm := range matched {
+		if hasNicInNetwork(vm, networkID) {
+			hostIDs = append(hostIDs, vm.Id)
 		} else {
-			// If the IP was specified in service spec, check if it was associated by the controller.
-			// First, check if there's an annotation indicating the controller associated it.
-			// If not, check if there are any other load balancer rules using this IP.
-			shouldDisassociate := getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPAssociatedByController, false)
-
-			if shouldDisassociate {
-				// Annotation is set, so check if there are any other load balancer rules using this IP.
-				// Since we've already deleted all rules for this service, any remaining rules must belong
-				// to other services. If no other rules exist, it's safe to disassociate the IP.
-				ip, count, err := lb.Address.GetPublicIpAddressByID(lb.ipAddrID)
-				if err != nil {
-					klog.Errorf("Error retrieving IP address %v for disassociation check: %v", lb.ipAddr, err)
-					shouldDisassociate = false
-				} else if count > 0 && ip.Allocated != "" {
-					p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
-					p.SetPublicipid(lb.ipAddrID)
-					p.SetListall(true)
-					if lb.projectID != "" {
-						p.SetProjectid(lb.projectID)
-					}
-					otherRules, err := lb.LoadBalancer.ListLoadBalancerRules(p)
-					if err != nil {
-						klog.Errorf("Error checking for other load balancer rules using IP %v: %v", lb.ipAddr, err)
-						shouldDisassociate = false
-					} else if otherRules.Count > 0 {
-						// Other load balancer rules are using this IP (other services are using it),
-						// so don't disassociate.
-						shouldDisassociate = false
-					}
+			missing = append(missing, vm.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		klog.Warningf("Hosts %v have no NIC in load balancer network %v of service %s/%s, they are not added to the load balancer", missing, networkID, service.Namespace, service.Name)
+		cs.recordEvent(service, corev1.EventTypeWarning, eventReasonHostsWithoutNetwork, "Hosts %v have no NIC in load balancer network %v and are not balanced", strings.Join(missing, ", "), networkID)
+	}
+
+	return hostIDs, networkID, nil
+}
+
+// selectLoadBalancerNetwork returns the network the load balancer balances the hosts in. If a
+// network is set by ID or name, the hosts with a NIC in it are used. Otherwise, all hosts must
+// share a network; the network of the most internal NICs is preferred.
+func (cs *CSCloud) selectLoadBalancerNetwork(vms []*cloudstack.VirtualMachine, networkID, networkName string) (string, error) {
+	if networkID != "" || networkName != "" {
+		for _, vm := range vms {
+			for _, nic := range vm.Nic {
+				if (networkID != "" && nic.Networkid == networkID) || (networkName != "" && nic.Networkname == networkName) {
+					return nic.Networkid, nil
 				}
 			}
+		}
+		return "", fmt.Errorf("none of the hosts has a NIC in load balancer network %v", firstNonEmpty(networkID, networkName))
+	}
 
-			if shouldDisassociate {
-				klog.V(4).Infof("Disassociating IP %v that was associated by the controller", lb.ipAddr)
-				if err := lb.releaseLoadBalancerIP(); err != nil {
-					return err
-				}
+	shared := make(map[string]int)
+	internal := make(map[string]int)
+	for _, vm := range vms {
+		seen := make(map[string]bool)
+		for _, nic := range vm.Nic {
+			if !seen[nic.Networkid] {
+				seen[nic.Networkid] = true
+				shared[nic.Networkid]++
 			}
 		}
+		if nic := cs.internalNic(vm); nic != nil {
+			internal[nic.Networkid]++
+		}
 	}
 
-	return nil
+	selected := ""
+	for id, count := range shared {
+		if count < len(vms) || id == "" {
+			continue
+		}
+		if selected == "" || internal[id] > internal[selected] || (internal[id] == internal[selected] && id < selected) {
+			selected = id
+		}
+	}
+
+	if selected == "" {
+		return "", fmt.Errorf("found hosts that belong to different networks, set the load balancer network to balance hosts with a NIC in it")
+	}
+
+	return selected, nil
+}
+
+// hasNicInNetwork returns true if the VM has a NIC in the network.
+func hasNicInNetwork(vm *cloudstack.VirtualMachine, networkID string) bool {
+	for _, nic := range vm.Nic {
+		if nic.Networkid == networkID {
+			return true
+		}
+	}
+	return false
 }
 
-// GetLoadBalancerName retrieves the name of the LoadBalancer.
-func (cs *CSCloud) GetLoadBalancerName(ctx context.Context, clusterName string, service *corev1.Service) string {
-	return cloudprovider.DefaultLoadBalancerName(service)
+// firstNonEmpty returns the first of the values that is not empty.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
 }
 
-// getLoadBalancer retrieves the IP address and ID and all the existing rules it can find.
-func (cs *CSCloud) getLoadBalancer(service *corev1.Service) (*loadBalancer, error) {
-	lb := &loadBalancer{
-		CloudStackClient: cs.client,
-		name:             cs.GetLoadBalancerName(context.TODO(), "", service),
-		projectID:        cs.projectID,
-		rules:            make(map[string]*cloudstack.LoadBalancerRule),
+// filterHostsByZone returns the hosts in a single zone, as a load balancer cannot span zones. The
+// configured zone is used if it has hosts, otherwise the zone with the most hosts. The nodes of the
+// other zones are recorded in a warning event on the service.
+func (cs *CSCloud) filterHostsByZone(service *corev1.Service, vms []*cloudstack.VirtualMachine) []*cloudstack.VirtualMachine {
+	byZone := make(map[string][]*cloudstack.VirtualMachine)
+	for _, vm := range vms {
+		byZone[vm.Zonename] = append(byZone[vm.Zonename], vm)
 	}
-
-	p := cs.client.LoadBalancer.NewListLoadBalancerRulesParams()
-	p.SetKeyword(lb.name)
-	p.SetListall(true)
-
-	if cs.projectID != "" {
-		p.SetProjectid(cs.projectID)
+	if len(byZone) <= 1 {
+		return vms
 	}
 
-	l, err := cs.client.LoadBalancer.ListLoadBalancerRules(p)
-	if err != nil {
-		return nil, fmt.Errorf("error retrieving load balancer rules: %v", err)
+	zone := cs.zone
+	if len(byZone[zone]) == 0 {
+		zone = ""
+		for z, zoneVMs := range byZone {
+			if zone == "" || len(zoneVMs) > len(byZone[zone]) || (len(zoneVMs) == len(byZone[zone]) && z < zone) {
+				zone = z
+			}
+		}
 	}
 
-	for _, lbRule := range l.LoadBalancerRules {
-		lb.rules[lbRule.Name] = lbRule
-
-		if lb.ipAddr != "" && lb.ipAddr != lbRule.Publicip {
-			klog.Warningf("Load balancer for service %v/%v has rules associated with different IP's: %v, %v", service.Namespace, service.Name, lb.ipAddr, lbRule.Publicip)
+	var dropped []string
+	for _, vm := range vms {
+		if vm.Zonename != zone {
+			dropped = append(dropped, cs.instanceNodeName(vm))
 		}
-
-		lb.ipAddr = lbRule.Publicip
-		lb.ipAddrID = lbRule.Publicipid
 	}
 
-	klog.V(4).Infof("Load balancer %v contains %d rule(s)", lb.name, len(lb.rules))
+	klog.Warningf("Hosts span %d zones, using the %d of %d host(s) in zone %v for the load balancer", len(byZone), len(byZone[zone]), len(vms), zone)
+	cs.recordEvent(service, corev1.EventTypeWarning, eventReasonHostsInOtherZones, "Nodes %v are not in zone %v of the load balancer and are not balanced", strings.Join(dropped, ", "), zone)
 
-	return lb, nil
+	return byZone[zone]
 }
 
-// Get network ID from Public IP Address
-func (cs *CSCloud) getNetworkIDFromIPAddress(publicIpId string) (string, error) {
-	ip, count, err := cs.client.Address.GetPublicIpAddressByID(publicIpId)
-	if err != nil {
-		klog.Errorf("Failed to fetch the public IP for id: %v", publicIpId)
-		return "", err
-	}
-	if count == 0 {
-		return "", err
-	}
-	if ip.Networkid != "" {
-		network, _, netErr := cs.client.Network.GetNetworkByID(ip.Associatednetworkid)
-		if netErr != nil {
-			klog.Errorf("Failed to fetch the network for id: %v", ip.Associatednetworkid)
-			return "", err
+// listVirtualMachinesForHosts lists the VMs to match the hosts against. The instance cache is
+// refreshed if it does not hold all hosts, as they may have been created since it was filled.
+func (cs *CSCloud) listVirtualMachinesForHosts(hostNames map[string]bool) ([]*cloudstack.VirtualMachine, error) {
+	if cs.instanceCache != nil {
+		vms, err := cs.instanceCache.virtualMachines()
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving list of hosts: %v", err)
 		}
-		return network.Id, nil
-	}
-	return "", nil
-}
 
-// verifyHosts verifies if all hosts belong to the same network, and returns the host ID's and network ID.
-func (cs *CSCloud) verifyHosts(nodes []*corev1.Node) ([]string, string, error) {
-	hostNames := map[string]bool{}
-	for _, node := range nodes {
-		// node.Name can be an FQDN as well, and CloudStack VM names aren't
-		// To match, we need to Split the domain part off here, if present
-		hostNames[strings.Split(strings.ToLower(node.Name), ".")[0]] = true
+		found := 0
+		for _, vm := range vms {
+			if hostNames[shortHostName(cs.instanceNodeName(vm))] {
+				found++
+			}
+		}
+		if found >= len(hostNames) {
+			return vms, nil
+		}
+
+		if vms, err = cs.instanceCache.refresh(); err != nil {
+			return nil, fmt.Errorf("error retrieving list of hosts: %v", err)
+		}
+		return vms, nil
 	}
 
 	p := cs.client.VirtualMachine.NewListVirtualMachinesParams()
@@ -509,29 +1039,10 @@ func (cs *CSCloud) verifyHosts(nodes []*corev1.Node) ([]string, string, error) {
 
 	l, err := cs.client.VirtualMachine.ListVirtualMachines(p)
 	if err != nil {
-		return nil, "", fmt.Errorf("error retrieving list of hosts: %v", err)
-	}
-
-	var hostIDs []string
-	var networkID string
-
-	// Check if the virtual machine is in the hosts slice, then add the corresponding ID.
-	for _, vm := range l.VirtualMachines {
-		if hostNames[strings.ToLower(vm.Name)] {
-			if networkID != "" && networkID != vm.Nic[0].Networkid {
-				return nil, "", fmt.Errorf("found hosts that belong to different networks")
-			}
-
-			networkID = vm.Nic[0].Networkid
-			hostIDs = append(hostIDs, vm.Id)
-		}
-	}
-
-	if len(hostIDs) == 0 || len(networkID) == 0 {
-		return nil, "", fmt.Errorf("none of the hosts matched the list of VMs retrieved from CS API")
+		return nil, fmt.Errorf("error retrieving list of hosts: %v", err)
 	}
 
-	return hostIDs, networkID, nil
+	return l.VirtualMachines, nil
 }
 
 // hasLoadBalancerIP returns true if we have a load balancer address and ID.
@@ -539,17 +1050,37 @@ func (lb *loadBalancer) hasLoadBalancerIP() bool {
 	return lb.ipAddr != "" && lb.ipAddrID != ""
 }
 
-// getLoadBalancerIP retrieves an existing IP or associates a new IP.
-func (lb *loadBalancer) getLoadBalancerIP(loadBalancerIP string) error {
+// getLoadBalancerIP retrieves an existing IP or associates a new IP. An IP selected by ID or tags
+// takes priority over the given address. The IP is returned locked against changes by other
+// services, together with the function that unlocks it.
+func (lb *loadBalancer) getLoadBalancerIP(loadBalancerIP string) (func(), error) {
+	if lb.service != nil && hasIPSelector(lb.service) {
+		return lb.getSelectedIPAddress(lb.service)
+	}
+
 	if loadBalancerIP != "" {
 		return lb.getPublicIPAddress(loadBalancerIP)
 	}
 
-	return lb.associatePublicIPAddress()
+	// Claim the IP of a deleted service that was retained for this one.
+	if lb.service != nil {
+		if name := getStringFromServiceAnnotation(lb.service, ServiceAnnotationLoadBalancerIPReservation, ""); name != "" {
+			unlock, err := lb.claimReservedIPAddress(name)
+			if err != nil || unlock != nil {
+				return unlock, err
+			}
+		}
+	}
+
+	if err := lb.associatePublicIPAddress(); err != nil {
+		return nil, err
+	}
+	// Other services cannot use the new IP before it is associated, so it is locked afterwards.
+	return lb.ipLocks.lock(lb.ipAddrID), nil
 }
 
 // getPublicIPAddressID retrieves the ID of the given IP, and sets the address and it's ID.
-func (lb *loadBalancer) getPublicIPAddress(loadBalancerIP string) error {
+func (lb *loadBalancer) getPublicIPAddress(loadBalancerIP string) (func(), error) {
 	klog.V(4).Infof("Retrieve load balancer IP details: %v", loadBalancerIP)
 
 	p := lb.Address.NewListPublicIpAddressesParams()
@@ -563,21 +1094,73 @@ func (lb *loadBalancer) getPublicIPAddress(loadBalancerIP string) error {
 
 	l, err := lb.Address.ListPublicIpAddresses(p)
 	if err != nil {
-		return fmt.Errorf("error retrieving IP address: %v", err)
+		return nil, fmt.Errorf("error retrieving IP address: %v", err)
 	}
 
 	if l.Count != 1 {
-		return fmt.Errorf("could not find IP address %v. Found %d addresses", loadBalancerIP, l.Count)
+		return nil, fmt.Errorf("could not find IP address %v. Found %d addresses", loadBalancerIP, l.Count)
+	}
+
+	return lb.acquireIPAddress(l.PublicIpAddresses[0].Id)
+}
+
+// acquireIPAddress locks a public IP that was looked up, and sets it as the load balancer IP. The
+// IP is associated if it is still not allocated once locked, and taken over if it is reserved, so
+// the reaper does not release it while it is in use.
+func (lb *loadBalancer) acquireIPAddress(id string) (func(), error) {
+	unlock, ip, err := lb.lockIPAddress(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if name, ok := getTag(ip.Tags, tagIPReservation); ok {
+		if err := lb.takeOverReservedIPAddress(ip, name); err != nil {
+			unlock()
+			return nil, err
+		}
+		return unlock, nil
 	}
 
-	lb.ipAddr = l.PublicIpAddresses[0].Ipaddress
-	lb.ipAddrID = l.PublicIpAddresses[0].Id
+	lb.ipAddr = ip.Ipaddress
+	lb.ipAddrID = ip.Id
 
 	// If the IP is not allocated, associate it.
-	if l.PublicIpAddresses[0].Allocated == "" {
-		return lb.associatePublicIPAddress()
+	if ip.Allocated == "" {
+		if err := lb.associatePublicIPAddress(); err != nil {
+			unlock()
+			return nil, err
+		}
 	}
-	return nil
+	return unlock, nil
+}
+
+// lockIPAddress locks a public IP against changes by other services, and retrieves it again, as
+// another service may have associated or released it since it was looked up. It returns the
+// function that unlocks the IP.
+func (lb *loadBalancer) lockIPAddress(id string) (func(), *cloudstack.PublicIpAddress, error) {
+	unlock := lb.ipLocks.lock(id)
+
+	p := lb.Address.NewListPublicIpAddressesParams()
+	p.SetId(id)
+	p.SetAllocatedonly(false)
+	p.SetListall(true)
+
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		unlock()
+		return nil, nil, fmt.Errorf("error retrieving IP address %v: %v", id, err)
+	}
+
+	if l.Count != 1 {
+		unlock()
+		return nil, nil, fmt.Errorf("could not find IP address %v", id)
+	}
+
+	return unlock, l.PublicIpAddresses[0], nil
 }
 
 // associatePublicIPAddress associates a new IP and sets the address and it's ID.
@@ -605,6 +1188,13 @@ func (lb *loadBalancer) associatePublicIPAddress() error {
 		p.SetProjectid(lb.projectID)
 	}
 
+	if lb.ipAddr == "" {
+		// Pick a free IP address from the requested public IP range or VLAN, if any.
+		if lb.ipAddr, err = lb.findFreeIPAddress(network.Zoneid); err != nil {
+			return err
+		}
+	}
+
 	if lb.ipAddr != "" {
 		p.SetIpaddress(lb.ipAddr)
 	}
@@ -618,8 +1208,9 @@ func (lb *loadBalancer) associatePublicIPAddress() error {
 	lb.ipAddr = r.Ipaddress
 	lb.ipAddrID = r.Id
 	lb.ipAssociatedByController = true
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonIPAssociated, "Associated IP address %v", lb.ipAddr)
 
-	return nil
+	return lb.tagResource(resourceTypePublicIPAddress, r.Id)
 }
 
 // releasePublicIPAddress releases an associated IP.
@@ -629,6 +1220,7 @@ func (lb *loadBalancer) releaseLoadBalancerIP() error {
 	if _, err := lb.Address.DisassociateIpAddress(p); err != nil {
 		return fmt.Errorf("error releasing load balancer IP %v: %v", lb.ipAddr, err)
 	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonIPReleased, "Released IP address %v", lb.ipAddr)
 
 	return nil
 }
@@ -649,6 +1241,24 @@ func (lb *loadBalancer) getCIDRList(service *corev1.Service) ([]string, error) {
 	return cidrList, nil
 }
 
+// getSourceRanges returns the CIDRs that may reach the load balancer. The source ranges of the
+// service spec take precedence over the source CIDR annotation.
+func (lb *loadBalancer) getSourceRanges(service *corev1.Service) ([]string, error) {
+	if len(service.Spec.LoadBalancerSourceRanges) == 0 {
+		return lb.getCIDRList(service)
+	}
+
+	cidrList := make([]string, 0, len(service.Spec.LoadBalancerSourceRanges))
+	for _, cidr := range service.Spec.LoadBalancerSourceRanges {
+		cidr = strings.TrimSpace(cidr)
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s in loadBalancerSourceRanges: %w", cidr, err)
+		}
+		cidrList = append(cidrList, cidr)
+	}
+	return cidrList, nil
+}
+
 // checkLoadBalancerRule checks if the rule already exists and if it does, if it can be updated. If
 // it does exist but cannot be updated, it will delete the existing rule so it can be created again.
 func (lb *loadBalancer) checkLoadBalancerRule(lbRuleName string, port corev1.ServicePort, protocol LoadBalancerProtocol, service *corev1.Service, version semver.Version) (*cloudstack.LoadBalancerRule, bool, error) {
@@ -711,8 +1321,12 @@ func (lb *loadBalancer) updateLoadBalancerRule(lbRuleName string, protocol LoadB
 		p.SetCidrlist(cidrList)
 	}
 
-	_, err := lb.LoadBalancer.UpdateLoadBalancerRule(p)
-	return err
+	if _, err := lb.LoadBalancer.UpdateLoadBalancerRule(p); err != nil {
+		return err
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonLoadBalancerRuleUpdated, "Updated load balancer rule %v", lbRuleName)
+
+	return nil
 }
 
 // createLoadBalancerRule creates a new load balancer rule and returns it's ID.
@@ -746,6 +1360,12 @@ func (lb *loadBalancer) createLoadBalancerRule(lbRuleName string, port corev1.Se
 		return nil, fmt.Errorf("error creating load balancer rule %v: %v", lbRuleName, err)
 	}
 
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonLoadBalancerRuleCreated, "Created load balancer rule %v", lbRuleName)
+
+	if err := lb.tagResource(resourceTypeLoadBalancer, r.Id); err != nil {
+		return nil, err
+	}
+
 	lbRule := &cloudstack.LoadBalancerRule{
 		Id:          r.Id,
 		Algorithm:   r.Algorithm,
@@ -769,6 +1389,7 @@ func (lb *loadBalancer) deleteLoadBalancerRule(lbRule *cloudstack.LoadBalancerRu
 	if _, err := lb.LoadBalancer.DeleteLoadBalancerRule(p); err != nil {
 		return fmt.Errorf("error deleting load balancer rule %v: %v", lbRule.Name, err)
 	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonLoadBalancerRuleDeleted, "Deleted load balancer rule %v", lbRule.Name)
 
 	// Delete the rule from the map as it no longer exists
 	delete(lb.rules, lbRule.Name)
@@ -959,6 +1580,8 @@ func (lb *loadBalancer) updateFirewallRule(publicIpId string, publicPort int, pr
 		if err != nil {
 			// report the error, but keep on deleting the other rules
 			klog.Errorf("Error deleting old firewall rule %v: %v", rule.Id, err)
+		} else {
+			lb.recordEvent(corev1.EventTypeNormal, eventReasonFirewallRuleDeleted, "Deleted firewall rule %v", ruleToString(rule))
 		}
 	}
 
@@ -969,18 +1592,33 @@ func (lb *loadBalancer) updateFirewallRule(publicIpId string, publicPort int, pr
 		p.SetCidrlist(allowedIPs)
 		p.SetStartport(publicPort)
 		p.SetEndport(publicPort)
-		_, err = lb.Firewall.CreateFirewallRule(p)
+		var r *cloudstack.CreateFirewallRuleResponse
+		r, err = lb.Firewall.CreateFirewallRule(p)
 		if err != nil {
 			// return immediately if we can't create the new rule
 			return false, fmt.Errorf("error creating new firewall rule for public IP %v, proto %v, port %v, allowed %v: %v", publicIpId, protocol, publicPort, allowedIPs, err)
 		}
+		lb.recordEvent(corev1.EventTypeNormal, eventReasonFirewallRuleCreated, "Created firewall rule for %v port %v from %v", protocol.IPProtocol(), publicPort, strings.Join(allowedIPs, ","))
+		if err := lb.tagResource(resourceTypeFirewallRule, r.Id); err != nil {
+			return false, err
+		}
 	}
 
 	// return true (because we changed something), but also the last error if deleting one old rule failed
 	return true, err
 }
 
-func (lb *loadBalancer) updateNetworkACL(publicPort int, protocol LoadBalancerProtocol, networkId string) (bool, error) {
+// updateNetworkACL reconciles the network ACL items of a load balancer port, so exactly the
+// allowed CIDRs can reach it. Network ACL items apply to the whole tier and only match on the
+// port, so the items are numbered to leave the rules of the operator and other services intact:
+// the allow items come after all items that are not managed by the controller, so the deny rules
+// of the operator keep precedence, and the deny item for all other sources comes in a separate
+// range after them, and after the allow items of other services for the same port.
+//
+// If the CIDR list is empty, only the deny item is created, blocking all traffic to the port.
+//
+// Returns true if the network ACL items are in place
+func (lb *loadBalancer) updateNetworkACL(publicPort int, protocol LoadBalancerProtocol, networkId string, allowedCIDRs []string) (bool, error) {
 	network, _, err := lb.Network.GetNetworkByID(networkId)
 	if err != nil {
 		return false, fmt.Errorf("error fetching Network with ID: %v, due to: %s", networkId, err)
@@ -995,9 +1633,18 @@ func (lb *loadBalancer) updateNetworkACL(publicPort int, protocol LoadBalancerPr
 		return false, fmt.Errorf("failed to find network ACL List with id: %v", network.Aclid)
 	}
 
-	if networkAclList.Name == "default_allow" || networkAclList.Name == "default_deny" {
-		klog.Infof("Network is using a default network ACL. Cannot add ACL rules to default ACLs")
-		return true, err
+	if isDefaultNetworkACLList(networkAclList) {
+		if !lb.manageNetworkACLLists {
+			klog.Infof("Network is using a default network ACL. Cannot add ACL rules to default ACLs")
+			lb.recordEvent(corev1.EventTypeWarning, eventReasonNetworkACLRuleSkipped, "Network %v uses the default network ACL %v, no ACL rule was added for %v port %v", network.Name, networkAclList.Name, protocol.IPProtocol(), publicPort)
+			return true, err
+		}
+
+		klog.V(4).Infof("Replacing default network ACL list %v of network %v", networkAclList.Name, network.Name)
+		if networkAclList, err = lb.ensureManagedNetworkACLList(network, networkAclList); err != nil {
+			return false, err
+		}
+		network.Aclid = networkAclList.Id
 	}
 
 	networkAclParams := lb.NetworkACL.NewListNetworkACLsParams()
@@ -1010,35 +1657,128 @@ func (lb *loadBalancer) updateNetworkACL(publicPort int, protocol LoadBalancerPr
 		return false, fmt.Errorf("error fetching Network ACL with ID: %v for network with id: %v, due to: %s", network.Aclid, networkId, err)
 	}
 
-	// find all network ACL rules that have a matching proto+port
-	// a map may or may not be faster, but is a bit easier to understand
-	filtered := make(map[*cloudstack.NetworkACL]bool)
-	for _, netAclRule := range networkAclResponse.NetworkACLs {
-		if netAclRule.Protocol == protocol.IPProtocol() && netAclRule.Startport == strconv.Itoa(publicPort) && netAclRule.Endport == strconv.Itoa(publicPort) {
-			filtered[netAclRule] = true
+	desired := desiredNetworkACLItems(allowedCIDRs)
+
+	// The items of other ports and services are only used to pick rule numbers. The highest
+	// number used by the operator is the lowest number available to the controller.
+	var own, others []*cloudstack.NetworkACL
+	operatorMax := 0
+	otherAllowMax := 0
+	adopted := make(map[networkACLItem]bool)
+	for _, rule := range networkAclResponse.NetworkACLs {
+		if networkACLRuleMatches(rule, publicPort, protocol) {
+			if lb.isOwnNetworkACLItem(rule) {
+				own = append(own, rule)
+				continue
+			}
+
+			// Tag an item created before tagging was introduced, so it is found as the service's own.
+			if item := networkACLItemFromRule(rule); isLegacyNetworkACLItem(rule, desired) && !adopted[item] {
+				klog.V(4).Infof("Adopting untagged network ACL rule %v for port %v and protocol %v", rule.Number, publicPort, protocol)
+				if err := lb.tagResource(resourceTypeNetworkACL, rule.Id); err != nil {
+					return false, err
+				}
+				adopted[item] = true
+				own = append(own, rule)
+				continue
+			}
+		}
+		others = append(others, rule)
+
+		// The rules copied into a managed network ACL list come after the load balancer rules.
+		if _, copied := getTag(rule.Tags, tagCopiedNetworkACLRule); copied {
+			continue
+		}
+
+		if _, managed := getTag(rule.Tags, tagServiceUID); !managed {
+			if rule.Number > operatorMax {
+				operatorMax = rule.Number
+			}
+		} else if networkACLRuleMatches(rule, publicPort, protocol) && strings.EqualFold(rule.Action, networkACLActionAllow) && rule.Number > otherAllowMax {
+			otherAllowMax = rule.Number
 		}
 	}
 
-	if len(filtered) > 0 {
-		klog.V(4).Infof("Network ACL rule for port %v and protocol %v already exists. No need to added a duplicate rule", publicPort, protocol)
-		return true, err
+	// Keep the items of this port that are still desired and come after the items of the
+	// operator, and delete all others.
+	kept := make(map[networkACLItem]*cloudstack.NetworkACL)
+	for _, rule := range own {
+		item := networkACLItemFromRule(rule)
+		if desired.contains(item) && kept[item] == nil && rule.Number > operatorMax {
+			klog.V(4).Infof("Network ACL rule %v for port %v and protocol %v is up-to-date", rule.Number, publicPort, protocol)
+			kept[item] = rule
+			continue
+		}
+
+		if err := lb.deleteNetworkACLItem(rule, publicPort, protocol); err != nil {
+			return false, err
+		}
 	}
 
-	// create ACL rule
-	acl := lb.NetworkACL.NewCreateNetworkACLParams(protocol.CSProtocol())
-	acl.SetAclid(network.Aclid)
-	acl.SetAction("Allow")
-	acl.SetCidrlist([]string{"0.0.0.0/0"})
-	acl.SetStartport(publicPort)
-	acl.SetEndport(publicPort)
-	acl.SetNetworkid(networkId)
-	acl.SetTraffictype("Ingress")
+	used := make(map[int]bool)
+	for _, rule := range others {
+		used[rule.Number] = true
+	}
+	for _, rule := range kept {
+		used[rule.Number] = true
+	}
 
-	_, err = lb.NetworkACL.CreateNetworkACL(acl)
-	if err != nil {
-		return false, fmt.Errorf("error creating Network ACL for port: %v, due to: %s", publicPort, err)
+	// Create the missing allow items with the lowest free numbers after the operator items.
+	lastAllow := 0
+	for _, item := range desired {
+		if item.action != networkACLActionAllow {
+			continue
+		}
+		rule, ok := kept[item]
+		if !ok {
+			if rule, err = lb.createNetworkACLItem(network.Aclid, networkId, publicPort, protocol, item, nextFreeNumber(used, operatorMax+1)); err != nil {
+				return false, err
+			}
+			used[rule.Number] = true
+		}
+		if rule.Number > lastAllow {
+			lastAllow = rule.Number
+		}
 	}
-	return true, err
+
+	denyItem := networkACLItem{action: networkACLActionDeny, cidr: defaultAllowedCIDR}
+	if !desired.contains(denyItem) {
+		return true, nil
+	}
+
+	// The deny item must come after the allow items of all services for the port, in the deny
+	// range so allow items of services added later still come before it.
+	deny, ok := kept[denyItem]
+	if ok {
+		delete(used, deny.Number)
+	}
+	first := operatorMax + networkACLDenyNumberOffset
+	if lastAllow >= first {
+		first = lastAllow + 1
+	}
+	if otherAllowMax >= first {
+		first = otherAllowMax + 1
+	}
+
+	if !ok || deny.Number < first {
+		number := nextFreeNumber(used, first)
+		if ok {
+			klog.V(4).Infof("Renumbering network ACL deny rule %v for port %v and protocol %v to %v", deny.Number, publicPort, protocol, number)
+			if err := lb.deleteNetworkACLItem(deny, publicPort, protocol); err != nil {
+				return false, err
+			}
+		}
+		if deny, err = lb.createNetworkACLItem(network.Aclid, networkId, publicPort, protocol, denyItem, number); err != nil {
+			return false, err
+		}
+	}
+
+	if shadow := shadowingNetworkACLRule(others, publicPort, protocol); shadow != nil && shadow.Number < deny.Number {
+		klog.Warningf("Network ACL deny rule %v for port %v and protocol %v is shadowed by rule %v", deny.Number, publicPort, protocol, shadow.Number)
+		lb.recordEvent(corev1.EventTypeWarning, eventReasonNetworkACLRuleShadowed, "Network ACL rule %v allows all sources to %v port %v before the deny rule %v, so the source ranges are not enforced", shadow.Number, protocol.IPProtocol(), publicPort, deny.Number)
+	}
+
+	return true, nil
 }
 
 // deleteFirewallRule deletes the firewall rule associated with the ip:port:protocol combo
@@ -1073,13 +1813,16 @@ func (lb *loadBalancer) deleteFirewallRule(publicIpId string, publicPort int, pr
 			klog.Errorf("Error deleting old firewall rule %v: %v", rule.Id, err)
 		} else {
 			deleted = true
+			lb.recordEvent(corev1.EventTypeNormal, eventReasonFirewallRuleDeleted, "Deleted firewall rule %v", ruleToString(rule))
 		}
 	}
 
 	return deleted, err
 }
 
-// Delete Network ACLs deletes the Network ACL rule associated with the ip:port:protocol combo
+// Delete Network ACLs deletes the Network ACL rules associated with the port:protocol combo
+//
+// returns true when corresponding rules were deleted
 func (lb *loadBalancer) deleteNetworkACLRule(publicPort int, protocol LoadBalancerProtocol, networkID string) (bool, error) {
 	p := lb.NetworkACL.NewListNetworkACLsParams()
 	p.SetListall(true)
@@ -1093,32 +1836,205 @@ func (lb *loadBalancer) deleteNetworkACLRule(publicPort int, protocol LoadBalanc
 		return false, fmt.Errorf("error fetching Network ACL rules Network ID %v: %v", networkID, err)
 	}
 
-	// filter by proto:port
+	// filter by proto:port, skipping the rules of the operator and other services
 	filtered := make([]*cloudstack.NetworkACL, 0, 1)
 	for _, rule := range r.NetworkACLs {
-		if rule.Protocol == protocol.IPProtocol() && rule.Startport == strconv.Itoa(publicPort) && rule.Endport == strconv.Itoa(publicPort) {
+		if !lb.isOwnNetworkACLItem(rule) {
+			continue
+		}
+		if networkACLRuleMatches(rule, publicPort, protocol) {
 			filtered = append(filtered, rule)
 		}
 	}
 
-	// delete first filtered rules
 	if len(filtered) == 0 {
 		klog.V(4).Infof("No ACL rules found matching protocol: %v and port: %v", protocol, publicPort)
 		return true, nil
 	}
+
+	// delete all rules, the allow rules for each source CIDR and the deny rule
 	deleted := false
-	ruleToBeDeleted := filtered[0]
-	deleteAclParams := lb.NetworkACL.NewDeleteNetworkACLParams(ruleToBeDeleted.Id)
-	_, err = lb.NetworkACL.DeleteNetworkACL(deleteAclParams)
-	if err != nil {
-		klog.Errorf("Error deleting old Network ACL rule %v: %v", ruleToBeDeleted.Id, err)
-	} else {
-		deleted = true
+	for _, rule := range filtered {
+		if err = lb.deleteNetworkACLItem(rule, publicPort, protocol); err != nil {
+			klog.Errorf("Error deleting old Network ACL rule %v: %v", rule.Id, err)
+		} else {
+			deleted = true
+		}
 	}
 
 	return deleted, err
 }
 
+const (
+	networkACLActionAllow = "allow"
+	networkACLActionDeny  = "deny"
+
+	// networkACLDenyNumberOffset separates the deny items of load balancers from the items of
+	// the operator, leaving room for the allow items of all services in between.
+	networkACLDenyNumberOffset = 1000
+)
+
+// isOwnNetworkACLItem returns true if the network ACL item is tagged for this load balancer.
+// Untagged items belong to the operator, unless they are adopted as legacy items.
+func (lb *loadBalancer) isOwnNetworkACLItem(rule *cloudstack.NetworkACL) bool {
+	if _, ok := getTag(rule.Tags, tagServiceUID); ok {
+		return !lb.isOwnedByOtherService(rule.Tags)
+	}
+	return false
+}
+
+// isLegacyNetworkACLItem returns true if an untagged network ACL item of the port may be an allow
+// item the controller created before tagging was introduced. Only items that exactly match a
+// desired allow item qualify, every other untagged item belongs to the operator.
+func isLegacyNetworkACLItem(rule *cloudstack.NetworkACL, desired networkACLItems) bool {
+	if _, ok := getTag(rule.Tags, tagServiceUID); ok {
+		return false
+	}
+	if _, ok := getTag(rule.Tags, tagCopiedNetworkACLRule); ok {
+		return false
+	}
+
+	item := networkACLItemFromRule(rule)
+	return item.action == networkACLActionAllow && desired.contains(item)
+}
+
+// networkACLItem is the part of a network ACL rule that is reconciled for a load balancer port.
+type networkACLItem struct {
+	action string
+	cidr   string
+}
+
+type networkACLItems []networkACLItem
+
+func (items networkACLItems) contains(item networkACLItem) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// desiredNetworkACLItems returns an allow item for each CIDR, followed by a deny item for all
+// other sources, unless all sources are allowed.
+func desiredNetworkACLItems(allowedCIDRs []string) networkACLItems {
+	cidrs := append([]string(nil), allowedCIDRs...)
+	sort.Strings(cidrs)
+
+	items := make(networkACLItems, 0, len(cidrs)+1)
+	restricted := true
+	for _, cidr := range cidrs {
+		items = append(items, networkACLItem{action: networkACLActionAllow, cidr: cidr})
+		if cidr == defaultAllowedCIDR {
+			restricted = false
+		}
+	}
+	if restricted {
+		items = append(items, networkACLItem{action: networkACLActionDeny, cidr: defaultAllowedCIDR})
+	}
+
+	return items
+}
+
+func networkACLItemFromRule(rule *cloudstack.NetworkACL) networkACLItem {
+	return networkACLItem{
+		action: strings.ToLower(rule.Action),
+		cidr:   strings.TrimSpace(rule.Cidrlist),
+	}
+}
+
+// networkACLRuleMatches returns true if the rule is an ingress rule for exactly the port and protocol.
+func networkACLRuleMatches(rule *cloudstack.NetworkACL, publicPort int, protocol LoadBalancerProtocol) bool {
+	return !strings.EqualFold(rule.Traffictype, "Egress") &&
+		rule.Protocol == protocol.IPProtocol() &&
+		rule.Startport == strconv.Itoa(publicPort) &&
+		rule.Endport == strconv.Itoa(publicPort)
+}
+
+// shadowingNetworkACLRule returns the first ingress rule that allows all sources to reach the port.
+func shadowingNetworkACLRule(rules []*cloudstack.NetworkACL, publicPort int, protocol LoadBalancerProtocol) *cloudstack.NetworkACL {
+	var shadow *cloudstack.NetworkACL
+	for _, rule := range rules {
+		if strings.EqualFold(rule.Traffictype, "Egress") || !strings.EqualFold(rule.Action, networkACLActionAllow) {
+			continue
+		}
+		if rule.Protocol != "all" && rule.Protocol != protocol.IPProtocol() {
+			continue
+		}
+		if !strings.Contains(rule.Cidrlist, defaultAllowedCIDR) {
+			continue
+		}
+		if rule.Startport != "" {
+			start, err1 := strconv.Atoi(rule.Startport)
+			end, err2 := strconv.Atoi(rule.Endport)
+			if err1 != nil || err2 != nil || publicPort < start || publicPort > end {
+				continue
+			}
+		}
+		if shadow == nil || rule.Number < shadow.Number {
+			shadow = rule
+		}
+	}
+	return shadow
+}
+
+// nextFreeNumber returns the lowest rule number from start on that is not used yet.
+func nextFreeNumber(used map[int]bool, start int) int {
+	number := start
+	for used[number] {
+		number++
+	}
+	return number
+}
+
+// createNetworkACLItem creates a network ACL rule for the port and protocol with the given number.
+func (lb *loadBalancer) createNetworkACLItem(aclID, networkID string, publicPort int, protocol LoadBalancerProtocol, item networkACLItem, number int) (*cloudstack.NetworkACL, error) {
+	action := "Allow"
+	if item.action == networkACLActionDeny {
+		action = "Deny"
+	}
+
+	acl := lb.NetworkACL.NewCreateNetworkACLParams(protocol.CSProtocol())
+	acl.SetAclid(aclID)
+	acl.SetAction(action)
+	acl.SetCidrlist([]string{item.cidr})
+	acl.SetNumber(number)
+	acl.SetStartport(publicPort)
+	acl.SetEndport(publicPort)
+	acl.SetNetworkid(networkID)
+	acl.SetTraffictype("Ingress")
+
+	r, err := lb.NetworkACL.CreateNetworkACL(acl)
+	if err != nil {
+		return nil, fmt.Errorf("error creating Network ACL for port: %v, due to: %s", publicPort, err)
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLRuleCreated, "Created network ACL rule %v to %v %v port %v from %v", number, strings.ToLower(action), protocol.IPProtocol(), publicPort, item.cidr)
+	if err := lb.tagResource(resourceTypeNetworkACL, r.Id); err != nil {
+		return nil, err
+	}
+
+	return &cloudstack.NetworkACL{
+		Id:        r.Id,
+		Action:    action,
+		Cidrlist:  item.cidr,
+		Number:    number,
+		Protocol:  protocol.IPProtocol(),
+		Startport: strconv.Itoa(publicPort),
+		Endport:   strconv.Itoa(publicPort),
+	}, nil
+}
+
+// deleteNetworkACLItem deletes a single network ACL rule of the port and protocol.
+func (lb *loadBalancer) deleteNetworkACLItem(rule *cloudstack.NetworkACL, publicPort int, protocol LoadBalancerProtocol) error {
+	p := lb.NetworkACL.NewDeleteNetworkACLParams(rule.Id)
+	if _, err := lb.NetworkACL.DeleteNetworkACL(p); err != nil {
+		return err
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLRuleDeleted, "Deleted network ACL rule %v for %v port %v", rule.Number, protocol.IPProtocol(), publicPort)
+
+	return nil
+}
+
 // getStringFromServiceAnnotation searches a given v1.Service for a specific annotationKey and either returns the annotation's value or a specified defaultSetting
 func getStringFromServiceAnnotation(service *corev1.Service, annotationKey string, defaultSetting string) string {
 	klog.V(4).Infof("getStringFromServiceAnnotation(%s/%s, %v, %v)", service.Namespace, service.Name, annotationKey, defaultSetting)
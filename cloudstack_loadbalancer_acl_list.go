@@ -0,0 +1,289 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// copiedNetworkACLNumberOffset is added to the numbers of the rules copied from the replaced
+	// network ACL list, so the rules of the load balancers are evaluated first.
+	copiedNetworkACLNumberOffset = 10000
+
+	// tagReplacedNetworkACLList holds the ID of the network ACL list a managed list replaced.
+	tagReplacedNetworkACLList = "kubernetes-replaced-acl-list"
+
+	// tagNetworkACLListComplete marks a managed network ACL list whose rules were all copied
+	// from the replaced list, so it can be attached to the network.
+	tagNetworkACLListComplete = "kubernetes-acl-list-complete"
+
+	// tagCopiedNetworkACLRule marks the rules copied from the replaced network ACL list, which
+	// are evaluated after the rules of the load balancers.
+	tagCopiedNetworkACLRule = "kubernetes-copied-acl-rule"
+
+	resourceTypeNetworkACLList = "NetworkACLList"
+)
+
+// isDefaultNetworkACLList returns true for the network ACL lists CloudStack provides, which cannot be changed.
+func isDefaultNetworkACLList(aclList *cloudstack.NetworkACLList) bool {
+	return aclList.Name == "default_allow" || aclList.Name == "default_deny"
+}
+
+// managedNetworkACLListName returns the name of the network ACL list managed for a network of the cluster.
+func managedNetworkACLListName(clusterName, networkName string) string {
+	return fmt.Sprintf("%s-%s", clusterName, networkName)
+}
+
+// ensureManagedNetworkACLList replaces the default network ACL list of the network with a list
+// owned by the cluster, so the load balancer rules can be added. The rules of the default list
+// are copied in when the list is created, so other traffic is handled as before.
+//
+// The list is only attached once all rules are copied, as its implicit deny would otherwise block
+// the traffic of the tier. A list left incomplete by an earlier attempt is deleted and created again.
+func (lb *loadBalancer) ensureManagedNetworkACLList(network *cloudstack.Network, replaced *cloudstack.NetworkACLList) (*cloudstack.NetworkACLList, error) {
+	clusterName := lb.tags[tagClusterName]
+	if clusterName == "" {
+		return nil, fmt.Errorf("cannot create a network ACL list for network %v without a cluster name", network.Name)
+	}
+	name := managedNetworkACLListName(clusterName, network.Name)
+
+	p := lb.NetworkACL.NewListNetworkACLListsParams()
+	p.SetName(name)
+	p.SetVpcid(network.Vpcid)
+	l, err := lb.NetworkACL.ListNetworkACLLists(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving network ACL list %v: %v", name, err)
+	}
+
+	var aclList *cloudstack.NetworkACLList
+	for _, list := range l.NetworkACLLists {
+		if list.Name == name {
+			aclList = list
+			break
+		}
+	}
+
+	if aclList != nil {
+		complete, err := lb.isCompleteNetworkACLList(aclList)
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			klog.V(4).Infof("Deleting incomplete network ACL list %v", name)
+			if _, err := lb.NetworkACL.DeleteNetworkACLList(lb.NetworkACL.NewDeleteNetworkACLListParams(aclList.Id)); err != nil {
+				return nil, fmt.Errorf("error deleting incomplete network ACL list %v: %v", name, err)
+			}
+			lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLListDeleted, "Deleted incomplete network ACL list %v", name)
+			aclList = nil
+		}
+	}
+
+	if aclList == nil {
+		if aclList, err = lb.createManagedNetworkACLList(network, replaced, name); err != nil {
+			return nil, err
+		}
+	}
+
+	rp := lb.NetworkACL.NewReplaceNetworkACLListParams(aclList.Id)
+	rp.SetNetworkid(network.Id)
+	if _, err := lb.NetworkACL.ReplaceNetworkACLList(rp); err != nil {
+		return nil, fmt.Errorf("error attaching network ACL list %v to network %v: %v", name, network.Name, err)
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLListAttached, "Replaced network ACL list %v of network %v with %v", replaced.Name, network.Name, name)
+
+	return aclList, nil
+}
+
+// createManagedNetworkACLList creates the managed network ACL list of the network, copies the
+// rules of the replaced list into it and marks it complete.
+func (lb *loadBalancer) createManagedNetworkACLList(network *cloudstack.Network, replaced *cloudstack.NetworkACLList, name string) (*cloudstack.NetworkACLList, error) {
+	clusterName := lb.tags[tagClusterName]
+
+	cp := lb.NetworkACL.NewCreateNetworkACLListParams(name, network.Vpcid)
+	cp.SetDescription(fmt.Sprintf("Managed by Kubernetes cluster %s", clusterName))
+
+	r, err := lb.NetworkACL.CreateNetworkACLList(cp)
+	if err != nil {
+		return nil, fmt.Errorf("error creating network ACL list %v: %v", name, err)
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLListCreated, "Created network ACL list %v for network %v", name, network.Name)
+
+	tp := lb.Resourcetags.NewCreateTagsParams([]string{r.Id}, resourceTypeNetworkACLList, map[string]string{
+		tagClusterName:            clusterName,
+		tagReplacedNetworkACLList: replaced.Id,
+	})
+	if _, err := lb.Resourcetags.CreateTags(tp); err != nil {
+		return nil, fmt.Errorf("error tagging network ACL list %v: %v", name, err)
+	}
+
+	aclList := &cloudstack.NetworkACLList{Id: r.Id, Name: name, Vpcid: network.Vpcid}
+
+	if err := lb.copyNetworkACLRules(replaced, aclList); err != nil {
+		return nil, err
+	}
+
+	tp = lb.Resourcetags.NewCreateTagsParams([]string{r.Id}, resourceTypeNetworkACLList, map[string]string{
+		tagNetworkACLListComplete: "true",
+	})
+	if _, err := lb.Resourcetags.CreateTags(tp); err != nil {
+		return nil, fmt.Errorf("error tagging network ACL list %v: %v", name, err)
+	}
+
+	return aclList, nil
+}
+
+// isCompleteNetworkACLList returns true if all rules of the replaced list were copied into the managed list.
+func (lb *loadBalancer) isCompleteNetworkACLList(aclList *cloudstack.NetworkACLList) (bool, error) {
+	tp := lb.Resourcetags.NewListTagsParams()
+	tp.SetResourceid(aclList.Id)
+	tp.SetResourcetype(resourceTypeNetworkACLList)
+	tp.SetKey(tagNetworkACLListComplete)
+
+	tags, err := lb.Resourcetags.ListTags(tp)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving the tags of network ACL list %v: %v", aclList.Name, err)
+	}
+
+	return tags.Count > 0, nil
+}
+
+// copyNetworkACLRules copies the rules of a network ACL list into another list, keeping their order.
+func (lb *loadBalancer) copyNetworkACLRules(from, to *cloudstack.NetworkACLList) error {
+	p := lb.NetworkACL.NewListNetworkACLsParams()
+	p.SetAclid(from.Id)
+	p.SetListall(true)
+
+	r, err := lb.NetworkACL.ListNetworkACLs(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving the rules of network ACL list %v: %v", from.Name, err)
+	}
+
+	var copied []string
+	for _, rule := range r.NetworkACLs {
+		acl := lb.NetworkACL.NewCreateNetworkACLParams(rule.Protocol)
+		acl.SetAclid(to.Id)
+		acl.SetAction(rule.Action)
+		acl.SetNumber(rule.Number + copiedNetworkACLNumberOffset)
+		acl.SetTraffictype(rule.Traffictype)
+		if rule.Cidrlist != "" {
+			acl.SetCidrlist(strings.Split(rule.Cidrlist, ","))
+		}
+		if start, err := strconv.Atoi(rule.Startport); err == nil {
+			acl.SetStartport(start)
+		}
+		if end, err := strconv.Atoi(rule.Endport); err == nil {
+			acl.SetEndport(end)
+		}
+		if rule.Protocol == "icmp" {
+			acl.SetIcmptype(rule.Icmptype)
+			acl.SetIcmpcode(rule.Icmpcode)
+		}
+
+		cr, err := lb.NetworkACL.CreateNetworkACL(acl)
+		if err != nil {
+			return fmt.Errorf("error copying rule %v of network ACL list %v: %v", rule.Number, from.Name, err)
+		}
+		copied = append(copied, cr.Id)
+	}
+
+	if len(copied) > 0 {
+		tp := lb.Resourcetags.NewCreateTagsParams(copied, resourceTypeNetworkACL, map[string]string{
+			tagCopiedNetworkACLRule: from.Id,
+		})
+		if _, err := lb.Resourcetags.CreateTags(tp); err != nil {
+			return fmt.Errorf("error tagging the rules copied into network ACL list %v: %v", to.Name, err)
+		}
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLRulesCopied, "Copied %d rules of network ACL list %v into %v", len(r.NetworkACLs), from.Name, to.Name)
+
+	return nil
+}
+
+// releaseManagedNetworkACLList restores the replaced network ACL list of the network and deletes
+// the managed list, once no load balancer rules of any service are left in it.
+func (lb *loadBalancer) releaseManagedNetworkACLList(networkID string) error {
+	clusterName := lb.tags[tagClusterName]
+	if clusterName == "" {
+		return nil
+	}
+
+	network, _, err := lb.Network.GetNetworkByID(networkID)
+	if err != nil {
+		return fmt.Errorf("error fetching Network with ID: %v, due to: %s", networkID, err)
+	}
+
+	aclList, count, err := lb.NetworkACL.GetNetworkACLListByID(network.Aclid)
+	if err != nil {
+		return fmt.Errorf("error fetching Network ACL List with ID: %v, due to: %s", network.Aclid, err)
+	}
+	if count == 0 || aclList.Name != managedNetworkACLListName(clusterName, network.Name) {
+		return nil
+	}
+
+	p := lb.NetworkACL.NewListNetworkACLsParams()
+	p.SetAclid(aclList.Id)
+	p.SetListall(true)
+	r, err := lb.NetworkACL.ListNetworkACLs(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving the rules of network ACL list %v: %v", aclList.Name, err)
+	}
+	for _, rule := range r.NetworkACLs {
+		if _, ok := getTag(rule.Tags, tagServiceUID); ok {
+			klog.V(4).Infof("Network ACL list %v is still used by other services", aclList.Name)
+			return nil
+		}
+	}
+
+	tp := lb.Resourcetags.NewListTagsParams()
+	tp.SetResourceid(aclList.Id)
+	tp.SetResourcetype(resourceTypeNetworkACLList)
+	tp.SetKey(tagReplacedNetworkACLList)
+	tags, err := lb.Resourcetags.ListTags(tp)
+	if err != nil {
+		return fmt.Errorf("error retrieving the tags of network ACL list %v: %v", aclList.Name, err)
+	}
+	if tags.Count == 0 {
+		return fmt.Errorf("network ACL list %v does not record the list it replaced", aclList.Name)
+	}
+	replacedID := tags.Tags[0].Value
+
+	rp := lb.NetworkACL.NewReplaceNetworkACLListParams(replacedID)
+	rp.SetNetworkid(network.Id)
+	if _, err := lb.NetworkACL.ReplaceNetworkACLList(rp); err != nil {
+		return fmt.Errorf("error restoring network ACL list %v of network %v: %v", replacedID, network.Name, err)
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLListDetached, "Restored network ACL list %v of network %v", replacedID, network.Name)
+
+	dp := lb.NetworkACL.NewDeleteNetworkACLListParams(aclList.Id)
+	if _, err := lb.NetworkACL.DeleteNetworkACLList(dp); err != nil {
+		return fmt.Errorf("error deleting network ACL list %v: %v", aclList.Name, err)
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonNetworkACLListDeleted, "Deleted network ACL list %v", aclList.Name)
+
+	return nil
+}
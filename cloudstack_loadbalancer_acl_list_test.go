@@ -0,0 +1,335 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestEnsureManagedNetworkACLList(t *testing.T) {
+	network := &cloudstack.Network{Id: "net-123", Name: "tier1", Vpcid: "vpc-1", Aclid: "acl-default"}
+	defaultList := &cloudstack.NetworkACLList{Id: "acl-default", Name: "default_allow"}
+
+	t.Run("creates list and copies rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+		listListsParams := &cloudstack.ListNetworkACLListsParams{}
+		createListParams := &cloudstack.CreateNetworkACLListParams{}
+		createTagsParams := &cloudstack.CreateTagsParams{}
+		listRulesParams := &cloudstack.ListNetworkACLsParams{}
+		copyParams := &cloudstack.CreateNetworkACLParams{}
+		replaceParams := &cloudstack.ReplaceNetworkACLListParams{}
+		recorder := record.NewFakeRecorder(10)
+
+		gomock.InOrder(
+			mockNetworkACL.EXPECT().NewListNetworkACLListsParams().Return(listListsParams),
+			mockNetworkACL.EXPECT().ListNetworkACLLists(listListsParams).Return(&cloudstack.ListNetworkACLListsResponse{}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLListParams("prod-tier1", "vpc-1").Return(createListParams),
+			mockNetworkACL.EXPECT().CreateNetworkACLList(createListParams).Return(&cloudstack.CreateNetworkACLListResponse{Id: "acl-managed", Name: "prod-tier1"}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"acl-managed"}, resourceTypeNetworkACLList, map[string]string{
+				tagClusterName:            "prod",
+				tagReplacedNetworkACLList: "acl-default",
+			}).Return(createTagsParams),
+			mockTags.EXPECT().CreateTags(createTagsParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(listRulesParams),
+			mockNetworkACL.EXPECT().ListNetworkACLs(listRulesParams).Return(&cloudstack.ListNetworkACLsResponse{
+				Count: 1,
+				NetworkACLs: []*cloudstack.NetworkACL{
+					{Id: "rule-1", Action: "Allow", Cidrlist: "0.0.0.0/0", Number: 1, Protocol: "all", Traffictype: "Ingress"},
+				},
+			}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("all").Return(copyParams),
+			mockNetworkACL.EXPECT().CreateNetworkACL(copyParams).Return(&cloudstack.CreateNetworkACLResponse{Id: "rule-copy"}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"rule-copy"}, resourceTypeNetworkACL, map[string]string{
+				tagCopiedNetworkACLRule: "acl-default",
+			}).Return(createTagsParams),
+			mockTags.EXPECT().CreateTags(createTagsParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"acl-managed"}, resourceTypeNetworkACLList, map[string]string{
+				tagNetworkACLListComplete: "true",
+			}).Return(createTagsParams),
+			mockTags.EXPECT().CreateTags(createTagsParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+			mockNetworkACL.EXPECT().NewReplaceNetworkACLListParams("acl-managed").Return(replaceParams),
+			mockNetworkACL.EXPECT().ReplaceNetworkACLList(replaceParams).Return(&cloudstack.ReplaceNetworkACLListResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags:          map[string]string{tagClusterName: "prod"},
+			service:       &corev1.Service{},
+			eventRecorder: recorder,
+		}
+
+		aclList, err := lb.ensureManagedNetworkACLList(network, defaultList)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		wantEvents := []string{
+			"Normal NetworkACLListCreated Created network ACL list prod-tier1 for network tier1",
+			"Normal NetworkACLRulesCopied Copied 1 rules of network ACL list default_allow into prod-tier1",
+		}
+		for _, want := range wantEvents {
+			select {
+			case event := <-recorder.Events:
+				if event != want {
+					t.Errorf("event = %q, want %q", event, want)
+				}
+			default:
+				t.Errorf("missing event %q", want)
+			}
+		}
+		if aclList.Id != "acl-managed" {
+			t.Errorf("list ID = %q, want acl-managed", aclList.Id)
+		}
+		if aclID, _ := listRulesParams.GetAclid(); aclID != "acl-default" {
+			t.Errorf("copied rules of list %q, want acl-default", aclID)
+		}
+		if number, _ := copyParams.GetNumber(); number != 1+copiedNetworkACLNumberOffset {
+			t.Errorf("copied rule number = %d, want %d", number, 1+copiedNetworkACLNumberOffset)
+		}
+		if cidrs, _ := copyParams.GetCidrlist(); !reflect.DeepEqual(cidrs, []string{"0.0.0.0/0"}) {
+			t.Errorf("copied rule CIDRs = %v, want 0.0.0.0/0", cidrs)
+		}
+		if networkID, _ := replaceParams.GetNetworkid(); networkID != "net-123" {
+			t.Errorf("attached to network %q, want net-123", networkID)
+		}
+	})
+
+	t.Run("attaches existing list", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		listTagsParams := &cloudstack.ListTagsParams{}
+		replaceParams := &cloudstack.ReplaceNetworkACLListParams{}
+
+		gomock.InOrder(
+			mockNetworkACL.EXPECT().NewListNetworkACLListsParams().Return(&cloudstack.ListNetworkACLListsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLLists(gomock.Any()).Return(&cloudstack.ListNetworkACLListsResponse{
+				Count:           1,
+				NetworkACLLists: []*cloudstack.NetworkACLList{{Id: "acl-managed", Name: "prod-tier1", Vpcid: "vpc-1"}},
+			}, nil),
+			mockTags.EXPECT().NewListTagsParams().Return(listTagsParams),
+			mockTags.EXPECT().ListTags(listTagsParams).Return(&cloudstack.ListTagsResponse{
+				Count: 1,
+				Tags:  []*cloudstack.Tag{{Key: tagNetworkACLListComplete, Value: "true"}},
+			}, nil),
+			mockNetworkACL.EXPECT().NewReplaceNetworkACLListParams("acl-managed").Return(replaceParams),
+			mockNetworkACL.EXPECT().ReplaceNetworkACLList(replaceParams).Return(&cloudstack.ReplaceNetworkACLListResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: map[string]string{tagClusterName: "prod"},
+		}
+
+		if _, err := lb.ensureManagedNetworkACLList(network, defaultList); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id, _ := listTagsParams.GetResourceid(); id != "acl-managed" {
+			t.Errorf("checked tags of %q, want acl-managed", id)
+		}
+	})
+
+	t.Run("recreates incomplete list", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		deleteParams := &cloudstack.DeleteNetworkACLListParams{}
+		createListParams := &cloudstack.CreateNetworkACLListParams{}
+		createTagsParams := &cloudstack.CreateTagsParams{}
+		replaceParams := &cloudstack.ReplaceNetworkACLListParams{}
+
+		gomock.InOrder(
+			mockNetworkACL.EXPECT().NewListNetworkACLListsParams().Return(&cloudstack.ListNetworkACLListsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLLists(gomock.Any()).Return(&cloudstack.ListNetworkACLListsResponse{
+				Count:           1,
+				NetworkACLLists: []*cloudstack.NetworkACLList{{Id: "acl-partial", Name: "prod-tier1", Vpcid: "vpc-1"}},
+			}, nil),
+			mockTags.EXPECT().NewListTagsParams().Return(&cloudstack.ListTagsParams{}),
+			mockTags.EXPECT().ListTags(gomock.Any()).Return(&cloudstack.ListTagsResponse{}, nil),
+			mockNetworkACL.EXPECT().NewDeleteNetworkACLListParams("acl-partial").Return(deleteParams),
+			mockNetworkACL.EXPECT().DeleteNetworkACLList(deleteParams).Return(&cloudstack.DeleteNetworkACLListResponse{}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLListParams("prod-tier1", "vpc-1").Return(createListParams),
+			mockNetworkACL.EXPECT().CreateNetworkACLList(createListParams).Return(&cloudstack.CreateNetworkACLListResponse{Id: "acl-managed", Name: "prod-tier1"}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"acl-managed"}, resourceTypeNetworkACLList, gomock.Any()).Return(createTagsParams),
+			mockTags.EXPECT().CreateTags(createTagsParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(&cloudstack.ListNetworkACLsResponse{}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"acl-managed"}, resourceTypeNetworkACLList, map[string]string{
+				tagNetworkACLListComplete: "true",
+			}).Return(createTagsParams),
+			mockTags.EXPECT().CreateTags(createTagsParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+			mockNetworkACL.EXPECT().NewReplaceNetworkACLListParams("acl-managed").Return(replaceParams),
+			mockNetworkACL.EXPECT().ReplaceNetworkACLList(replaceParams).Return(&cloudstack.ReplaceNetworkACLListResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: map[string]string{tagClusterName: "prod"},
+		}
+
+		aclList, err := lb.ensureManagedNetworkACLList(network, defaultList)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if aclList.Id != "acl-managed" {
+			t.Errorf("list ID = %q, want acl-managed", aclList.Id)
+		}
+	})
+
+	t.Run("requires cluster name", func(t *testing.T) {
+		lb := &loadBalancer{}
+		if _, err := lb.ensureManagedNetworkACLList(network, defaultList); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
+
+func TestReleaseManagedNetworkACLList(t *testing.T) {
+	network := &cloudstack.Network{Id: "net-123", Name: "tier1", Vpcid: "vpc-1", Aclid: "acl-managed"}
+	managedList := &cloudstack.NetworkACLList{Id: "acl-managed", Name: "prod-tier1"}
+
+	t.Run("restores replaced list", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+		listTagsParams := &cloudstack.ListTagsParams{}
+		replaceParams := &cloudstack.ReplaceNetworkACLListParams{}
+		deleteParams := &cloudstack.DeleteNetworkACLListParams{}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(network, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-managed").Return(managedList, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(&cloudstack.ListNetworkACLsResponse{
+				Count:       1,
+				NetworkACLs: []*cloudstack.NetworkACL{{Id: "rule-copy", Number: 1001}},
+			}, nil),
+			mockTags.EXPECT().NewListTagsParams().Return(listTagsParams),
+			mockTags.EXPECT().ListTags(listTagsParams).Return(&cloudstack.ListTagsResponse{
+				Count: 1,
+				Tags:  []*cloudstack.Tag{{Key: tagReplacedNetworkACLList, Value: "acl-default"}},
+			}, nil),
+			mockNetworkACL.EXPECT().NewReplaceNetworkACLListParams("acl-default").Return(replaceParams),
+			mockNetworkACL.EXPECT().ReplaceNetworkACLList(replaceParams).Return(&cloudstack.ReplaceNetworkACLListResponse{}, nil),
+			mockNetworkACL.EXPECT().NewDeleteNetworkACLListParams("acl-managed").Return(deleteParams),
+			mockNetworkACL.EXPECT().DeleteNetworkACLList(deleteParams).Return(&cloudstack.DeleteNetworkACLListResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: map[string]string{tagClusterName: "prod"},
+		}
+
+		if err := lb.releaseManagedNetworkACLList("net-123"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if networkID, _ := replaceParams.GetNetworkid(); networkID != "net-123" {
+			t.Errorf("restored list of network %q, want net-123", networkID)
+		}
+	})
+
+	t.Run("keeps list used by other services", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(network, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-managed").Return(managedList, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(&cloudstack.ListNetworkACLsResponse{
+				Count: 1,
+				NetworkACLs: []*cloudstack.NetworkACL{
+					{Id: "rule-1", Number: 1, Tags: []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-other"}}},
+				},
+			}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:    mockNetwork,
+				NetworkACL: mockNetworkACL,
+			},
+			tags: map[string]string{tagClusterName: "prod"},
+		}
+
+		if err := lb.releaseManagedNetworkACLList("net-123"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ignores unmanaged list", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(network, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-managed").Return(&cloudstack.NetworkACLList{Id: "acl-managed", Name: "custom"}, 1, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:    mockNetwork,
+				NetworkACL: mockNetworkACL,
+			},
+			tags: map[string]string{tagClusterName: "prod"},
+		}
+
+		if err := lb.releaseManagedNetworkACLList("net-123"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,236 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// secondaryLoadBalancerName returns the name of the load balancer on the IP of the secondary IP
+// family of a dual-stack service, which prefixes the names of its rules.
+func secondaryLoadBalancerName(lbName string, family corev1.IPFamily) string {
+	return fmt.Sprintf("%s-%s", lbName, strings.ToLower(string(family)))
+}
+
+// isSecondaryRule returns true if the rule belongs to the load balancer on the IP of the secondary
+// IP family. No protocol name starts with the name of an IP family, so the names of the rules on
+// the primary IP never match.
+func isSecondaryRule(lbName, ruleName string) bool {
+	for _, family := range []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol} {
+		if strings.HasPrefix(ruleName, secondaryLoadBalancerName(lbName, family)+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// secondaryIPFamily returns the secondary IP family of a dual-stack service.
+func secondaryIPFamily(service *corev1.Service) (corev1.IPFamily, bool) {
+	if len(service.Spec.IPFamilies) > 1 {
+		return service.Spec.IPFamilies[1], true
+	}
+	return "", false
+}
+
+// secondaryLoadBalancer returns the load balancer on the IP of the secondary IP family, with the
+// rules found for it. It balances the same hosts in the same network as the load balancer. If no
+// family is given, it is taken from the IP of the rules.
+func (lb *loadBalancer) secondaryLoadBalancer(family corev1.IPFamily) *loadBalancer {
+	if lb.secondaryRules == nil {
+		lb.secondaryRules = make(map[string]*cloudstack.LoadBalancerRule)
+	}
+
+	sec := &loadBalancer{
+		CloudStackClient:      lb.CloudStackClient,
+		algorithm:             lb.algorithm,
+		hostIDs:               lb.hostIDs,
+		networkID:             lb.networkID,
+		projectID:             lb.projectID,
+		rules:                 lb.secondaryRules,
+		tags:                  lb.tags,
+		manageNetworkACLLists: lb.manageNetworkACLLists,
+		ipLocks:               lb.ipLocks,
+		isStaleIPSharer:       lb.isStaleIPSharer,
+		service:               lb.service,
+		eventRecorder:         lb.eventRecorder,
+		primaryName:           lb.name,
+	}
+
+	for _, lbRule := range sec.rules {
+		sec.ipAddr = lbRule.Publicip
+		sec.ipAddrID = lbRule.Publicipid
+	}
+
+	if family == "" {
+		family = ipFamily(sec.ipAddr)
+	}
+	sec.name = secondaryLoadBalancerName(lb.name, family)
+
+	return sec
+}
+
+// ensureSecondaryLoadBalancer sets up the load balancer on the IP selected for the secondary IP
+// family of a dual-stack service. CloudStack balances a single public IP per rule, so the IP gets
+// rules of its own for every port. The load balancer is deleted if no IP of the secondary family
+// is selected. It returns the load balancer, or nil if there is none.
+func (cs *CSCloud) ensureSecondaryLoadBalancer(lb *loadBalancer, network *cloudstack.Network, service *corev1.Service, sslCertID string) (sec *loadBalancer, err error) {
+	family, dualStack := secondaryIPFamily(service)
+
+	var ip *cloudstack.PublicIpAddress
+	if dualStack && hasIPSelector(service) {
+		ips, err := lb.selectIPAddresses(service)
+		if err != nil {
+			return nil, err
+		}
+		ip = ips[family]
+	}
+
+	if ip == nil {
+		return nil, cs.deleteSecondaryLoadBalancer(lb, service)
+	}
+
+	sec = lb.secondaryLoadBalancer(family)
+
+	var unlockIP func()
+	if sec.hasLoadBalancerIP() {
+		unlockIP = cs.ipLocks.lock(sec.ipAddrID)
+		defer unlockIP()
+
+		if err := sec.checkIPAddress(ip); err != nil {
+			return nil, err
+		}
+	} else {
+		if unlockIP, err = sec.acquireIPAddress(ip.Id); err != nil {
+			return nil, err
+		}
+		defer unlockIP()
+
+		if sec.ipAssociatedByController {
+			defer func() {
+				if err != nil {
+					if err := sec.releaseLoadBalancerIP(); err != nil {
+						klog.Errorf(err.Error())
+					}
+				}
+			}()
+		}
+	}
+
+	klog.V(4).Infof("Load balancer %v is associated with IP %v", sec.name, sec.ipAddr)
+
+	if err := sec.shareIPAddress(service); err != nil {
+		return nil, err
+	}
+
+	if err := cs.ensureLoadBalancerRules(sec, service, network, sslCertID); err != nil {
+		return nil, err
+	}
+
+	return sec, nil
+}
+
+// deleteSecondaryLoadBalancer deletes the rules on the IP of the secondary IP family, together
+// with their firewall rules and certificates, and releases the IP if the controller associated it.
+// The network ACL items are left alone, as the rules on the primary IP use the same ports.
+func (cs *CSCloud) deleteSecondaryLoadBalancer(lb *loadBalancer, service *corev1.Service) error {
+	if len(lb.secondaryRules) == 0 {
+		return nil
+	}
+
+	sec := lb.secondaryLoadBalancer("")
+	klog.V(4).Infof("Deleting load balancer %v on IP %v", sec.name, sec.ipAddr)
+
+	unlock := cs.ipLocks.lock(sec.ipAddrID)
+	defer unlock()
+
+	var sslCertIDs []string
+	for _, lbRule := range sec.rules {
+		protocol := ProtocolFromLoadBalancer(lbRule.Protocol)
+		if protocol == LoadBalancerProtocolSSL {
+			certIDs, err := sec.ownedSSLCertificateIDs(lbRule)
+			if err != nil {
+				return err
+			}
+			sslCertIDs = append(sslCertIDs, certIDs...)
+		}
+
+		network, count, err := sec.Network.GetNetworkByID(lbRule.Networkid, cloudstack.WithProject(sec.projectID))
+		if err != nil {
+			if count == 0 {
+				return fmt.Errorf("could not find network %v", lbRule.Networkid)
+			}
+			return fmt.Errorf("error retrieving network: %v", err)
+		}
+
+		port, err := strconv.ParseInt(lbRule.Publicport, 10, 32)
+		if err != nil {
+			klog.Errorf("Error parsing port: %v", err)
+		} else if protocol != LoadBalancerProtocolInvalid && network.Vpcid == "" {
+			if _, err := sec.deleteFirewallRule(lbRule.Publicipid, int(port), protocol); err != nil {
+				return err
+			}
+		}
+
+		klog.V(4).Infof("Deleting load balancer rule: %v", lbRule.Name)
+		if err := sec.deleteLoadBalancerRule(lbRule); err != nil {
+			return err
+		}
+	}
+
+	if err := sec.deleteUnusedSSLCertificates(sslCertIDs); err != nil {
+		return err
+	}
+
+	ip, count, err := sec.Address.GetPublicIpAddressByID(sec.ipAddrID)
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find IP address %v", sec.ipAddr)
+		}
+		return fmt.Errorf("error retrieving IP address %v: %v", sec.ipAddr, err)
+	}
+
+	// The IP is released if the controller associated it for the service, which tagged it.
+	owner, _ := getTag(ip.Tags, tagServiceUID)
+	release := owner != "" && owner == sec.tags[tagServiceUID]
+
+	users, release, err := sec.unshareIPAddress(release)
+	if err != nil {
+		return fmt.Errorf("error checking the other services using IP %v, not releasing it: %v", sec.ipAddr, err)
+	}
+
+	switch {
+	case users > 0:
+		klog.V(4).Infof("IP %v is still used by %d other service(s), not releasing it", sec.ipAddr, users)
+	case release:
+		klog.V(4).Infof("Releasing load balancer IP: %v", sec.ipAddr)
+		if err := sec.releaseLoadBalancerIP(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
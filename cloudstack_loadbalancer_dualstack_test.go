@@ -0,0 +1,203 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestIsSecondaryRule(t *testing.T) {
+	tests := []struct {
+		ruleName string
+		want     bool
+	}{
+		{ruleName: "prod-auid1-tcp-80", want: false},
+		{ruleName: "prod-auid1-ssl-443", want: false},
+		{ruleName: "prod-auid1-ipv4-tcp-80", want: true},
+		{ruleName: "prod-auid1-ipv6-tcp-80", want: true},
+		{ruleName: "prod-auid10-ipv6-tcp-80", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isSecondaryRule("prod-auid1", tt.ruleName); got != tt.want {
+			t.Errorf("isSecondaryRule(%q) = %v, want %v", tt.ruleName, got, tt.want)
+		}
+	}
+}
+
+func TestGetLoadBalancerDualStack(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+		Count: 2,
+		LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+			{Id: "rule-6", Name: "prod-auid1-ipv6-tcp-80", Publicip: "2001:db8::1", Publicipid: "ip-6"},
+			{Id: "rule-4", Name: "prod-auid1-tcp-80", Publicip: "203.0.113.1", Publicipid: "ip-4"},
+		},
+	}, nil)
+
+	cs := &CSCloud{client: &cloudstack.CloudStackClient{LoadBalancer: mockLB}}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"},
+		Spec:       corev1.ServiceSpec{IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}},
+	}
+
+	status, exists, err := cs.GetLoadBalancer(context.TODO(), "prod", service)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exists {
+		t.Fatalf("load balancer does not exist")
+	}
+
+	want := []corev1.LoadBalancerIngress{{IP: "203.0.113.1"}, {IP: "2001:db8::1"}}
+	if !reflect.DeepEqual(status.Ingress, want) {
+		t.Errorf("ingress = %v, want %v", status.Ingress, want)
+	}
+}
+
+func TestEnsureSecondaryLoadBalancerSelection(t *testing.T) {
+	ipv4 := &cloudstack.PublicIpAddress{Id: "ip-4", Ipaddress: "203.0.113.1", Allocated: "2026-01-01T00:00:00+0000"}
+	ipv6 := &cloudstack.PublicIpAddress{Id: "ip-6b", Ipaddress: "2001:db8::2", Allocated: "2026-01-01T00:00:00+0000"}
+
+	t.Run("no secondary family", func(t *testing.T) {
+		cs := &CSCloud{}
+		lb := &loadBalancer{name: "prod-auid1", ipLocks: &cs.ipLocks}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: "ip-4"}},
+			Spec:       corev1.ServiceSpec{IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol}},
+		}
+
+		sec, err := cs.ensureSecondaryLoadBalancer(lb, &cloudstack.Network{Id: "net-1"}, service, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if sec != nil {
+			t.Errorf("secondary load balancer %v, want none", sec.name)
+		}
+	})
+
+	t.Run("another IP than the one in use", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-4", gomock.Any()).Return(ipv4, 1, nil)
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-6b", gomock.Any()).Return(ipv6, 1, nil)
+
+		recorder := record.NewFakeRecorder(10)
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: "ip-4, ip-6b"}},
+			Spec:       corev1.ServiceSpec{IPFamilies: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}},
+		}
+		cs := &CSCloud{}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			name:             "prod-auid1",
+			secondaryRules: map[string]*cloudstack.LoadBalancerRule{
+				"prod-auid1-ipv6-tcp-80": {Id: "rule-6", Name: "prod-auid1-ipv6-tcp-80", Publicip: "2001:db8::1", Publicipid: "ip-6"},
+			},
+			ipLocks:       &cs.ipLocks,
+			service:       service,
+			eventRecorder: recorder,
+		}
+
+		if _, err := cs.ensureSecondaryLoadBalancer(lb, &cloudstack.Network{Id: "net-1"}, service, ""); err == nil {
+			t.Fatalf("expected error")
+		}
+
+		want := "Warning IPSelectionRejected Selected IP address 2001:db8::2, but the load balancer uses IP address 2001:db8::1; recreate the service to move it"
+		select {
+		case event := <-recorder.Events:
+			if event != want {
+				t.Errorf("event = %q, want %q", event, want)
+			}
+		default:
+			t.Errorf("no event recorded")
+		}
+	})
+}
+
+func TestDeleteSecondaryLoadBalancer(t *testing.T) {
+	tests := []struct {
+		name        string
+		ipTags      []cloudstack.Tags
+		wantRelease bool
+	}{
+		{name: "IP associated for the service", ipTags: []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-1"}}, wantRelease: true},
+		{name: "IP allocated beforehand"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil)
+			mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{})
+			mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil)
+			mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-6").Return(&cloudstack.DeleteLoadBalancerRuleParams{})
+			mockLB.EXPECT().DeleteLoadBalancerRule(gomock.Any()).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-6").Return(&cloudstack.PublicIpAddress{Id: "ip-6", Ipaddress: "2001:db8::1", Tags: tt.ipTags}, 1, nil).Times(2)
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil)
+			if tt.wantRelease {
+				mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-6").Return(&cloudstack.DisassociateIpAddressParams{})
+				mockAddress.EXPECT().DisassociateIpAddress(gomock.Any()).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+			}
+
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"}}
+			cs := &CSCloud{}
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB, Network: mockNetwork, Firewall: mockFirewall},
+				name:             "prod-auid1",
+				rules:            map[string]*cloudstack.LoadBalancerRule{},
+				secondaryRules: map[string]*cloudstack.LoadBalancerRule{
+					"prod-auid1-ipv6-tcp-80": {Id: "rule-6", Name: "prod-auid1-ipv6-tcp-80", Networkid: "net-1", Protocol: "tcp", Publicport: "80", Publicip: "2001:db8::1", Publicipid: "ip-6"},
+				},
+				tags:    serviceTags("prod", service),
+				ipLocks: &cs.ipLocks,
+			}
+
+			if err := cs.deleteSecondaryLoadBalancer(lb, service); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(lb.secondaryRules) != 0 {
+				t.Errorf("secondary rules left: %v", lb.secondaryRules)
+			}
+		})
+	}
+}
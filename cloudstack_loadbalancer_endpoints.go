@@ -0,0 +1,232 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// endpointResyncPeriod is the resync period of the informers used to follow endpoint changes.
+	endpointResyncPeriod = 10 * time.Minute
+
+	// labelNodeExcludeBalancers is the label used by the service controller to exclude
+	// nodes from external load balancers.
+	labelNodeExcludeBalancers = "node.kubernetes.io/exclude-from-external-load-balancers"
+
+	// taintToBeDeletedByClusterAutoscaler is the taint of nodes that the cluster autoscaler
+	// is about to delete, which the service controller excludes from load balancers.
+	taintToBeDeletedByClusterAutoscaler = "ToBeDeletedByClusterAutoscaler"
+)
+
+// startEndpointWatcher watches EndpointSlices, so the hosts of load balancers for services with
+// externalTrafficPolicy Local follow their endpoints instead of only changing with the nodes.
+func (cs *CSCloud) startEndpointWatcher(client kubernetes.Interface, stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(client, endpointResyncPeriod)
+
+	endpointSliceInformer := factory.Discovery().V1().EndpointSlices()
+	serviceInformer := factory.Core().V1().Services()
+	nodeInformer := factory.Core().V1().Nodes()
+
+	cs.endpointSliceLister = endpointSliceInformer.Lister()
+	cs.serviceLister = serviceInformer.Lister()
+	cs.nodeLister = nodeInformer.Lister()
+	cs.servicesSynced = serviceInformer.Informer().HasSynced
+	cs.endpointQueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "cloudstack-endpoints")
+
+	endpointSliceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    cs.enqueueEndpointSlice,
+		UpdateFunc: func(_, obj interface{}) { cs.enqueueEndpointSlice(obj) },
+		DeleteFunc: cs.enqueueEndpointSlice,
+	})
+
+	factory.Start(stop)
+
+	go func() {
+		defer cs.endpointQueue.ShutDown()
+
+		if !cache.WaitForCacheSync(stop, endpointSliceInformer.Informer().HasSynced, serviceInformer.Informer().HasSynced, nodeInformer.Informer().HasSynced) {
+			klog.Errorf("Failed to sync the endpoint watcher caches")
+			return
+		}
+
+		go wait.Until(cs.runEndpointWorker, time.Second, stop)
+		<-stop
+	}()
+}
+
+// enqueueEndpointSlice queues the service an EndpointSlice belongs to.
+func (cs *CSCloud) enqueueEndpointSlice(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+
+	serviceName := slice.Labels[discoveryv1.LabelServiceName]
+	if serviceName == "" {
+		return
+	}
+
+	cs.endpointQueue.Add(slice.Namespace + "/" + serviceName)
+}
+
+func (cs *CSCloud) runEndpointWorker() {
+	for cs.processNextEndpointItem() {
+	}
+}
+
+func (cs *CSCloud) processNextEndpointItem() bool {
+	key, quit := cs.endpointQueue.Get()
+	if quit {
+		return false
+	}
+	defer cs.endpointQueue.Done(key)
+
+	if err := cs.syncLocalTrafficHosts(key.(string)); err != nil {
+		klog.Errorf("Error updating load balancer hosts for service %v: %v", key, err)
+		cs.endpointQueue.AddRateLimited(key)
+		return true
+	}
+
+	cs.endpointQueue.Forget(key)
+	return true
+}
+
+// syncLocalTrafficHosts updates the hosts of the load balancer of a service with
+// externalTrafficPolicy Local after its endpoints changed.
+func (cs *CSCloud) syncLocalTrafficHosts(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	service, err := cs.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		// The service is gone, the service controller takes care of its load balancer.
+		return nil
+	}
+
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer || !hasLocalTrafficPolicy(service) {
+		return nil
+	}
+
+	allNodes, err := cs.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var nodes []*corev1.Node
+	for _, node := range allNodes {
+		if isLoadBalancerNode(node) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return cs.UpdateLoadBalancer(context.TODO(), cs.clusterName, service, nodes)
+}
+
+// isLoadBalancerNode returns true if the node can receive load balancer traffic. It applies
+// the same conditions as the service controller uses to select the nodes it passes to
+// EnsureLoadBalancer and UpdateLoadBalancer, so both paths assign the same hosts.
+func isLoadBalancerNode(node *corev1.Node) bool {
+	if _, excluded := node.Labels[labelNodeExcludeBalancers]; excluded {
+		return false
+	}
+
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == taintToBeDeletedByClusterAutoscaler {
+			return false
+		}
+	}
+
+	if len(node.Status.Conditions) == 0 {
+		return false
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady && cond.Status != corev1.ConditionTrue {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasLocalTrafficPolicy returns true if the service only routes external traffic to local endpoints.
+func hasLocalTrafficPolicy(service *corev1.Service) bool {
+	return service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal
+}
+
+// filterNodesWithLocalEndpoints returns the nodes that have a ready endpoint of the service, if
+// the service uses externalTrafficPolicy Local. The nodes are returned unchanged for other
+// services, when endpoints are not being watched or when none of the nodes has a ready endpoint,
+// so the load balancer can still be set up.
+func filterNodesWithLocalEndpoints(endpointSliceLister discoverylisters.EndpointSliceLister, service *corev1.Service, nodes []*corev1.Node) []*corev1.Node {
+	if endpointSliceLister == nil || !hasLocalTrafficPolicy(service) {
+		return nodes
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: service.Name})
+	slices, err := endpointSliceLister.EndpointSlices(service.Namespace).List(selector)
+	if err != nil {
+		klog.Warningf("Failed to list endpoints of service %s/%s, using all nodes: %v", service.Namespace, service.Name, err)
+		return nodes
+	}
+
+	ready := make(map[string]bool)
+	for _, slice := range slices {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.NodeName == nil || (endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready) {
+				continue
+			}
+			ready[*endpoint.NodeName] = true
+		}
+	}
+
+	var filtered []*corev1.Node
+	for _, node := range nodes {
+		if ready[node.Name] {
+			filtered = append(filtered, node)
+		}
+	}
+
+	if len(filtered) == 0 {
+		klog.V(4).Infof("Service %s/%s has no ready local endpoints, using all nodes", service.Namespace, service.Name)
+		return nodes
+	}
+
+	klog.V(4).Infof("Service %s/%s has ready local endpoints on %d of %d node(s)", service.Namespace, service.Name, len(filtered), len(nodes))
+	return filtered
+}
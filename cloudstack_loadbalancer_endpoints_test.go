@@ -0,0 +1,239 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func newEndpointSlice(name, serviceName string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: serviceName},
+		},
+		Endpoints: endpoints,
+	}
+}
+
+func newEndpoint(nodeName string, ready *bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		NodeName:   &nodeName,
+		Conditions: discoveryv1.EndpointConditions{Ready: ready},
+	}
+}
+
+func TestFilterNodesWithLocalEndpoints(t *testing.T) {
+	ready := true
+	notReady := false
+
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+	}
+
+	tests := []struct {
+		name          string
+		trafficPolicy corev1.ServiceExternalTrafficPolicyType
+		slices        []*discoveryv1.EndpointSlice
+		noLister      bool
+		want          []string
+	}{
+		{
+			name:          "cluster policy uses all nodes",
+			trafficPolicy: corev1.ServiceExternalTrafficPolicyTypeCluster,
+			slices: []*discoveryv1.EndpointSlice{
+				newEndpointSlice("web-abc", "web", newEndpoint("node-1", &ready)),
+			},
+			want: []string{"node-1", "node-2", "node-3"},
+		},
+		{
+			name:          "local policy uses nodes with ready endpoints",
+			trafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			slices: []*discoveryv1.EndpointSlice{
+				newEndpointSlice("web-abc", "web", newEndpoint("node-1", &ready), newEndpoint("node-2", &notReady)),
+				newEndpointSlice("web-def", "web", newEndpoint("node-3", nil)),
+				newEndpointSlice("other-abc", "other", newEndpoint("node-2", &ready)),
+			},
+			want: []string{"node-1", "node-3"},
+		},
+		{
+			name:          "local policy without ready endpoints uses all nodes",
+			trafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			slices: []*discoveryv1.EndpointSlice{
+				newEndpointSlice("web-abc", "web", newEndpoint("node-1", &notReady)),
+			},
+			want: []string{"node-1", "node-2", "node-3"},
+		},
+		{
+			name:          "local policy without watcher uses all nodes",
+			trafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			noLister:      true,
+			want:          []string{"node-1", "node-2", "node-3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lister discoverylisters.EndpointSliceLister
+			if !tt.noLister {
+				indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+				for _, slice := range tt.slices {
+					if err := indexer.Add(slice); err != nil {
+						t.Fatalf("unexpected error: %v", err)
+					}
+				}
+				lister = discoverylisters.NewEndpointSliceLister(indexer)
+			}
+
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+				Spec:       corev1.ServiceSpec{ExternalTrafficPolicy: tt.trafficPolicy},
+			}
+
+			var got []string
+			for _, node := range filterNodesWithLocalEndpoints(lister, service, nodes) {
+				got = append(got, node.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterNodesWithLocalEndpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncRuleHostsAfterTrafficPolicySwitch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	ready := true
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(newEndpointSlice("web-abc", "web", newEndpoint("node-1", &ready))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lister := discoverylisters.NewEndpointSliceLister(indexer)
+
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+	}
+
+	// The service was switched from Local to Cluster, so its rule only has the node with an endpoint.
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeCluster},
+	}
+
+	var hostIDs []string
+	for _, node := range filterNodesWithLocalEndpoints(lister, service, nodes) {
+		hostIDs = append(hostIDs, strings.Replace(node.Name, "node", "vm", 1))
+	}
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+	gomock.InOrder(
+		mockLB.EXPECT().NewListLoadBalancerRuleInstancesParams("rule-1").Return(&cloudstack.ListLoadBalancerRuleInstancesParams{}),
+		mockLB.EXPECT().ListLoadBalancerRuleInstances(gomock.Any()).Return(&cloudstack.ListLoadBalancerRuleInstancesResponse{
+			Count:                     1,
+			LoadBalancerRuleInstances: []*cloudstack.VirtualMachine{{Id: "vm-1"}},
+		}, nil),
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("rule-1").Return(assignParams),
+		mockLB.EXPECT().AssignToLoadBalancerRule(assignParams).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+	)
+
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+		hostIDs:          hostIDs,
+	}
+
+	if err := lb.syncRuleHosts(&cloudstack.LoadBalancerRule{Id: "rule-1", Name: "web-tcp-80"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	assigned, _ := assignParams.GetVirtualmachineids()
+	sort.Strings(assigned)
+	if want := []string{"vm-2", "vm-3"}; !reflect.DeepEqual(assigned, want) {
+		t.Errorf("assigned hosts = %v, want %v", assigned, want)
+	}
+}
+
+func TestIsLoadBalancerNode(t *testing.T) {
+	ready := []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}}
+
+	tests := []struct {
+		name string
+		node *corev1.Node
+		want bool
+	}{
+		{
+			name: "ready node",
+			node: &corev1.Node{Status: corev1.NodeStatus{Conditions: ready}},
+			want: true,
+		},
+		{
+			name: "excluded by label",
+			node: &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{labelNodeExcludeBalancers: ""}},
+				Status:     corev1.NodeStatus{Conditions: ready},
+			},
+			want: false,
+		},
+		{
+			name: "about to be deleted by the cluster autoscaler",
+			node: &corev1.Node{
+				Spec:   corev1.NodeSpec{Taints: []corev1.Taint{{Key: taintToBeDeletedByClusterAutoscaler, Effect: corev1.TaintEffectNoSchedule}}},
+				Status: corev1.NodeStatus{Conditions: ready},
+			},
+			want: false,
+		},
+		{
+			name: "not ready",
+			node: &corev1.Node{Status: corev1.NodeStatus{Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionUnknown}}}},
+			want: false,
+		},
+		{
+			name: "no conditions",
+			node: &corev1.Node{},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLoadBalancerNode(tt.node); got != tt.want {
+				t.Errorf("isLoadBalancerNode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
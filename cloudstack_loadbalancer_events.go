@@ -0,0 +1,117 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerReconcileStatus is the annotation set by the controller
+	// on the service to summarize the result of the last load balancer reconcile. The value
+	// is "Succeeded" or "Failed", the error itself is recorded as an event.
+	ServiceAnnotationLoadBalancerReconcileStatus = "service.beta.kubernetes.io/cloudstack-load-balancer-reconcile-status"
+
+	reconcileStatusSucceeded = "Succeeded"
+	reconcileStatusFailed    = "Failed"
+)
+
+// Reasons of the events recorded on services.
+const (
+	eventReasonIPAssociated              = "IPAssociated"
+	eventReasonIPReleased                = "IPReleased"
+	eventReasonIPReserved                = "IPReserved"
+	eventReasonIPReservationClaimed      = "IPReservationClaimed"
+	eventReasonIPSelectionRejected       = "IPSelectionRejected"
+	eventReasonNetworkChangeRejected     = "NetworkChangeRejected"
+	eventReasonLoadBalancerRuleCreated   = "LoadBalancerRuleCreated"
+	eventReasonLoadBalancerRuleUpdated   = "LoadBalancerRuleUpdated"
+	eventReasonLoadBalancerRuleDeleted   = "LoadBalancerRuleDeleted"
+	eventReasonInternalLBCreated         = "InternalLoadBalancerCreated"
+	eventReasonInternalLBDeleted         = "InternalLoadBalancerDeleted"
+	eventReasonFirewallRuleCreated       = "FirewallRuleCreated"
+	eventReasonFirewallRuleDeleted       = "FirewallRuleDeleted"
+	eventReasonNetworkACLRuleCreated     = "NetworkACLRuleCreated"
+	eventReasonNetworkACLRuleDeleted     = "NetworkACLRuleDeleted"
+	eventReasonNetworkACLRuleSkipped     = "NetworkACLRuleSkipped"
+	eventReasonNetworkACLRuleShadowed    = "NetworkACLRuleShadowed"
+	eventReasonNetworkACLListCreated     = "NetworkACLListCreated"
+	eventReasonNetworkACLRulesCopied     = "NetworkACLRulesCopied"
+	eventReasonNetworkACLListAttached    = "NetworkACLListAttached"
+	eventReasonNetworkACLListDetached    = "NetworkACLListDetached"
+	eventReasonNetworkACLListDeleted     = "NetworkACLListDeleted"
+	eventReasonLoadBalancerReconcileFail = "LoadBalancerReconcileFailed"
+	eventReasonLoadBalancerReconciled    = "LoadBalancerReconciled"
+	eventReasonHostsWithoutNetwork       = "HostsWithoutLoadBalancerNetwork"
+	eventReasonHostsInOtherZones         = "HostsInOtherZones"
+)
+
+// recordEvent records an event if the event recorder is set up.
+func (cs *CSCloud) recordEvent(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if cs.eventRecorder == nil || object == nil {
+		return
+	}
+	cs.eventRecorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// recordEvent records an event on the service of the load balancer.
+func (lb *loadBalancer) recordEvent(eventType, reason, messageFmt string, args ...interface{}) {
+	if lb.eventRecorder == nil || lb.service == nil {
+		return
+	}
+	lb.eventRecorder.Eventf(lb.service, eventType, reason, messageFmt, args...)
+}
+
+// reconcileStatus returns the value of the reconcile status annotation for the result of a reconcile.
+func reconcileStatus(err error) string {
+	if err == nil {
+		return reconcileStatusSucceeded
+	}
+	return reconcileStatusFailed
+}
+
+// setReconcileStatus records the result of a reconcile on the service. Failures are recorded
+// as events, so they show up next to the steps that were taken. The annotation only changes
+// when a reconcile fails after succeeding or the other way around, so it doesn't cause an
+// update of the service on every reconcile.
+func (cs *CSCloud) setReconcileStatus(ctx context.Context, service *corev1.Service, err error) {
+	if err != nil {
+		cs.recordEvent(service, corev1.EventTypeWarning, eventReasonLoadBalancerReconcileFail, "Error reconciling load balancer: %v", err)
+	}
+
+	previous := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerReconcileStatus, "")
+	status := reconcileStatus(err)
+	if previous == status {
+		return
+	}
+
+	if err == nil && previous != "" {
+		cs.recordEvent(service, corev1.EventTypeNormal, eventReasonLoadBalancerReconciled, "Load balancer reconciled after previous failures")
+	}
+
+	if err := cs.setServiceAnnotation(ctx, service, ServiceAnnotationLoadBalancerReconcileStatus, status); err != nil {
+		klog.Warningf("Failed to set reconcile status on service %s/%s: %v", service.Namespace, service.Name, err)
+	}
+}
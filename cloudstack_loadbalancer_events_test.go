@@ -0,0 +1,140 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReconcileStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "success", want: "Succeeded"},
+		{name: "failure", err: errors.New("boom"), want: "Failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reconcileStatus(tt.err); got != tt.want {
+				t.Errorf("reconcileStatus() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetReconcileStatusRecordsFailure(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	cs := &CSCloud{eventRecorder: recorder}
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:        "svc",
+		Namespace:   "default",
+		Annotations: map[string]string{ServiceAnnotationLoadBalancerReconcileStatus: reconcileStatusSucceeded},
+	}}
+
+	cs.setReconcileStatus(context.Background(), service, nil)
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("unexpected event %q", event)
+	default:
+	}
+
+	cs.setReconcileStatus(context.Background(), service, errors.New("found hosts that belong to different networks"))
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning "+eventReasonLoadBalancerReconcileFail) || !strings.Contains(event, "different networks") {
+			t.Errorf("event = %q, want %s warning", event, eventReasonLoadBalancerReconcileFail)
+		}
+	default:
+		t.Errorf("expected an event")
+	}
+}
+
+func TestSetReconcileStatusRecordsRecovery(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	cs := &CSCloud{eventRecorder: recorder}
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+		Name:        "svc",
+		Namespace:   "default",
+		Annotations: map[string]string{ServiceAnnotationLoadBalancerReconcileStatus: reconcileStatusFailed},
+	}}
+
+	cs.setReconcileStatus(context.Background(), service, nil)
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Normal "+eventReasonLoadBalancerReconciled) {
+			t.Errorf("event = %q, want %s event", event, eventReasonLoadBalancerReconciled)
+		}
+	default:
+		t.Errorf("expected an event")
+	}
+}
+
+func TestLoadBalancerRuleEvents(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+	mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-1").Return(deleteParams)
+	mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+	recorder := record.NewFakeRecorder(10)
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+		rules: map[string]*cloudstack.LoadBalancerRule{
+			"lb-tcp-80": {Id: "rule-1", Name: "lb-tcp-80"},
+		},
+		service:       &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "default"}},
+		eventRecorder: recorder,
+	}
+
+	if err := lb.deleteLoadBalancerRule(lb.rules["lb-tcp-80"]); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if want := "Normal " + eventReasonLoadBalancerRuleDeleted + " Deleted load balancer rule lb-tcp-80"; event != want {
+			t.Errorf("event = %q, want %q", event, want)
+		}
+	default:
+		t.Errorf("expected an event")
+	}
+}
+
+func TestRecordEventWithoutRecorder(t *testing.T) {
+	lb := &loadBalancer{}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonIPAssociated, "Associated IP address %v", "203.0.113.1")
+
+	cs := &CSCloud{}
+	cs.recordEvent(&corev1.Service{}, corev1.EventTypeNormal, eventReasonIPAssociated, "Associated IP address %v", "203.0.113.1")
+}
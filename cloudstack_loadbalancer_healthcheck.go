@@ -0,0 +1,213 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerHealthCheckPath is the annotation used on the
+	// service to set the HTTP path that CloudStack probes on every node. Without
+	// it, CloudStack only checks that the node accepts TCP connections. Setting
+	// any of the health check annotations enables a health check policy.
+	ServiceAnnotationLoadBalancerHealthCheckPath = "service.beta.kubernetes.io/cloudstack-load-balancer-healthcheck-path"
+
+	// ServiceAnnotationLoadBalancerHealthCheckInterval is the annotation used on the
+	// service to set the number of seconds between two health checks.
+	ServiceAnnotationLoadBalancerHealthCheckInterval = "service.beta.kubernetes.io/cloudstack-load-balancer-healthcheck-interval"
+
+	// ServiceAnnotationLoadBalancerHealthCheckTimeout is the annotation used on the
+	// service to set the number of seconds to wait for a health check response.
+	ServiceAnnotationLoadBalancerHealthCheckTimeout = "service.beta.kubernetes.io/cloudstack-load-balancer-healthcheck-timeout"
+
+	// ServiceAnnotationLoadBalancerHealthCheckHealthyThreshold is the annotation used on the
+	// service to set the number of consecutive successful checks before a node is healthy.
+	ServiceAnnotationLoadBalancerHealthCheckHealthyThreshold = "service.beta.kubernetes.io/cloudstack-load-balancer-healthcheck-healthy-threshold"
+
+	// ServiceAnnotationLoadBalancerHealthCheckUnhealthyThreshold is the annotation used on the
+	// service to set the number of consecutive failed checks before a node is unhealthy.
+	ServiceAnnotationLoadBalancerHealthCheckUnhealthyThreshold = "service.beta.kubernetes.io/cloudstack-load-balancer-healthcheck-unhealthy-threshold"
+
+	// The defaults below match the ones CloudStack applies when a parameter
+	// is omitted, so that existing policies compare equal to the desired ones.
+	// CloudStack stores "/" when no ping path is given and only configures an
+	// HTTP check for longer paths, so "/" stands for a TCP check.
+	defaultHealthCheckPath               = "/"
+	defaultHealthCheckInterval           = 5
+	defaultHealthCheckTimeout            = 2
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 10
+)
+
+// healthCheckPolicy is the desired health check configuration of a load balancer rule.
+type healthCheckPolicy struct {
+	pingPath           string
+	interval           int
+	responseTimeout    int
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+// getHealthCheckPolicy returns the health check policy requested by the service
+// annotations, or nil if the service does not need a health check policy.
+//
+// A policy is enabled when any of the health check annotations is present, or
+// when the service uses externalTrafficPolicy Local. CloudStack always probes the
+// private port of the rule (the NodePort) and has no way to target another port,
+// so the healthCheckNodePort of the service cannot be probed directly. Without a
+// path annotation the policy is a TCP check instead of an HTTP request to the
+// application: kube-proxy drops NodePort traffic of Local services on nodes
+// without ready local endpoints, which is the same signal /healthz reports on
+// the healthCheckNodePort.
+func getHealthCheckPolicy(service *corev1.Service) (*healthCheckPolicy, error) {
+	enabled := service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyTypeLocal
+	for _, key := range []string{
+		ServiceAnnotationLoadBalancerHealthCheckPath,
+		ServiceAnnotationLoadBalancerHealthCheckInterval,
+		ServiceAnnotationLoadBalancerHealthCheckTimeout,
+		ServiceAnnotationLoadBalancerHealthCheckHealthyThreshold,
+		ServiceAnnotationLoadBalancerHealthCheckUnhealthyThreshold,
+	} {
+		if _, ok := service.Annotations[key]; ok {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	policy := &healthCheckPolicy{
+		pingPath: getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerHealthCheckPath, defaultHealthCheckPath),
+	}
+	if policy.pingPath == "" {
+		policy.pingPath = defaultHealthCheckPath
+	}
+
+	var err error
+	if policy.interval, err = getPositiveIntFromServiceAnnotation(service, ServiceAnnotationLoadBalancerHealthCheckInterval, defaultHealthCheckInterval); err != nil {
+		return nil, err
+	}
+	if policy.responseTimeout, err = getPositiveIntFromServiceAnnotation(service, ServiceAnnotationLoadBalancerHealthCheckTimeout, defaultHealthCheckTimeout); err != nil {
+		return nil, err
+	}
+	if policy.healthyThreshold, err = getPositiveIntFromServiceAnnotation(service, ServiceAnnotationLoadBalancerHealthCheckHealthyThreshold, defaultHealthCheckHealthyThreshold); err != nil {
+		return nil, err
+	}
+	if policy.unhealthyThreshold, err = getPositiveIntFromServiceAnnotation(service, ServiceAnnotationLoadBalancerHealthCheckUnhealthyThreshold, defaultHealthCheckUnhealthyThreshold); err != nil {
+		return nil, err
+	}
+
+	if policy.responseTimeout >= policy.interval {
+		return nil, fmt.Errorf("health check timeout (%d) must be lower than the health check interval (%d)", policy.responseTimeout, policy.interval)
+	}
+
+	return policy, nil
+}
+
+// matches returns true if an existing CloudStack health check policy has the desired settings.
+func (hc *healthCheckPolicy) matches(existing cloudstack.LBHealthCheckPolicyHealthcheckpolicy) bool {
+	pingPath := existing.Pingpath
+	if pingPath == "" {
+		pingPath = defaultHealthCheckPath
+	}
+
+	return pingPath == hc.pingPath &&
+		existing.Healthcheckinterval == hc.interval &&
+		existing.Responsetime == hc.responseTimeout &&
+		existing.Healthcheckthresshold == hc.healthyThreshold &&
+		existing.Unhealthcheckthresshold == hc.unhealthyThreshold
+}
+
+// reconcileHealthCheckPolicy makes sure the health check policy of a load balancer rule
+// matches the service. CloudStack cannot update the settings of an existing policy, so
+// outdated policies are deleted and a new one is created.
+func (lb *loadBalancer) reconcileHealthCheckPolicy(lbRule *cloudstack.LoadBalancerRule, service *corev1.Service) error {
+	desired, err := getHealthCheckPolicy(service)
+	if err != nil {
+		return err
+	}
+
+	p := lb.LoadBalancer.NewListLBHealthCheckPoliciesParams()
+	p.SetLbruleid(lbRule.Id)
+
+	l, err := lb.LoadBalancer.ListLBHealthCheckPolicies(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving health check policies for load balancer rule %v: %v", lbRule.Name, err)
+	}
+
+	found := false
+	for _, policies := range l.LBHealthCheckPolicies {
+		for _, policy := range policies.Healthcheckpolicy {
+			if desired != nil && !found && desired.matches(policy) {
+				klog.V(4).Infof("Health check policy %v of load balancer rule %v is up-to-date", policy.Id, lbRule.Name)
+				found = true
+				continue
+			}
+
+			klog.V(4).Infof("Deleting health check policy %v of load balancer rule %v", policy.Id, lbRule.Name)
+			if _, err := lb.LoadBalancer.DeleteLBHealthCheckPolicy(lb.LoadBalancer.NewDeleteLBHealthCheckPolicyParams(policy.Id)); err != nil {
+				return fmt.Errorf("error deleting health check policy %v of load balancer rule %v: %v", policy.Id, lbRule.Name, err)
+			}
+		}
+	}
+
+	if desired == nil || found {
+		return nil
+	}
+
+	klog.V(4).Infof("Creating health check policy for load balancer rule %v: %+v", lbRule.Name, *desired)
+	cp := lb.LoadBalancer.NewCreateLBHealthCheckPolicyParams(lbRule.Id)
+	if desired.pingPath != defaultHealthCheckPath {
+		cp.SetPingpath(desired.pingPath)
+	}
+	cp.SetIntervaltime(desired.interval)
+	cp.SetResponsetimeout(desired.responseTimeout)
+	cp.SetHealthythreshold(desired.healthyThreshold)
+	cp.SetUnhealthythreshold(desired.unhealthyThreshold)
+
+	if _, err := lb.LoadBalancer.CreateLBHealthCheckPolicy(cp); err != nil {
+		return fmt.Errorf("error creating health check policy for load balancer rule %v: %v", lbRule.Name, err)
+	}
+
+	return nil
+}
+
+// getPositiveIntFromServiceAnnotation searches a given v1.Service for a specific annotationKey and either returns
+// the annotation's value as a positive integer or a specified defaultSetting
+func getPositiveIntFromServiceAnnotation(service *corev1.Service, annotationKey string, defaultSetting int) (int, error) {
+	annotationValue, ok := service.Annotations[annotationKey]
+	if !ok || annotationValue == "" {
+		return defaultSetting, nil
+	}
+
+	value, err := strconv.Atoi(annotationValue)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid value %q in annotation %s: must be a positive integer", annotationValue, annotationKey)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,410 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetHealthCheckPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		trafficPolicy corev1.ServiceExternalTrafficPolicyType
+		want          *healthCheckPolicy
+		wantErr       bool
+	}{
+		{
+			name: "no annotations and cluster traffic policy",
+			want: nil,
+		},
+		{
+			name:          "local traffic policy enables defaults",
+			trafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			want: &healthCheckPolicy{
+				pingPath:           "/",
+				interval:           5,
+				responseTimeout:    2,
+				healthyThreshold:   2,
+				unhealthyThreshold: 10,
+			},
+		},
+		{
+			name: "all annotations set",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerHealthCheckPath:               "/healthz",
+				ServiceAnnotationLoadBalancerHealthCheckInterval:           "10",
+				ServiceAnnotationLoadBalancerHealthCheckTimeout:            "3",
+				ServiceAnnotationLoadBalancerHealthCheckHealthyThreshold:   "4",
+				ServiceAnnotationLoadBalancerHealthCheckUnhealthyThreshold: "5",
+			},
+			want: &healthCheckPolicy{
+				pingPath:           "/healthz",
+				interval:           10,
+				responseTimeout:    3,
+				healthyThreshold:   4,
+				unhealthyThreshold: 5,
+			},
+		},
+		{
+			name: "empty path falls back to default",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerHealthCheckPath: "",
+			},
+			want: &healthCheckPolicy{
+				pingPath:           "/",
+				interval:           5,
+				responseTimeout:    2,
+				healthyThreshold:   2,
+				unhealthyThreshold: 10,
+			},
+		},
+		{
+			name: "invalid interval",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerHealthCheckInterval: "often",
+			},
+			wantErr: true,
+		},
+		{
+			name: "negative threshold",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerHealthCheckUnhealthyThreshold: "-1",
+			},
+			wantErr: true,
+		},
+		{
+			name: "timeout not lower than interval",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerHealthCheckInterval: "3",
+				ServiceAnnotationLoadBalancerHealthCheckTimeout:  "3",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-service",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+				Spec: corev1.ServiceSpec{
+					ExternalTrafficPolicy: tt.trafficPolicy,
+				},
+			}
+
+			got, err := getHealthCheckPolicy(service)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (got == nil) != (tt.want == nil) {
+				t.Fatalf("getHealthCheckPolicy() = %+v, want %+v", got, tt.want)
+			}
+			if got != nil && *got != *tt.want {
+				t.Errorf("getHealthCheckPolicy() = %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileHealthCheckPolicy(t *testing.T) {
+	rule := &cloudstack.LoadBalancerRule{
+		Id:   "rule-123",
+		Name: "test-rule",
+	}
+
+	annotated := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServiceAnnotationLoadBalancerHealthCheckPath: "/healthz",
+			},
+		},
+	}
+
+	t.Run("creates missing policy", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBHealthCheckPoliciesParams{}
+		createParams := &cloudstack.CreateLBHealthCheckPolicyParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBHealthCheckPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBHealthCheckPolicies(listParams).Return(&cloudstack.ListLBHealthCheckPoliciesResponse{}, nil),
+			mockLB.EXPECT().NewCreateLBHealthCheckPolicyParams("rule-123").Return(createParams),
+			mockLB.EXPECT().CreateLBHealthCheckPolicy(createParams).Return(&cloudstack.CreateLBHealthCheckPolicyResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileHealthCheckPolicy(rule, annotated); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if path, _ := createParams.GetPingpath(); path != "/healthz" {
+			t.Errorf("pingpath = %q, want %q", path, "/healthz")
+		}
+		if interval, _ := createParams.GetIntervaltime(); interval != defaultHealthCheckInterval {
+			t.Errorf("intervaltime = %d, want %d", interval, defaultHealthCheckInterval)
+		}
+	})
+
+	local := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-service", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			ExternalTrafficPolicy: corev1.ServiceExternalTrafficPolicyTypeLocal,
+			HealthCheckNodePort:   32000,
+		},
+	}
+
+	t.Run("creates tcp check for local traffic policy", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBHealthCheckPoliciesParams{}
+		createParams := &cloudstack.CreateLBHealthCheckPolicyParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBHealthCheckPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBHealthCheckPolicies(listParams).Return(&cloudstack.ListLBHealthCheckPoliciesResponse{}, nil),
+			mockLB.EXPECT().NewCreateLBHealthCheckPolicyParams("rule-123").Return(createParams),
+			mockLB.EXPECT().CreateLBHealthCheckPolicy(createParams).Return(&cloudstack.CreateLBHealthCheckPolicyResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileHealthCheckPolicy(rule, local); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if path, ok := createParams.GetPingpath(); ok {
+			t.Errorf("pingpath = %q, want no HTTP path", path)
+		}
+	})
+
+	t.Run("keeps tcp check without ping path", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBHealthCheckPoliciesParams{}
+		listResp := &cloudstack.ListLBHealthCheckPoliciesResponse{
+			Count: 1,
+			LBHealthCheckPolicies: []*cloudstack.LBHealthCheckPolicy{
+				{
+					Lbruleid: "rule-123",
+					Healthcheckpolicy: []cloudstack.LBHealthCheckPolicyHealthcheckpolicy{
+						{Id: "hc-1", Healthcheckinterval: 5, Responsetime: 2, Healthcheckthresshold: 2, Unhealthcheckthresshold: 10},
+					},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBHealthCheckPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBHealthCheckPolicies(listParams).Return(listResp, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileHealthCheckPolicy(rule, local); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("keeps matching policy", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBHealthCheckPoliciesParams{}
+		listResp := &cloudstack.ListLBHealthCheckPoliciesResponse{
+			Count: 1,
+			LBHealthCheckPolicies: []*cloudstack.LBHealthCheckPolicy{
+				{
+					Lbruleid: "rule-123",
+					Healthcheckpolicy: []cloudstack.LBHealthCheckPolicyHealthcheckpolicy{
+						{
+							Id:                      "hc-1",
+							Pingpath:                "/healthz",
+							Healthcheckinterval:     5,
+							Responsetime:            2,
+							Healthcheckthresshold:   2,
+							Unhealthcheckthresshold: 10,
+						},
+					},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBHealthCheckPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBHealthCheckPolicies(listParams).Return(listResp, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileHealthCheckPolicy(rule, annotated); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("replaces outdated policy", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBHealthCheckPoliciesParams{}
+		deleteParams := &cloudstack.DeleteLBHealthCheckPolicyParams{}
+		createParams := &cloudstack.CreateLBHealthCheckPolicyParams{}
+		listResp := &cloudstack.ListLBHealthCheckPoliciesResponse{
+			Count: 1,
+			LBHealthCheckPolicies: []*cloudstack.LBHealthCheckPolicy{
+				{
+					Lbruleid: "rule-123",
+					Healthcheckpolicy: []cloudstack.LBHealthCheckPolicyHealthcheckpolicy{
+						{Id: "hc-1", Pingpath: "/old", Healthcheckinterval: 5, Responsetime: 2, Healthcheckthresshold: 2, Unhealthcheckthresshold: 10},
+					},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBHealthCheckPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBHealthCheckPolicies(listParams).Return(listResp, nil),
+			mockLB.EXPECT().NewDeleteLBHealthCheckPolicyParams("hc-1").Return(deleteParams),
+			mockLB.EXPECT().DeleteLBHealthCheckPolicy(deleteParams).Return(&cloudstack.DeleteLBHealthCheckPolicyResponse{}, nil),
+			mockLB.EXPECT().NewCreateLBHealthCheckPolicyParams("rule-123").Return(createParams),
+			mockLB.EXPECT().CreateLBHealthCheckPolicy(createParams).Return(&cloudstack.CreateLBHealthCheckPolicyResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileHealthCheckPolicy(rule, annotated); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("deletes policy when annotations are removed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBHealthCheckPoliciesParams{}
+		deleteParams := &cloudstack.DeleteLBHealthCheckPolicyParams{}
+		listResp := &cloudstack.ListLBHealthCheckPoliciesResponse{
+			Count: 1,
+			LBHealthCheckPolicies: []*cloudstack.LBHealthCheckPolicy{
+				{
+					Lbruleid: "rule-123",
+					Healthcheckpolicy: []cloudstack.LBHealthCheckPolicyHealthcheckpolicy{
+						{Id: "hc-1", Pingpath: "/"},
+					},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBHealthCheckPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBHealthCheckPolicies(listParams).Return(listResp, nil),
+			mockLB.EXPECT().NewDeleteLBHealthCheckPolicyParams("hc-1").Return(deleteParams),
+			mockLB.EXPECT().DeleteLBHealthCheckPolicy(deleteParams).Return(&cloudstack.DeleteLBHealthCheckPolicyResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-service", Namespace: "default"},
+		}
+
+		if err := lb.reconcileHealthCheckPolicy(rule, service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("error listing policies", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBHealthCheckPoliciesParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBHealthCheckPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBHealthCheckPolicies(listParams).Return(nil, fmt.Errorf("list API error")),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		err := lb.reconcileHealthCheckPolicy(rule, annotated)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+		if !strings.Contains(err.Error(), "error retrieving health check policies") {
+			t.Errorf("error message = %q, want to contain 'error retrieving health check policies'", err.Error())
+		}
+	})
+}
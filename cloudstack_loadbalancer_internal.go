@@ -0,0 +1,311 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerInternal is the annotation used on the service
+	// to provision a CloudStack internal load balancer instead of a public one.
+	// The source IP is allocated from the VPC tier of the nodes, so the service is
+	// only reachable from within the VPC.
+	ServiceAnnotationLoadBalancerInternal = "service.beta.kubernetes.io/cloudstack-load-balancer-internal"
+
+	// internalLoadBalancerScheme is the CloudStack scheme of internal load balancers.
+	internalLoadBalancerScheme = "Internal"
+)
+
+// isInternalLoadBalancer returns true if the service requests an internal load balancer.
+func isInternalLoadBalancer(service *corev1.Service) bool {
+	return getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerInternal, false)
+}
+
+// getInternalLoadBalancers retrieves the internal load balancers of the service by their tags,
+// keyed by name. Like load balancer rules, there is one internal load balancer per service port.
+func (lb *loadBalancer) getInternalLoadBalancers() (map[string]*cloudstack.LoadBalancer, error) {
+	p := lb.LoadBalancer.NewListLoadBalancersParams()
+	if owner := lb.ownerTags(); owner != nil {
+		p.SetTags(owner)
+	} else {
+		p.SetKeyword(lb.name)
+	}
+	p.SetScheme(internalLoadBalancerScheme)
+	p.SetListall(true)
+
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancers(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving internal load balancers: %v", err)
+	}
+
+	ilbs := make(map[string]*cloudstack.LoadBalancer)
+	for _, ilb := range l.LoadBalancers {
+		ilbs[ilb.Name] = ilb
+	}
+
+	klog.V(4).Infof("Load balancer %v contains %d internal load balancer(s)", lb.name, len(ilbs))
+
+	return ilbs, nil
+}
+
+// ensureInternalLoadBalancer creates or updates the internal load balancers of the service and
+// returns the status of the balancer. The source IP is the one of the service spec if set, or
+// else the one CloudStack allocated from the tier for the first internal load balancer.
+func (cs *CSCloud) ensureInternalLoadBalancer(ctx context.Context, clusterName string, lb *loadBalancer, network *cloudstack.Network, service *corev1.Service) (*corev1.LoadBalancerStatus, error) {
+	if network.Vpcid == "" {
+		return nil, fmt.Errorf("internal load balancers require a VPC tier, network %v is not part of a VPC", network.Name)
+	}
+
+	// Remove the public load balancer if the service was switched to an internal one. The
+	// managed network ACL list is kept, as the internal load balancer uses the same tier.
+	if len(lb.rules) > 0 {
+		klog.V(4).Infof("Deleting public load balancer %v, the service uses an internal load balancer", lb.name)
+		if _, err := cs.deletePublicLoadBalancerRules(lb); err != nil {
+			return nil, err
+		}
+		if err := cs.releasePublicLoadBalancerIP(lb, service); err != nil {
+			return nil, err
+		}
+		lb.rules = make(map[string]*cloudstack.LoadBalancerRule)
+	}
+	if err := cs.deleteSecondaryLoadBalancer(lb, service); err != nil {
+		return nil, err
+	}
+
+	ilbs, err := lb.getInternalLoadBalancers()
+	if err != nil {
+		return nil, err
+	}
+
+	sourceIP := service.Spec.LoadBalancerIP
+	if sourceIP == "" {
+		for _, ilb := range ilbs {
+			sourceIP = ilb.Sourceipaddress
+			break
+		}
+	}
+
+	for _, port := range service.Spec.Ports {
+		protocol := ProtocolFromServicePort(port, service)
+		if protocol != LoadBalancerProtocolTCP {
+			return nil, fmt.Errorf("unsupported internal load balancer protocol %v for port %d, only plain TCP is supported", protocol, port.Port)
+		}
+
+		// All ports have their own internal load balancer, named like the public load balancer rules.
+		ilbName := fmt.Sprintf("%s-%s-%d", lb.name, protocol, port.Port)
+
+		ilb, ok := ilbs[ilbName]
+		delete(ilbs, ilbName)
+
+		// Internal load balancers cannot be updated, so recreate them when they changed.
+		if ok && !internalLoadBalancerMatches(ilb, lb.algorithm, port, sourceIP) {
+			// Keep the source IP, as CloudStack releases it with the last internal load balancer using it.
+			if sourceIP == "" {
+				sourceIP = ilb.Sourceipaddress
+			}
+
+			klog.V(4).Infof("Deleting outdated internal load balancer: %v", ilbName)
+			if err := lb.deleteInternalLoadBalancer(ilb); err != nil {
+				return nil, err
+			}
+			ok = false
+		}
+
+		if !ok {
+			klog.V(4).Infof("Creating internal load balancer: %v", ilbName)
+			ilb, err = lb.createInternalLoadBalancer(ilbName, port, sourceIP)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			klog.V(4).Infof("Internal load balancer %v is up-to-date", ilbName)
+		}
+
+		if sourceIP == "" {
+			sourceIP = ilb.Sourceipaddress
+		}
+
+		if err := lb.updateInternalLoadBalancerHosts(ilb); err != nil {
+			return nil, err
+		}
+
+		if isNetworkACLSupported(network.Service) {
+			klog.V(4).Infof("Creating ACL rules for internal load balancer: %v (%v:%v:%v)", ilbName, protocol, ilb.Sourceipaddress, port.Port)
+			sourceRanges, err := lb.getSourceRanges(service)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := lb.updateNetworkACL(int(port.Port), protocol, network.Id, sourceRanges); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Cleanup any internal load balancers that are no longer needed.
+	if err := lb.deleteInternalLoadBalancers(ilbs); err != nil {
+		return nil, err
+	}
+
+	status := &corev1.LoadBalancerStatus{}
+	if hostname := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerLoadbalancerHostname, ""); hostname != "" {
+		status.Ingress = []corev1.LoadBalancerIngress{{Hostname: hostname}}
+		return status, nil
+	}
+	status.Ingress = []corev1.LoadBalancerIngress{{IP: sourceIP}}
+
+	return status, nil
+}
+
+// internalLoadBalancerMatches returns true if the internal load balancer uses the wanted
+// algorithm, ports and source IP.
+func internalLoadBalancerMatches(ilb *cloudstack.LoadBalancer, algorithm string, port corev1.ServicePort, sourceIP string) bool {
+	if ilb.Algorithm != algorithm {
+		return false
+	}
+	if sourceIP != "" && ilb.Sourceipaddress != sourceIP {
+		return false
+	}
+	if len(ilb.Loadbalancerrule) != 1 {
+		return false
+	}
+
+	rule := ilb.Loadbalancerrule[0]
+	return rule.Sourceport == int(port.Port) && rule.Instanceport == int(port.NodePort)
+}
+
+// createInternalLoadBalancer creates a new internal load balancer in the tier of the nodes.
+func (lb *loadBalancer) createInternalLoadBalancer(ilbName string, port corev1.ServicePort, sourceIP string) (*cloudstack.LoadBalancer, error) {
+	p := lb.LoadBalancer.NewCreateLoadBalancerParams(
+		lb.algorithm,
+		int(port.NodePort),
+		ilbName,
+		lb.networkID,
+		internalLoadBalancerScheme,
+		lb.networkID,
+		int(port.Port),
+	)
+
+	if sourceIP != "" {
+		p.SetSourceipaddress(sourceIP)
+	}
+
+	r, err := lb.LoadBalancer.CreateLoadBalancer(p)
+	if err != nil {
+		return nil, fmt.Errorf("error creating internal load balancer %v: %v", ilbName, err)
+	}
+
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonInternalLBCreated, "Created internal load balancer %v with source IP %v", ilbName, r.Sourceipaddress)
+
+	if err := lb.tagResource(resourceTypeLoadBalancer, r.Id); err != nil {
+		return nil, err
+	}
+
+	ilb := &cloudstack.LoadBalancer{
+		Id:                       r.Id,
+		Algorithm:                r.Algorithm,
+		Name:                     r.Name,
+		Networkid:                r.Networkid,
+		Sourceipaddress:          r.Sourceipaddress,
+		Sourceipaddressnetworkid: r.Sourceipaddressnetworkid,
+	}
+	for _, rule := range r.Loadbalancerrule {
+		ilb.Loadbalancerrule = append(ilb.Loadbalancerrule, cloudstack.LoadBalancerLoadbalancerrule{
+			Instanceport: rule.Instanceport,
+			Sourceport:   rule.Sourceport,
+			State:        rule.State,
+		})
+	}
+
+	return ilb, nil
+}
+
+// updateInternalLoadBalancerHosts assigns and removes hosts, so the internal load balancer
+// balances over exactly the hosts of the load balancer.
+func (lb *loadBalancer) updateInternalLoadBalancerHosts(ilb *cloudstack.LoadBalancer) error {
+	var instances []*cloudstack.VirtualMachine
+	for _, instance := range ilb.Loadbalancerinstance {
+		instances = append(instances, &cloudstack.VirtualMachine{Id: instance.Id, Name: instance.Name})
+	}
+
+	assign, remove := symmetricDifference(lb.hostIDs, instances)
+
+	// Hosts of internal load balancers are managed with the same API calls as load balancer rules.
+	lbRule := &cloudstack.LoadBalancerRule{Id: ilb.Id, Name: ilb.Name}
+
+	if len(assign) > 0 {
+		klog.V(4).Infof("Assigning new hosts (%v) to internal load balancer: %v", assign, ilb.Name)
+		if err := lb.assignHostsToRule(lbRule, assign); err != nil {
+			return err
+		}
+	}
+
+	if len(remove) > 0 {
+		klog.V(4).Infof("Removing old hosts (%v) from internal load balancer: %v", remove, ilb.Name)
+		if err := lb.removeHostsFromRule(lbRule, remove); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteInternalLoadBalancers deletes the internal load balancers and their ACL rules. CloudStack
+// releases the source IP once the last internal load balancer using it is deleted, so an IP
+// shared with other services stays allocated.
+func (lb *loadBalancer) deleteInternalLoadBalancers(ilbs map[string]*cloudstack.LoadBalancer) error {
+	for _, ilb := range ilbs {
+		for _, rule := range ilb.Loadbalancerrule {
+			klog.V(4).Infof("Deleting Network ACL rules associated with internal load balancer: %v (%v:%v)", ilb.Name, LoadBalancerProtocolTCP, rule.Sourceport)
+			if _, err := lb.deleteNetworkACLRule(rule.Sourceport, LoadBalancerProtocolTCP, ilb.Networkid); err != nil {
+				klog.Errorf("Error deleting Network ACL rule: %v", err)
+			}
+		}
+
+		klog.V(4).Infof("Deleting obsolete internal load balancer: %v", ilb.Name)
+		if err := lb.deleteInternalLoadBalancer(ilb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteInternalLoadBalancer deletes an internal load balancer.
+func (lb *loadBalancer) deleteInternalLoadBalancer(ilb *cloudstack.LoadBalancer) error {
+	p := lb.LoadBalancer.NewDeleteLoadBalancerParams(ilb.Id)
+
+	if _, err := lb.LoadBalancer.DeleteLoadBalancer(p); err != nil {
+		return fmt.Errorf("error deleting internal load balancer %v: %v", ilb.Name, err)
+	}
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonInternalLBDeleted, "Deleted internal load balancer %v", ilb.Name)
+
+	return nil
+}
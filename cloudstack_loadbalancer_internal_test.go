@@ -0,0 +1,335 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInternalLoadBalancerMatches(t *testing.T) {
+	port := corev1.ServicePort{Port: 80, NodePort: 30080}
+
+	ilb := &cloudstack.LoadBalancer{
+		Algorithm:       "roundrobin",
+		Sourceipaddress: "10.1.1.50",
+		Loadbalancerrule: []cloudstack.LoadBalancerLoadbalancerrule{
+			{Sourceport: 80, Instanceport: 30080},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		algorithm string
+		port      corev1.ServicePort
+		sourceIP  string
+		want      bool
+	}{
+		{name: "matches", algorithm: "roundrobin", port: port, sourceIP: "10.1.1.50", want: true},
+		{name: "matches any source IP", algorithm: "roundrobin", port: port, want: true},
+		{name: "different algorithm", algorithm: "leastconn", port: port, want: false},
+		{name: "different source IP", algorithm: "roundrobin", port: port, sourceIP: "10.1.1.51", want: false},
+		{name: "different node port", algorithm: "roundrobin", port: corev1.ServicePort{Port: 80, NodePort: 30081}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := internalLoadBalancerMatches(ilb, tt.algorithm, tt.port, tt.sourceIP); got != tt.want {
+				t.Errorf("internalLoadBalancerMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureInternalLoadBalancer(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServiceAnnotationLoadBalancerInternal: "true",
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080},
+			},
+		},
+	}
+
+	t.Run("creates internal load balancer", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancersParams{}
+		createParams := &cloudstack.CreateLoadBalancerParams{}
+		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancersParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancers(listParams).Return(&cloudstack.ListLoadBalancersResponse{}, nil),
+			mockLB.EXPECT().NewCreateLoadBalancerParams("roundrobin", 30080, "lb-tcp-80", "tier-1", "Internal", "tier-1", 80).Return(createParams),
+			mockLB.EXPECT().CreateLoadBalancer(createParams).Return(&cloudstack.CreateLoadBalancerResponse{
+				Id:              "ilb-1",
+				Name:            "lb-tcp-80",
+				Algorithm:       "roundrobin",
+				Networkid:       "tier-1",
+				Sourceipaddress: "10.1.1.50",
+			}, nil),
+			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("ilb-1").Return(assignParams),
+			mockLB.EXPECT().AssignToLoadBalancerRule(assignParams).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+		)
+
+		cs := &CSCloud{}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+			name:      "lb",
+			algorithm: "roundrobin",
+			hostIDs:   []string{"vm-1"},
+			networkID: "tier-1",
+			rules:     map[string]*cloudstack.LoadBalancerRule{},
+		}
+		network := &cloudstack.Network{Id: "tier-1", Name: "tier", Vpcid: "vpc-1"}
+
+		status, err := cs.ensureInternalLoadBalancer(context.Background(), "kubernetes", lb, network, service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(status.Ingress) != 1 || status.Ingress[0].IP != "10.1.1.50" {
+			t.Errorf("status = %+v, want IP 10.1.1.50", status)
+		}
+	})
+
+	t.Run("keeps up-to-date internal load balancer and removes obsolete ones", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancersParams{}
+		aclListParams := &cloudstack.ListNetworkACLsParams{}
+		deleteParams := &cloudstack.DeleteLoadBalancerParams{}
+		listResp := &cloudstack.ListLoadBalancersResponse{
+			Count: 2,
+			LoadBalancers: []*cloudstack.LoadBalancer{
+				{
+					Id:                   "ilb-1",
+					Name:                 "lb-tcp-80",
+					Algorithm:            "roundrobin",
+					Networkid:            "tier-1",
+					Sourceipaddress:      "10.1.1.50",
+					Loadbalancerrule:     []cloudstack.LoadBalancerLoadbalancerrule{{Sourceport: 80, Instanceport: 30080}},
+					Loadbalancerinstance: []cloudstack.LoadBalancerLoadbalancerinstance{{Id: "vm-1"}},
+				},
+				{
+					Id:               "ilb-2",
+					Name:             "lb-tcp-443",
+					Algorithm:        "roundrobin",
+					Networkid:        "tier-1",
+					Sourceipaddress:  "10.1.1.50",
+					Loadbalancerrule: []cloudstack.LoadBalancerLoadbalancerrule{{Sourceport: 443, Instanceport: 30443}},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancersParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancers(listParams).Return(listResp, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(aclListParams),
+			mockNetworkACL.EXPECT().ListNetworkACLs(aclListParams).Return(&cloudstack.ListNetworkACLsResponse{}, nil),
+			mockLB.EXPECT().NewDeleteLoadBalancerParams("ilb-2").Return(deleteParams),
+			mockLB.EXPECT().DeleteLoadBalancer(deleteParams).Return(&cloudstack.DeleteLoadBalancerResponse{}, nil),
+		)
+
+		cs := &CSCloud{}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				NetworkACL:   mockNetworkACL,
+			},
+			name:      "lb",
+			algorithm: "roundrobin",
+			hostIDs:   []string{"vm-1"},
+			networkID: "tier-1",
+			rules:     map[string]*cloudstack.LoadBalancerRule{},
+		}
+		network := &cloudstack.Network{Id: "tier-1", Name: "tier", Vpcid: "vpc-1"}
+
+		status, err := cs.ensureInternalLoadBalancer(context.Background(), "kubernetes", lb, network, service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(status.Ingress) != 1 || status.Ingress[0].IP != "10.1.1.50" {
+			t.Errorf("status = %+v, want IP 10.1.1.50", status)
+		}
+	})
+
+	t.Run("recreates outdated internal load balancer with its source IP", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancersParams{}
+		deleteParams := &cloudstack.DeleteLoadBalancerParams{}
+		createParams := &cloudstack.CreateLoadBalancerParams{}
+		assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+		listResp := &cloudstack.ListLoadBalancersResponse{
+			Count: 1,
+			LoadBalancers: []*cloudstack.LoadBalancer{
+				{
+					Id:               "ilb-1",
+					Name:             "lb-tcp-80",
+					Algorithm:        "roundrobin",
+					Networkid:        "tier-1",
+					Sourceipaddress:  "10.1.1.50",
+					Loadbalancerrule: []cloudstack.LoadBalancerLoadbalancerrule{{Sourceport: 80, Instanceport: 31080}},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancersParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancers(listParams).Return(listResp, nil),
+			mockLB.EXPECT().NewDeleteLoadBalancerParams("ilb-1").Return(deleteParams),
+			mockLB.EXPECT().DeleteLoadBalancer(deleteParams).Return(&cloudstack.DeleteLoadBalancerResponse{}, nil),
+			mockLB.EXPECT().NewCreateLoadBalancerParams("roundrobin", 30080, "lb-tcp-80", "tier-1", "Internal", "tier-1", 80).Return(createParams),
+			mockLB.EXPECT().CreateLoadBalancer(createParams).Return(&cloudstack.CreateLoadBalancerResponse{
+				Id:              "ilb-2",
+				Name:            "lb-tcp-80",
+				Algorithm:       "roundrobin",
+				Networkid:       "tier-1",
+				Sourceipaddress: "10.1.1.50",
+			}, nil),
+			mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("ilb-2").Return(assignParams),
+			mockLB.EXPECT().AssignToLoadBalancerRule(assignParams).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+		)
+
+		cs := &CSCloud{}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+			name:      "lb",
+			algorithm: "roundrobin",
+			hostIDs:   []string{"vm-1"},
+			networkID: "tier-1",
+			rules:     map[string]*cloudstack.LoadBalancerRule{},
+		}
+		network := &cloudstack.Network{Id: "tier-1", Name: "tier", Vpcid: "vpc-1"}
+
+		if _, err := cs.ensureInternalLoadBalancer(context.Background(), "kubernetes", lb, network, service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if ip, _ := createParams.GetSourceipaddress(); ip != "10.1.1.50" {
+			t.Errorf("sourceipaddress = %q, want %q", ip, "10.1.1.50")
+		}
+	})
+
+	t.Run("requires a VPC tier", func(t *testing.T) {
+		cs := &CSCloud{}
+		lb := &loadBalancer{name: "lb"}
+		network := &cloudstack.Network{Id: "net-1", Name: "isolated"}
+
+		if _, err := cs.ensureInternalLoadBalancer(context.Background(), "kubernetes", lb, network, service); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("rejects UDP ports", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancersParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancersParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancers(listParams).Return(&cloudstack.ListLoadBalancersResponse{}, nil),
+		)
+
+		cs := &CSCloud{}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+			name:  "lb",
+			rules: map[string]*cloudstack.LoadBalancerRule{},
+		}
+		network := &cloudstack.Network{Id: "tier-1", Name: "tier", Vpcid: "vpc-1"}
+
+		udpService := service.DeepCopy()
+		udpService.Spec.Ports[0].Protocol = corev1.ProtocolUDP
+
+		if _, err := cs.ensureInternalLoadBalancer(context.Background(), "kubernetes", lb, network, udpService); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
+
+func TestUpdateInternalLoadBalancerHosts(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	assignParams := &cloudstack.AssignToLoadBalancerRuleParams{}
+	removeParams := &cloudstack.RemoveFromLoadBalancerRuleParams{}
+
+	gomock.InOrder(
+		mockLB.EXPECT().NewAssignToLoadBalancerRuleParams("ilb-1").Return(assignParams),
+		mockLB.EXPECT().AssignToLoadBalancerRule(assignParams).Return(&cloudstack.AssignToLoadBalancerRuleResponse{}, nil),
+		mockLB.EXPECT().NewRemoveFromLoadBalancerRuleParams("ilb-1").Return(removeParams),
+		mockLB.EXPECT().RemoveFromLoadBalancerRule(removeParams).Return(&cloudstack.RemoveFromLoadBalancerRuleResponse{}, nil),
+	)
+
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{
+			LoadBalancer: mockLB,
+		},
+		hostIDs: []string{"vm-1", "vm-2"},
+	}
+
+	ilb := &cloudstack.LoadBalancer{
+		Id:   "ilb-1",
+		Name: "lb-tcp-80",
+		Loadbalancerinstance: []cloudstack.LoadBalancerLoadbalancerinstance{
+			{Id: "vm-1"},
+			{Id: "vm-3"},
+		},
+	}
+
+	if err := lb.updateInternalLoadBalancerHosts(ilb); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if ids, _ := assignParams.GetVirtualmachineids(); len(ids) != 1 || ids[0] != "vm-2" {
+		t.Errorf("assigned = %v, want [vm-2]", ids)
+	}
+	if ids, _ := removeParams.GetVirtualmachineids(); len(ids) != 1 || ids[0] != "vm-3" {
+		t.Errorf("removed = %v, want [vm-3]", ids)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerIPID is the annotation used on the service to select the
+	// public IP by its CloudStack ID. Dual-stack services may list one ID per IP family. It
+	// takes priority over spec.loadBalancerIP.
+	ServiceAnnotationLoadBalancerIPID = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-id"
+
+	// ServiceAnnotationLoadBalancerIPTags is the annotation used on the service to select the
+	// public IP by its tags, as a comma separated list of key=value pairs. Dual-stack services
+	// may select one IP per IP family. It is used if no IP ID is given and takes priority over
+	// spec.loadBalancerIP.
+	ServiceAnnotationLoadBalancerIPTags = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-tags"
+)
+
+// hasIPSelector returns true if the service selects its public IP by ID or tags.
+func hasIPSelector(service *corev1.Service) bool {
+	return getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPID, "") != "" ||
+		getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPTags, "") != ""
+}
+
+// ipRequestedByService returns true if the IP of the load balancer was requested by the service,
+// by ID, tags or spec.loadBalancerIP, rather than allocated for it by the controller.
+func ipRequestedByService(service *corev1.Service, ipAddr string) bool {
+	return hasIPSelector(service) || ipAddr == service.Spec.LoadBalancerIP
+}
+
+// primaryIPFamily returns the IP family of the load balancer IP of a service.
+func primaryIPFamily(service *corev1.Service) corev1.IPFamily {
+	if len(service.Spec.IPFamilies) > 0 {
+		return service.Spec.IPFamilies[0]
+	}
+	return corev1.IPv4Protocol
+}
+
+// parseTagSelector parses a comma separated list of key=value pairs.
+func parseTagSelector(selector string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range splitList(selector) {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid IP tag selector %q, want a comma separated list of key=value pairs", selector)
+		}
+		tags[key] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// getSelectedIPAddress sets the public IP selected by the ID or tag annotations of the service.
+// The IP is associated if it is not allocated yet, and returned locked.
+func (lb *loadBalancer) getSelectedIPAddress(service *corev1.Service) (func(), error) {
+	ip, err := lb.selectIPAddress(service)
+	if err != nil {
+		return nil, err
+	}
+
+	klog.V(4).Infof("Selected load balancer IP %v (%v)", ip.Ipaddress, ip.Id)
+
+	return lb.acquireIPAddress(ip.Id)
+}
+
+// checkSelectedIPAddress verifies that the ID or tag annotations of the service still select the
+// IP of its load balancer.
+func (lb *loadBalancer) checkSelectedIPAddress(service *corev1.Service) error {
+	ip, err := lb.selectIPAddress(service)
+	if err != nil {
+		return err
+	}
+	return lb.checkIPAddress(ip)
+}
+
+// checkIPAddress verifies that the selected IP is the IP of the load balancer. The rules are not
+// moved to another IP, so a changed selection is rejected until it is reverted or the service is
+// recreated.
+func (lb *loadBalancer) checkIPAddress(ip *cloudstack.PublicIpAddress) error {
+	if ip.Id != lb.ipAddrID {
+		lb.recordEvent(corev1.EventTypeWarning, eventReasonIPSelectionRejected, "Selected IP address %v, but the load balancer uses IP address %v; recreate the service to move it", ip.Ipaddress, lb.ipAddr)
+		return fmt.Errorf("selected IP address %v, but the load balancer already uses IP address %v", ip.Ipaddress, lb.ipAddr)
+	}
+	return nil
+}
+
+// selectIPAddress returns the public IP selected for the primary IP family of the service.
+func (lb *loadBalancer) selectIPAddress(service *corev1.Service) (*cloudstack.PublicIpAddress, error) {
+	ips, err := lb.selectIPAddresses(service)
+	if err != nil {
+		return nil, err
+	}
+	return ips[primaryIPFamily(service)], nil
+}
+
+// selectIPAddresses returns the public IPs selected by the ID or tag annotations of the service,
+// by IP family. The selection must match one IP in the primary IP family of the service, and at
+// most one IP in its secondary family, as CloudStack balances a single public IP per rule.
+func (lb *loadBalancer) selectIPAddresses(service *corev1.Service) (map[corev1.IPFamily]*cloudstack.PublicIpAddress, error) {
+	var ips []*cloudstack.PublicIpAddress
+
+	if ids := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPID, ""); ids != "" {
+		for _, id := range splitList(ids) {
+			ip, count, err := lb.Address.GetPublicIpAddressByID(id, cloudstack.WithProject(lb.projectID))
+			if err != nil {
+				if count == 0 {
+					return nil, fmt.Errorf("could not find IP address with ID %v", id)
+				}
+				return nil, fmt.Errorf("error retrieving IP address %v: %v", id, err)
+			}
+			ips = append(ips, ip)
+		}
+	} else {
+		selector := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPTags, "")
+		tags, err := parseTagSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+
+		p := lb.Address.NewListPublicIpAddressesParams()
+		p.SetTags(tags)
+		p.SetListall(true)
+		if lb.projectID != "" {
+			p.SetProjectid(lb.projectID)
+		}
+
+		l, err := lb.Address.ListPublicIpAddresses(p)
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving IP addresses tagged %v: %v", selector, err)
+		}
+		ips = l.PublicIpAddresses
+	}
+
+	families := service.Spec.IPFamilies
+	if len(families) == 0 {
+		families = []corev1.IPFamily{primaryIPFamily(service)}
+	}
+
+	byFamily := make(map[corev1.IPFamily][]string)
+	selected := make(map[corev1.IPFamily]*cloudstack.PublicIpAddress)
+	for _, ip := range ips {
+		family := ipFamily(ip.Ipaddress)
+		if !hasIPFamily(families, family) {
+			return nil, fmt.Errorf("selected IP address %v is an %v address, the service only has IP families %v", ip.Ipaddress, family, families)
+		}
+		byFamily[family] = append(byFamily[family], ip.Ipaddress)
+		selected[family] = ip
+	}
+
+	for _, family := range families {
+		if addresses := byFamily[family]; len(addresses) > 1 {
+			return nil, fmt.Errorf("selected %d %v addresses (%v), only one per IP family can be used", len(addresses), family, strings.Join(addresses, ", "))
+		}
+	}
+
+	if family := primaryIPFamily(service); selected[family] == nil {
+		return nil, fmt.Errorf("no %v address is selected for the primary IP family of the service", family)
+	}
+
+	return selected, nil
+}
+
+// hasIPFamily returns true if the IP families contain the given family.
+func hasIPFamily(families []corev1.IPFamily, family corev1.IPFamily) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFamily returns the IP family of an address.
+func ipFamily(address string) corev1.IPFamily {
+	ip := net.ParseIP(address)
+	if ip != nil && ip.To4() == nil {
+		return corev1.IPv6Protocol
+	}
+	return corev1.IPv4Protocol
+}
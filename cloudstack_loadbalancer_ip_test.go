@@ -0,0 +1,463 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseTagSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{selector: "role=ingress", want: map[string]string{"role": "ingress"}},
+		{selector: "role=ingress, env = prod", want: map[string]string{"role": "ingress", "env": "prod"}},
+		{selector: "role", wantErr: true},
+		{selector: "=ingress", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			got, err := parseTagSelector(tt.selector)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTagSelector() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPRequestedByService(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		specIP      string
+		want        bool
+	}{
+		{name: "allocated by the controller"},
+		{name: "spec.loadBalancerIP", specIP: "203.0.113.1", want: true},
+		{name: "IP ID", annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: "ip-1"}, want: true},
+		{name: "IP tags", annotations: map[string]string{ServiceAnnotationLoadBalancerIPTags: "role=ingress"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec:       corev1.ServiceSpec{LoadBalancerIP: tt.specIP},
+			}
+			if got := ipRequestedByService(service, "203.0.113.1"); got != tt.want {
+				t.Errorf("ipRequestedByService() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetSelectedIPAddress(t *testing.T) {
+	ipv4 := &cloudstack.PublicIpAddress{Id: "ip-4", Ipaddress: "203.0.113.1", Allocated: "2026-01-01T00:00:00+0000"}
+	ipv6 := &cloudstack.PublicIpAddress{Id: "ip-6", Ipaddress: "2001:db8::1", Allocated: "2026-01-01T00:00:00+0000"}
+
+	t.Run("by ID takes priority over spec.loadBalancerIP", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-4", gomock.Any()).Return(ipv4, 1, nil)
+		expectLockIPAddress(mockAddress, ipv4)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			ipLocks:          &keyedMutex{},
+			service: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: "ip-4"}},
+			},
+		}
+
+		unlock, err := lb.getLoadBalancerIP("198.51.100.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		unlock()
+		if lb.ipAddr != "203.0.113.1" || lb.ipAddrID != "ip-4" || lb.ipAssociatedByController {
+			t.Errorf("load balancer IP = %q (%q), associated by controller %v", lb.ipAddr, lb.ipAddrID, lb.ipAssociatedByController)
+		}
+	})
+
+	for _, tt := range []struct {
+		name     string
+		families []corev1.IPFamily
+		ids      string
+		wantID   string
+		wantErr  bool
+	}{
+		{name: "dual-stack IPv4 primary", families: []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}, ids: "ip-4", wantID: "ip-4"},
+		{name: "dual-stack IPv6 primary", families: []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol}, ids: "ip-6", wantID: "ip-6"},
+		{name: "IP of the secondary family", families: []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol}, ids: "ip-4", wantErr: true},
+		{name: "IP per family", families: []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol}, ids: "ip-4, ip-6", wantID: "ip-6"},
+		{name: "IP of a family the service does not have", families: []corev1.IPFamily{corev1.IPv4Protocol}, ids: "ip-4, ip-6", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-4", gomock.Any()).Return(ipv4, 1, nil).AnyTimes()
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-6", gomock.Any()).Return(ipv6, 1, nil).AnyTimes()
+			if !tt.wantErr {
+				expectLockIPAddress(mockAddress, map[string]*cloudstack.PublicIpAddress{"ip-4": ipv4, "ip-6": ipv6}[tt.wantID])
+			}
+
+			lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress}, ipLocks: &keyedMutex{}}
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: tt.ids}},
+				Spec:       corev1.ServiceSpec{IPFamilies: tt.families},
+			}
+
+			unlock, err := lb.getSelectedIPAddress(service)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			unlock()
+			if lb.ipAddrID != tt.wantID {
+				t.Errorf("selected IP %q, want %q", lb.ipAddrID, tt.wantID)
+			}
+		})
+	}
+
+	t.Run("by tags", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		listParams := &cloudstack.ListPublicIpAddressesParams{}
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+		mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count:             1,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{ipv4},
+		}, nil)
+		expectLockIPAddress(mockAddress, ipv4)
+
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress}, ipLocks: &keyedMutex{}}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPTags: "role=ingress"}},
+		}
+
+		unlock, err := lb.getSelectedIPAddress(service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		unlock()
+		if lb.ipAddrID != "ip-4" {
+			t.Errorf("selected IP %q, want %q", lb.ipAddrID, "ip-4")
+		}
+		if tags, _ := listParams.GetTags(); !reflect.DeepEqual(tags, map[string]string{"role": "ingress"}) {
+			t.Errorf("lookup tags = %v", tags)
+		}
+	})
+
+	t.Run("tags matching both families of a single-stack service", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count:             2,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{ipv6, ipv4},
+		}, nil)
+
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress}}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPTags: "role=ingress"}},
+		}
+
+		if _, err := lb.getSelectedIPAddress(service); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("ambiguous tags", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+			Count: 2,
+			PublicIpAddresses: []*cloudstack.PublicIpAddress{
+				ipv4,
+				{Id: "ip-4b", Ipaddress: "203.0.113.2", Allocated: "2026-01-01T00:00:00+0000"},
+			},
+		}, nil)
+
+		lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress}}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPTags: "role=ingress"}},
+		}
+
+		if _, err := lb.getSelectedIPAddress(service); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("unallocated IP is associated", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+
+		associateParams := &cloudstack.AssociateIpAddressParams{}
+		gomock.InOrder(
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-free", gomock.Any()).Return(&cloudstack.PublicIpAddress{Id: "ip-free", Ipaddress: "203.0.113.9"}, 1, nil),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}),
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             1,
+				PublicIpAddresses: []*cloudstack.PublicIpAddress{{Id: "ip-free", Ipaddress: "203.0.113.9"}},
+			}, nil),
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1"}, 1, nil),
+			mockAddress.EXPECT().NewAssociateIpAddressParams().Return(associateParams),
+			mockAddress.EXPECT().AssociateIpAddress(associateParams).Return(&cloudstack.AssociateIpAddressResponse{Id: "ip-free", Ipaddress: "203.0.113.9"}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, Network: mockNetwork},
+			networkID:        "net-1",
+			ipLocks:          &keyedMutex{},
+		}
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: "ip-free"}},
+		}
+
+		unlock, err := lb.getSelectedIPAddress(service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		unlock()
+		if !lb.ipAssociatedByController {
+			t.Errorf("expected the IP to be associated by the controller")
+		}
+		if ip, _ := associateParams.GetIpaddress(); ip != "203.0.113.9" {
+			t.Errorf("associated IP %q, want %q", ip, "203.0.113.9")
+		}
+	})
+
+	t.Run("reserved IP is taken over", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		reserved := &cloudstack.PublicIpAddress{
+			Id:        "ip-reserved",
+			Ipaddress: "203.0.113.7",
+			Allocated: "2026-01-01T00:00:00+0000",
+			Tags: []cloudstack.Tags{
+				{Key: tagClusterName, Value: "prod"},
+				{Key: tagIPReservation, Value: "web-ip"},
+				{Key: tagIPReservedAt, Value: "2026-01-01T00:00:00Z"},
+			},
+		}
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-reserved", gomock.Any()).Return(reserved, 1, nil)
+		expectLockIPAddress(mockAddress, reserved)
+
+		deleteParams := &cloudstack.DeleteTagsParams{}
+		createParams := &cloudstack.CreateTagsParams{}
+		gomock.InOrder(
+			mockTags.EXPECT().NewDeleteTagsParams([]string{"ip-reserved"}, resourceTypePublicIPAddress).Return(deleteParams),
+			mockTags.EXPECT().DeleteTags(deleteParams).Return(&cloudstack.DeleteTagsResponse{}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"ip-reserved"}, resourceTypePublicIPAddress, map[string]string{
+				tagServiceNamespace: "default",
+				tagServiceName:      "web",
+				tagServiceUID:       "uid-1",
+			}).Return(createParams),
+			mockTags.EXPECT().CreateTags(createParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+		)
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "web",
+				UID:         "uid-1",
+				Annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: "ip-reserved"},
+			},
+		}
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, Resourcetags: mockTags},
+			ipLocks:          &keyedMutex{},
+			tags:             serviceTags("prod", service),
+		}
+
+		unlock, err := lb.getSelectedIPAddress(service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		unlock()
+		if lb.ipAddrID != "ip-reserved" || lb.ipReservation != "web-ip" {
+			t.Errorf("load balancer IP %q claimed from %q, want ip-reserved from web-ip", lb.ipAddrID, lb.ipReservation)
+		}
+		wantDeleted := map[string]string{tagIPReservation: "web-ip", tagIPReservedAt: "2026-01-01T00:00:00Z"}
+		if tags, _ := deleteParams.GetTags(); !reflect.DeepEqual(tags, wantDeleted) {
+			t.Errorf("deleted tags = %v, want %v", tags, wantDeleted)
+		}
+	})
+}
+
+func TestCheckSelectedIPAddress(t *testing.T) {
+	ip := &cloudstack.PublicIpAddress{Id: "ip-2", Ipaddress: "203.0.113.2", Allocated: "2026-01-01T00:00:00+0000"}
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPID: "ip-2"}},
+	}
+
+	tests := []struct {
+		name      string
+		ipAddrID  string
+		wantEvent string
+	}{
+		{name: "same IP", ipAddrID: "ip-2"},
+		{name: "other IP", ipAddrID: "ip-1", wantEvent: "Warning IPSelectionRejected Selected IP address 203.0.113.2, but the load balancer uses IP address 203.0.113.1; recreate the service to move it"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-2", gomock.Any()).Return(ip, 1, nil)
+
+			recorder := record.NewFakeRecorder(10)
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+				ipAddr:           "203.0.113.1",
+				ipAddrID:         tt.ipAddrID,
+				service:          service,
+				eventRecorder:    recorder,
+			}
+
+			err := lb.checkSelectedIPAddress(service)
+			if (err != nil) != (tt.wantEvent != "") {
+				t.Fatalf("checkSelectedIPAddress() error = %v", err)
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if event != tt.wantEvent {
+				t.Errorf("event = %q, want %q", event, tt.wantEvent)
+			}
+		})
+	}
+}
+
+// expectLockIPAddress expects the IP to be retrieved again once it is locked.
+func expectLockIPAddress(mockAddress *cloudstack.MockAddressServiceIface, ip *cloudstack.PublicIpAddress) {
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+	mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+		Count:             1,
+		PublicIpAddresses: []*cloudstack.PublicIpAddress{ip},
+	}, nil)
+}
+
+func TestSelectIPAddresses(t *testing.T) {
+	ipv4 := &cloudstack.PublicIpAddress{Id: "ip-4", Ipaddress: "203.0.113.1", Allocated: "2026-01-01T00:00:00+0000"}
+	ipv4b := &cloudstack.PublicIpAddress{Id: "ip-4b", Ipaddress: "203.0.113.2", Allocated: "2026-01-01T00:00:00+0000"}
+	ipv6 := &cloudstack.PublicIpAddress{Id: "ip-6", Ipaddress: "2001:db8::1", Allocated: "2026-01-01T00:00:00+0000"}
+	dualStack := []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}
+
+	tests := []struct {
+		name     string
+		families []corev1.IPFamily
+		ips      []*cloudstack.PublicIpAddress
+		want     map[corev1.IPFamily]string
+		wantErr  bool
+	}{
+		{name: "one IP per family", families: dualStack, ips: []*cloudstack.PublicIpAddress{ipv6, ipv4}, want: map[corev1.IPFamily]string{corev1.IPv4Protocol: "ip-4", corev1.IPv6Protocol: "ip-6"}},
+		{name: "primary family only", families: dualStack, ips: []*cloudstack.PublicIpAddress{ipv4}, want: map[corev1.IPFamily]string{corev1.IPv4Protocol: "ip-4"}},
+		{name: "secondary family only", families: dualStack, ips: []*cloudstack.PublicIpAddress{ipv6}, wantErr: true},
+		{name: "two IPs of a family", families: dualStack, ips: []*cloudstack.PublicIpAddress{ipv4, ipv4b, ipv6}, wantErr: true},
+		{name: "family the service does not have", families: []corev1.IPFamily{corev1.IPv4Protocol}, ips: []*cloudstack.PublicIpAddress{ipv4, ipv6}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{})
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             len(tt.ips),
+				PublicIpAddresses: tt.ips,
+			}, nil)
+
+			lb := &loadBalancer{CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress}}
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{ServiceAnnotationLoadBalancerIPTags: "role=ingress"}},
+				Spec:       corev1.ServiceSpec{IPFamilies: tt.families},
+			}
+
+			ips, err := lb.selectIPAddresses(service)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make(map[corev1.IPFamily]string)
+			for family, ip := range ips {
+				got[family] = ip.Id
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selected IPs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerNetwork is the annotation used on the service to select
+	// the network or VPC tier, by ID or name, the load balancer rules are created in. It
+	// overrides the load balancer network of the cloud config.
+	ServiceAnnotationLoadBalancerNetwork = "service.beta.kubernetes.io/cloudstack-load-balancer-network"
+
+	// ServiceAnnotationLoadBalancerIPRange is the annotation used on the service to allocate
+	// the public IP from the public IP range with this ID.
+	ServiceAnnotationLoadBalancerIPRange = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-range"
+
+	// ServiceAnnotationLoadBalancerIPVlan is the annotation used on the service to allocate
+	// the public IP from the public IP ranges of this VLAN.
+	ServiceAnnotationLoadBalancerIPVlan = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-vlan"
+
+	publicIPStateFree = "Free"
+)
+
+// loadBalancerNetwork returns the ID and name of the network selected for the load balancer
+// of a service. The annotation may hold either, so it is returned as both.
+func (cs *CSCloud) loadBalancerNetwork(service *corev1.Service) (string, string) {
+	if network := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerNetwork, ""); network != "" {
+		return network, network
+	}
+	return cs.lbNetworkID, cs.lbNetworkName
+}
+
+// checkLoadBalancerNetwork verifies that the existing rules of the load balancer are in the
+// network selected for it. The public IP of the rules is bound to their network or VPC tier, so
+// the rules are not moved to another network, and a changed selection is rejected until it is
+// reverted or the service is recreated.
+func (lb *loadBalancer) checkLoadBalancerNetwork() error {
+	for _, rules := range []map[string]*cloudstack.LoadBalancerRule{lb.rules, lb.secondaryRules} {
+		for _, lbRule := range rules {
+			if lbRule.Networkid == "" || lbRule.Networkid == lb.networkID {
+				continue
+			}
+			lb.recordEvent(corev1.EventTypeWarning, eventReasonNetworkChangeRejected, "Load balancer rule %v is in network %v, but the service selects network %v; recreate the service to move it", lbRule.Name, lbRule.Networkid, lb.networkID)
+			return fmt.Errorf("load balancer rule %v is in network %v, not in the selected network %v", lbRule.Name, lbRule.Networkid, lb.networkID)
+		}
+	}
+	return nil
+}
+
+// findFreeIPAddress returns a free public IP address in the IP range or VLAN requested by the
+// annotations of the service, or "" if none is requested.
+func (lb *loadBalancer) findFreeIPAddress(zoneID string) (string, error) {
+	if lb.service == nil {
+		return "", nil
+	}
+
+	ipRange := getStringFromServiceAnnotation(lb.service, ServiceAnnotationLoadBalancerIPRange, "")
+	vlan := getStringFromServiceAnnotation(lb.service, ServiceAnnotationLoadBalancerIPVlan, "")
+	if ipRange == "" && vlan == "" {
+		return "", nil
+	}
+
+	p := lb.Address.NewListPublicIpAddressesParams()
+	p.SetAllocatedonly(false)
+	p.SetForvirtualnetwork(true)
+	p.SetListall(true)
+	if zoneID != "" {
+		p.SetZoneid(zoneID)
+	}
+	if ipRange != "" {
+		p.SetVlanid(ipRange)
+	}
+
+	l, err := lb.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return "", fmt.Errorf("error retrieving free public IP addresses: %v", err)
+	}
+
+	for _, ip := range l.PublicIpAddresses {
+		if ip.State != publicIPStateFree {
+			continue
+		}
+		if ipRange != "" && ip.Vlanid != ipRange {
+			continue
+		}
+		if vlan != "" && !isVlan(ip.Vlanname, vlan) {
+			continue
+		}
+		return ip.Ipaddress, nil
+	}
+
+	if ipRange != "" {
+		return "", fmt.Errorf("no free public IP address in public IP range %v", ipRange)
+	}
+	return "", fmt.Errorf("no free public IP address in VLAN %v", vlan)
+}
+
+// isVlan returns true if the VLAN of a public IP range, such as "vlan://100", is the given VLAN.
+func isVlan(vlanName, vlan string) bool {
+	return vlanName == vlan || strings.TrimPrefix(vlanName, "vlan://") == strings.TrimPrefix(vlan, "vlan://")
+}
@@ -0,0 +1,218 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestLoadBalancerNetwork(t *testing.T) {
+	cs := &CSCloud{lbNetworkName: "lb-tier"}
+
+	id, name := cs.loadBalancerNetwork(&corev1.Service{})
+	if id != "" || name != "lb-tier" {
+		t.Errorf("loadBalancerNetwork() = %q, %q, want the configured network", id, name)
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerNetwork: "dmz"},
+		},
+	}
+	id, name = cs.loadBalancerNetwork(service)
+	if id != "dmz" || name != "dmz" {
+		t.Errorf("loadBalancerNetwork() = %q, %q, want the annotated network", id, name)
+	}
+}
+
+func TestVerifyHostsWithNetworkAnnotation(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	gomock.InOrder(
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}),
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count: 2,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "net-1", Isdefault: true}, {Networkid: "net-dmz", Networkname: "dmz"}}},
+				{Id: "vm-2", Name: "node-2", Nic: []cloudstack.Nic{{Networkid: "net-1", Isdefault: true}}},
+			},
+		}, nil),
+	)
+
+	recorder := record.NewFakeRecorder(10)
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			VirtualMachine: mockVM,
+		},
+		eventRecorder: recorder,
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "svc",
+			Namespace:   "default",
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerNetwork: "dmz"},
+		},
+	}
+	nodes := []*corev1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+	}
+
+	hostIDs, networkID, err := cs.verifyHosts(service, nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(hostIDs, []string{"vm-1"}) || networkID != "net-dmz" {
+		t.Errorf("verifyHosts() = %v, %q, want [vm-1], %q", hostIDs, networkID, "net-dmz")
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, eventReasonHostsWithoutNetwork) || !strings.Contains(event, "node-2") {
+			t.Errorf("event = %q, want %s for node-2", event, eventReasonHostsWithoutNetwork)
+		}
+	default:
+		t.Errorf("expected an event")
+	}
+}
+
+func TestFindFreeIPAddress(t *testing.T) {
+	ips := []*cloudstack.PublicIpAddress{
+		{Ipaddress: "203.0.113.1", State: "Allocated", Vlanid: "range-dmz", Vlanname: "vlan://100"},
+		{Ipaddress: "203.0.113.2", State: publicIPStateFree, Vlanid: "range-dmz", Vlanname: "vlan://100"},
+		{Ipaddress: "198.51.100.1", State: publicIPStateFree, Vlanid: "range-public", Vlanname: "vlan://200"},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantList    bool
+		want        string
+		wantErr     bool
+	}{
+		{name: "no annotation"},
+		{name: "IP range", annotations: map[string]string{ServiceAnnotationLoadBalancerIPRange: "range-dmz"}, wantList: true, want: "203.0.113.2"},
+		{name: "VLAN", annotations: map[string]string{ServiceAnnotationLoadBalancerIPVlan: "200"}, wantList: true, want: "198.51.100.1"},
+		{name: "no free IP", annotations: map[string]string{ServiceAnnotationLoadBalancerIPVlan: "300"}, wantList: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			listParams := &cloudstack.ListPublicIpAddressesParams{}
+			if tt.wantList {
+				mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+				mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+					Count:             len(ips),
+					PublicIpAddresses: ips,
+				}, nil)
+			}
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+				service:          &corev1.Service{ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations}},
+			}
+
+			got, err := lb.findFreeIPAddress("zone-1")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("findFreeIPAddress() = %q, want %q", got, tt.want)
+			}
+			if tt.wantList {
+				if zoneID, _ := listParams.GetZoneid(); zoneID != "zone-1" {
+					t.Errorf("lookup zone = %q, want %q", zoneID, "zone-1")
+				}
+			}
+		})
+	}
+}
+
+func TestCheckLoadBalancerNetwork(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     map[string]*cloudstack.LoadBalancerRule
+		secondary map[string]*cloudstack.LoadBalancerRule
+		wantEvent string
+	}{
+		{
+			name:  "rules in the selected network",
+			rules: map[string]*cloudstack.LoadBalancerRule{"lb-tcp-80": {Name: "lb-tcp-80", Networkid: "net-dmz"}},
+		},
+		{
+			name:      "rule in another network",
+			rules:     map[string]*cloudstack.LoadBalancerRule{"lb-tcp-80": {Name: "lb-tcp-80", Networkid: "net-1"}},
+			wantEvent: "Warning NetworkChangeRejected Load balancer rule lb-tcp-80 is in network net-1, but the service selects network net-dmz; recreate the service to move it",
+		},
+		{
+			name:      "secondary rule in another network",
+			secondary: map[string]*cloudstack.LoadBalancerRule{"lb-ipv6-tcp-80": {Name: "lb-ipv6-tcp-80", Networkid: "net-1"}},
+			wantEvent: "Warning NetworkChangeRejected Load balancer rule lb-ipv6-tcp-80 is in network net-1, but the service selects network net-dmz; recreate the service to move it",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			lb := &loadBalancer{
+				networkID:      "net-dmz",
+				rules:          tt.rules,
+				secondaryRules: tt.secondary,
+				service:        &corev1.Service{},
+				eventRecorder:  recorder,
+			}
+
+			err := lb.checkLoadBalancerNetwork()
+			if (err != nil) != (tt.wantEvent != "") {
+				t.Fatalf("checkLoadBalancerNetwork() error = %v", err)
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if event != tt.wantEvent {
+				t.Errorf("event = %q, want %q", event, tt.wantEvent)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerRetainIP is the annotation used on the service to keep the
+	// public IP associated when the service is deleted. The IP is reserved under the name of
+	// ServiceAnnotationLoadBalancerIPReservation, or else <namespace>/<name> of the service.
+	ServiceAnnotationLoadBalancerRetainIP = "service.beta.kubernetes.io/cloudstack-load-balancer-retain-ip"
+
+	// ServiceAnnotationLoadBalancerIPReservation is the annotation used on the service to name
+	// the reservation of its retained IP, and to claim the IP of an existing reservation.
+	ServiceAnnotationLoadBalancerIPReservation = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-reservation"
+
+	// tagIPReservation and tagIPReservedAt are the tags of a reserved IP, holding the name of
+	// the reservation and when it was made.
+	tagIPReservation = "kubernetes-ip-reservation"
+	tagIPReservedAt  = "kubernetes-ip-reserved-at"
+
+	// ipReservationReaperInterval is the time between two checks for expired reservations.
+	ipReservationReaperInterval = 10 * time.Minute
+)
+
+// ipReservationName returns the name the IP of a service is reserved under.
+func ipReservationName(service *corev1.Service) string {
+	if name := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPReservation, ""); name != "" {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+}
+
+// releaseOrRetainLoadBalancerIP releases the IP of a deleted service, or reserves it if the
+// service asked to retain it.
+func (lb *loadBalancer) releaseOrRetainLoadBalancerIP(service *corev1.Service) error {
+	if getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerRetainIP, false) {
+		return lb.reserveIPAddress(ipReservationName(service))
+	}
+	return lb.releaseLoadBalancerIP()
+}
+
+// releaseUnusedLoadBalancerIP releases an IP the load balancer failed to set up. An IP claimed
+// from a reservation is reserved again instead, so it is not lost.
+func (lb *loadBalancer) releaseUnusedLoadBalancerIP() error {
+	if lb.ipReservation != "" {
+		return lb.reserveIPAddress(lb.ipReservation)
+	}
+	return lb.releaseLoadBalancerIP()
+}
+
+// reserveIPAddress keeps the IP of the load balancer associated under a reservation name. The
+// tags of the service are removed, so the sweeper does not release the IP as orphaned.
+func (lb *loadBalancer) reserveIPAddress(name string) error {
+	ip, count, err := lb.Address.GetPublicIpAddressByID(lb.ipAddrID)
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find IP address %v to reserve", lb.ipAddr)
+		}
+		return fmt.Errorf("error retrieving IP address %v: %v", lb.ipAddr, err)
+	}
+
+	if err := lb.deleteIPAddressTags(ip, tagServiceNamespace, tagServiceName, tagServiceUID, tagIPReservation, tagIPReservedAt); err != nil {
+		return err
+	}
+
+	tags := map[string]string{
+		tagIPReservation: name,
+		tagIPReservedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if clusterName := lb.tags[tagClusterName]; clusterName != "" {
+		if _, ok := getTag(ip.Tags, tagClusterName); !ok {
+			tags[tagClusterName] = clusterName
+		}
+	}
+
+	p := lb.Resourcetags.NewCreateTagsParams([]string{ip.Id}, resourceTypePublicIPAddress, tags)
+	if _, err := lb.Resourcetags.CreateTags(p); err != nil {
+		return fmt.Errorf("error reserving IP address %v: %v", lb.ipAddr, err)
+	}
+
+	klog.V(4).Infof("Reserved IP address %v as %v", lb.ipAddr, name)
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonIPReserved, "Reserved IP address %v as %v", lb.ipAddr, name)
+
+	return nil
+}
+
+// claimReservedIPAddress takes over the IP reserved under a name, if it can be used in the
+// network of the load balancer. The IP is returned locked, together with the function that
+// unlocks it, which is nil if there is no such reservation.
+func (lb *loadBalancer) claimReservedIPAddress(name string) (func(), error) {
+	network, count, err := lb.Network.GetNetworkByID(lb.networkID, cloudstack.WithProject(lb.projectID))
+	if err != nil {
+		if count == 0 {
+			return nil, fmt.Errorf("could not find network %v", lb.networkID)
+		}
+		return nil, fmt.Errorf("error retrieving network: %v", err)
+	}
+
+	reservation := map[string]string{tagIPReservation: name}
+	if clusterName := lb.tags[tagClusterName]; clusterName != "" {
+		reservation[tagClusterName] = clusterName
+	}
+
+	p := lb.Address.NewListPublicIpAddressesParams()
+	p.SetTags(reservation)
+	p.SetListall(true)
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving IP addresses reserved as %v: %v", name, err)
+	}
+
+	for _, ip := range l.PublicIpAddresses {
+		// An IP is associated with a VPC, or else with an isolated network.
+		if (network.Vpcid != "" && ip.Vpcid != network.Vpcid) || (network.Vpcid == "" && ip.Associatednetworkid != network.Id) {
+			klog.Warningf("IP address %v reserved as %v is not usable in network %v", ip.Ipaddress, name, network.Name)
+			continue
+		}
+
+		// Another service may have claimed the IP, or the reaper released it, since the lookup.
+		unlock, locked, err := lb.lockIPAddress(ip.Id)
+		if err != nil {
+			return nil, err
+		}
+		if reserved, _ := getTag(locked.Tags, tagIPReservation); reserved != name {
+			unlock()
+			continue
+		}
+
+		if err := lb.takeOverReservedIPAddress(locked, name); err != nil {
+			unlock()
+			return nil, err
+		}
+		return unlock, nil
+	}
+
+	return nil, nil
+}
+
+// takeOverReservedIPAddress removes the reservation of an IP and tags it for the service.
+func (lb *loadBalancer) takeOverReservedIPAddress(ip *cloudstack.PublicIpAddress, name string) error {
+	if err := lb.deleteIPAddressTags(ip, tagIPReservation, tagIPReservedAt); err != nil {
+		return err
+	}
+
+	lb.ipAddr = ip.Ipaddress
+	lb.ipAddrID = ip.Id
+	lb.ipAssociatedByController = true
+	lb.ipReservation = name
+
+	tags := make(map[string]string)
+	for key, value := range lb.tags {
+		if _, ok := getTag(ip.Tags, key); !ok {
+			tags[key] = value
+		}
+	}
+	if len(tags) > 0 {
+		if _, err := lb.Resourcetags.CreateTags(lb.Resourcetags.NewCreateTagsParams([]string{ip.Id}, resourceTypePublicIPAddress, tags)); err != nil {
+			return fmt.Errorf("error tagging %v %v: %v", resourceTypePublicIPAddress, ip.Id, err)
+		}
+	}
+
+	klog.V(4).Infof("Claimed IP address %v reserved as %v", lb.ipAddr, name)
+	lb.recordEvent(corev1.EventTypeNormal, eventReasonIPReservationClaimed, "Claimed IP address %v reserved as %v", lb.ipAddr, name)
+
+	return nil
+}
+
+// deleteIPAddressTags deletes the tags with the given keys that are set on an IP.
+func (lb *loadBalancer) deleteIPAddressTags(ip *cloudstack.PublicIpAddress, keys ...string) error {
+	tags := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := getTag(ip.Tags, key); ok {
+			tags[key] = value
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	p := lb.Resourcetags.NewDeleteTagsParams([]string{ip.Id}, resourceTypePublicIPAddress)
+	p.SetTags(tags)
+	if _, err := lb.Resourcetags.DeleteTags(p); err != nil {
+		return fmt.Errorf("error deleting tags of IP address %v: %v", ip.Ipaddress, err)
+	}
+
+	return nil
+}
+
+// startIPReservationReaper periodically releases the reserved IPs that were not claimed within
+// the reserved IP TTL.
+func (cs *CSCloud) startIPReservationReaper(stop <-chan struct{}) {
+	if cs.clusterName == "" {
+		klog.Warningf("Cluster name is not set, reserved IP addresses will not expire")
+		return
+	}
+
+	klog.Infof("Starting IP reservation reaper (TTL %v)", cs.reservedIPTTL)
+	go wait.Until(func() {
+		if err := cs.releaseExpiredIPReservations(); err != nil {
+			klog.Errorf("Error releasing expired IP reservations: %v", err)
+		}
+	}, ipReservationReaperInterval, stop)
+}
+
+// releaseExpiredIPReservations releases the IPs of this cluster that have been reserved for
+// longer than the reserved IP TTL.
+func (cs *CSCloud) releaseExpiredIPReservations() error {
+	p := cs.client.Address.NewListPublicIpAddressesParams()
+	p.SetTags(map[string]string{tagClusterName: cs.clusterName})
+	p.SetListall(true)
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := cs.client.Address.ListPublicIpAddresses(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving public IP addresses: %v", err)
+	}
+
+	for _, ip := range l.PublicIpAddresses {
+		name, ok := getTag(ip.Tags, tagIPReservation)
+		if !ok {
+			continue
+		}
+
+		value, _ := getTag(ip.Tags, tagIPReservedAt)
+		reservedAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			klog.Warningf("IP address %v reserved as %v has an invalid reservation time %q", ip.Ipaddress, name, value)
+			continue
+		}
+		if time.Since(reservedAt) < cs.reservedIPTTL {
+			continue
+		}
+
+		if err := cs.releaseExpiredIPReservation(ip.Id, name, value); err != nil {
+			klog.Errorf("Error releasing expired IP address %v: %v", ip.Ipaddress, err)
+		}
+	}
+
+	return nil
+}
+
+// releaseExpiredIPReservation releases a reserved IP, unless its reservation changed since it was
+// listed, as a service may have claimed the IP or reserved it again in the meantime.
+func (cs *CSCloud) releaseExpiredIPReservation(id, name, reservedAt string) error {
+	unlock := cs.ipLocks.lock(id)
+	defer unlock()
+
+	ip, count, err := cs.client.Address.GetPublicIpAddressByID(id)
+	if err != nil {
+		if count == 0 {
+			return nil
+		}
+		return fmt.Errorf("error retrieving IP address %v: %v", id, err)
+	}
+	if current, _ := getTag(ip.Tags, tagIPReservation); current != name {
+		return nil
+	}
+	if current, _ := getTag(ip.Tags, tagIPReservedAt); current != reservedAt {
+		return nil
+	}
+
+	klog.Infof("Releasing IP address %v reserved as %v since %v", ip.Ipaddress, name, reservedAt)
+	return cs.releaseUnusedIPAddress(id)
+}
@@ -0,0 +1,304 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIPReservationName(t *testing.T) {
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "blue", Name: "web"}}
+	if got := ipReservationName(service); got != "blue/web" {
+		t.Errorf("ipReservationName() = %q, want %q", got, "blue/web")
+	}
+
+	service.Annotations = map[string]string{ServiceAnnotationLoadBalancerIPReservation: "web-ip"}
+	if got := ipReservationName(service); got != "web-ip" {
+		t.Errorf("ipReservationName() = %q, want %q", got, "web-ip")
+	}
+}
+
+func TestReleaseOrRetainLoadBalancerIP(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "blue", Name: "web", UID: "uid-1"},
+	}
+
+	t.Run("release", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		disassociateParams := &cloudstack.DisassociateIpAddressParams{}
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-1").Return(disassociateParams)
+		mockAddress.EXPECT().DisassociateIpAddress(disassociateParams).Return(&cloudstack.DisassociateIpAddressResponse{}, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+			ipAddr:           "203.0.113.1",
+			ipAddrID:         "ip-1",
+		}
+
+		if err := lb.releaseOrRetainLoadBalancerIP(service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("retain", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+		retained := service.DeepCopy()
+		retained.Annotations = map[string]string{
+			ServiceAnnotationLoadBalancerRetainIP:      "true",
+			ServiceAnnotationLoadBalancerIPReservation: "web-ip",
+		}
+		ip := &cloudstack.PublicIpAddress{
+			Id:        "ip-1",
+			Ipaddress: "203.0.113.1",
+			Tags: []cloudstack.Tags{
+				{Key: tagClusterName, Value: "prod"},
+				{Key: tagServiceNamespace, Value: "blue"},
+				{Key: tagServiceName, Value: "web"},
+				{Key: tagServiceUID, Value: "uid-1"},
+			},
+		}
+
+		deleteParams := &cloudstack.DeleteTagsParams{}
+		var createdTags map[string]string
+		gomock.InOrder(
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-1").Return(ip, 1, nil),
+			mockTags.EXPECT().NewDeleteTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress).Return(deleteParams),
+			mockTags.EXPECT().DeleteTags(deleteParams).Return(&cloudstack.DeleteTagsResponse{}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress, gomock.Any()).DoAndReturn(
+				func(_ []string, _ string, tags map[string]string) *cloudstack.CreateTagsParams {
+					createdTags = tags
+					return &cloudstack.CreateTagsParams{}
+				}),
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, Resourcetags: mockTags},
+			ipAddr:           "203.0.113.1",
+			ipAddrID:         "ip-1",
+			tags:             serviceTags("prod", retained),
+		}
+
+		if err := lb.releaseOrRetainLoadBalancerIP(retained); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		deleted, _ := deleteParams.GetTags()
+		wantDeleted := map[string]string{tagServiceNamespace: "blue", tagServiceName: "web", tagServiceUID: "uid-1"}
+		if !reflect.DeepEqual(deleted, wantDeleted) {
+			t.Errorf("deleted tags = %v, want %v", deleted, wantDeleted)
+		}
+
+		if createdTags[tagIPReservation] != "web-ip" {
+			t.Errorf("reservation = %q, want %q", createdTags[tagIPReservation], "web-ip")
+		}
+		if _, err := time.Parse(time.RFC3339, createdTags[tagIPReservedAt]); err != nil {
+			t.Errorf("invalid reservation time %q: %v", createdTags[tagIPReservedAt], err)
+		}
+		if _, ok := createdTags[tagClusterName]; ok {
+			t.Errorf("cluster tag set again: %v", createdTags)
+		}
+	})
+}
+
+func TestClaimReservedIPAddress(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "green", Name: "web", UID: "uid-2"},
+	}
+	reservedTags := []cloudstack.Tags{
+		{Key: tagClusterName, Value: "prod"},
+		{Key: tagIPReservation, Value: "web-ip"},
+		{Key: tagIPReservedAt, Value: "2026-01-01T00:00:00Z"},
+	}
+
+	tests := []struct {
+		name             string
+		ips              []*cloudstack.PublicIpAddress
+		claimedMeanwhile bool
+		wantClaimed      bool
+	}{
+		{
+			name:        "reserved IP in the VPC",
+			ips:         []*cloudstack.PublicIpAddress{{Id: "ip-1", Ipaddress: "203.0.113.1", Vpcid: "vpc-1", Tags: reservedTags}},
+			wantClaimed: true,
+		},
+		{
+			name: "reserved IP in another VPC",
+			ips:  []*cloudstack.PublicIpAddress{{Id: "ip-1", Ipaddress: "203.0.113.1", Vpcid: "vpc-2", Tags: reservedTags}},
+		},
+		{
+			name: "no reservation",
+		},
+		{
+			name:             "claimed by another service since the lookup",
+			ips:              []*cloudstack.PublicIpAddress{{Id: "ip-1", Ipaddress: "203.0.113.1", Vpcid: "vpc-1", Tags: reservedTags}},
+			claimedMeanwhile: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+			mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+			listParams := &cloudstack.ListPublicIpAddressesParams{}
+			mockNetwork.EXPECT().GetNetworkByID("net-1", gomock.Any()).Return(&cloudstack.Network{Id: "net-1", Name: "tier-1", Vpcid: "vpc-1"}, 1, nil)
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+			mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             len(tt.ips),
+				PublicIpAddresses: tt.ips,
+			}, nil)
+
+			deleteParams := &cloudstack.DeleteTagsParams{}
+			createParams := &cloudstack.CreateTagsParams{}
+			if tt.claimedMeanwhile {
+				expectLockIPAddress(mockAddress, &cloudstack.PublicIpAddress{Id: "ip-1", Ipaddress: "203.0.113.1", Vpcid: "vpc-1", Tags: []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-3"}}})
+			}
+			if tt.wantClaimed {
+				expectLockIPAddress(mockAddress, tt.ips[0])
+				mockTags.EXPECT().NewDeleteTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress).Return(deleteParams)
+				mockTags.EXPECT().DeleteTags(deleteParams).Return(&cloudstack.DeleteTagsResponse{}, nil)
+				mockTags.EXPECT().NewCreateTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress, map[string]string{
+					tagServiceNamespace: "green",
+					tagServiceName:      "web",
+					tagServiceUID:       "uid-2",
+				}).Return(createParams)
+				mockTags.EXPECT().CreateTags(createParams).Return(&cloudstack.CreateTagsResponse{}, nil)
+			}
+
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, Network: mockNetwork, Resourcetags: mockTags},
+				networkID:        "net-1",
+				tags:             serviceTags("prod", service),
+				ipLocks:          &keyedMutex{},
+			}
+
+			unlock, err := lb.claimReservedIPAddress("web-ip")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if claimed := unlock != nil; claimed != tt.wantClaimed {
+				t.Fatalf("claimed = %v, want %v", claimed, tt.wantClaimed)
+			}
+			if unlock != nil {
+				unlock()
+			}
+
+			listTags, _ := listParams.GetTags()
+			if want := map[string]string{tagIPReservation: "web-ip", tagClusterName: "prod"}; !reflect.DeepEqual(listTags, want) {
+				t.Errorf("lookup tags = %v, want %v", listTags, want)
+			}
+
+			if !tt.wantClaimed {
+				return
+			}
+			if lb.ipAddr != "203.0.113.1" || lb.ipAddrID != "ip-1" || !lb.ipAssociatedByController || lb.ipReservation != "web-ip" {
+				t.Errorf("load balancer IP = %q (%q), associated by controller %v, reservation %q", lb.ipAddr, lb.ipAddrID, lb.ipAssociatedByController, lb.ipReservation)
+			}
+			deleted, _ := deleteParams.GetTags()
+			if want := map[string]string{tagIPReservation: "web-ip", tagIPReservedAt: "2026-01-01T00:00:00Z"}; !reflect.DeepEqual(deleted, want) {
+				t.Errorf("deleted tags = %v, want %v", deleted, want)
+			}
+		})
+	}
+}
+
+func TestReleaseExpiredIPReservations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+
+	reserved := func(at time.Time) []cloudstack.Tags {
+		return []cloudstack.Tags{
+			{Key: tagClusterName, Value: "prod"},
+			{Key: tagIPReservation, Value: "web-ip"},
+			{Key: tagIPReservedAt, Value: at.UTC().Format(time.RFC3339)},
+		}
+	}
+
+	expired := &cloudstack.PublicIpAddress{Id: "ip-expired", Ipaddress: "203.0.113.1", Tags: reserved(time.Now().Add(-2 * time.Hour))}
+
+	listParams := &cloudstack.ListPublicIpAddressesParams{}
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams)
+	mockAddress.EXPECT().ListPublicIpAddresses(listParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+		Count: 5,
+		PublicIpAddresses: []*cloudstack.PublicIpAddress{
+			expired,
+			{Id: "ip-claimed", Ipaddress: "203.0.113.5", Tags: reserved(time.Now().Add(-2 * time.Hour))},
+			{Id: "ip-fresh", Ipaddress: "203.0.113.2", Tags: reserved(time.Now())},
+			{Id: "ip-in-use", Ipaddress: "203.0.113.3", Tags: []cloudstack.Tags{{Key: tagClusterName, Value: "prod"}}},
+			{Id: "ip-invalid", Ipaddress: "203.0.113.4", Tags: []cloudstack.Tags{{Key: tagIPReservation, Value: "db-ip"}, {Key: tagIPReservedAt, Value: "yesterday"}}},
+		},
+	}, nil)
+
+	rulesParams := &cloudstack.ListLoadBalancerRulesParams{}
+	disassociateParams := &cloudstack.DisassociateIpAddressParams{}
+	gomock.InOrder(
+		mockAddress.EXPECT().GetPublicIpAddressByID("ip-expired").Return(expired, 1, nil),
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(rulesParams),
+		mockLB.EXPECT().ListLoadBalancerRules(rulesParams).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil),
+		mockAddress.EXPECT().NewDisassociateIpAddressParams("ip-expired").Return(disassociateParams),
+		mockAddress.EXPECT().DisassociateIpAddress(disassociateParams).Return(&cloudstack.DisassociateIpAddressResponse{}, nil),
+	)
+	// A service claimed the IP since it was listed, so it is kept.
+	mockAddress.EXPECT().GetPublicIpAddressByID("ip-claimed").Return(&cloudstack.PublicIpAddress{
+		Id:        "ip-claimed",
+		Ipaddress: "203.0.113.5",
+		Tags:      []cloudstack.Tags{{Key: tagClusterName, Value: "prod"}, {Key: tagServiceUID, Value: "uid-1"}},
+	}, 1, nil)
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			Address:      mockAddress,
+			LoadBalancer: mockLB,
+		},
+		clusterName:   "prod",
+		reservedIPTTL: time.Hour,
+	}
+
+	if err := cs.releaseExpiredIPReservations(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if tags, _ := listParams.GetTags(); !reflect.DeepEqual(tags, map[string]string{tagClusterName: "prod"}) {
+		t.Errorf("lookup tags = %v, want the cluster tag", tags)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerIPSharingKey is the annotation used on the services that share
+	// a public IP. All services using the IP must have the same key.
+	ServiceAnnotationLoadBalancerIPSharingKey = "service.beta.kubernetes.io/cloudstack-load-balancer-ip-sharing-key"
+
+	// tagIPSharingKey is the tag holding the sharing key of a public IP.
+	tagIPSharingKey = "kubernetes-ip-sharing-key"
+
+	// tagIPSharerPrefix prefixes the UID of every service using a public IP, in the tags that
+	// count the services sharing it. The value is the cluster, namespace and name of the service.
+	tagIPSharerPrefix = "kubernetes-ip-sharer-"
+
+	// tagIPReleaseWithLastSharer is set on a public IP that is released when its last sharer is
+	// deleted, because the service it was associated for was deleted while others still used it.
+	tagIPReleaseWithLastSharer = "kubernetes-ip-release-with-last-sharer"
+)
+
+// keyedMutex serializes operations per key, such as the changes to a shared public IP.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks the key and returns the function that unlocks it.
+func (m *keyedMutex) lock(key string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedMutexEntry)
+	}
+	e, ok := m.locks[key]
+	if !ok {
+		e = &keyedMutexEntry{}
+		m.locks[key] = e
+	}
+	e.refs++
+	m.mu.Unlock()
+
+	e.mu.Lock()
+
+	return func() {
+		e.mu.Unlock()
+
+		m.mu.Lock()
+		e.refs--
+		if e.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// shareIPAddress registers the service as a user of the public IP of the load balancer. It fails
+// if other services use the IP under another sharing key, or use one of the ports of the service.
+func (lb *loadBalancer) shareIPAddress(service *corev1.Service) error {
+	ip, count, err := lb.Address.GetPublicIpAddressByID(lb.ipAddrID)
+	if err != nil {
+		if count == 0 {
+			return fmt.Errorf("could not find IP address %v", lb.ipAddr)
+		}
+		return fmt.Errorf("error retrieving IP address %v: %v", lb.ipAddr, err)
+	}
+
+	otherRules, err := lb.otherLoadBalancerRules()
+	if err != nil {
+		return err
+	}
+
+	sharerTag := tagIPSharerPrefix + lb.tags[tagServiceUID]
+	sharers := ipSharers(ip.Tags, sharerTag)
+
+	key := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerIPSharingKey, "")
+	ipKey, hasKey := getTag(ip.Tags, tagIPSharingKey)
+
+	tags := make(map[string]string)
+
+	if len(otherRules) > 0 || len(sharers) > 0 {
+		if (key != "" || hasKey) && key != ipKey {
+			return fmt.Errorf("IP address %v is shared by other services with sharing key %q, the service has sharing key %q", lb.ipAddr, ipKey, key)
+		}
+		if key == "" {
+			klog.Warningf("IP address %v is shared without a sharing key, set the %v annotation on the services sharing it", lb.ipAddr, ServiceAnnotationLoadBalancerIPSharingKey)
+		}
+
+		if err := checkPortConflicts(service, otherRules, lb.ipAddr); err != nil {
+			return err
+		}
+	} else if key != ipKey {
+		// The service is the only user of the IP, so it sets the sharing key.
+		if err := lb.deleteIPAddressTags(ip, tagIPSharingKey); err != nil {
+			return err
+		}
+		if key != "" {
+			tags[tagIPSharingKey] = key
+		}
+	}
+
+	if lb.tags[tagServiceUID] != "" {
+		if _, ok := getTag(ip.Tags, sharerTag); !ok {
+			tags[sharerTag] = ipSharerValue(lb.tags[tagClusterName], service)
+		}
+	}
+
+	if len(tags) > 0 {
+		if _, err := lb.Resourcetags.CreateTags(lb.Resourcetags.NewCreateTagsParams([]string{ip.Id}, resourceTypePublicIPAddress, tags)); err != nil {
+			return fmt.Errorf("error tagging %v %v: %v", resourceTypePublicIPAddress, ip.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// unshareIPAddress removes the service from the users of the public IP of the load balancer,
+// once its rules are deleted. It returns the number of services still using the IP, and whether
+// the IP is to be released. If it is to be released but still used, the release is handed over
+// to the last service using it.
+func (lb *loadBalancer) unshareIPAddress(release bool) (int, bool, error) {
+	ip, count, err := lb.Address.GetPublicIpAddressByID(lb.ipAddrID)
+	if err != nil {
+		if count == 0 {
+			return 0, false, fmt.Errorf("could not find IP address %v", lb.ipAddr)
+		}
+		return 0, false, fmt.Errorf("error retrieving IP address %v: %v", lb.ipAddr, err)
+	}
+
+	sharerTag := tagIPSharerPrefix + lb.tags[tagServiceUID]
+	if err := lb.deleteIPAddressTags(ip, sharerTag); err != nil {
+		return 0, false, err
+	}
+
+	otherRules, err := lb.otherLoadBalancerRules()
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Count the services still using the IP, by their sharer tags and by the rules left on the IP.
+	users := make(map[string]bool)
+	for tag, value := range ipSharers(ip.Tags, sharerTag) {
+		// A service deleted while the controller was down leaves its sharer tag behind.
+		if lb.isStaleIPSharer != nil && lb.isStaleIPSharer(tag, value) {
+			klog.V(4).Infof("Deleting sharer tag %v of deleted service %v from IP %v", tag, value, lb.ipAddr)
+			if err := lb.deleteIPAddressTags(ip, tag); err != nil {
+				return 0, false, err
+			}
+			continue
+		}
+		users[strings.TrimPrefix(tag, tagIPSharerPrefix)] = true
+	}
+	for _, lbRule := range otherRules {
+		if uid, ok := getTag(lbRule.Tags, tagServiceUID); ok {
+			users[uid] = true
+		} else {
+			users[lbRule.Id] = true
+		}
+	}
+
+	_, handedOver := getTag(ip.Tags, tagIPReleaseWithLastSharer)
+
+	if len(users) > 0 && release && !handedOver {
+		// Drop the tags of the service the IP was associated for, so the sweeper does not treat
+		// the IP as orphaned while it is still in use.
+		if uid, _ := getTag(ip.Tags, tagServiceUID); uid != "" && uid == lb.tags[tagServiceUID] {
+			if err := lb.deleteIPAddressTags(ip, tagServiceNamespace, tagServiceName, tagServiceUID); err != nil {
+				return 0, false, err
+			}
+		}
+
+		tags := map[string]string{tagIPReleaseWithLastSharer: "true"}
+		if _, err := lb.Resourcetags.CreateTags(lb.Resourcetags.NewCreateTagsParams([]string{ip.Id}, resourceTypePublicIPAddress, tags)); err != nil {
+			return 0, false, fmt.Errorf("error tagging %v %v: %v", resourceTypePublicIPAddress, ip.Id, err)
+		}
+	}
+
+	return len(users), release || handedOver, nil
+}
+
+// otherLoadBalancerRules returns the load balancer rules on the public IP that do not belong to
+// the load balancer.
+func (lb *loadBalancer) otherLoadBalancerRules() ([]*cloudstack.LoadBalancerRule, error) {
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetPublicipid(lb.ipAddrID)
+	p.SetListall(true)
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving load balancer rules of IP %v: %v", lb.ipAddr, err)
+	}
+
+	own := make(map[string]bool)
+	for _, lbRule := range lb.rules {
+		own[lbRule.Id] = true
+	}
+
+	var rules []*cloudstack.LoadBalancerRule
+	for _, lbRule := range l.LoadBalancerRules {
+		if !own[lbRule.Id] {
+			rules = append(rules, lbRule)
+		}
+	}
+
+	return rules, nil
+}
+
+// ipSharers returns the sharer tags of the services using an IP, except the given one.
+func ipSharers(tags []cloudstack.Tags, except string) map[string]string {
+	sharers := make(map[string]string)
+	for _, tag := range tags {
+		if strings.HasPrefix(tag.Key, tagIPSharerPrefix) && tag.Key != except {
+			sharers[tag.Key] = tag.Value
+		}
+	}
+	return sharers
+}
+
+// ipSharerValue returns the value of the sharer tag of a service.
+func ipSharerValue(clusterName string, service *corev1.Service) string {
+	return fmt.Sprintf("%s/%s/%s", clusterName, service.Namespace, service.Name)
+}
+
+// parseIPSharerValue returns the cluster, namespace and name of the service of a sharer tag.
+func parseIPSharerValue(value string) (string, string, string, bool) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
+
+// isStaleIPSharer returns true if a sharer tag of a public IP belongs to a service of this
+// cluster that no longer exists as a LoadBalancer service. The services of other clusters are
+// unknown, and the service cache may be incomplete until it is synced, so their sharer tags are
+// never stale.
+func (cs *CSCloud) isStaleIPSharer(key, value string) bool {
+	if cs.serviceLister == nil || cs.servicesSynced == nil || !cs.servicesSynced() {
+		return false
+	}
+
+	clusterName, namespace, name, ok := parseIPSharerValue(value)
+	if !ok || clusterName != cs.clusterName {
+		return false
+	}
+
+	service, err := cs.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		return apierrors.IsNotFound(err)
+	}
+	return string(service.UID) != strings.TrimPrefix(key, tagIPSharerPrefix) || service.Spec.Type != corev1.ServiceTypeLoadBalancer
+}
+
+// checkPortConflicts returns an error if a port of the service is used by a load balancer rule of
+// another service on the same IP.
+func checkPortConflicts(service *corev1.Service, otherRules []*cloudstack.LoadBalancerRule, ipAddr string) error {
+	for _, port := range service.Spec.Ports {
+		protocol := ProtocolFromServicePort(port, service).IPProtocol()
+		for _, lbRule := range otherRules {
+			if lbRule.Publicport != strconv.Itoa(int(port.Port)) || ProtocolFromLoadBalancer(lbRule.Protocol).IPProtocol() != protocol {
+				continue
+			}
+
+			namespace, _ := getTag(lbRule.Tags, tagServiceNamespace)
+			name, _ := getTag(lbRule.Tags, tagServiceName)
+			return fmt.Errorf("port %d/%v of IP address %v is already used by load balancer rule %v of service %v/%v", port.Port, protocol, ipAddr, lbRule.Name, namespace, name)
+		}
+	}
+	return nil
+}
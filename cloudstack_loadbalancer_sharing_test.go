@@ -0,0 +1,374 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var m keyedMutex
+
+	unlock := m.lock("ip-1")
+
+	// Another key is not blocked.
+	m.lock("ip-2")()
+
+	locked := make(chan struct{})
+	go func() {
+		defer m.lock("ip-1")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		t.Fatalf("second lock of the same key did not block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatalf("second lock of the same key was not released")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.locks) != 0 {
+		t.Errorf("locks not cleaned up: %v", m.locks)
+	}
+}
+
+func TestCheckPortConflicts(t *testing.T) {
+	service := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Port: 53, Protocol: corev1.ProtocolUDP}},
+		},
+	}
+
+	tcpRule := &cloudstack.LoadBalancerRule{Name: "dns-tcp", Publicport: "53", Protocol: "tcp"}
+	if err := checkPortConflicts(service, []*cloudstack.LoadBalancerRule{tcpRule}, "203.0.113.1"); err != nil {
+		t.Errorf("unexpected conflict between UDP and TCP: %v", err)
+	}
+
+	udpRule := &cloudstack.LoadBalancerRule{
+		Name:       "dns-udp",
+		Publicport: "53",
+		Protocol:   "udp",
+		Tags: []cloudstack.Tags{
+			{Key: tagServiceNamespace, Value: "kube-system"},
+			{Key: tagServiceName, Value: "dns"},
+		},
+	}
+	err := checkPortConflicts(service, []*cloudstack.LoadBalancerRule{tcpRule, udpRule}, "203.0.113.1")
+	if err == nil || !strings.Contains(err.Error(), "kube-system/dns") {
+		t.Errorf("checkPortConflicts() error = %v, want a conflict with kube-system/dns", err)
+	}
+}
+
+func TestShareIPAddress(t *testing.T) {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	ownRule := &cloudstack.LoadBalancerRule{Id: "rule-own", Name: "web-tcp-80", Publicport: "80", Protocol: "tcp"}
+	otherRule := func(port string) *cloudstack.LoadBalancerRule {
+		return &cloudstack.LoadBalancerRule{
+			Id:         "rule-other",
+			Name:       "api-tcp-" + port,
+			Publicport: port,
+			Protocol:   "tcp",
+			Tags:       []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-2"}},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		key         string
+		ipTags      []cloudstack.Tags
+		rules       []*cloudstack.LoadBalancerRule
+		wantTags    map[string]string
+		wantErr     string
+		wantDeleted bool
+	}{
+		{
+			name:     "only user sets the sharing key",
+			key:      "frontend",
+			rules:    []*cloudstack.LoadBalancerRule{ownRule},
+			wantTags: map[string]string{tagIPSharingKey: "frontend", tagIPSharerPrefix + "uid-1": "prod/default/web"},
+		},
+		{
+			name:        "only user changes the sharing key",
+			key:         "frontend",
+			ipTags:      []cloudstack.Tags{{Key: tagIPSharingKey, Value: "old"}, {Key: tagIPSharerPrefix + "uid-1", Value: "prod/default/web"}},
+			wantTags:    map[string]string{tagIPSharingKey: "frontend"},
+			wantDeleted: true,
+		},
+		{
+			name:     "shared with the same key",
+			key:      "frontend",
+			ipTags:   []cloudstack.Tags{{Key: tagIPSharingKey, Value: "frontend"}, {Key: tagIPSharerPrefix + "uid-2", Value: "prod/default/api"}},
+			rules:    []*cloudstack.LoadBalancerRule{otherRule("443")},
+			wantTags: map[string]string{tagIPSharerPrefix + "uid-1": "prod/default/web"},
+		},
+		{
+			name:    "shared with another key",
+			key:     "frontend",
+			ipTags:  []cloudstack.Tags{{Key: tagIPSharingKey, Value: "backend"}, {Key: tagIPSharerPrefix + "uid-2", Value: "prod/default/api"}},
+			rules:   []*cloudstack.LoadBalancerRule{otherRule("443")},
+			wantErr: "sharing key",
+		},
+		{
+			name:    "port used by another service",
+			key:     "frontend",
+			ipTags:  []cloudstack.Tags{{Key: tagIPSharingKey, Value: "frontend"}},
+			rules:   []*cloudstack.LoadBalancerRule{otherRule("80")},
+			wantErr: "already used",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-1").Return(&cloudstack.PublicIpAddress{Id: "ip-1", Ipaddress: "203.0.113.1", Tags: tt.ipTags}, 1, nil)
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count:             len(tt.rules),
+				LoadBalancerRules: tt.rules,
+			}, nil)
+			if tt.wantDeleted {
+				deleteParams := &cloudstack.DeleteTagsParams{}
+				mockTags.EXPECT().NewDeleteTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress).Return(deleteParams)
+				mockTags.EXPECT().DeleteTags(deleteParams).Return(&cloudstack.DeleteTagsResponse{}, nil)
+			}
+			if tt.wantTags != nil {
+				createParams := &cloudstack.CreateTagsParams{}
+				mockTags.EXPECT().NewCreateTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress, tt.wantTags).Return(createParams)
+				mockTags.EXPECT().CreateTags(createParams).Return(&cloudstack.CreateTagsResponse{}, nil)
+			}
+
+			svc := service.DeepCopy()
+			svc.Annotations = map[string]string{ServiceAnnotationLoadBalancerIPSharingKey: tt.key}
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB, Resourcetags: mockTags},
+				ipAddr:           "203.0.113.1",
+				ipAddrID:         "ip-1",
+				rules:            map[string]*cloudstack.LoadBalancerRule{ownRule.Name: ownRule},
+				tags:             serviceTags("prod", svc),
+			}
+
+			err := lb.shareIPAddress(svc)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("shareIPAddress() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestUnshareIPAddress(t *testing.T) {
+	ownSharer := cloudstack.Tags{Key: tagIPSharerPrefix + "uid-1", Value: "prod/default/web"}
+	otherSharer := cloudstack.Tags{Key: tagIPSharerPrefix + "uid-2", Value: "prod/default/api"}
+	staleSharer := cloudstack.Tags{Key: tagIPSharerPrefix + "uid-3", Value: "prod/default/deleted"}
+	otherClusterSharer := cloudstack.Tags{Key: tagIPSharerPrefix + "uid-4", Value: "staging/default/deleted"}
+	ownerTags := []cloudstack.Tags{
+		{Key: tagServiceNamespace, Value: "default"},
+		{Key: tagServiceName, Value: "web"},
+		{Key: tagServiceUID, Value: "uid-1"},
+	}
+
+	tests := []struct {
+		name        string
+		release     bool
+		ipTags      []cloudstack.Tags
+		rules       []*cloudstack.LoadBalancerRule
+		wantDeletes []map[string]string
+		wantHandOff bool
+		wantUsers   int
+		wantRelease bool
+	}{
+		{
+			name:        "last user releases",
+			release:     true,
+			ipTags:      []cloudstack.Tags{ownSharer},
+			wantDeletes: []map[string]string{{ownSharer.Key: ownSharer.Value}},
+			wantRelease: true,
+		},
+		{
+			name:    "other users hand the release over",
+			release: true,
+			ipTags:  append([]cloudstack.Tags{ownSharer, otherSharer}, ownerTags...),
+			wantDeletes: []map[string]string{
+				{ownSharer.Key: ownSharer.Value},
+				{tagServiceNamespace: "default", tagServiceName: "web", tagServiceUID: "uid-1"},
+			},
+			wantHandOff: true,
+			wantUsers:   1,
+			wantRelease: true,
+		},
+		{
+			name:        "untagged rules of other services are counted",
+			ipTags:      []cloudstack.Tags{ownSharer},
+			rules:       []*cloudstack.LoadBalancerRule{{Id: "legacy-rule"}},
+			wantDeletes: []map[string]string{{ownSharer.Key: ownSharer.Value}},
+			wantUsers:   1,
+		},
+		{
+			name:        "last user releases a handed over IP",
+			ipTags:      []cloudstack.Tags{ownSharer, {Key: tagIPReleaseWithLastSharer, Value: "true"}},
+			wantDeletes: []map[string]string{{ownSharer.Key: ownSharer.Value}},
+			wantRelease: true,
+		},
+		{
+			name:    "sharers of deleted services are pruned",
+			release: true,
+			ipTags:  []cloudstack.Tags{ownSharer, staleSharer},
+			wantDeletes: []map[string]string{
+				{ownSharer.Key: ownSharer.Value},
+				{staleSharer.Key: staleSharer.Value},
+			},
+			wantRelease: true,
+		},
+		{
+			name:        "sharers of other clusters are kept",
+			release:     true,
+			ipTags:      []cloudstack.Tags{ownSharer, otherClusterSharer},
+			wantDeletes: []map[string]string{{ownSharer.Key: ownSharer.Value}},
+			wantHandOff: true,
+			wantUsers:   1,
+			wantRelease: true,
+		},
+		{
+			name: "requested IP is kept",
+		},
+	}
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "api", UID: "uid-2"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cs := &CSCloud{
+		clusterName:    "prod",
+		serviceLister:  corelisters.NewServiceLister(indexer),
+		servicesSynced: func() bool { return true },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			t.Cleanup(ctrl.Finish)
+
+			mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+			mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+			mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+			mockAddress.EXPECT().GetPublicIpAddressByID("ip-1").Return(&cloudstack.PublicIpAddress{Id: "ip-1", Ipaddress: "203.0.113.1", Tags: tt.ipTags}, 1, nil)
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{})
+			mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+				Count:             len(tt.rules),
+				LoadBalancerRules: tt.rules,
+			}, nil)
+
+			var deleted []map[string]string
+			mockTags.EXPECT().NewDeleteTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress).Return(&cloudstack.DeleteTagsParams{}).Times(len(tt.wantDeletes))
+			mockTags.EXPECT().DeleteTags(gomock.Any()).DoAndReturn(func(p *cloudstack.DeleteTagsParams) (*cloudstack.DeleteTagsResponse, error) {
+				tags, _ := p.GetTags()
+				deleted = append(deleted, tags)
+				return &cloudstack.DeleteTagsResponse{}, nil
+			}).Times(len(tt.wantDeletes))
+			if tt.wantHandOff {
+				createParams := &cloudstack.CreateTagsParams{}
+				mockTags.EXPECT().NewCreateTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress, map[string]string{tagIPReleaseWithLastSharer: "true"}).Return(createParams)
+				mockTags.EXPECT().CreateTags(createParams).Return(&cloudstack.CreateTagsResponse{}, nil)
+			}
+
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"}}
+			lb := &loadBalancer{
+				CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress, LoadBalancer: mockLB, Resourcetags: mockTags},
+				ipAddr:           "203.0.113.1",
+				ipAddrID:         "ip-1",
+				rules:            map[string]*cloudstack.LoadBalancerRule{},
+				tags:             serviceTags("prod", service),
+				isStaleIPSharer:  cs.isStaleIPSharer,
+			}
+
+			users, release, err := lb.unshareIPAddress(tt.release)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if users != tt.wantUsers || release != tt.wantRelease {
+				t.Errorf("unshareIPAddress() = %d, %v, want %d, %v", users, release, tt.wantUsers, tt.wantRelease)
+			}
+			if len(tt.wantDeletes) > 0 && !reflect.DeepEqual(deleted, tt.wantDeletes) {
+				t.Errorf("deleted tags = %v, want %v", deleted, tt.wantDeletes)
+			}
+		})
+	}
+}
+
+func TestReleasePublicLoadBalancerIPUnshareError(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockAddress.EXPECT().GetPublicIpAddressByID("ip-1").Return(nil, -1, fmt.Errorf("API error"))
+
+	service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "uid-1"}}
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{Address: mockAddress},
+		ipAddr:           "203.0.113.1",
+		ipAddrID:         "ip-1",
+		tags:             serviceTags("prod", service),
+	}
+
+	cs := &CSCloud{}
+	if err := cs.releasePublicLoadBalancerIP(lb, service); err == nil {
+		t.Fatalf("expected error")
+	}
+}
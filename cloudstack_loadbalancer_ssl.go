@@ -0,0 +1,450 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerSSLCertSecret is the annotation used on the
+	// service to terminate TLS on the CloudStack load balancer. The value is the
+	// name of a kubernetes.io/tls Secret in the namespace of the service.
+	ServiceAnnotationLoadBalancerSSLCertSecret = "service.beta.kubernetes.io/cloudstack-load-balancer-ssl-cert-secret"
+
+	// ServiceAnnotationLoadBalancerSSLPorts is the annotation used on the service
+	// to select the ports that terminate TLS. The value is a comma-separated list
+	// of port numbers or names. If not specified, all TCP ports terminate TLS.
+	ServiceAnnotationLoadBalancerSSLPorts = "service.beta.kubernetes.io/cloudstack-load-balancer-ssl-ports"
+)
+
+// sslCertificate is a certificate that is uploaded to CloudStack for a load balancer.
+type sslCertificate struct {
+	name        string
+	certificate string
+	certChain   string
+	privateKey  string
+}
+
+// isSSLPort returns true if the service port should terminate TLS on the load balancer.
+func isSSLPort(port corev1.ServicePort, service *corev1.Service) bool {
+	if getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerSSLCertSecret, "") == "" {
+		return false
+	}
+
+	ports := strings.TrimSpace(getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerSSLPorts, "*"))
+	if ports == "*" {
+		return true
+	}
+
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if p == port.Name || p == strconv.Itoa(int(port.Port)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getSSLCertificate reads the TLS secret referenced by the service, or returns nil
+// if the service does not terminate TLS on the load balancer.
+//
+// The certificate is named after the load balancer and a digest of its content,
+// so a changed secret results in a new certificate that replaces the old one.
+func (cs *CSCloud) getSSLCertificate(ctx context.Context, service *corev1.Service, lbName string) (*sslCertificate, error) {
+	secretName := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerSSLCertSecret, "")
+	if secretName == "" {
+		return nil, nil
+	}
+
+	if cs.clientBuilder == nil {
+		return nil, fmt.Errorf("clientBuilder not initialized, cannot read secret %s/%s", service.Namespace, secretName)
+	}
+
+	client, err := cs.clientBuilder.Client("cloud-controller-manager")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Kubernetes client: %v", err)
+	}
+
+	secret, err := client.CoreV1().Secrets(service.Namespace).Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %v", service.Namespace, secretName, err)
+	}
+
+	return newSSLCertificate(secret, lbName)
+}
+
+// newSSLCertificate converts a kubernetes.io/tls secret into a CloudStack certificate. The
+// first certificate in tls.crt is the server certificate, any further ones form the chain.
+func newSSLCertificate(secret *corev1.Secret, lbName string) (*sslCertificate, error) {
+	if secret.Type != corev1.SecretTypeTLS {
+		return nil, fmt.Errorf("secret %s/%s is of type %s, expected %s", secret.Namespace, secret.Name, secret.Type, corev1.SecretTypeTLS)
+	}
+
+	crt := secret.Data[corev1.TLSCertKey]
+	key := secret.Data[corev1.TLSPrivateKeyKey]
+	if len(crt) == 0 || len(key) == 0 {
+		return nil, fmt.Errorf("secret %s/%s does not contain %s and %s", secret.Namespace, secret.Name, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+	}
+
+	var blocks []string
+	for rest := crt; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			blocks = append(blocks, string(pem.EncodeToMemory(block)))
+		}
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("secret %s/%s does not contain a PEM encoded certificate", secret.Namespace, secret.Name)
+	}
+
+	sum := sha256.Sum256(append(append([]byte{}, crt...), key...))
+
+	return &sslCertificate{
+		name:        fmt.Sprintf("%s-%x", lbName, sum[:6]),
+		certificate: blocks[0],
+		certChain:   strings.Join(blocks[1:], ""),
+		privateKey:  string(key),
+	}, nil
+}
+
+// isOwnedSSLCertificate returns true if the certificate was uploaded for this load balancer.
+func (lb *loadBalancer) isOwnedSSLCertificate(cert *cloudstack.SslCert) bool {
+	return strings.HasPrefix(cert.Name, firstNonEmpty(lb.primaryName, lb.name)+"-")
+}
+
+// listSSLCertificates returns the certificates assigned to a load balancer rule.
+func (lb *loadBalancer) listSSLCertificates(lbRule *cloudstack.LoadBalancerRule) ([]*cloudstack.SslCert, error) {
+	p := lb.LoadBalancer.NewListSslCertsParams()
+	p.SetLbruleid(lbRule.Id)
+
+	l, err := lb.LoadBalancer.ListSslCerts(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving SSL certificates of load balancer rule %v: %v", lbRule.Name, err)
+	}
+
+	return l.SslCerts, nil
+}
+
+// ownedSSLCertificateIDs returns the ID's of the certificates this load balancer
+// uploaded that are assigned to a load balancer rule.
+func (lb *loadBalancer) ownedSSLCertificateIDs(lbRule *cloudstack.LoadBalancerRule) ([]string, error) {
+	certs, err := lb.listSSLCertificates(lbRule)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, cert := range certs {
+		if lb.isOwnedSSLCertificate(cert) {
+			ids = append(ids, cert.Id)
+		}
+	}
+
+	return ids, nil
+}
+
+// ensureSSLCertificate returns the ID of the CloudStack certificate, uploading it if it does
+// not exist yet. The certificate is looked up by name in the whole account rather than on
+// the rules of the load balancer, so a certificate that was uploaded but never assigned,
+// e.g. because the assignment failed, is reused instead of uploaded again. The returned
+// bool is true if the certificate was uploaded.
+func (lb *loadBalancer) ensureSSLCertificate(cert *sslCertificate) (string, bool, error) {
+	p := lb.LoadBalancer.NewListSslCertsParams()
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListSslCerts(p)
+	if err != nil {
+		return "", false, fmt.Errorf("error retrieving SSL certificates: %v", err)
+	}
+
+	for _, c := range l.SslCerts {
+		if c.Name == cert.name {
+			klog.V(4).Infof("Found SSL certificate %v (%v) for load balancer %v", c.Name, c.Id, lb.name)
+			return c.Id, false, nil
+		}
+	}
+
+	klog.V(4).Infof("Uploading SSL certificate %v for load balancer %v", cert.name, lb.name)
+	up := lb.LoadBalancer.NewUploadSslCertParams(cert.certificate, cert.name, cert.privateKey)
+	if cert.certChain != "" {
+		up.SetCertchain(cert.certChain)
+	}
+	if lb.projectID != "" {
+		up.SetProjectid(lb.projectID)
+	}
+
+	r, err := lb.LoadBalancer.UploadSslCert(up)
+	if err != nil {
+		return "", false, fmt.Errorf("error uploading SSL certificate %v: %v", cert.name, err)
+	}
+
+	return r.Id, true, nil
+}
+
+// reconcileSSLCertificate makes sure the certificate is the one assigned to an ssl load
+// balancer rule. It returns the ID's of owned certificates that were removed from the rule,
+// so they can be deleted once they are no longer used.
+func (lb *loadBalancer) reconcileSSLCertificate(lbRule *cloudstack.LoadBalancerRule, certID string) ([]string, error) {
+	certs, err := lb.listSSLCertificates(lbRule)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, cert := range certs {
+		if cert.Id == certID {
+			klog.V(4).Infof("SSL certificate %v of load balancer rule %v is up-to-date", cert.Name, lbRule.Name)
+			return nil, nil
+		}
+		if lb.isOwnedSSLCertificate(cert) {
+			removed = append(removed, cert.Id)
+		}
+	}
+
+	if len(certs) > 0 {
+		klog.V(4).Infof("Removing SSL certificate from load balancer rule %v", lbRule.Name)
+		if _, err := lb.LoadBalancer.RemoveCertFromLoadBalancer(lb.LoadBalancer.NewRemoveCertFromLoadBalancerParams(lbRule.Id)); err != nil {
+			return nil, fmt.Errorf("error removing SSL certificate from load balancer rule %v: %v", lbRule.Name, err)
+		}
+	}
+
+	klog.V(4).Infof("Assigning SSL certificate %v to load balancer rule %v", certID, lbRule.Name)
+	if _, err := lb.LoadBalancer.AssignCertToLoadBalancer(lb.LoadBalancer.NewAssignCertToLoadBalancerParams(certID, lbRule.Id)); err != nil {
+		return removed, fmt.Errorf("error assigning SSL certificate to load balancer rule %v: %v", lbRule.Name, err)
+	}
+
+	return removed, nil
+}
+
+// deleteUnusedSSLCertificates deletes the given certificates if they are no longer
+// assigned to any load balancer rule.
+func (lb *loadBalancer) deleteUnusedSSLCertificates(certIDs []string) error {
+	seen := make(map[string]bool)
+	for _, certID := range certIDs {
+		if seen[certID] {
+			continue
+		}
+		seen[certID] = true
+
+		p := lb.LoadBalancer.NewListSslCertsParams()
+		p.SetCertid(certID)
+
+		l, err := lb.LoadBalancer.ListSslCerts(p)
+		if err != nil {
+			return fmt.Errorf("error retrieving SSL certificate %v: %v", certID, err)
+		}
+		if l.Count == 0 || len(l.SslCerts[0].Loadbalancerrulelist) > 0 {
+			continue
+		}
+
+		klog.V(4).Infof("Deleting unused SSL certificate %v", l.SslCerts[0].Name)
+		if _, err := lb.LoadBalancer.DeleteSslCert(lb.LoadBalancer.NewDeleteSslCertParams(certID)); err != nil {
+			return fmt.Errorf("error deleting SSL certificate %v: %v", l.SslCerts[0].Name, err)
+		}
+	}
+
+	return nil
+}
+
+// startSSLCertificateWatcher watches TLS secrets, so the certificates of load balancers follow
+// changes to the secrets referenced by their services. It relies on the service lister of the
+// endpoint watcher.
+func (cs *CSCloud) startSSLCertificateWatcher(client kubernetes.Interface, stop <-chan struct{}) {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, endpointResyncPeriod, informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("type", string(corev1.SecretTypeTLS)).String()
+	}))
+	secretInformer := factory.Core().V1().Secrets()
+
+	cs.sslCertQueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "cloudstack-ssl-certificates")
+
+	// New secrets are picked up by the service controller, which retries services
+	// whose secret is missing, so only changes need to be followed.
+	secretInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(old, obj interface{}) {
+			if old.(*corev1.Secret).ResourceVersion != obj.(*corev1.Secret).ResourceVersion {
+				cs.enqueueSecretServices(obj)
+			}
+		},
+	})
+
+	factory.Start(stop)
+
+	go func() {
+		defer cs.sslCertQueue.ShutDown()
+
+		if !cache.WaitForCacheSync(stop, secretInformer.Informer().HasSynced, cs.servicesSynced) {
+			klog.Errorf("Failed to sync the SSL certificate watcher caches")
+			return
+		}
+
+		go wait.Until(cs.runSSLCertificateWorker, time.Second, stop)
+		<-stop
+	}()
+}
+
+// enqueueSecretServices queues the load balancer services that terminate TLS with a secret.
+func (cs *CSCloud) enqueueSecretServices(obj interface{}) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return
+	}
+
+	services, err := cs.serviceLister.Services(secret.Namespace).List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Error listing services referencing secret %s/%s: %v", secret.Namespace, secret.Name, err)
+		return
+	}
+
+	for _, service := range services {
+		if service.Spec.Type == corev1.ServiceTypeLoadBalancer && service.Annotations[ServiceAnnotationLoadBalancerSSLCertSecret] == secret.Name {
+			cs.sslCertQueue.Add(service.Namespace + "/" + service.Name)
+		}
+	}
+}
+
+func (cs *CSCloud) runSSLCertificateWorker() {
+	for cs.processNextSSLCertificateItem() {
+	}
+}
+
+func (cs *CSCloud) processNextSSLCertificateItem() bool {
+	key, quit := cs.sslCertQueue.Get()
+	if quit {
+		return false
+	}
+	defer cs.sslCertQueue.Done(key)
+
+	if err := cs.syncSSLCertificate(key.(string)); err != nil {
+		klog.Errorf("Error updating SSL certificate for service %v: %v", key, err)
+		cs.sslCertQueue.AddRateLimited(key)
+		return true
+	}
+
+	cs.sslCertQueue.Forget(key)
+	return true
+}
+
+// syncSSLCertificate assigns the certificate of the current secret to the ssl load balancer
+// rules of a service, after the secret changed. Load balancers that don't exist yet are left
+// to the service controller.
+func (cs *CSCloud) syncSSLCertificate(key string) (err error) {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	service, err := cs.serviceLister.Services(namespace).Get(name)
+	if err != nil {
+		// The service is gone, the service controller takes care of its load balancer.
+		return nil
+	}
+
+	if service.Spec.Type != corev1.ServiceTypeLoadBalancer || isInternalLoadBalancer(service) {
+		return nil
+	}
+
+	unlockService := cs.serviceLocks.lock(key)
+	defer unlockService()
+
+	lb, err := cs.getLoadBalancer(cs.clusterName, service)
+	if err != nil {
+		return err
+	}
+	if lb.ipAddrID == "" {
+		return nil
+	}
+
+	// Serialize with the other services sharing the IP.
+	unlockIP := cs.ipLocks.lock(lb.ipAddrID)
+	defer unlockIP()
+
+	sslCert, err := cs.getSSLCertificate(context.TODO(), service, lb.name)
+	if err != nil || sslCert == nil {
+		return err
+	}
+
+	sslCertID, uploaded, err := lb.ensureSSLCertificate(sslCert)
+	if err != nil {
+		return err
+	}
+	if uploaded {
+		defer func() {
+			if err != nil {
+				if err := lb.deleteUnusedSSLCertificates([]string{sslCertID}); err != nil {
+					klog.Errorf(err.Error())
+				}
+			}
+		}()
+	}
+
+	// The rules on the IP of the secondary family of a dual-stack service use the same certificate.
+	var lbRules []*cloudstack.LoadBalancerRule
+	for _, lbRule := range lb.rules {
+		lbRules = append(lbRules, lbRule)
+	}
+	for _, lbRule := range lb.secondaryRules {
+		lbRules = append(lbRules, lbRule)
+	}
+
+	var staleSSLCertIDs []string
+	for _, lbRule := range lbRules {
+		if ProtocolFromLoadBalancer(lbRule.Protocol) != LoadBalancerProtocolSSL {
+			continue
+		}
+
+		removed, err := lb.reconcileSSLCertificate(lbRule, sslCertID)
+		staleSSLCertIDs = append(staleSSLCertIDs, removed...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return lb.deleteUnusedSSLCertificates(staleSSLCertIDs)
+}
@@ -0,0 +1,466 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func testPEM(blockType, content string) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: []byte(content)})
+}
+
+func TestIsSSLPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		port        corev1.ServicePort
+		annotations map[string]string
+		want        bool
+	}{
+		{
+			name: "no secret annotation",
+			port: corev1.ServicePort{Name: "https", Port: 443},
+			want: false,
+		},
+		{
+			name:        "secret without ports selects all ports",
+			port:        corev1.ServicePort{Name: "http", Port: 80},
+			annotations: map[string]string{ServiceAnnotationLoadBalancerSSLCertSecret: "tls"},
+			want:        true,
+		},
+		{
+			name: "port selected by number",
+			port: corev1.ServicePort{Name: "https", Port: 443},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerSSLCertSecret: "tls",
+				ServiceAnnotationLoadBalancerSSLPorts:      "8443, 443",
+			},
+			want: true,
+		},
+		{
+			name: "port selected by name",
+			port: corev1.ServicePort{Name: "https", Port: 443},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerSSLCertSecret: "tls",
+				ServiceAnnotationLoadBalancerSSLPorts:      "https",
+			},
+			want: true,
+		},
+		{
+			name: "port not selected",
+			port: corev1.ServicePort{Name: "http", Port: 80},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerSSLCertSecret: "tls",
+				ServiceAnnotationLoadBalancerSSLPorts:      "443",
+			},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-service",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+			}
+			if got := isSSLPort(tt.port, service); got != tt.want {
+				t.Errorf("isSSLPort() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewSSLCertificate(t *testing.T) {
+	leaf := testPEM("CERTIFICATE", "leaf")
+	intermediate := testPEM("CERTIFICATE", "intermediate")
+	key := testPEM("PRIVATE KEY", "key")
+
+	t.Run("certificate with chain", func(t *testing.T) {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: "default"},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       append(append([]byte{}, leaf...), intermediate...),
+				corev1.TLSPrivateKeyKey: key,
+			},
+		}
+
+		cert, err := newSSLCertificate(secret, "lb")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cert.certificate != string(leaf) {
+			t.Errorf("certificate = %q, want %q", cert.certificate, leaf)
+		}
+		if cert.certChain != string(intermediate) {
+			t.Errorf("certChain = %q, want %q", cert.certChain, intermediate)
+		}
+		if cert.privateKey != string(key) {
+			t.Errorf("privateKey = %q, want %q", cert.privateKey, key)
+		}
+		if !strings.HasPrefix(cert.name, "lb-") || len(cert.name) != len("lb-")+12 {
+			t.Errorf("name = %q, want lb- followed by 12 hex characters", cert.name)
+		}
+	})
+
+	t.Run("name changes with content", func(t *testing.T) {
+		secret := func(crt []byte) *corev1.Secret {
+			return &corev1.Secret{
+				Type: corev1.SecretTypeTLS,
+				Data: map[string][]byte{corev1.TLSCertKey: crt, corev1.TLSPrivateKeyKey: key},
+			}
+		}
+
+		a, err := newSSLCertificate(secret(leaf), "lb")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		b, err := newSSLCertificate(secret(intermediate), "lb")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if a.name == b.name {
+			t.Errorf("expected different names for different certificates, got %q", a.name)
+		}
+	})
+
+	t.Run("wrong secret type", func(t *testing.T) {
+		secret := &corev1.Secret{
+			Type: corev1.SecretTypeOpaque,
+			Data: map[string][]byte{corev1.TLSCertKey: leaf, corev1.TLSPrivateKeyKey: key},
+		}
+		if _, err := newSSLCertificate(secret, "lb"); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("no PEM certificate", func(t *testing.T) {
+		secret := &corev1.Secret{
+			Type: corev1.SecretTypeTLS,
+			Data: map[string][]byte{corev1.TLSCertKey: []byte("garbage"), corev1.TLSPrivateKeyKey: key},
+		}
+		if _, err := newSSLCertificate(secret, "lb"); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
+
+func TestGetSSLCertificate(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: "default"},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       testPEM("CERTIFICATE", "leaf"),
+			corev1.TLSPrivateKeyKey: testPEM("PRIVATE KEY", "key"),
+		},
+	}
+
+	cs := &CSCloud{
+		clientBuilder: &fakeClientBuilder{client: fake.NewSimpleClientset(secret)},
+	}
+
+	t.Run("no annotation", func(t *testing.T) {
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "default"}}
+		cert, err := cs.getSSLCertificate(context.TODO(), service, "lb")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cert != nil {
+			t.Errorf("expected no certificate, got %+v", cert)
+		}
+	})
+
+	t.Run("secret found", func(t *testing.T) {
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+			Name:        "svc",
+			Namespace:   "default",
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerSSLCertSecret: "tls"},
+		}}
+		cert, err := cs.getSSLCertificate(context.TODO(), service, "lb")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cert == nil {
+			t.Fatalf("expected certificate")
+		}
+	})
+
+	t.Run("secret in other namespace is not used", func(t *testing.T) {
+		service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+			Name:        "svc",
+			Namespace:   "other",
+			Annotations: map[string]string{ServiceAnnotationLoadBalancerSSLCertSecret: "tls"},
+		}}
+		if _, err := cs.getSSLCertificate(context.TODO(), service, "lb"); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
+
+func TestEnsureSSLCertificate(t *testing.T) {
+	cert := &sslCertificate{name: "lb-bbbbbbbbbbbb", certificate: "crt", privateKey: "key"}
+
+	t.Run("reuses certificate that was never assigned", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListSslCertsParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListSslCertsParams().Return(listParams),
+			mockLB.EXPECT().ListSslCerts(listParams).Return(&cloudstack.ListSslCertsResponse{
+				Count: 2,
+				SslCerts: []*cloudstack.SslCert{
+					{Id: "cert-old", Name: "lb-aaaaaaaaaaaa"},
+					{Id: "cert-orphan", Name: "lb-bbbbbbbbbbbb"},
+				},
+			}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			name:             "lb",
+		}
+
+		id, uploaded, err := lb.ensureSSLCertificate(cert)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id != "cert-orphan" || uploaded {
+			t.Errorf("ensureSSLCertificate() = %q, %v, want %q, false", id, uploaded, "cert-orphan")
+		}
+	})
+
+	t.Run("uploads missing certificate", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListSslCertsParams{}
+		uploadParams := &cloudstack.UploadSslCertParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListSslCertsParams().Return(listParams),
+			mockLB.EXPECT().ListSslCerts(listParams).Return(&cloudstack.ListSslCertsResponse{}, nil),
+			mockLB.EXPECT().NewUploadSslCertParams("crt", "lb-bbbbbbbbbbbb", "key").Return(uploadParams),
+			mockLB.EXPECT().UploadSslCert(uploadParams).Return(&cloudstack.UploadSslCertResponse{Id: "cert-new"}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			name:             "lb",
+		}
+
+		id, uploaded, err := lb.ensureSSLCertificate(cert)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if id != "cert-new" || !uploaded {
+			t.Errorf("ensureSSLCertificate() = %q, %v, want %q, true", id, uploaded, "cert-new")
+		}
+	})
+}
+
+func TestEnqueueSecretServices(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, service := range []*corev1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: map[string]string{ServiceAnnotationLoadBalancerSSLCertSecret: "tls"}},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", Annotations: map[string]string{ServiceAnnotationLoadBalancerSSLCertSecret: "other-tls"}},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "other", Annotations: map[string]string{ServiceAnnotationLoadBalancerSSLCertSecret: "tls"}},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "internal", Namespace: "default", Annotations: map[string]string{ServiceAnnotationLoadBalancerSSLCertSecret: "tls"}},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP},
+		},
+	} {
+		if err := indexer.Add(service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	cs := &CSCloud{
+		serviceLister: corelisters.NewServiceLister(indexer),
+		sslCertQueue:  workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+	}
+	t.Cleanup(cs.sslCertQueue.ShutDown)
+
+	cs.enqueueSecretServices(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: "default"}})
+
+	if cs.sslCertQueue.Len() != 1 {
+		t.Fatalf("queue length = %d, want 1", cs.sslCertQueue.Len())
+	}
+	if key, _ := cs.sslCertQueue.Get(); key != "default/web" {
+		t.Errorf("queued %v, want default/web", key)
+	}
+}
+
+func TestReconcileSSLCertificate(t *testing.T) {
+	rule := &cloudstack.LoadBalancerRule{
+		Id:   "rule-123",
+		Name: "lb-ssl-443",
+	}
+
+	t.Run("certificate already assigned", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListSslCertsParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListSslCertsParams().Return(listParams),
+			mockLB.EXPECT().ListSslCerts(listParams).Return(&cloudstack.ListSslCertsResponse{
+				Count:    1,
+				SslCerts: []*cloudstack.SslCert{{Id: "cert-1", Name: "lb-aaaaaaaaaaaa"}},
+			}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			name:             "lb",
+		}
+
+		removed, err := lb.reconcileSSLCertificate(rule, "cert-1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(removed) != 0 {
+			t.Errorf("removed = %v, want none", removed)
+		}
+	})
+
+	t.Run("rotates certificate", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListSslCertsParams{}
+		removeParams := &cloudstack.RemoveCertFromLoadBalancerParams{}
+		assignParams := &cloudstack.AssignCertToLoadBalancerParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListSslCertsParams().Return(listParams),
+			mockLB.EXPECT().ListSslCerts(listParams).Return(&cloudstack.ListSslCertsResponse{
+				Count:    1,
+				SslCerts: []*cloudstack.SslCert{{Id: "cert-old", Name: "lb-aaaaaaaaaaaa"}},
+			}, nil),
+			mockLB.EXPECT().NewRemoveCertFromLoadBalancerParams("rule-123").Return(removeParams),
+			mockLB.EXPECT().RemoveCertFromLoadBalancer(removeParams).Return(&cloudstack.RemoveCertFromLoadBalancerResponse{}, nil),
+			mockLB.EXPECT().NewAssignCertToLoadBalancerParams("cert-new", "rule-123").Return(assignParams),
+			mockLB.EXPECT().AssignCertToLoadBalancer(assignParams).Return(&cloudstack.AssignCertToLoadBalancerResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			name:             "lb",
+		}
+
+		removed, err := lb.reconcileSSLCertificate(rule, "cert-new")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(removed) != 1 || removed[0] != "cert-old" {
+			t.Errorf("removed = %v, want [cert-old]", removed)
+		}
+	})
+
+	t.Run("assigns to rule without certificate", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListSslCertsParams{}
+		assignParams := &cloudstack.AssignCertToLoadBalancerParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListSslCertsParams().Return(listParams),
+			mockLB.EXPECT().ListSslCerts(listParams).Return(&cloudstack.ListSslCertsResponse{}, nil),
+			mockLB.EXPECT().NewAssignCertToLoadBalancerParams("cert-new", "rule-123").Return(assignParams),
+			mockLB.EXPECT().AssignCertToLoadBalancer(assignParams).Return(&cloudstack.AssignCertToLoadBalancerResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+			name:             "lb",
+		}
+
+		if _, err := lb.reconcileSSLCertificate(rule, "cert-new"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestDeleteUnusedSSLCertificates(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	usedParams := &cloudstack.ListSslCertsParams{}
+	unusedParams := &cloudstack.ListSslCertsParams{}
+	deleteParams := &cloudstack.DeleteSslCertParams{}
+
+	gomock.InOrder(
+		mockLB.EXPECT().NewListSslCertsParams().Return(usedParams),
+		mockLB.EXPECT().ListSslCerts(usedParams).Return(&cloudstack.ListSslCertsResponse{
+			Count:    1,
+			SslCerts: []*cloudstack.SslCert{{Id: "cert-used", Name: "lb-1", Loadbalancerrulelist: []string{"rule-1"}}},
+		}, nil),
+		mockLB.EXPECT().NewListSslCertsParams().Return(unusedParams),
+		mockLB.EXPECT().ListSslCerts(unusedParams).Return(&cloudstack.ListSslCertsResponse{
+			Count:    1,
+			SslCerts: []*cloudstack.SslCert{{Id: "cert-unused", Name: "lb-2"}},
+		}, nil),
+		mockLB.EXPECT().NewDeleteSslCertParams("cert-unused").Return(deleteParams),
+		mockLB.EXPECT().DeleteSslCert(deleteParams).Return(&cloudstack.DeleteSslCertResponse{}, nil),
+	)
+
+	lb := &loadBalancer{
+		CloudStackClient: &cloudstack.CloudStackClient{LoadBalancer: mockLB},
+		name:             "lb",
+	}
+
+	if err := lb.deleteUnusedSSLCertificates([]string{"cert-used", "cert-unused", "cert-used"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
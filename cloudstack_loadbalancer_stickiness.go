@@ -0,0 +1,177 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ServiceAnnotationLoadBalancerStickinessMethod is the annotation used on the
+	// service to attach a stickiness policy to every load balancer rule.
+	// Supported values are "LbCookie", "AppCookie" and "SourceBased".
+	ServiceAnnotationLoadBalancerStickinessMethod = "service.beta.kubernetes.io/cloudstack-load-balancer-stickiness-method"
+
+	// ServiceAnnotationLoadBalancerStickinessCookieName is the annotation used on the
+	// service to set the cookie name of a LbCookie or AppCookie stickiness policy.
+	ServiceAnnotationLoadBalancerStickinessCookieName = "service.beta.kubernetes.io/cloudstack-load-balancer-stickiness-cookie-name"
+
+	// ServiceAnnotationLoadBalancerStickinessExpire is the annotation used on the
+	// service to set the expiry of SourceBased stickiness entries (e.g. "30m").
+	ServiceAnnotationLoadBalancerStickinessExpire = "service.beta.kubernetes.io/cloudstack-load-balancer-stickiness-expire"
+
+	// ServiceAnnotationLoadBalancerStickinessHoldTime is the annotation used on the
+	// service to set the hold time of AppCookie stickiness entries (e.g. "3h").
+	ServiceAnnotationLoadBalancerStickinessHoldTime = "service.beta.kubernetes.io/cloudstack-load-balancer-stickiness-holdtime"
+
+	stickinessMethodLbCookie    = "LbCookie"
+	stickinessMethodAppCookie   = "AppCookie"
+	stickinessMethodSourceBased = "SourceBased"
+)
+
+// stickinessDurationRegex matches the duration format accepted by the CloudStack
+// stickiness policy parameters: a number with an optional ms, s, m, h or d unit.
+var stickinessDurationRegex = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d)?$`)
+
+// stickinessPolicy is the desired stickiness configuration of a load balancer rule.
+type stickinessPolicy struct {
+	method string
+	params map[string]string
+}
+
+// getStickinessPolicy returns the stickiness policy requested by the service
+// annotations, or nil if the service does not need a stickiness policy.
+func getStickinessPolicy(service *corev1.Service) (*stickinessPolicy, error) {
+	method := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerStickinessMethod, "")
+	if method == "" {
+		return nil, nil
+	}
+
+	cookieName := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerStickinessCookieName, "")
+	expire := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerStickinessExpire, "")
+	holdTime := getStringFromServiceAnnotation(service, ServiceAnnotationLoadBalancerStickinessHoldTime, "")
+
+	for key, value := range map[string]string{
+		ServiceAnnotationLoadBalancerStickinessExpire:   expire,
+		ServiceAnnotationLoadBalancerStickinessHoldTime: holdTime,
+	} {
+		if value != "" && !stickinessDurationRegex.MatchString(value) {
+			return nil, fmt.Errorf("invalid duration %q in annotation %s", value, key)
+		}
+	}
+
+	policy := &stickinessPolicy{
+		method: method,
+		params: make(map[string]string),
+	}
+
+	switch method {
+	case stickinessMethodLbCookie:
+		if cookieName != "" {
+			policy.params["cookie-name"] = cookieName
+		}
+	case stickinessMethodAppCookie:
+		if cookieName == "" {
+			return nil, fmt.Errorf("annotation %s is required for stickiness method %s", ServiceAnnotationLoadBalancerStickinessCookieName, method)
+		}
+		policy.params["cookie-name"] = cookieName
+		if holdTime != "" {
+			policy.params["holdtime"] = holdTime
+		}
+	case stickinessMethodSourceBased:
+		if expire != "" {
+			policy.params["expire"] = expire
+		}
+	default:
+		return nil, fmt.Errorf("unsupported stickiness method %q in annotation %s", method, ServiceAnnotationLoadBalancerStickinessMethod)
+	}
+
+	return policy, nil
+}
+
+// matches returns true if an existing CloudStack stickiness policy has the desired method
+// and parameters. Parameters that CloudStack filled in with defaults are ignored.
+func (sp *stickinessPolicy) matches(existing cloudstack.LBStickinessPolicyStickinesspolicy) bool {
+	if existing.Methodname != sp.method {
+		return false
+	}
+	for key, value := range sp.params {
+		if existing.Params[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// reconcileStickinessPolicy makes sure the stickiness policy of a load balancer rule matches
+// the service. CloudStack allows a single stickiness policy per rule, so outdated policies
+// are deleted before the new one is created.
+func (lb *loadBalancer) reconcileStickinessPolicy(lbRule *cloudstack.LoadBalancerRule, service *corev1.Service) error {
+	desired, err := getStickinessPolicy(service)
+	if err != nil {
+		return err
+	}
+
+	p := lb.LoadBalancer.NewListLBStickinessPoliciesParams()
+	p.SetLbruleid(lbRule.Id)
+
+	l, err := lb.LoadBalancer.ListLBStickinessPolicies(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving stickiness policies for load balancer rule %v: %v", lbRule.Name, err)
+	}
+
+	found := false
+	for _, policies := range l.LBStickinessPolicies {
+		for _, policy := range policies.Stickinesspolicy {
+			if desired != nil && !found && desired.matches(policy) {
+				klog.V(4).Infof("Stickiness policy %v of load balancer rule %v is up-to-date", policy.Id, lbRule.Name)
+				found = true
+				continue
+			}
+
+			klog.V(4).Infof("Deleting stickiness policy %v of load balancer rule %v", policy.Id, lbRule.Name)
+			if _, err := lb.LoadBalancer.DeleteLBStickinessPolicy(lb.LoadBalancer.NewDeleteLBStickinessPolicyParams(policy.Id)); err != nil {
+				return fmt.Errorf("error deleting stickiness policy %v of load balancer rule %v: %v", policy.Id, lbRule.Name, err)
+			}
+		}
+	}
+
+	if desired == nil || found {
+		return nil
+	}
+
+	klog.V(4).Infof("Creating %v stickiness policy for load balancer rule %v: %v", desired.method, lbRule.Name, desired.params)
+	cp := lb.LoadBalancer.NewCreateLBStickinessPolicyParams(lbRule.Id, desired.method, lbRule.Name)
+	if len(desired.params) > 0 {
+		cp.SetParam(desired.params)
+	}
+
+	if _, err := lb.LoadBalancer.CreateLBStickinessPolicy(cp); err != nil {
+		return fmt.Errorf("error creating stickiness policy for load balancer rule %v: %v", lbRule.Name, err)
+	}
+
+	return nil
+}
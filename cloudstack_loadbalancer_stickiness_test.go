@@ -0,0 +1,279 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetStickinessPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        *stickinessPolicy
+		wantErr     bool
+	}{
+		{
+			name: "no annotations",
+			want: nil,
+		},
+		{
+			name: "lb cookie with name",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerStickinessMethod:     "LbCookie",
+				ServiceAnnotationLoadBalancerStickinessCookieName: "SRVID",
+			},
+			want: &stickinessPolicy{method: "LbCookie", params: map[string]string{"cookie-name": "SRVID"}},
+		},
+		{
+			name: "app cookie with hold time",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerStickinessMethod:     "AppCookie",
+				ServiceAnnotationLoadBalancerStickinessCookieName: "JSESSIONID",
+				ServiceAnnotationLoadBalancerStickinessHoldTime:   "3h",
+			},
+			want: &stickinessPolicy{method: "AppCookie", params: map[string]string{"cookie-name": "JSESSIONID", "holdtime": "3h"}},
+		},
+		{
+			name: "app cookie without cookie name",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerStickinessMethod: "AppCookie",
+			},
+			wantErr: true,
+		},
+		{
+			name: "source based with expiry",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerStickinessMethod: "SourceBased",
+				ServiceAnnotationLoadBalancerStickinessExpire: "30m",
+			},
+			want: &stickinessPolicy{method: "SourceBased", params: map[string]string{"expire": "30m"}},
+		},
+		{
+			name: "invalid expiry",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerStickinessMethod: "SourceBased",
+				ServiceAnnotationLoadBalancerStickinessExpire: "30 minutes",
+			},
+			wantErr: true,
+		},
+		{
+			name: "unsupported method",
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerStickinessMethod: "Magic",
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-service",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+			}
+
+			got, err := getStickinessPolicy(service)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getStickinessPolicy() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconcileStickinessPolicy(t *testing.T) {
+	rule := &cloudstack.LoadBalancerRule{
+		Id:   "rule-123",
+		Name: "test-rule",
+	}
+
+	annotated := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ServiceAnnotationLoadBalancerStickinessMethod:     "LbCookie",
+				ServiceAnnotationLoadBalancerStickinessCookieName: "SRVID",
+			},
+		},
+	}
+
+	t.Run("creates missing policy", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBStickinessPoliciesParams{}
+		createParams := &cloudstack.CreateLBStickinessPolicyParams{}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBStickinessPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBStickinessPolicies(listParams).Return(&cloudstack.ListLBStickinessPoliciesResponse{}, nil),
+			mockLB.EXPECT().NewCreateLBStickinessPolicyParams("rule-123", "LbCookie", "test-rule").Return(createParams),
+			mockLB.EXPECT().CreateLBStickinessPolicy(createParams).Return(&cloudstack.CreateLBStickinessPolicyResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileStickinessPolicy(rule, annotated); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if params, _ := createParams.GetParam(); params["cookie-name"] != "SRVID" {
+			t.Errorf("params = %v, want cookie-name SRVID", params)
+		}
+	})
+
+	t.Run("keeps matching policy", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBStickinessPoliciesParams{}
+		listResp := &cloudstack.ListLBStickinessPoliciesResponse{
+			Count: 1,
+			LBStickinessPolicies: []*cloudstack.LBStickinessPolicy{
+				{
+					Lbruleid: "rule-123",
+					Stickinesspolicy: []cloudstack.LBStickinessPolicyStickinesspolicy{
+						{Id: "sp-1", Methodname: "LbCookie", Params: map[string]string{"cookie-name": "SRVID", "mode": "insert"}},
+					},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBStickinessPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBStickinessPolicies(listParams).Return(listResp, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileStickinessPolicy(rule, annotated); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("replaces policy with different method", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBStickinessPoliciesParams{}
+		deleteParams := &cloudstack.DeleteLBStickinessPolicyParams{}
+		createParams := &cloudstack.CreateLBStickinessPolicyParams{}
+		listResp := &cloudstack.ListLBStickinessPoliciesResponse{
+			Count: 1,
+			LBStickinessPolicies: []*cloudstack.LBStickinessPolicy{
+				{
+					Lbruleid: "rule-123",
+					Stickinesspolicy: []cloudstack.LBStickinessPolicyStickinesspolicy{
+						{Id: "sp-1", Methodname: "SourceBased"},
+					},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBStickinessPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBStickinessPolicies(listParams).Return(listResp, nil),
+			mockLB.EXPECT().NewDeleteLBStickinessPolicyParams("sp-1").Return(deleteParams),
+			mockLB.EXPECT().DeleteLBStickinessPolicy(deleteParams).Return(&cloudstack.DeleteLBStickinessPolicyResponse{}, nil),
+			mockLB.EXPECT().NewCreateLBStickinessPolicyParams("rule-123", "LbCookie", "test-rule").Return(createParams),
+			mockLB.EXPECT().CreateLBStickinessPolicy(createParams).Return(&cloudstack.CreateLBStickinessPolicyResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		if err := lb.reconcileStickinessPolicy(rule, annotated); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("deletes policy when annotation is removed", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLBStickinessPoliciesParams{}
+		deleteParams := &cloudstack.DeleteLBStickinessPolicyParams{}
+		listResp := &cloudstack.ListLBStickinessPoliciesResponse{
+			Count: 1,
+			LBStickinessPolicies: []*cloudstack.LBStickinessPolicy{
+				{
+					Lbruleid: "rule-123",
+					Stickinesspolicy: []cloudstack.LBStickinessPolicyStickinesspolicy{
+						{Id: "sp-1", Methodname: "LbCookie"},
+					},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLBStickinessPoliciesParams().Return(listParams),
+			mockLB.EXPECT().ListLBStickinessPolicies(listParams).Return(listResp, nil),
+			mockLB.EXPECT().NewDeleteLBStickinessPolicyParams("sp-1").Return(deleteParams),
+			mockLB.EXPECT().DeleteLBStickinessPolicy(deleteParams).Return(&cloudstack.DeleteLBStickinessPolicyResponse{}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-service", Namespace: "default"},
+		}
+
+		if err := lb.reconcileStickinessPolicy(rule, service); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
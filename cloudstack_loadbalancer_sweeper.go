@@ -0,0 +1,411 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// defaultSweeperInterval is the default time between two sweeps.
+	defaultSweeperInterval = 10 * time.Minute
+
+	// defaultSweeperGracePeriod is the default time a resource must be orphaned before it is deleted.
+	defaultSweeperGracePeriod = 30 * time.Minute
+)
+
+// loadBalancerSweeper deletes the CloudStack resources of load balancers whose service no
+// longer exists, for example because the service was deleted while the controller was down.
+type loadBalancerSweeper struct {
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+
+	// orphanedSince holds when a resource was first found without its service.
+	orphanedSince map[string]time.Time
+	now           func() time.Time
+}
+
+// orphanedResource is a CloudStack resource that was created for a service that no longer exists.
+type orphanedResource struct {
+	kind   string
+	id     string
+	tags   []cloudstack.Tags
+	delete func() error
+}
+
+// newLoadBalancerSweeper creates a sweeper from the [Sweeper] section of the config.
+func newLoadBalancerSweeper(cfg *CSConfig) (*loadBalancerSweeper, error) {
+	s := &loadBalancerSweeper{
+		interval:      defaultSweeperInterval,
+		gracePeriod:   defaultSweeperGracePeriod,
+		dryRun:        cfg.Sweeper.DryRun,
+		orphanedSince: make(map[string]time.Time),
+		now:           time.Now,
+	}
+
+	if cfg.Sweeper.Interval != "" {
+		interval, err := time.ParseDuration(cfg.Sweeper.Interval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid sweeper interval %q", cfg.Sweeper.Interval)
+		}
+		s.interval = interval
+	}
+
+	if cfg.Sweeper.GracePeriod != "" {
+		gracePeriod, err := time.ParseDuration(cfg.Sweeper.GracePeriod)
+		if err != nil || gracePeriod < 0 {
+			return nil, fmt.Errorf("invalid sweeper grace period %q", cfg.Sweeper.GracePeriod)
+		}
+		s.gracePeriod = gracePeriod
+	}
+
+	return s, nil
+}
+
+// startLoadBalancerSweeper periodically sweeps the resources of this cluster, once the
+// service cache of the endpoint watcher is synced.
+func (cs *CSCloud) startLoadBalancerSweeper(stop <-chan struct{}) {
+	if cs.clusterName == "" {
+		klog.Warningf("Cluster name is not set, the load balancer sweeper is disabled")
+		return
+	}
+
+	go func() {
+		if !cache.WaitForCacheSync(stop, cs.servicesSynced) {
+			klog.Errorf("Failed to sync the service cache of the load balancer sweeper")
+			return
+		}
+
+		klog.Infof("Starting load balancer sweeper (interval %v, grace period %v, dry-run %v)", cs.sweeper.interval, cs.sweeper.gracePeriod, cs.sweeper.dryRun)
+		wait.Until(func() {
+			if err := cs.sweepLoadBalancerResources(); err != nil {
+				klog.Errorf("Error sweeping load balancer resources: %v", err)
+			}
+		}, cs.sweeper.interval, stop)
+	}()
+}
+
+// sweepLoadBalancerResources deletes the resources of this cluster that belong to services that
+// no longer exist, once they have been orphaned for the grace period.
+func (cs *CSCloud) sweepLoadBalancerResources() error {
+	services, err := cs.serviceLister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("error listing services: %v", err)
+	}
+
+	live := make(map[string]bool)
+	for _, service := range services {
+		if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+			live[string(service.UID)] = true
+		}
+	}
+
+	resources, err := cs.listOwnedResources()
+	if err != nil {
+		return err
+	}
+
+	orphanedSince := make(map[string]time.Time)
+	for _, r := range resources {
+		uid, _ := getTag(r.tags, tagServiceUID)
+		if uid == "" || live[uid] {
+			continue
+		}
+
+		since, ok := cs.sweeper.orphanedSince[r.id]
+		if !ok {
+			since = cs.sweeper.now()
+		}
+		orphanedSince[r.id] = since
+
+		if cs.sweeper.now().Sub(since) < cs.sweeper.gracePeriod {
+			klog.V(4).Infof("Found orphaned %v %v, waiting for the grace period to pass", r.kind, r.id)
+			continue
+		}
+
+		ref := orphanedServiceReference(r.tags)
+
+		if cs.sweeper.dryRun {
+			klog.Infof("Would delete orphaned %v %v of service %v/%v (dry-run)", r.kind, r.id, ref.Namespace, ref.Name)
+			cs.recordEvent(ref, corev1.EventTypeWarning, "OrphanedLoadBalancerResource", "Orphaned %v %v would be deleted (dry-run)", r.kind, r.id)
+			continue
+		}
+
+		klog.Infof("Deleting orphaned %v %v of service %v/%v", r.kind, r.id, ref.Namespace, ref.Name)
+		if err := r.delete(); err != nil {
+			klog.Errorf("Error deleting orphaned %v %v: %v", r.kind, r.id, err)
+			continue
+		}
+		delete(orphanedSince, r.id)
+		cs.recordEvent(ref, corev1.EventTypeNormal, "DeletedOrphanedLoadBalancerResource", "Deleted orphaned %v %v", r.kind, r.id)
+	}
+
+	cs.sweeper.orphanedSince = orphanedSince
+
+	return nil
+}
+
+// listOwnedResources lists the resources tagged with the name of this cluster. Public IP
+// addresses come last, so they are released after the rules using them are deleted.
+func (cs *CSCloud) listOwnedResources() ([]*orphanedResource, error) {
+	owner := map[string]string{tagClusterName: cs.clusterName}
+	var resources []*orphanedResource
+
+	lbp := cs.client.LoadBalancer.NewListLoadBalancerRulesParams()
+	lbp.SetTags(owner)
+	lbp.SetListall(true)
+	if cs.projectID != "" {
+		lbp.SetProjectid(cs.projectID)
+	}
+	lbRules, err := cs.client.LoadBalancer.ListLoadBalancerRules(lbp)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving load balancer rules: %v", err)
+	}
+	for _, lbRule := range lbRules.LoadBalancerRules {
+		id := lbRule.Id
+		resources = append(resources, &orphanedResource{
+			kind: "load balancer rule",
+			id:   id,
+			tags: lbRule.Tags,
+			delete: func() error {
+				_, err := cs.client.LoadBalancer.DeleteLoadBalancerRule(cs.client.LoadBalancer.NewDeleteLoadBalancerRuleParams(id))
+				return err
+			},
+		})
+	}
+
+	ilbp := cs.client.LoadBalancer.NewListLoadBalancersParams()
+	ilbp.SetTags(owner)
+	ilbp.SetScheme(internalLoadBalancerScheme)
+	ilbp.SetListall(true)
+	if cs.projectID != "" {
+		ilbp.SetProjectid(cs.projectID)
+	}
+	ilbs, err := cs.client.LoadBalancer.ListLoadBalancers(ilbp)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving internal load balancers: %v", err)
+	}
+	for _, ilb := range ilbs.LoadBalancers {
+		id := ilb.Id
+		resources = append(resources, &orphanedResource{
+			kind: "internal load balancer",
+			id:   id,
+			tags: ilb.Tags,
+			delete: func() error {
+				_, err := cs.client.LoadBalancer.DeleteLoadBalancer(cs.client.LoadBalancer.NewDeleteLoadBalancerParams(id))
+				return err
+			},
+		})
+	}
+
+	fwp := cs.client.Firewall.NewListFirewallRulesParams()
+	fwp.SetTags(owner)
+	fwp.SetListall(true)
+	if cs.projectID != "" {
+		fwp.SetProjectid(cs.projectID)
+	}
+	fwRules, err := cs.client.Firewall.ListFirewallRules(fwp)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving firewall rules: %v", err)
+	}
+	for _, rule := range fwRules.FirewallRules {
+		id := rule.Id
+		resources = append(resources, &orphanedResource{
+			kind: "firewall rule",
+			id:   id,
+			tags: rule.Tags,
+			delete: func() error {
+				_, err := cs.client.Firewall.DeleteFirewallRule(cs.client.Firewall.NewDeleteFirewallRuleParams(id))
+				return err
+			},
+		})
+	}
+
+	aclp := cs.client.NetworkACL.NewListNetworkACLsParams()
+	aclp.SetTags(owner)
+	aclp.SetListall(true)
+	if cs.projectID != "" {
+		aclp.SetProjectid(cs.projectID)
+	}
+	acls, err := cs.client.NetworkACL.ListNetworkACLs(aclp)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving network ACL rules: %v", err)
+	}
+	for _, acl := range acls.NetworkACLs {
+		id := acl.Id
+		resources = append(resources, &orphanedResource{
+			kind: "network ACL rule",
+			id:   id,
+			tags: acl.Tags,
+			delete: func() error {
+				_, err := cs.client.NetworkACL.DeleteNetworkACL(cs.client.NetworkACL.NewDeleteNetworkACLParams(id))
+				return err
+			},
+		})
+	}
+
+	// The sharer tags of the services of this cluster that share a public IP. An IP is not
+	// released while it has sharer tags, so the tags of deleted services are swept as well.
+	tp := cs.client.Resourcetags.NewListTagsParams()
+	tp.SetResourcetype(resourceTypePublicIPAddress)
+	tp.SetListall(true)
+	if cs.projectID != "" {
+		tp.SetProjectid(cs.projectID)
+	}
+	ipTags, err := cs.client.Resourcetags.ListTags(tp)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving the tags of public IP addresses: %v", err)
+	}
+	for _, tag := range ipTags.Tags {
+		if !strings.HasPrefix(tag.Key, tagIPSharerPrefix) {
+			continue
+		}
+		clusterName, namespace, name, ok := parseIPSharerValue(tag.Value)
+		if !ok || clusterName != cs.clusterName {
+			continue
+		}
+
+		ipID, key, value := tag.Resourceid, tag.Key, tag.Value
+		resources = append(resources, &orphanedResource{
+			kind: "IP sharer tag",
+			id:   ipID + "/" + key,
+			tags: []cloudstack.Tags{
+				{Key: tagServiceNamespace, Value: namespace},
+				{Key: tagServiceName, Value: name},
+				{Key: tagServiceUID, Value: strings.TrimPrefix(key, tagIPSharerPrefix)},
+			},
+			delete: func() error {
+				return cs.deleteIPSharerTag(ipID, key, value)
+			},
+		})
+	}
+
+	ipp := cs.client.Address.NewListPublicIpAddressesParams()
+	ipp.SetTags(owner)
+	ipp.SetListall(true)
+	if cs.projectID != "" {
+		ipp.SetProjectid(cs.projectID)
+	}
+	ips, err := cs.client.Address.ListPublicIpAddresses(ipp)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving public IP addresses: %v", err)
+	}
+	for _, ip := range ips.PublicIpAddresses {
+		id := ip.Id
+		resources = append(resources, &orphanedResource{
+			kind: "public IP address",
+			id:   id,
+			tags: ip.Tags,
+			delete: func() error {
+				return cs.releaseOrphanedIPAddress(id)
+			},
+		})
+	}
+
+	return resources, nil
+}
+
+// releaseOrphanedIPAddress releases a public IP address, unless other load balancer rules
+// still use it.
+func (cs *CSCloud) releaseOrphanedIPAddress(id string) error {
+	unlock := cs.ipLocks.lock(id)
+	defer unlock()
+
+	return cs.releaseUnusedIPAddress(id)
+}
+
+// deleteIPSharerTag deletes the sharer tag of a deleted service from a public IP. If the release
+// of the IP was handed over to the services sharing it and no other service is left, the IP is
+// released as well.
+func (cs *CSCloud) deleteIPSharerTag(ipID, key, value string) error {
+	unlock := cs.ipLocks.lock(ipID)
+	defer unlock()
+
+	ip, count, err := cs.client.Address.GetPublicIpAddressByID(ipID)
+	if err != nil {
+		if count == 0 {
+			return nil
+		}
+		return fmt.Errorf("error retrieving IP address %v: %v", ipID, err)
+	}
+	if current, ok := getTag(ip.Tags, key); !ok || current != value {
+		return nil
+	}
+
+	p := cs.client.Resourcetags.NewDeleteTagsParams([]string{ipID}, resourceTypePublicIPAddress)
+	p.SetTags(map[string]string{key: value})
+	if _, err := cs.client.Resourcetags.DeleteTags(p); err != nil {
+		return fmt.Errorf("error deleting tag %v of IP address %v: %v", key, ip.Ipaddress, err)
+	}
+
+	if _, handedOver := getTag(ip.Tags, tagIPReleaseWithLastSharer); handedOver && len(ipSharers(ip.Tags, key)) == 0 {
+		return cs.releaseUnusedIPAddress(ipID)
+	}
+	return nil
+}
+
+// releaseUnusedIPAddress releases a locked public IP address, unless load balancer rules still
+// use it.
+func (cs *CSCloud) releaseUnusedIPAddress(id string) error {
+	p := cs.client.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetPublicipid(id)
+	p.SetListall(true)
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := cs.client.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return fmt.Errorf("error retrieving load balancer rules of IP address %v: %v", id, err)
+	}
+	if l.Count > 0 {
+		return fmt.Errorf("IP address %v is still used by %d load balancer rule(s)", id, l.Count)
+	}
+
+	_, err = cs.client.Address.DisassociateIpAddress(cs.client.Address.NewDisassociateIpAddressParams(id))
+	return err
+}
+
+// orphanedServiceReference returns a reference to the deleted service a resource was created for.
+func orphanedServiceReference(tags []cloudstack.Tags) *corev1.ObjectReference {
+	namespace, _ := getTag(tags, tagServiceNamespace)
+	name, _ := getTag(tags, tagServiceName)
+	uid, _ := getTag(tags, tagServiceUID)
+
+	return &corev1.ObjectReference{
+		Kind:       "Service",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       name,
+		UID:        types.UID(uid),
+	}
+}
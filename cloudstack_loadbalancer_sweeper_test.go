@@ -0,0 +1,301 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestNewLoadBalancerSweeper(t *testing.T) {
+	tests := []struct {
+		name            string
+		interval        string
+		gracePeriod     string
+		wantInterval    time.Duration
+		wantGracePeriod time.Duration
+		wantErr         bool
+	}{
+		{name: "defaults", wantInterval: defaultSweeperInterval, wantGracePeriod: defaultSweeperGracePeriod},
+		{name: "custom", interval: "5m", gracePeriod: "1h", wantInterval: 5 * time.Minute, wantGracePeriod: time.Hour},
+		{name: "invalid interval", interval: "often", wantErr: true},
+		{name: "zero interval", interval: "0s", wantErr: true},
+		{name: "negative grace period", gracePeriod: "-1m", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &CSConfig{}
+			cfg.Sweeper.Enabled = true
+			cfg.Sweeper.Interval = tt.interval
+			cfg.Sweeper.GracePeriod = tt.gracePeriod
+
+			s, err := newLoadBalancerSweeper(cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if s.interval != tt.wantInterval || s.gracePeriod != tt.wantGracePeriod {
+				t.Errorf("interval, grace period = %v, %v, want %v, %v", s.interval, s.gracePeriod, tt.wantInterval, tt.wantGracePeriod)
+			}
+		})
+	}
+}
+
+func TestSweepLoadBalancerResources(t *testing.T) {
+	orphanTags := []cloudstack.Tags{
+		{Key: tagClusterName, Value: "prod"},
+		{Key: tagServiceNamespace, Value: "default"},
+		{Key: tagServiceName, Value: "deleted-service"},
+		{Key: tagServiceUID, Value: "uid-deleted"},
+	}
+	liveTags := []cloudstack.Tags{
+		{Key: tagClusterName, Value: "prod"},
+		{Key: tagServiceNamespace, Value: "default"},
+		{Key: tagServiceName, Value: "live-service"},
+		{Key: tagServiceUID, Value: "uid-live"},
+	}
+
+	setup := func(t *testing.T, dryRun bool) (*CSCloud, *cloudstack.MockLoadBalancerServiceIface, *record.FakeRecorder, *time.Time) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+
+		mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}).AnyTimes()
+		mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{
+			Count: 2,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Id: "rule-orphan", Tags: orphanTags},
+				{Id: "rule-live", Tags: liveTags},
+			},
+		}, nil).AnyTimes()
+		mockLB.EXPECT().NewListLoadBalancersParams().Return(&cloudstack.ListLoadBalancersParams{}).AnyTimes()
+		mockLB.EXPECT().ListLoadBalancers(gomock.Any()).Return(&cloudstack.ListLoadBalancersResponse{}, nil).AnyTimes()
+		mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).AnyTimes()
+		mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil).AnyTimes()
+		mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}).AnyTimes()
+		mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(&cloudstack.ListNetworkACLsResponse{}, nil).AnyTimes()
+		mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}).AnyTimes()
+		mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{}, nil).AnyTimes()
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewListTagsParams().Return(&cloudstack.ListTagsParams{}).AnyTimes()
+		mockTags.EXPECT().ListTags(gomock.Any()).Return(&cloudstack.ListTagsResponse{}, nil).AnyTimes()
+
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		if err := indexer.Add(&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "live-service", Namespace: "default", UID: "uid-live"},
+			Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+		}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		now := time.Now()
+		recorder := record.NewFakeRecorder(10)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Firewall:     mockFirewall,
+				NetworkACL:   mockNetworkACL,
+				Address:      mockAddress,
+				Resourcetags: mockTags,
+			},
+			clusterName:   "prod",
+			serviceLister: corelisters.NewServiceLister(indexer),
+			eventRecorder: recorder,
+			sweeper: &loadBalancerSweeper{
+				interval:      time.Minute,
+				gracePeriod:   10 * time.Minute,
+				dryRun:        dryRun,
+				orphanedSince: make(map[string]time.Time),
+				now:           func() time.Time { return now },
+			},
+		}
+
+		return cs, mockLB, recorder, &now
+	}
+
+	t.Run("deletes orphans after the grace period", func(t *testing.T) {
+		cs, mockLB, recorder, now := setup(t, false)
+
+		// The first sweep only notes the orphan.
+		if err := cs.sweepLoadBalancerResources(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := cs.sweeper.orphanedSince["rule-orphan"]; !ok {
+			t.Fatalf("expected rule-orphan to be tracked")
+		}
+		if _, ok := cs.sweeper.orphanedSince["rule-live"]; ok {
+			t.Fatalf("expected rule-live not to be tracked")
+		}
+
+		deleteParams := &cloudstack.DeleteLoadBalancerRuleParams{}
+		mockLB.EXPECT().NewDeleteLoadBalancerRuleParams("rule-orphan").Return(deleteParams)
+		mockLB.EXPECT().DeleteLoadBalancerRule(deleteParams).Return(&cloudstack.DeleteLoadBalancerRuleResponse{}, nil)
+
+		*now = now.Add(11 * time.Minute)
+		if err := cs.sweepLoadBalancerResources(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := cs.sweeper.orphanedSince["rule-orphan"]; ok {
+			t.Errorf("expected rule-orphan to be forgotten after deletion")
+		}
+
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, "DeletedOrphanedLoadBalancerResource") {
+				t.Errorf("event = %q, want DeletedOrphanedLoadBalancerResource", event)
+			}
+		default:
+			t.Errorf("expected an event")
+		}
+	})
+
+	t.Run("dry-run only records events", func(t *testing.T) {
+		cs, _, recorder, now := setup(t, true)
+
+		if err := cs.sweepLoadBalancerResources(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		*now = now.Add(11 * time.Minute)
+		if err := cs.sweepLoadBalancerResources(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, "OrphanedLoadBalancerResource") || !strings.Contains(event, "dry-run") {
+				t.Errorf("event = %q, want dry-run OrphanedLoadBalancerResource", event)
+			}
+		default:
+			t.Errorf("expected an event")
+		}
+	})
+}
+
+func TestSweepStaleIPSharerTags(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+	mockFirewall := cloudstack.NewMockFirewallServiceIface(ctrl)
+	mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+	mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+	mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+	mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(&cloudstack.ListLoadBalancerRulesParams{}).AnyTimes()
+	mockLB.EXPECT().ListLoadBalancerRules(gomock.Any()).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil).AnyTimes()
+	mockLB.EXPECT().NewListLoadBalancersParams().Return(&cloudstack.ListLoadBalancersParams{}).AnyTimes()
+	mockLB.EXPECT().ListLoadBalancers(gomock.Any()).Return(&cloudstack.ListLoadBalancersResponse{}, nil).AnyTimes()
+	mockFirewall.EXPECT().NewListFirewallRulesParams().Return(&cloudstack.ListFirewallRulesParams{}).AnyTimes()
+	mockFirewall.EXPECT().ListFirewallRules(gomock.Any()).Return(&cloudstack.ListFirewallRulesResponse{}, nil).AnyTimes()
+	mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}).AnyTimes()
+	mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(&cloudstack.ListNetworkACLsResponse{}, nil).AnyTimes()
+	mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}).AnyTimes()
+	mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{}, nil).AnyTimes()
+
+	staleTag := cloudstack.Tags{Key: tagIPSharerPrefix + "uid-deleted", Value: "prod/default/deleted-service"}
+	liveTag := cloudstack.Tags{Key: tagIPSharerPrefix + "uid-live", Value: "prod/default/live-service"}
+	otherClusterTag := cloudstack.Tags{Key: tagIPSharerPrefix + "uid-other", Value: "staging/default/web"}
+	mockTags.EXPECT().NewListTagsParams().Return(&cloudstack.ListTagsParams{}).AnyTimes()
+	mockTags.EXPECT().ListTags(gomock.Any()).Return(&cloudstack.ListTagsResponse{
+		Count: 4,
+		Tags: []*cloudstack.Tag{
+			{Key: staleTag.Key, Value: staleTag.Value, Resourceid: "ip-1", Resourcetype: resourceTypePublicIPAddress},
+			{Key: liveTag.Key, Value: liveTag.Value, Resourceid: "ip-1", Resourcetype: resourceTypePublicIPAddress},
+			{Key: otherClusterTag.Key, Value: otherClusterTag.Value, Resourceid: "ip-2", Resourcetype: resourceTypePublicIPAddress},
+			{Key: tagIPSharingKey, Value: "frontend", Resourceid: "ip-1", Resourcetype: resourceTypePublicIPAddress},
+		},
+	}, nil).AnyTimes()
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "live-service", Namespace: "default", UID: "uid-live"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeLoadBalancer},
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{
+			LoadBalancer: mockLB,
+			Firewall:     mockFirewall,
+			NetworkACL:   mockNetworkACL,
+			Address:      mockAddress,
+			Resourcetags: mockTags,
+		},
+		clusterName:   "prod",
+		serviceLister: corelisters.NewServiceLister(indexer),
+		sweeper: &loadBalancerSweeper{
+			interval:      time.Minute,
+			gracePeriod:   10 * time.Minute,
+			orphanedSince: make(map[string]time.Time),
+			now:           func() time.Time { return now },
+		},
+	}
+
+	if err := cs.sweepLoadBalancerResources(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := cs.sweeper.orphanedSince["ip-1/"+staleTag.Key]; !ok {
+		t.Fatalf("expected the stale sharer tag to be tracked")
+	}
+	if len(cs.sweeper.orphanedSince) != 1 {
+		t.Fatalf("tracked %v, want only the stale sharer tag", cs.sweeper.orphanedSince)
+	}
+
+	// The IP was handed over to its sharers, but the live service still uses it.
+	mockAddress.EXPECT().GetPublicIpAddressByID("ip-1").Return(&cloudstack.PublicIpAddress{
+		Id:        "ip-1",
+		Ipaddress: "203.0.113.1",
+		Tags:      []cloudstack.Tags{staleTag, liveTag, {Key: tagIPReleaseWithLastSharer, Value: "true"}},
+	}, 1, nil)
+	deleteParams := &cloudstack.DeleteTagsParams{}
+	mockTags.EXPECT().NewDeleteTagsParams([]string{"ip-1"}, resourceTypePublicIPAddress).Return(deleteParams)
+	mockTags.EXPECT().DeleteTags(deleteParams).Return(&cloudstack.DeleteTagsResponse{}, nil)
+
+	now = now.Add(11 * time.Minute)
+	if err := cs.sweepLoadBalancerResources(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tags, _ := deleteParams.GetTags(); len(tags) != 1 || tags[staleTag.Key] != staleTag.Value {
+		t.Errorf("deleted tags = %v, want the stale sharer tag", tags)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Resource tags set on every CloudStack object the controller creates for a service.
+const (
+	tagClusterName      = "kubernetes-cluster"
+	tagServiceNamespace = "kubernetes-service-namespace"
+	tagServiceName      = "kubernetes-service-name"
+	tagServiceUID       = "kubernetes-service-uid"
+)
+
+// CloudStack resource types of the objects that are tagged.
+const (
+	resourceTypeLoadBalancer    = "LoadBalancer"
+	resourceTypePublicIPAddress = "PublicIpAddress"
+	resourceTypeFirewallRule    = "FirewallRule"
+	resourceTypeNetworkACL      = "NetworkACL"
+)
+
+// serviceTags returns the tags of the CloudStack objects created for the service.
+func serviceTags(clusterName string, service *corev1.Service) map[string]string {
+	tags := map[string]string{
+		tagServiceNamespace: service.Namespace,
+		tagServiceName:      service.Name,
+	}
+	if service.UID != "" {
+		tags[tagServiceUID] = string(service.UID)
+	}
+	if clusterName != "" {
+		tags[tagClusterName] = clusterName
+	}
+
+	return tags
+}
+
+// ownerTags returns the tags used to look up the objects of the load balancer, or nil if the
+// service has no UID to look them up with.
+func (lb *loadBalancer) ownerTags() map[string]string {
+	uid := lb.tags[tagServiceUID]
+	if uid == "" {
+		return nil
+	}
+
+	owner := map[string]string{tagServiceUID: uid}
+	if clusterName := lb.tags[tagClusterName]; clusterName != "" {
+		owner[tagClusterName] = clusterName
+	}
+
+	return owner
+}
+
+// tagResource sets the tags of the load balancer on a CloudStack object.
+func (lb *loadBalancer) tagResource(resourceType string, resourceID string) error {
+	if len(lb.tags) == 0 || resourceID == "" {
+		return nil
+	}
+
+	p := lb.Resourcetags.NewCreateTagsParams([]string{resourceID}, resourceType, lb.tags)
+
+	if _, err := lb.Resourcetags.CreateTags(p); err != nil {
+		return fmt.Errorf("error tagging %v %v: %v", resourceType, resourceID, err)
+	}
+
+	return nil
+}
+
+// getTag returns the value of a tag.
+func getTag(tags []cloudstack.Tags, key string) (string, bool) {
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag.Value, true
+		}
+	}
+	return "", false
+}
+
+// isOwnedByOtherService returns true if the tags show that the object belongs to another service.
+// Untagged objects were created before tagging was introduced and are not excluded.
+func (lb *loadBalancer) isOwnedByOtherService(tags []cloudstack.Tags) bool {
+	uid := lb.tags[tagServiceUID]
+	if uid == "" {
+		return false
+	}
+
+	owner, ok := getTag(tags, tagServiceUID)
+	return ok && owner != uid
+}
+
+// adoptLegacyLoadBalancerRules looks up the rules of the load balancer by keyword, the way they
+// were found before tagging was introduced. Untagged rules are renamed to the cluster-scoped name
+// and tagged, so the next lookup finds them by their tags. Rules that are tagged already belong
+// to another service or cluster and are ignored.
+func (lb *loadBalancer) adoptLegacyLoadBalancerRules(legacyName string) ([]*cloudstack.LoadBalancerRule, error) {
+	p := lb.LoadBalancer.NewListLoadBalancerRulesParams()
+	p.SetKeyword(legacyName)
+	p.SetListall(true)
+
+	if lb.projectID != "" {
+		p.SetProjectid(lb.projectID)
+	}
+
+	l, err := lb.LoadBalancer.ListLoadBalancerRules(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving load balancer rules: %v", err)
+	}
+
+	var rules []*cloudstack.LoadBalancerRule
+	for _, lbRule := range l.LoadBalancerRules {
+		if _, tagged := getTag(lbRule.Tags, tagServiceUID); tagged {
+			continue
+		}
+
+		name := lbRule.Name
+		if !strings.HasPrefix(name, lb.name+"-") && strings.HasPrefix(name, legacyName+"-") {
+			name = lb.name + strings.TrimPrefix(name, legacyName)
+		}
+
+		// Only adopt rules when the cluster is known, so they can be found by all their owner tags.
+		if lb.ownerTags() != nil && lb.tags[tagClusterName] != "" {
+			if name != lbRule.Name {
+				klog.V(4).Infof("Renaming load balancer rule %v to %v", lbRule.Name, name)
+				up := lb.LoadBalancer.NewUpdateLoadBalancerRuleParams(lbRule.Id)
+				up.SetName(name)
+				if _, err := lb.LoadBalancer.UpdateLoadBalancerRule(up); err != nil {
+					return nil, fmt.Errorf("error renaming load balancer rule %v: %v", lbRule.Name, err)
+				}
+				lbRule.Name = name
+			}
+
+			klog.V(4).Infof("Adopting untagged load balancer rule %v", lbRule.Name)
+			if err := lb.tagResource(resourceTypeLoadBalancer, lbRule.Id); err != nil {
+				return nil, err
+			}
+		}
+
+		rules = append(rules, lbRule)
+	}
+
+	return rules, nil
+}
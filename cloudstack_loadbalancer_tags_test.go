@@ -0,0 +1,207 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTaggedService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-service",
+			Namespace: "default",
+			UID:       "0f0e0d0c-0b0a-0908-0706-050403020100",
+		},
+	}
+}
+
+func TestGetLoadBalancerName(t *testing.T) {
+	cs := &CSCloud{}
+	service := newTaggedService()
+
+	if got, want := cs.GetLoadBalancerName(context.Background(), "", service), "a0f0e0d0c0b0a09080706050403020100"[:32]; got != want {
+		t.Errorf("GetLoadBalancerName() = %q, want %q", got, want)
+	}
+	if got, want := cs.GetLoadBalancerName(context.Background(), "prod", service), "prod-"+"a0f0e0d0c0b0a09080706050403020100"[:32]; got != want {
+		t.Errorf("GetLoadBalancerName() = %q, want %q", got, want)
+	}
+}
+
+func TestServiceTags(t *testing.T) {
+	service := newTaggedService()
+
+	want := map[string]string{
+		tagClusterName:      "prod",
+		tagServiceNamespace: "default",
+		tagServiceName:      "test-service",
+		tagServiceUID:       "0f0e0d0c-0b0a-0908-0706-050403020100",
+	}
+	if got := serviceTags("prod", service); !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceTags() = %v, want %v", got, want)
+	}
+
+	lb := &loadBalancer{tags: want}
+	wantOwner := map[string]string{
+		tagClusterName: "prod",
+		tagServiceUID:  "0f0e0d0c-0b0a-0908-0706-050403020100",
+	}
+	if got := lb.ownerTags(); !reflect.DeepEqual(got, wantOwner) {
+		t.Errorf("ownerTags() = %v, want %v", got, wantOwner)
+	}
+
+	lb = &loadBalancer{tags: serviceTags("", &corev1.Service{})}
+	if got := lb.ownerTags(); got != nil {
+		t.Errorf("ownerTags() = %v, want nil", got)
+	}
+}
+
+func TestIsOwnedByOtherService(t *testing.T) {
+	lb := &loadBalancer{tags: map[string]string{tagServiceUID: "uid-1"}}
+
+	tests := []struct {
+		name string
+		tags []cloudstack.Tags
+		want bool
+	}{
+		{name: "untagged", want: false},
+		{name: "same service", tags: []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-1"}}, want: false},
+		{name: "other service", tags: []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-2"}}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lb.isOwnedByOtherService(tt.tags); got != tt.want {
+				t.Errorf("isOwnedByOtherService() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetLoadBalancerByTags(t *testing.T) {
+	service := newTaggedService()
+	legacyName := "a0f0e0d0c0b0a09080706050403020100"[:32]
+
+	t.Run("finds tagged rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		listParams := &cloudstack.ListLoadBalancerRulesParams{}
+		listResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count: 1,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Id: "rule-1", Name: "prod-" + legacyName + "-tcp-80", Publicip: "203.0.113.1", Publicipid: "ip-123"},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(listParams),
+			mockLB.EXPECT().ListLoadBalancerRules(listParams).Return(listResp, nil),
+		)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+			},
+		}
+
+		lb, err := cs.getLoadBalancer("prod", service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if _, ok := lb.rules["prod-"+legacyName+"-tcp-80"]; !ok {
+			t.Errorf("rules = %v, want rule prod-%s-tcp-80", lb.rules, legacyName)
+		}
+		if tags, _ := listParams.GetTags(); tags[tagServiceUID] != string(service.UID) || tags[tagClusterName] != "prod" {
+			t.Errorf("lookup tags = %v, want service UID and cluster name", tags)
+		}
+		if _, ok := listParams.GetKeyword(); ok {
+			t.Errorf("expected lookup without keyword")
+		}
+	})
+
+	t.Run("adopts untagged legacy rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockLB := cloudstack.NewMockLoadBalancerServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		tagListParams := &cloudstack.ListLoadBalancerRulesParams{}
+		legacyListParams := &cloudstack.ListLoadBalancerRulesParams{}
+		updateParams := &cloudstack.UpdateLoadBalancerRuleParams{}
+		createTagsParams := &cloudstack.CreateTagsParams{}
+		legacyResp := &cloudstack.ListLoadBalancerRulesResponse{
+			Count: 2,
+			LoadBalancerRules: []*cloudstack.LoadBalancerRule{
+				{Id: "rule-1", Name: legacyName + "-tcp-80", Publicip: "203.0.113.1", Publicipid: "ip-123"},
+				{
+					Id:         "rule-2",
+					Name:       "other-" + legacyName + "-tcp-80",
+					Publicip:   "203.0.113.2",
+					Publicipid: "ip-456",
+					Tags:       []cloudstack.Tags{{Key: tagServiceUID, Value: string(service.UID)}, {Key: tagClusterName, Value: "other"}},
+				},
+			},
+		}
+
+		gomock.InOrder(
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(tagListParams),
+			mockLB.EXPECT().ListLoadBalancerRules(tagListParams).Return(&cloudstack.ListLoadBalancerRulesResponse{}, nil),
+			mockLB.EXPECT().NewListLoadBalancerRulesParams().Return(legacyListParams),
+			mockLB.EXPECT().ListLoadBalancerRules(legacyListParams).Return(legacyResp, nil),
+			mockLB.EXPECT().NewUpdateLoadBalancerRuleParams("rule-1").Return(updateParams),
+			mockLB.EXPECT().UpdateLoadBalancerRule(updateParams).Return(&cloudstack.UpdateLoadBalancerRuleResponse{}, nil),
+			mockTags.EXPECT().NewCreateTagsParams([]string{"rule-1"}, resourceTypeLoadBalancer, serviceTags("prod", service)).Return(createTagsParams),
+			mockTags.EXPECT().CreateTags(createTagsParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+		)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				LoadBalancer: mockLB,
+				Resourcetags: mockTags,
+			},
+		}
+
+		lb, err := cs.getLoadBalancer("prod", service)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if name, _ := updateParams.GetName(); name != "prod-"+legacyName+"-tcp-80" {
+			t.Errorf("renamed to %q, want %q", name, "prod-"+legacyName+"-tcp-80")
+		}
+		if len(lb.rules) != 1 {
+			t.Fatalf("rules count = %d, want 1", len(lb.rules))
+		}
+		if _, ok := lb.rules["prod-"+legacyName+"-tcp-80"]; !ok {
+			t.Errorf("rules = %v, want adopted rule", lb.rules)
+		}
+		if lb.ipAddr != "203.0.113.1" {
+			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
+		}
+	})
+}
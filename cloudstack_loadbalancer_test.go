@@ -31,6 +31,7 @@ import (
 	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 func TestCompareStringSlice(t *testing.T) {
@@ -341,6 +342,146 @@ func TestIsNetworkACLSupported(t *testing.T) {
 	}
 }
 
+func TestIsLoadBalancerAlgorithmSupported(t *testing.T) {
+	lbService := func(value string) []cloudstack.NetworkServiceInternal {
+		return []cloudstack.NetworkServiceInternal{
+			{Name: "Dhcp"},
+			{
+				Name: "Lb",
+				Capability: []cloudstack.NetworkServiceInternalCapability{
+					{Name: "SupportedProtocols", Value: "tcp, udp, tcp-proxy"},
+					{Name: "SupportedLbAlgorithms", Value: value},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		services  []cloudstack.NetworkServiceInternal
+		algorithm string
+		want      bool
+	}{
+		{
+			name:      "nil services",
+			services:  nil,
+			algorithm: "leastconn",
+			want:      true,
+		},
+		{
+			name:      "algorithms not advertised",
+			services:  []cloudstack.NetworkServiceInternal{{Name: "Lb"}},
+			algorithm: "leastconn",
+			want:      true,
+		},
+		{
+			name:      "algorithm advertised",
+			services:  lbService("roundrobin,leastconn,source"),
+			algorithm: "leastconn",
+			want:      true,
+		},
+		{
+			name:      "algorithm advertised with spaces and different case",
+			services:  lbService("RoundRobin, LeastConn, Source"),
+			algorithm: "leastconn",
+			want:      true,
+		},
+		{
+			name:      "algorithm not advertised",
+			services:  lbService("roundrobin,source"),
+			algorithm: "leastconn",
+			want:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLoadBalancerAlgorithmSupported(tt.services, tt.algorithm); got != tt.want {
+				t.Errorf("isLoadBalancerAlgorithmSupported() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetLoadBalancerAlgorithm(t *testing.T) {
+	tests := []struct {
+		name        string
+		affinity    corev1.ServiceAffinity
+		annotations map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:     "no affinity defaults to roundrobin",
+			affinity: corev1.ServiceAffinityNone,
+			want:     "roundrobin",
+		},
+		{
+			name:     "client IP affinity maps to source",
+			affinity: corev1.ServiceAffinityClientIP,
+			want:     "source",
+		},
+		{
+			name:        "annotation selects leastconn",
+			affinity:    corev1.ServiceAffinityNone,
+			annotations: map[string]string{ServiceAnnotationLoadBalancerAlgorithm: "leastconn"},
+			want:        "leastconn",
+		},
+		{
+			name:        "annotation is case insensitive",
+			affinity:    corev1.ServiceAffinityNone,
+			annotations: map[string]string{ServiceAnnotationLoadBalancerAlgorithm: "LeastConn"},
+			want:        "leastconn",
+		},
+		{
+			name:        "client IP affinity with source annotation",
+			affinity:    corev1.ServiceAffinityClientIP,
+			annotations: map[string]string{ServiceAnnotationLoadBalancerAlgorithm: "source"},
+			want:        "source",
+		},
+		{
+			name:        "client IP affinity conflicts with leastconn",
+			affinity:    corev1.ServiceAffinityClientIP,
+			annotations: map[string]string{ServiceAnnotationLoadBalancerAlgorithm: "leastconn"},
+			wantErr:     true,
+		},
+		{
+			name:     "unsupported affinity",
+			affinity: corev1.ServiceAffinity("Unknown"),
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-service",
+					Namespace:   "default",
+					Annotations: tt.annotations,
+				},
+				Spec: corev1.ServiceSpec{
+					SessionAffinity: tt.affinity,
+				},
+			}
+
+			got, err := getLoadBalancerAlgorithm(service)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("getLoadBalancerAlgorithm() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestGetStringFromServiceAnnotation(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -1054,18 +1195,25 @@ func TestGetPublicIPAddress(t *testing.T) {
 		gomock.InOrder(
 			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams),
 			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}),
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
 		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
 				Address: mockAddress,
 			},
+			ipLocks: &keyedMutex{},
 		}
 
-		err := lb.getPublicIPAddress("203.0.113.1")
+		unlock, err := lb.getPublicIPAddress("203.0.113.1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		if len(lb.ipLocks.locks) != 1 {
+			t.Errorf("IP is not locked")
+		}
+		unlock()
 		if lb.ipAddr != "203.0.113.1" {
 			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
 		}
@@ -1107,6 +1255,8 @@ func TestGetPublicIPAddress(t *testing.T) {
 		gomock.InOrder(
 			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams),
 			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}),
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
 			mockNetwork.EXPECT().GetNetworkByID("net-123", gomock.Any()).Return(networkResp, 1, nil),
 			mockAddress.EXPECT().NewAssociateIpAddressParams().Return(associateParams),
 			mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(associateResp, nil),
@@ -1117,14 +1267,16 @@ func TestGetPublicIPAddress(t *testing.T) {
 				Address: mockAddress,
 				Network: mockNetwork,
 			},
+			ipLocks:   &keyedMutex{},
 			networkID: "net-123",
 			ipAddr:    "203.0.113.1",
 		}
 
-		err := lb.getPublicIPAddress("203.0.113.1")
+		unlock, err := lb.getPublicIPAddress("203.0.113.1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		unlock()
 		if lb.ipAddr != "203.0.113.1" {
 			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
 		}
@@ -1155,7 +1307,7 @@ func TestGetPublicIPAddress(t *testing.T) {
 			},
 		}
 
-		err := lb.getPublicIPAddress("203.0.113.1")
+		_, err := lb.getPublicIPAddress("203.0.113.1")
 		if err == nil {
 			t.Fatalf("expected error for IP not found")
 		}
@@ -1189,7 +1341,7 @@ func TestGetPublicIPAddress(t *testing.T) {
 			},
 		}
 
-		err := lb.getPublicIPAddress("203.0.113.1")
+		_, err := lb.getPublicIPAddress("203.0.113.1")
 		if err == nil {
 			t.Fatalf("expected error for multiple IPs found")
 		}
@@ -1217,7 +1369,7 @@ func TestGetPublicIPAddress(t *testing.T) {
 			},
 		}
 
-		err := lb.getPublicIPAddress("203.0.113.1")
+		_, err := lb.getPublicIPAddress("203.0.113.1")
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -1246,19 +1398,23 @@ func TestGetPublicIPAddress(t *testing.T) {
 		gomock.InOrder(
 			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams),
 			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}),
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
 		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
 				Address: mockAddress,
 			},
+			ipLocks:   &keyedMutex{},
 			projectID: "proj-123",
 		}
 
-		err := lb.getPublicIPAddress("203.0.113.1")
+		unlock, err := lb.getPublicIPAddress("203.0.113.1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		unlock()
 		if lb.ipAddr != "203.0.113.1" {
 			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
 		}
@@ -1266,6 +1422,46 @@ func TestGetPublicIPAddress(t *testing.T) {
 			t.Errorf("ipAddrID = %q, want %q", lb.ipAddrID, "ip-123")
 		}
 	})
+
+	t.Run("IP associated by another service since the lookup", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockAddress := cloudstack.NewMockAddressServiceIface(ctrl)
+		lockParams := &cloudstack.ListPublicIpAddressesParams{}
+
+		gomock.InOrder(
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}),
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             1,
+				PublicIpAddresses: []*cloudstack.PublicIpAddress{{Id: "ip-123", Ipaddress: "203.0.113.1"}},
+			}, nil),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(lockParams),
+			mockAddress.EXPECT().ListPublicIpAddresses(lockParams).Return(&cloudstack.ListPublicIpAddressesResponse{
+				Count:             1,
+				PublicIpAddresses: []*cloudstack.PublicIpAddress{{Id: "ip-123", Ipaddress: "203.0.113.1", Allocated: "2023-01-01T00:00:00+0000"}},
+			}, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Address: mockAddress,
+			},
+			ipLocks: &keyedMutex{},
+		}
+
+		unlock, err := lb.getPublicIPAddress("203.0.113.1")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		unlock()
+		if lb.ipAssociatedByController {
+			t.Errorf("IP associated again")
+		}
+		if id, _ := lockParams.GetId(); id != "ip-123" {
+			t.Errorf("retrieved IP %q after locking, want ip-123", id)
+		}
+	})
 }
 
 func TestAssociatePublicIPAddress(t *testing.T) {
@@ -1569,18 +1765,22 @@ func TestGetLoadBalancerIP(t *testing.T) {
 		gomock.InOrder(
 			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams),
 			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}),
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
 		)
 
 		lb := &loadBalancer{
 			CloudStackClient: &cloudstack.CloudStackClient{
 				Address: mockAddress,
 			},
+			ipLocks: &keyedMutex{},
 		}
 
-		err := lb.getLoadBalancerIP("203.0.113.1")
+		unlock, err := lb.getLoadBalancerIP("203.0.113.1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		unlock()
 		if lb.ipAddr != "203.0.113.1" {
 			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
 		}
@@ -1619,6 +1819,8 @@ func TestGetLoadBalancerIP(t *testing.T) {
 		gomock.InOrder(
 			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(listParams),
 			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
+			mockAddress.EXPECT().NewListPublicIpAddressesParams().Return(&cloudstack.ListPublicIpAddressesParams{}),
+			mockAddress.EXPECT().ListPublicIpAddresses(gomock.Any()).Return(resp, nil),
 			mockNetwork.EXPECT().GetNetworkByID("net-123", gomock.Any()).Return(networkResp, 1, nil),
 			mockAddress.EXPECT().NewAssociateIpAddressParams().Return(associateParams),
 			mockAddress.EXPECT().AssociateIpAddress(gomock.Any()).Return(associateResp, nil),
@@ -1629,14 +1831,16 @@ func TestGetLoadBalancerIP(t *testing.T) {
 				Address: mockAddress,
 				Network: mockNetwork,
 			},
+			ipLocks:   &keyedMutex{},
 			networkID: "net-123",
 			ipAddr:    "203.0.113.1",
 		}
 
-		err := lb.getLoadBalancerIP("203.0.113.1")
+		unlock, err := lb.getLoadBalancerIP("203.0.113.1")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		unlock()
 		if lb.ipAddr != "203.0.113.1" {
 			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
 		}
@@ -1677,13 +1881,15 @@ func TestGetLoadBalancerIP(t *testing.T) {
 				Address: mockAddress,
 				Network: mockNetwork,
 			},
+			ipLocks:   &keyedMutex{},
 			networkID: "net-123",
 		}
 
-		err := lb.getLoadBalancerIP("")
+		unlock, err := lb.getLoadBalancerIP("")
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
+		unlock()
 		if lb.ipAddr != "203.0.113.1" {
 			t.Errorf("ipAddr = %q, want %q", lb.ipAddr, "203.0.113.1")
 		}
@@ -2844,7 +3050,7 @@ func TestUpdateNetworkACL(t *testing.T) {
 			},
 		}
 
-		updated, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123")
+		updated, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{defaultAllowedCIDR})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -2875,10 +3081,14 @@ func TestUpdateNetworkACL(t *testing.T) {
 			Count: 1,
 			NetworkACLs: []*cloudstack.NetworkACL{
 				{
-					Id:        "acl-rule-123",
-					Protocol:  "tcp",
-					Startport: "80",
-					Endport:   "80",
+					Id:          "acl-rule-123",
+					Action:      "Allow",
+					Cidrlist:    "0.0.0.0/0",
+					Number:      1,
+					Protocol:    "tcp",
+					Startport:   "80",
+					Endport:     "80",
+					Traffictype: "Ingress",
 				},
 			},
 		}
@@ -2897,7 +3107,7 @@ func TestUpdateNetworkACL(t *testing.T) {
 			},
 		}
 
-		updated, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123")
+		updated, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{defaultAllowedCIDR})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -2935,7 +3145,7 @@ func TestUpdateNetworkACL(t *testing.T) {
 			},
 		}
 
-		updated, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123")
+		updated, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{defaultAllowedCIDR})
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -2959,7 +3169,7 @@ func TestUpdateNetworkACL(t *testing.T) {
 			},
 		}
 
-		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123")
+		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{defaultAllowedCIDR})
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -2994,7 +3204,7 @@ func TestUpdateNetworkACL(t *testing.T) {
 			},
 		}
 
-		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123")
+		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{defaultAllowedCIDR})
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -3037,7 +3247,7 @@ func TestUpdateNetworkACL(t *testing.T) {
 			},
 		}
 
-		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123")
+		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{defaultAllowedCIDR})
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -3088,7 +3298,7 @@ func TestUpdateNetworkACL(t *testing.T) {
 			},
 		}
 
-		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123")
+		_, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{defaultAllowedCIDR})
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -3110,9 +3320,11 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 			NetworkACLs: []*cloudstack.NetworkACL{
 				{
 					Id:        "acl-rule-123",
+					Action:    "Allow",
 					Protocol:  "tcp",
 					Startport: "80",
 					Endport:   "80",
+					Tags:      []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-a"}},
 				},
 			},
 		}
@@ -3130,6 +3342,7 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 			CloudStackClient: &cloudstack.CloudStackClient{
 				NetworkACL: mockNetworkACL,
 			},
+			tags: map[string]string{tagServiceUID: "uid-a"},
 		}
 
 		deleted, err := lb.deleteNetworkACLRule(80, LoadBalancerProtocolTCP, "net-123")
@@ -3141,6 +3354,36 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 		}
 	})
 
+	t.Run("untagged rules are kept", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 2,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-operator", Action: "Allow", Protocol: "tcp", Startport: "80", Endport: "80"},
+				{Id: "acl-rule-other", Action: "Allow", Protocol: "tcp", Startport: "80", Endport: "80", Tags: []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-b"}}},
+			},
+		}
+
+		gomock.InOrder(
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+		)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				NetworkACL: mockNetworkACL,
+			},
+			tags: map[string]string{tagServiceUID: "uid-a"},
+		}
+
+		if _, err := lb.deleteNetworkACLRule(80, LoadBalancerProtocolTCP, "net-123"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
 	t.Run("no matching rules", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
@@ -3161,6 +3404,7 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 			CloudStackClient: &cloudstack.CloudStackClient{
 				NetworkACL: mockNetworkACL,
 			},
+			tags: map[string]string{tagServiceUID: "uid-a"},
 		}
 
 		deleted, err := lb.deleteNetworkACLRule(80, LoadBalancerProtocolTCP, "net-123")
@@ -3189,6 +3433,7 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 			CloudStackClient: &cloudstack.CloudStackClient{
 				NetworkACL: mockNetworkACL,
 			},
+			tags: map[string]string{tagServiceUID: "uid-a"},
 		}
 
 		_, err := lb.deleteNetworkACLRule(80, LoadBalancerProtocolTCP, "net-123")
@@ -3211,9 +3456,11 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 			NetworkACLs: []*cloudstack.NetworkACL{
 				{
 					Id:        "acl-rule-123",
+					Action:    "Allow",
 					Protocol:  "tcp",
 					Startport: "80",
 					Endport:   "80",
+					Tags:      []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-a"}},
 				},
 			},
 		}
@@ -3232,6 +3479,7 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 			CloudStackClient: &cloudstack.CloudStackClient{
 				NetworkACL: mockNetworkACL,
 			},
+			tags: map[string]string{tagServiceUID: "uid-a"},
 		}
 
 		deleted, err := lb.deleteNetworkACLRule(80, LoadBalancerProtocolTCP, "net-123")
@@ -3244,6 +3492,436 @@ func TestDeleteNetworkACLRule(t *testing.T) {
 	})
 }
 
+func TestGetSourceRanges(t *testing.T) {
+	tests := []struct {
+		name         string
+		sourceRanges []string
+		annotations  map[string]string
+		want         []string
+		wantErr      bool
+	}{
+		{name: "default", want: []string{"0.0.0.0/0"}},
+		{name: "annotation", annotations: map[string]string{ServiceAnnotationLoadBalancerSourceCidrs: "10.0.0.0/8, 192.168.0.0/16"}, want: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{name: "spec takes precedence", sourceRanges: []string{"172.16.0.0/12"}, annotations: map[string]string{ServiceAnnotationLoadBalancerSourceCidrs: "10.0.0.0/8"}, want: []string{"172.16.0.0/12"}},
+		{name: "invalid spec range", sourceRanges: []string{"not-a-cidr"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Annotations: tt.annotations},
+				Spec:       corev1.ServiceSpec{LoadBalancerSourceRanges: tt.sourceRanges},
+			}
+
+			lb := &loadBalancer{}
+			got, err := lb.getSourceRanges(service)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("getSourceRanges() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateNetworkACLSourceRanges(t *testing.T) {
+	networkResp := &cloudstack.Network{
+		Id:      "net-123",
+		Aclid:   "acl-456",
+		Service: []cloudstack.NetworkServiceInternal{},
+	}
+	aclListResp := &cloudstack.NetworkACLList{
+		Id:   "acl-456",
+		Name: "custom-acl",
+	}
+
+	owned := []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-a"}}
+	ownerTags := map[string]string{tagServiceUID: "uid-a"}
+
+	t.Run("replaces open rule with allow and deny rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 2,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-open", Action: "Allow", Cidrlist: "0.0.0.0/0", Number: 1, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress", Tags: owned},
+				{Id: "acl-rule-ssh", Action: "Allow", Cidrlist: "10.0.0.0/8", Number: 2, Protocol: "tcp", Startport: "22", Endport: "22", Traffictype: "Ingress"},
+			},
+		}
+
+		deleteParams := &cloudstack.DeleteNetworkACLParams{}
+		createParams := []*cloudstack.CreateNetworkACLParams{{}, {}, {}}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(networkResp, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-456").Return(aclListResp, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+			mockNetworkACL.EXPECT().NewDeleteNetworkACLParams("acl-rule-open").Return(deleteParams),
+			mockNetworkACL.EXPECT().DeleteNetworkACL(deleteParams).Return(&cloudstack.DeleteNetworkACLResponse{}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[0]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[0]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-1"}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[1]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[1]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-2"}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[2]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[2]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-3"}, nil),
+		)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), resourceTypeNetworkACL, ownerTags).Return(&cloudstack.CreateTagsParams{}).AnyTimes()
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil).AnyTimes()
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: ownerTags,
+		}
+
+		if _, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{"192.168.0.0/16", "10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		want := []struct {
+			action string
+			cidr   string
+			number int
+		}{
+			{action: "Allow", cidr: "10.0.0.0/8", number: 3},
+			{action: "Allow", cidr: "192.168.0.0/16", number: 4},
+			{action: "Deny", cidr: "0.0.0.0/0", number: 1002},
+		}
+		for i, w := range want {
+			action, _ := createParams[i].GetAction()
+			cidrs, _ := createParams[i].GetCidrlist()
+			number, _ := createParams[i].GetNumber()
+			if action != w.action || !reflect.DeepEqual(cidrs, []string{w.cidr}) || number != w.number {
+				t.Errorf("rule %d = %v %v #%v, want %v %v #%v", i, action, cidrs, number, w.action, w.cidr, w.number)
+			}
+		}
+	})
+
+	t.Run("moves rules after the operator rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 3,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-allow", Action: "Allow", Cidrlist: "10.0.0.0/8", Number: 1, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress", Tags: owned},
+				{Id: "acl-rule-operator", Action: "Deny", Cidrlist: "10.66.0.0/16", Number: 2, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress"},
+				{Id: "acl-rule-deny", Action: "Deny", Cidrlist: "0.0.0.0/0", Number: 3, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress", Tags: owned},
+			},
+		}
+
+		deleteParams := []*cloudstack.DeleteNetworkACLParams{{}, {}}
+		createParams := []*cloudstack.CreateNetworkACLParams{{}, {}}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(networkResp, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-456").Return(aclListResp, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+			mockNetworkACL.EXPECT().NewDeleteNetworkACLParams("acl-rule-allow").Return(deleteParams[0]),
+			mockNetworkACL.EXPECT().DeleteNetworkACL(deleteParams[0]).Return(&cloudstack.DeleteNetworkACLResponse{}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[0]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[0]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-allow-2"}, nil),
+			mockNetworkACL.EXPECT().NewDeleteNetworkACLParams("acl-rule-deny").Return(deleteParams[1]),
+			mockNetworkACL.EXPECT().DeleteNetworkACL(deleteParams[1]).Return(&cloudstack.DeleteNetworkACLResponse{}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[1]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[1]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-deny-2"}, nil),
+		)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), resourceTypeNetworkACL, ownerTags).Return(&cloudstack.CreateTagsParams{}).AnyTimes()
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil).AnyTimes()
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: ownerTags,
+		}
+
+		if _, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if number, _ := createParams[0].GetNumber(); number != 4 {
+			t.Errorf("allow number = %d, want 4", number)
+		}
+		if number, _ := createParams[1].GetNumber(); number != 1002 {
+			t.Errorf("deny number = %d, want 1002", number)
+		}
+	})
+
+	t.Run("numbers rules before the copied rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 1,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-copy", Action: "Allow", Cidrlist: "0.0.0.0/0", Number: 1 + copiedNetworkACLNumberOffset, Protocol: "all", Traffictype: "Ingress", Tags: []cloudstack.Tags{{Key: tagCopiedNetworkACLRule, Value: "acl-default"}}},
+			},
+		}
+
+		createParams := []*cloudstack.CreateNetworkACLParams{{}, {}}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(networkResp, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-456").Return(aclListResp, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[0]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[0]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-allow"}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[1]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[1]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-deny"}, nil),
+		)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), resourceTypeNetworkACL, ownerTags).Return(&cloudstack.CreateTagsParams{}).AnyTimes()
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil).AnyTimes()
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: ownerTags,
+		}
+
+		if _, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if number, _ := createParams[0].GetNumber(); number != 1 {
+			t.Errorf("allow number = %d, want 1", number)
+		}
+		if number, _ := createParams[1].GetNumber(); number != networkACLDenyNumberOffset {
+			t.Errorf("deny number = %d, want %d", number, networkACLDenyNumberOffset)
+		}
+	})
+
+	t.Run("keeps rules in order", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 3,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-operator", Action: "Deny", Cidrlist: "10.66.0.0/16", Number: 1, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress"},
+				{Id: "acl-rule-allow", Action: "Allow", Cidrlist: "10.0.0.0/8", Number: 2, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress", Tags: owned},
+				{Id: "acl-rule-deny", Action: "Deny", Cidrlist: "0.0.0.0/0", Number: 1001, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress", Tags: owned},
+			},
+		}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(networkResp, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-456").Return(aclListResp, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+		)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), resourceTypeNetworkACL, ownerTags).Return(&cloudstack.CreateTagsParams{}).AnyTimes()
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil).AnyTimes()
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: ownerTags,
+		}
+
+		if _, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("two services sharing a port with an operator deny rule", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		other := []cloudstack.Tags{{Key: tagServiceUID, Value: "uid-b"}}
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 3,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-operator", Action: "Deny", Cidrlist: "192.0.2.0/24", Number: 1, Protocol: "tcp", Startport: "443", Endport: "443", Traffictype: "Ingress"},
+				{Id: "acl-rule-b-allow", Action: "Allow", Cidrlist: "172.16.0.0/12", Number: 2, Protocol: "tcp", Startport: "443", Endport: "443", Traffictype: "Ingress", Tags: other},
+				{Id: "acl-rule-b-deny", Action: "Deny", Cidrlist: "0.0.0.0/0", Number: 1001, Protocol: "tcp", Startport: "443", Endport: "443", Traffictype: "Ingress", Tags: other},
+			},
+		}
+
+		createParams := []*cloudstack.CreateNetworkACLParams{{}, {}}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(networkResp, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-456").Return(aclListResp, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[0]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[0]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-a-allow"}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[1]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[1]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-a-deny"}, nil),
+		)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), resourceTypeNetworkACL, ownerTags).Return(&cloudstack.CreateTagsParams{}).AnyTimes()
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil).AnyTimes()
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: ownerTags,
+		}
+
+		if _, err := lb.updateNetworkACL(443, LoadBalancerProtocolTCP, "net-123", []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// The allow rule comes after the operator deny rule and before the deny rule of the other
+		// service, and the deny rule comes after the allow rules of both services.
+		if action, _ := createParams[0].GetAction(); action != "Allow" {
+			t.Errorf("action = %q, want Allow", action)
+		}
+		if number, _ := createParams[0].GetNumber(); number != 3 {
+			t.Errorf("allow number = %d, want 3", number)
+		}
+		if action, _ := createParams[1].GetAction(); action != "Deny" {
+			t.Errorf("action = %q, want Deny", action)
+		}
+		if number, _ := createParams[1].GetNumber(); number != 1002 {
+			t.Errorf("deny number = %d, want 1002", number)
+		}
+	})
+
+	t.Run("keeps untagged operator allow rules", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 1,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-operator", Action: "Allow", Cidrlist: "198.51.100.0/24", Number: 1, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress"},
+			},
+		}
+
+		createParams := []*cloudstack.CreateNetworkACLParams{{}, {}}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(networkResp, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-456").Return(aclListResp, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[0]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[0]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-allow"}, nil),
+			mockNetworkACL.EXPECT().NewCreateNetworkACLParams("tcp").Return(createParams[1]),
+			mockNetworkACL.EXPECT().CreateNetworkACL(createParams[1]).Return(&cloudstack.CreateNetworkACLResponse{Id: "acl-rule-deny"}, nil),
+		)
+
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"acl-rule-allow"}, resourceTypeNetworkACL, ownerTags).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().NewCreateTagsParams([]string{"acl-rule-deny"}, resourceTypeNetworkACL, ownerTags).Return(&cloudstack.CreateTagsParams{})
+		mockTags.EXPECT().CreateTags(gomock.Any()).Return(&cloudstack.CreateTagsResponse{}, nil).Times(2)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: ownerTags,
+		}
+
+		if _, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if number, _ := createParams[0].GetNumber(); number != 2 {
+			t.Errorf("allow number = %d, want 2", number)
+		}
+		if number, _ := createParams[1].GetNumber(); number != 1001 {
+			t.Errorf("deny number = %d, want 1001", number)
+		}
+	})
+
+	t.Run("adopts a legacy rule matching a desired rule", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockNetwork := cloudstack.NewMockNetworkServiceIface(ctrl)
+		mockNetworkACL := cloudstack.NewMockNetworkACLServiceIface(ctrl)
+
+		listResp := &cloudstack.ListNetworkACLsResponse{
+			Count: 2,
+			NetworkACLs: []*cloudstack.NetworkACL{
+				{Id: "acl-rule-legacy", Action: "Allow", Cidrlist: "10.0.0.0/8", Number: 5, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress"},
+				{Id: "acl-rule-deny", Action: "Deny", Cidrlist: "0.0.0.0/0", Number: 1005, Protocol: "tcp", Startport: "80", Endport: "80", Traffictype: "Ingress", Tags: owned},
+			},
+		}
+
+		gomock.InOrder(
+			mockNetwork.EXPECT().GetNetworkByID("net-123").Return(networkResp, 1, nil),
+			mockNetworkACL.EXPECT().GetNetworkACLListByID("acl-456").Return(aclListResp, 1, nil),
+			mockNetworkACL.EXPECT().NewListNetworkACLsParams().Return(&cloudstack.ListNetworkACLsParams{}),
+			mockNetworkACL.EXPECT().ListNetworkACLs(gomock.Any()).Return(listResp, nil),
+		)
+
+		tagParams := &cloudstack.CreateTagsParams{}
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+		mockTags.EXPECT().NewCreateTagsParams([]string{"acl-rule-legacy"}, resourceTypeNetworkACL, ownerTags).Return(tagParams)
+		mockTags.EXPECT().CreateTags(tagParams).Return(&cloudstack.CreateTagsResponse{}, nil)
+
+		lb := &loadBalancer{
+			CloudStackClient: &cloudstack.CloudStackClient{
+				Network:      mockNetwork,
+				NetworkACL:   mockNetworkACL,
+				Resourcetags: mockTags,
+			},
+			tags: ownerTags,
+		}
+
+		if _, err := lb.updateNetworkACL(80, LoadBalancerProtocolTCP, "net-123", []string{"10.0.0.0/8"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
 func TestGetLoadBalancer(t *testing.T) {
 	t.Run("load balancer with existing rules", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -3295,7 +3973,7 @@ func TestGetLoadBalancer(t *testing.T) {
 			},
 		}
 
-		lb, err := cs.getLoadBalancer(service)
+		lb, err := cs.getLoadBalancer("", service)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -3339,7 +4017,7 @@ func TestGetLoadBalancer(t *testing.T) {
 			},
 		}
 
-		lb, err := cs.getLoadBalancer(service)
+		lb, err := cs.getLoadBalancer("", service)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -3377,7 +4055,7 @@ func TestGetLoadBalancer(t *testing.T) {
 			},
 		}
 
-		_, err := cs.getLoadBalancer(service)
+		_, err := cs.getLoadBalancer("", service)
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -3452,6 +4130,107 @@ func TestGetNetworkIDFromIPAddress(t *testing.T) {
 	})
 }
 
+func TestFilterHostsByZone(t *testing.T) {
+	vms := []*cloudstack.VirtualMachine{
+		{Id: "vm-1", Name: "node-1", Zonename: "zone-b"},
+		{Id: "vm-2", Name: "node-2", Zonename: "zone-a"},
+		{Id: "vm-3", Name: "node-3", Zonename: "zone-b"},
+		{Id: "vm-4", Name: "node-4", Zonename: "zone-c"},
+	}
+
+	ids := func(vms []*cloudstack.VirtualMachine) []string {
+		var ids []string
+		for _, vm := range vms {
+			ids = append(ids, vm.Id)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		name      string
+		zone      string
+		vms       []*cloudstack.VirtualMachine
+		want      []string
+		wantEvent string
+	}{
+		{name: "single zone", vms: vms[:1], want: []string{"vm-1"}},
+		{name: "zone with most hosts", vms: vms, want: []string{"vm-1", "vm-3"}, wantEvent: "Warning HostsInOtherZones Nodes node-2, node-4 are not in zone zone-b of the load balancer and are not balanced"},
+		{name: "configured zone", zone: "zone-c", vms: vms, want: []string{"vm-4"}, wantEvent: "Warning HostsInOtherZones Nodes node-1, node-2, node-3 are not in zone zone-c of the load balancer and are not balanced"},
+		{name: "configured zone without hosts", zone: "zone-d", vms: vms, want: []string{"vm-1", "vm-3"}, wantEvent: "Warning HostsInOtherZones Nodes node-2, node-4 are not in zone zone-b of the load balancer and are not balanced"},
+		{name: "tie", vms: []*cloudstack.VirtualMachine{vms[0], vms[1]}, want: []string{"vm-2"}, wantEvent: "Warning HostsInOtherZones Nodes node-1 are not in zone zone-a of the load balancer and are not balanced"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			cs := &CSCloud{zone: tt.zone, eventRecorder: recorder}
+			service := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "svc", Namespace: "default"}}
+
+			if got := ids(cs.filterHostsByZone(service, tt.vms)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterHostsByZone() = %v, want %v", got, tt.want)
+			}
+
+			var event string
+			select {
+			case event = <-recorder.Events:
+			default:
+			}
+			if event != tt.wantEvent {
+				t.Errorf("event = %q, want %q", event, tt.wantEvent)
+			}
+		})
+	}
+}
+
+func TestSelectLoadBalancerNetwork(t *testing.T) {
+	vms := []*cloudstack.VirtualMachine{
+		{Id: "vm-1", Nic: []cloudstack.Nic{{Networkid: "tier-a", Networkname: "workers-a", Isdefault: true}, {Networkid: "tier-lb", Networkname: "lb"}}},
+		{Id: "vm-2", Nic: []cloudstack.Nic{{Networkid: "tier-b", Networkname: "workers-b", Isdefault: true}, {Networkid: "tier-lb", Networkname: "lb"}}},
+	}
+
+	tests := []struct {
+		name        string
+		vms         []*cloudstack.VirtualMachine
+		networkID   string
+		networkName string
+		want        string
+		wantErr     bool
+	}{
+		{name: "shared network", vms: vms, want: "tier-lb"},
+		{name: "internal network preferred", vms: vms[:1], want: "tier-a"},
+		{name: "by network name", vms: vms, networkName: "workers-b", want: "tier-b"},
+		{name: "by network ID", vms: vms, networkID: "tier-a", want: "tier-a"},
+		{name: "unknown network", vms: vms, networkName: "other", wantErr: true},
+		{
+			name: "no shared network",
+			vms: []*cloudstack.VirtualMachine{
+				{Id: "vm-1", Nic: []cloudstack.Nic{{Networkid: "tier-a"}}},
+				{Id: "vm-2", Nic: []cloudstack.Nic{{Networkid: "tier-b"}}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := &CSCloud{}
+			got, err := cs.selectLoadBalancerNetwork(tt.vms, tt.networkID, tt.networkName)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("selectLoadBalancerNetwork() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestVerifyHosts(t *testing.T) {
 	t.Run("all hosts in same network", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
@@ -3495,7 +4274,7 @@ func TestVerifyHosts(t *testing.T) {
 			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
 		}
 
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
+		hostIDs, networkID, err := cs.verifyHosts(&corev1.Service{}, nodes)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -3507,6 +4286,50 @@ func TestVerifyHosts(t *testing.T) {
 		}
 	})
 
+	t.Run("hosts in different tiers with a load balancer network", func(t *testing.T) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		listResp := &cloudstack.ListVirtualMachinesResponse{
+			Count: 3,
+			VirtualMachines: []*cloudstack.VirtualMachine{
+				{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Networkid: "tier-a", Isdefault: true}, {Networkid: "tier-lb", Networkname: "lb"}}},
+				{Id: "vm-2", Name: "node-2", Nic: []cloudstack.Nic{{Networkid: "tier-b", Isdefault: true}, {Networkid: "tier-lb", Networkname: "lb"}}},
+				{Id: "vm-3", Name: "node-3", Nic: []cloudstack.Nic{{Networkid: "tier-c", Isdefault: true}}},
+			},
+		}
+
+		gomock.InOrder(
+			mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{}),
+			mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(listResp, nil),
+		)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
+			},
+			lbNetworkName: "lb",
+		}
+
+		nodes := []*corev1.Node{
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "node-3"}},
+		}
+
+		hostIDs, networkID, err := cs.verifyHosts(&corev1.Service{}, nodes)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(hostIDs, []string{"vm-1", "vm-2"}) {
+			t.Errorf("hostIDs = %v, want %v", hostIDs, []string{"vm-1", "vm-2"})
+		}
+		if networkID != "tier-lb" {
+			t.Errorf("networkID = %q, want %q", networkID, "tier-lb")
+		}
+	})
+
 	t.Run("hosts in different networks", func(t *testing.T) {
 		ctrl := gomock.NewController(t)
 		t.Cleanup(ctrl.Finish)
@@ -3549,7 +4372,7 @@ func TestVerifyHosts(t *testing.T) {
 			{ObjectMeta: metav1.ObjectMeta{Name: "node-2"}},
 		}
 
-		_, _, err := cs.verifyHosts(nodes)
+		_, _, err := cs.verifyHosts(&corev1.Service{}, nodes)
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -3584,7 +4407,7 @@ func TestVerifyHosts(t *testing.T) {
 			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
 		}
 
-		_, _, err := cs.verifyHosts(nodes)
+		_, _, err := cs.verifyHosts(&corev1.Service{}, nodes)
 		if err == nil {
 			t.Fatalf("expected error")
 		}
@@ -3627,7 +4450,7 @@ func TestVerifyHosts(t *testing.T) {
 			{ObjectMeta: metav1.ObjectMeta{Name: "node-1.example.com"}},
 		}
 
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
+		hostIDs, networkID, err := cs.verifyHosts(&corev1.Service{}, nodes)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -3673,7 +4496,7 @@ func TestVerifyHosts(t *testing.T) {
 			{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}},
 		}
 
-		hostIDs, networkID, err := cs.verifyHosts(nodes)
+		hostIDs, networkID, err := cs.verifyHosts(&corev1.Service{}, nodes)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -0,0 +1,176 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/apimachinery/pkg/types"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// tagRouteNode is the tag holding the name of the node a static route points to.
+	tagRouteNode = "kubernetes-route-node"
+
+	resourceTypeStaticRoute = "StaticRoute"
+)
+
+// ListRoutes lists the VPC static routes of the cluster.
+func (cs *CSCloud) ListRoutes(ctx context.Context, clusterName string) ([]*cloudprovider.Route, error) {
+	staticRoutes, err := cs.listClusterStaticRoutes(clusterName)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []*cloudprovider.Route
+	for _, staticRoute := range staticRoutes {
+		nodeName, _ := getTag(staticRoute.Tags, tagRouteNode)
+		routes = append(routes, &cloudprovider.Route{
+			Name:            staticRoute.Id,
+			TargetNode:      types.NodeName(nodeName),
+			DestinationCIDR: staticRoute.Cidr,
+		})
+	}
+
+	return routes, nil
+}
+
+// CreateRoute creates a VPC static route from the pod CIDR of a node to the IP of the node.
+func (cs *CSCloud) CreateRoute(ctx context.Context, clusterName string, nameHint string, route *cloudprovider.Route) error {
+	instance, err := cs.getInstanceByNodeName(string(route.TargetNode), "")
+	if err != nil {
+		return fmt.Errorf("error retrieving instance of node %v: %v", route.TargetNode, err)
+	}
+
+	nic := cs.internalNic(instance)
+	if nic == nil {
+		return fmt.Errorf("instance of node %v has no NICs", route.TargetNode)
+	}
+
+	vpcID := cs.routesVPCID
+	if vpcID == "" {
+		vpcID = nic.Vpcid
+	}
+	if vpcID == "" {
+		return fmt.Errorf("node %v is not in a VPC, static routes are not supported", route.TargetNode)
+	}
+
+	nextHop, err := routeNextHop(nic, route.DestinationCIDR)
+	if err != nil {
+		return fmt.Errorf("error creating route for node %v: %v", route.TargetNode, err)
+	}
+
+	p := cs.client.VPC.NewCreateStaticRouteParams(route.DestinationCIDR)
+	p.SetVpcid(vpcID)
+	p.SetNexthop(nextHop)
+
+	r, err := cs.client.VPC.CreateStaticRoute(p)
+	if err != nil {
+		return fmt.Errorf("error creating static route %v via %v: %v", route.DestinationCIDR, nextHop, err)
+	}
+
+	tags := map[string]string{
+		tagClusterName: clusterName,
+		tagRouteNode:   string(route.TargetNode),
+	}
+	if _, err := cs.client.Resourcetags.CreateTags(cs.client.Resourcetags.NewCreateTagsParams([]string{r.Id}, resourceTypeStaticRoute, tags)); err != nil {
+		// An untagged route would not be listed or deleted again, so remove it.
+		if _, derr := cs.client.VPC.DeleteStaticRoute(cs.client.VPC.NewDeleteStaticRouteParams(r.Id)); derr != nil {
+			klog.Errorf("Error deleting untagged static route %v: %v", r.Id, derr)
+		}
+		return fmt.Errorf("error tagging static route %v: %v", r.Id, err)
+	}
+
+	klog.V(2).Infof("Created static route %v (%v) via %v for node %v", r.Id, route.DestinationCIDR, nextHop, route.TargetNode)
+
+	return nil
+}
+
+// DeleteRoute deletes a VPC static route of the cluster.
+func (cs *CSCloud) DeleteRoute(ctx context.Context, clusterName string, route *cloudprovider.Route) error {
+	id := route.Name
+	if id == "" {
+		staticRoutes, err := cs.listClusterStaticRoutes(clusterName)
+		if err != nil {
+			return err
+		}
+		for _, staticRoute := range staticRoutes {
+			nodeName, _ := getTag(staticRoute.Tags, tagRouteNode)
+			if staticRoute.Cidr == route.DestinationCIDR && nodeName == string(route.TargetNode) {
+				id = staticRoute.Id
+				break
+			}
+		}
+		if id == "" {
+			return nil
+		}
+	}
+
+	if _, err := cs.client.VPC.DeleteStaticRoute(cs.client.VPC.NewDeleteStaticRouteParams(id)); err != nil {
+		return fmt.Errorf("error deleting static route %v: %v", id, err)
+	}
+
+	klog.V(2).Infof("Deleted static route %v (%v) of node %v", id, route.DestinationCIDR, route.TargetNode)
+
+	return nil
+}
+
+// listClusterStaticRoutes lists the static routes tagged with the cluster name.
+func (cs *CSCloud) listClusterStaticRoutes(clusterName string) ([]*cloudstack.StaticRoute, error) {
+	p := cs.client.VPC.NewListStaticRoutesParams()
+	p.SetTags(map[string]string{tagClusterName: clusterName})
+	p.SetListall(true)
+	if cs.routesVPCID != "" {
+		p.SetVpcid(cs.routesVPCID)
+	}
+	if cs.projectID != "" {
+		p.SetProjectid(cs.projectID)
+	}
+
+	l, err := cs.client.VPC.ListStaticRoutes(p)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving static routes: %v", err)
+	}
+
+	return l.StaticRoutes, nil
+}
+
+// routeNextHop returns the address of the NIC in the family of the destination CIDR.
+func routeNextHop(nic *cloudstack.Nic, destinationCIDR string) (string, error) {
+	ip, _, err := net.ParseCIDR(destinationCIDR)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination CIDR %q: %v", destinationCIDR, err)
+	}
+
+	nextHop := nic.Ipaddress
+	if ip.To4() == nil {
+		nextHop = nic.Ip6address
+	}
+	if nextHop == "" {
+		return "", fmt.Errorf("NIC has no address for %v", destinationCIDR)
+	}
+
+	return nextHop, nil
+}
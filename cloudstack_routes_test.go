@@ -0,0 +1,184 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package cloudstack
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"go.uber.org/mock/gomock"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+func TestListRoutes(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockVPC := cloudstack.NewMockVPCServiceIface(ctrl)
+	listParams := &cloudstack.ListStaticRoutesParams{}
+	gomock.InOrder(
+		mockVPC.EXPECT().NewListStaticRoutesParams().Return(listParams),
+		mockVPC.EXPECT().ListStaticRoutes(listParams).Return(&cloudstack.ListStaticRoutesResponse{
+			Count: 1,
+			StaticRoutes: []*cloudstack.StaticRoute{
+				{Id: "route-1", Cidr: "10.244.1.0/24", Tags: []cloudstack.Tags{{Key: tagClusterName, Value: "prod"}, {Key: tagRouteNode, Value: "node-1"}}},
+			},
+		}, nil),
+	)
+
+	cs := &CSCloud{
+		client:      &cloudstack.CloudStackClient{VPC: mockVPC},
+		routesVPCID: "vpc-1",
+	}
+
+	routes, err := cs.ListRoutes(context.Background(), "prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []*cloudprovider.Route{{Name: "route-1", TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"}}
+	if !reflect.DeepEqual(routes, want) {
+		t.Errorf("ListRoutes() = %v, want %v", routes, want)
+	}
+	if tags, _ := listParams.GetTags(); tags[tagClusterName] != "prod" {
+		t.Errorf("lookup tags = %v, want cluster name", tags)
+	}
+	if vpcID, _ := listParams.GetVpcid(); vpcID != "vpc-1" {
+		t.Errorf("lookup VPC = %q, want %q", vpcID, "vpc-1")
+	}
+}
+
+func TestCreateRoute(t *testing.T) {
+	instance := &cloudstack.VirtualMachine{
+		Id:   "vm-1",
+		Name: "node-1",
+		Nic:  []cloudstack.Nic{{Ipaddress: "10.0.0.1", Ip6address: "fd00::1", Vpcid: "vpc-1", Isdefault: true}},
+	}
+
+	setup := func(t *testing.T, instance *cloudstack.VirtualMachine) (*CSCloud, *cloudstack.MockVPCServiceIface, *cloudstack.MockResourcetagsServiceIface) {
+		ctrl := gomock.NewController(t)
+		t.Cleanup(ctrl.Finish)
+
+		mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+		mockVPC := cloudstack.NewMockVPCServiceIface(ctrl)
+		mockTags := cloudstack.NewMockResourcetagsServiceIface(ctrl)
+
+		mockVM.EXPECT().NewListVirtualMachinesParams().Return(&cloudstack.ListVirtualMachinesParams{})
+		mockVM.EXPECT().ListVirtualMachines(gomock.Any()).Return(&cloudstack.ListVirtualMachinesResponse{
+			Count:           1,
+			VirtualMachines: []*cloudstack.VirtualMachine{instance},
+		}, nil)
+
+		cs := &CSCloud{
+			client: &cloudstack.CloudStackClient{
+				VirtualMachine: mockVM,
+				VPC:            mockVPC,
+				Resourcetags:   mockTags,
+			},
+		}
+
+		return cs, mockVPC, mockTags
+	}
+
+	tests := []struct {
+		name        string
+		cidr        string
+		wantNextHop string
+	}{
+		{name: "IPv4", cidr: "10.244.1.0/24", wantNextHop: "10.0.0.1"},
+		{name: "IPv6", cidr: "fd00:10:244:1::/64", wantNextHop: "fd00::1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs, mockVPC, mockTags := setup(t, instance)
+
+			createParams := &cloudstack.CreateStaticRouteParams{}
+			tagParams := &cloudstack.CreateTagsParams{}
+			gomock.InOrder(
+				mockVPC.EXPECT().NewCreateStaticRouteParams(tt.cidr).Return(createParams),
+				mockVPC.EXPECT().CreateStaticRoute(createParams).Return(&cloudstack.CreateStaticRouteResponse{Id: "route-1"}, nil),
+				mockTags.EXPECT().NewCreateTagsParams([]string{"route-1"}, resourceTypeStaticRoute, map[string]string{tagClusterName: "prod", tagRouteNode: "node-1"}).Return(tagParams),
+				mockTags.EXPECT().CreateTags(tagParams).Return(&cloudstack.CreateTagsResponse{}, nil),
+			)
+
+			err := cs.CreateRoute(context.Background(), "prod", "hint", &cloudprovider.Route{TargetNode: "node-1", DestinationCIDR: tt.cidr})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if nextHop, _ := createParams.GetNexthop(); nextHop != tt.wantNextHop {
+				t.Errorf("next hop = %q, want %q", nextHop, tt.wantNextHop)
+			}
+			if vpcID, _ := createParams.GetVpcid(); vpcID != "vpc-1" {
+				t.Errorf("VPC = %q, want %q", vpcID, "vpc-1")
+			}
+		})
+	}
+
+	t.Run("untagged route is deleted", func(t *testing.T) {
+		cs, mockVPC, mockTags := setup(t, instance)
+
+		createParams := &cloudstack.CreateStaticRouteParams{}
+		deleteParams := &cloudstack.DeleteStaticRouteParams{}
+		gomock.InOrder(
+			mockVPC.EXPECT().NewCreateStaticRouteParams("10.244.1.0/24").Return(createParams),
+			mockVPC.EXPECT().CreateStaticRoute(createParams).Return(&cloudstack.CreateStaticRouteResponse{Id: "route-1"}, nil),
+			mockTags.EXPECT().NewCreateTagsParams(gomock.Any(), gomock.Any(), gomock.Any()).Return(&cloudstack.CreateTagsParams{}),
+			mockTags.EXPECT().CreateTags(gomock.Any()).Return(nil, errors.New("API error")),
+			mockVPC.EXPECT().NewDeleteStaticRouteParams("route-1").Return(deleteParams),
+			mockVPC.EXPECT().DeleteStaticRoute(deleteParams).Return(&cloudstack.DeleteStaticRouteResponse{}, nil),
+		)
+
+		if err := cs.CreateRoute(context.Background(), "prod", "hint", &cloudprovider.Route{TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"}); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+
+	t.Run("node outside a VPC", func(t *testing.T) {
+		cs, _, _ := setup(t, &cloudstack.VirtualMachine{Id: "vm-1", Name: "node-1", Nic: []cloudstack.Nic{{Ipaddress: "10.0.0.1"}}})
+
+		if err := cs.CreateRoute(context.Background(), "prod", "hint", &cloudprovider.Route{TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"}); err == nil {
+			t.Fatalf("expected error")
+		}
+	})
+}
+
+func TestDeleteRoute(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	mockVPC := cloudstack.NewMockVPCServiceIface(ctrl)
+	deleteParams := &cloudstack.DeleteStaticRouteParams{}
+	gomock.InOrder(
+		mockVPC.EXPECT().NewDeleteStaticRouteParams("route-1").Return(deleteParams),
+		mockVPC.EXPECT().DeleteStaticRoute(deleteParams).Return(&cloudstack.DeleteStaticRouteResponse{}, nil),
+	)
+
+	cs := &CSCloud{
+		client: &cloudstack.CloudStackClient{VPC: mockVPC},
+	}
+
+	if err := cs.DeleteRoute(context.Background(), "prod", &cloudprovider.Route{Name: "route-1", TargetNode: "node-1", DestinationCIDR: "10.244.1.0/24"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
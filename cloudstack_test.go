@@ -32,10 +32,33 @@ import (
 	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	restclient "k8s.io/client-go/rest"
 )
 
 const testClusterName = "testCluster"
 
+// fakeClientBuilder is a cloudprovider.ControllerClientBuilder that returns a fixed client.
+type fakeClientBuilder struct {
+	client kubernetes.Interface
+}
+
+func (b *fakeClientBuilder) Config(name string) (*restclient.Config, error) {
+	return &restclient.Config{}, nil
+}
+
+func (b *fakeClientBuilder) ConfigOrDie(name string) *restclient.Config {
+	return &restclient.Config{}
+}
+
+func (b *fakeClientBuilder) Client(name string) (kubernetes.Interface, error) {
+	return b.client, nil
+}
+
+func (b *fakeClientBuilder) ClientOrDie(name string) kubernetes.Interface {
+	return b.client
+}
+
 func TestReadConfig(t *testing.T) {
 	_, err := readConfig(nil)
 	if err != nil {
@@ -49,6 +72,36 @@ func TestReadConfig(t *testing.T) {
  secret-key			= a-valid-secret-key
  ssl-no-verify	= true
  project-id			= a-valid-project-id
+ node-name-source	= displayname
+ instance-type-format	= {name}-{cpu}cpu
+ multi-zone			= true
+
+ [NodeAddresses]
+ internal-network-name	= cluster
+ external-ip-sources	= override,static-nat
+
+ [NodeLabels]
+ enabled				= true
+ taints				= dedicated:NoSchedule
+
+ [LoadBalancer]
+ network-name		= lb-tier
+ reserved-ip-ttl	= 72h
+
+ [Routes]
+ enabled				= true
+ vpc-id				= a-valid-vpc-id
+
+ [InstanceCache]
+ ttl					= 2m
+
+ [Sweeper]
+ enabled				= true
+ grace-period		= 1h
+ dry-run				= true
+
+ [NetworkACL]
+ manage-lists		= true
  `))
 	if err != nil {
 		t.Fatalf("Should succeed when a valid config is provided: %v", err)
@@ -66,6 +119,42 @@ func TestReadConfig(t *testing.T) {
 	if !cfg.Global.SSLNoVerify {
 		t.Errorf("incorrect ssl-no-verify: %t", cfg.Global.SSLNoVerify)
 	}
+	if cfg.Global.NodeNameSource != "displayname" {
+		t.Errorf("incorrect node-name-source: %s", cfg.Global.NodeNameSource)
+	}
+	if !cfg.Global.MultiZone {
+		t.Errorf("incorrect multi-zone: %t", cfg.Global.MultiZone)
+	}
+	if cfg.Global.InstanceTypeFormat != "{name}-{cpu}cpu" {
+		t.Errorf("incorrect instance-type-format: %s", cfg.Global.InstanceTypeFormat)
+	}
+	if cfg.NodeAddresses.InternalNetworkName != "cluster" {
+		t.Errorf("incorrect internal-network-name: %s", cfg.NodeAddresses.InternalNetworkName)
+	}
+	if cfg.NodeAddresses.ExternalIPSources != "override,static-nat" {
+		t.Errorf("incorrect external-ip-sources: %s", cfg.NodeAddresses.ExternalIPSources)
+	}
+	if !cfg.NodeLabels.Enabled || cfg.NodeLabels.Taints != "dedicated:NoSchedule" {
+		t.Errorf("incorrect node labels config: %+v", cfg.NodeLabels)
+	}
+	if cfg.LoadBalancer.NetworkName != "lb-tier" {
+		t.Errorf("incorrect load balancer network-name: %s", cfg.LoadBalancer.NetworkName)
+	}
+	if cfg.LoadBalancer.ReservedIPTTL != "72h" {
+		t.Errorf("incorrect load balancer reserved-ip-ttl: %s", cfg.LoadBalancer.ReservedIPTTL)
+	}
+	if !cfg.Routes.Enabled || cfg.Routes.VPCID != "a-valid-vpc-id" {
+		t.Errorf("incorrect routes config: %+v", cfg.Routes)
+	}
+	if cfg.InstanceCache.TTL != "2m" {
+		t.Errorf("incorrect instance cache ttl: %s", cfg.InstanceCache.TTL)
+	}
+	if !cfg.Sweeper.Enabled || !cfg.Sweeper.DryRun || cfg.Sweeper.GracePeriod != "1h" {
+		t.Errorf("incorrect sweeper config: %+v", cfg.Sweeper)
+	}
+	if !cfg.NetworkACL.ManageLists {
+		t.Errorf("incorrect network ACL config: %+v", cfg.NetworkACL)
+	}
 }
 
 // This allows acceptance testing against an existing CloudStack environment.
@@ -99,6 +188,56 @@ func TestNewCSCloud(t *testing.T) {
 	}
 }
 
+func TestNewCSCloudInvalidNodeNameSource(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.NodeNameSource = "uuid"
+
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "node-name-source") {
+		t.Fatalf("newCSCloud() error = %v, want invalid node-name-source", err)
+	}
+}
+
+func TestNewCSCloudHostnameNodeNameSource(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.Global.NodeNameSource = "hostname"
+
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "node-name-source") {
+		t.Fatalf("newCSCloud() error = %v, want invalid node-name-source", err)
+	}
+}
+
+func TestGetZoneByNodeName(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	t.Cleanup(ctrl.Finish)
+
+	listParams := &cloudstack.ListVirtualMachinesParams{}
+	mockVM := cloudstack.NewMockVirtualMachineServiceIface(ctrl)
+	mockVM.EXPECT().NewListVirtualMachinesParams().Return(listParams)
+	mockVM.EXPECT().ListVirtualMachines(listParams).Return(&cloudstack.ListVirtualMachinesResponse{
+		Count: 2,
+		VirtualMachines: []*cloudstack.VirtualMachine{
+			{Id: "vm-1", Name: "i-2-10-VM", Displayname: "worker-1", Zonename: "zone-1"},
+			{Id: "vm-2", Name: "i-2-11-VM", Displayname: "worker-10", Zonename: "zone-2"},
+		},
+	}, nil)
+
+	cs := &CSCloud{
+		client:         &cloudstack.CloudStackClient{VirtualMachine: mockVM},
+		nodeNameSource: nodeNameSourceDisplayName,
+	}
+
+	zone, err := cs.GetZoneByNodeName(context.Background(), "worker-1.cluster.local")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if zone.FailureDomain != "zone-1" {
+		t.Errorf("zone = %q, want zone-1", zone.FailureDomain)
+	}
+	if keyword, _ := listParams.GetKeyword(); keyword != "worker-1" {
+		t.Errorf("lookup keyword = %q, want worker-1", keyword)
+	}
+}
+
 func TestLoadBalancer(t *testing.T) {
 	cfg, ok := configFromEnv()
 	if !ok {
@@ -315,3 +454,22 @@ func TestGetRegionFromZone(t *testing.T) {
 		})
 	}
 }
+
+func TestNewCSCloudInvalidInternalNetwork(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.NodeAddresses.InternalNetworkID = "net-1"
+	cfg.NodeAddresses.InternalNetworkName = "cluster"
+
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "internal-network") {
+		t.Fatalf("newCSCloud() error = %v, want invalid internal network", err)
+	}
+}
+
+func TestNewCSCloudInvalidReservedIPTTL(t *testing.T) {
+	cfg := &CSConfig{}
+	cfg.LoadBalancer.ReservedIPTTL = "forever"
+
+	if _, err := newCSCloud(cfg); err == nil || !strings.Contains(err.Error(), "reserved-ip-ttl") {
+		t.Fatalf("newCSCloud() error = %v, want invalid reserved-ip-ttl", err)
+	}
+}
@@ -77,6 +77,11 @@ func cloudInitializer(config *config.CompletedConfig) cloudprovider.Interface {
 		klog.Fatalf("Cloud provider is nil")
 	}
 
+	// Pass the cluster name to the provider, for the resources it manages on its own.
+	if c, ok := cloud.(interface{ SetClusterName(string) }); ok {
+		c.SetClusterName(config.ComponentConfig.KubeCloudShared.ClusterName)
+	}
+
 	if !cloud.HasClusterID() {
 		if config.ComponentConfig.KubeCloudShared.AllowUntaggedCloud {
 			klog.Warning("detected a cluster without a ClusterID.  A ClusterID will be required in the future.  Please tag your cluster to avoid any future issues")
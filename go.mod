@@ -10,6 +10,7 @@ require (
 	gopkg.in/gcfg.v1 v1.2.3
 	k8s.io/api v0.24.17
 	k8s.io/apimachinery v0.24.17
+	k8s.io/client-go v0.24.17
 	k8s.io/cloud-provider v0.24.17
 	k8s.io/component-base v0.24.17
 	k8s.io/klog/v2 v2.80.1
@@ -95,7 +96,6 @@ require (
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	k8s.io/apiserver v0.24.17 // indirect
-	k8s.io/client-go v0.24.17 // indirect
 	k8s.io/component-helpers v0.24.17 // indirect
 	k8s.io/controller-manager v0.24.17 // indirect
 	k8s.io/kube-openapi v0.0.0-20220328201542-3ee0da9b0b42 // indirect
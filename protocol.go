@@ -32,6 +32,7 @@ const (
 	LoadBalancerProtocolTCP LoadBalancerProtocol = iota
 	LoadBalancerProtocolUDP
 	LoadBalancerProtocolTCPProxy
+	LoadBalancerProtocolSSL
 	LoadBalancerProtocolInvalid
 )
 
@@ -50,6 +51,8 @@ func (p LoadBalancerProtocol) CSProtocol() string {
 		return "udp"
 	case LoadBalancerProtocolTCPProxy:
 		return "tcp-proxy"
+	case LoadBalancerProtocolSSL:
+		return "ssl"
 	default:
 		return ""
 	}
@@ -62,6 +65,8 @@ func (p LoadBalancerProtocol) IPProtocol() string {
 	case LoadBalancerProtocolTCP:
 		fallthrough
 	case LoadBalancerProtocolTCPProxy:
+		fallthrough
+	case LoadBalancerProtocolSSL:
 		return "tcp"
 	case LoadBalancerProtocolUDP:
 		return "udp"
@@ -79,13 +84,17 @@ func (p LoadBalancerProtocol) IPProtocol() string {
 //	v1.ProtocolTCP="udp" -> "udp" (CloudStack 4.6 and later)
 //	v1.ProtocolTCP="tcp" + annotation "service.beta.kubernetes.io/cloudstack-load-balancer-proxy-protocol"
 //	                     -> "tcp-proxy" (CloudStack 4.6 and later)
+//	v1.ProtocolTCP="tcp" + annotation "service.beta.kubernetes.io/cloudstack-load-balancer-ssl-cert-secret"
+//	                     -> "ssl" for the ports selected by "service.beta.kubernetes.io/cloudstack-load-balancer-ssl-ports"
 //
 // Other values return LoadBalancerProtocolInvalid.
 func ProtocolFromServicePort(port v1.ServicePort, service *v1.Service) LoadBalancerProtocol {
 	proxy := getBoolFromServiceAnnotation(service, ServiceAnnotationLoadBalancerProxyProtocol, false)
 	switch port.Protocol {
 	case v1.ProtocolTCP:
-		if proxy {
+		if isSSLPort(port, service) {
+			return LoadBalancerProtocolSSL
+		} else if proxy {
 			return LoadBalancerProtocolTCPProxy
 		} else {
 			return LoadBalancerProtocolTCP
@@ -107,6 +116,8 @@ func ProtocolFromLoadBalancer(protocol string) LoadBalancerProtocol {
 		return LoadBalancerProtocolUDP
 	case "tcp-proxy":
 		return LoadBalancerProtocolTCPProxy
+	case "ssl":
+		return LoadBalancerProtocolSSL
 	default:
 		return LoadBalancerProtocolInvalid
 	}
@@ -47,6 +47,11 @@ func TestLoadBalancerProtocol_CSProtocol(t *testing.T) {
 			protocol: LoadBalancerProtocolTCPProxy,
 			want:     "tcp-proxy",
 		},
+		{
+			name:     "SSL protocol",
+			protocol: LoadBalancerProtocolSSL,
+			want:     "ssl",
+		},
 		{
 			name:     "Invalid protocol",
 			protocol: LoadBalancerProtocolInvalid,
@@ -84,6 +89,11 @@ func TestLoadBalancerProtocol_IPProtocol(t *testing.T) {
 			protocol: LoadBalancerProtocolTCPProxy,
 			want:     "tcp",
 		},
+		{
+			name:     "SSL protocol also maps to tcp",
+			protocol: LoadBalancerProtocolSSL,
+			want:     "tcp",
+		},
 		{
 			name:     "UDP protocol maps to udp",
 			protocol: LoadBalancerProtocolUDP,
@@ -116,6 +126,7 @@ func TestLoadBalancerProtocol_String(t *testing.T) {
 		LoadBalancerProtocolTCP,
 		LoadBalancerProtocolUDP,
 		LoadBalancerProtocolTCPProxy,
+		LoadBalancerProtocolSSL,
 		LoadBalancerProtocolInvalid,
 	}
 
@@ -147,6 +158,11 @@ func TestProtocolFromLoadBalancer(t *testing.T) {
 			protocol: "tcp-proxy",
 			want:     LoadBalancerProtocolTCPProxy,
 		},
+		{
+			name:     "ssl string",
+			protocol: "ssl",
+			want:     LoadBalancerProtocolSSL,
+		},
 		{
 			name:     "empty string returns invalid",
 			protocol: "",
@@ -231,6 +247,41 @@ func TestProtocolFromServicePort(t *testing.T) {
 			},
 			want: LoadBalancerProtocolUDP,
 		},
+		{
+			name: "TCP port with SSL certificate secret",
+			port: corev1.ServicePort{
+				Protocol: corev1.ProtocolTCP,
+				Port:     443,
+			},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerSSLCertSecret: "tls-secret",
+			},
+			want: LoadBalancerProtocolSSL,
+		},
+		{
+			name: "TCP port not selected by SSL ports",
+			port: corev1.ServicePort{
+				Protocol: corev1.ProtocolTCP,
+				Port:     80,
+			},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerSSLCertSecret: "tls-secret",
+				ServiceAnnotationLoadBalancerSSLPorts:      "443",
+				ServiceAnnotationLoadBalancerProxyProtocol: "true",
+			},
+			want: LoadBalancerProtocolTCPProxy,
+		},
+		{
+			name: "UDP port ignores SSL certificate secret",
+			port: corev1.ServicePort{
+				Protocol: corev1.ProtocolUDP,
+				Port:     443,
+			},
+			annotations: map[string]string{
+				ServiceAnnotationLoadBalancerSSLCertSecret: "tls-secret",
+			},
+			want: LoadBalancerProtocolUDP,
+		},
 		{
 			name: "SCTP port returns invalid",
 			port: corev1.ServicePort{